@@ -0,0 +1,236 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package barcode validates and normalizes the barcodes read by a scanner
+// (see the scanner package), before they are looked up, or saved: each
+// retail (GTIN) code has its check digit verified, and is converted to a
+// single canonical form, so that the same product scanned as a UPC-E, a
+// UPC-A, or a zero-padded EAN-13 is always saved under the same barcode.
+// The date barcodes scanned after a product (e.g., the GS1 DataBar on
+// fresh food) are read for its expiration date instead (see ParseExpiry).
+//
+// The check digit and UPC-E rules are those of the GS1 General
+// Specifications (https://www.gs1.org/standards/barcodes-epcrfid-id-keys/gs1-general-specifications)
+
+package barcode
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+const (
+	// Barcode kinds
+	UPC_A   = "UPC-A" // including each UPC-E, once converted
+	EAN_8   = "EAN-8"
+	EAN_13  = "EAN-13"
+	GTIN_14 = "GTIN-14"
+	ISBN    = "ISBN"  // a book's EAN-13 (978 or 979), including each ISBN-10, once converted
+	OTHER   = "other" // anything else a scanner can read, e.g., a QR code, or a Code 128
+
+	MAX_LENGTH = 128
+
+	// the EAN-13 prefixes reserved for books ("Bookland")
+	ISBN_PREFIX     = "978"
+	ISBN_ALT_PREFIX = "979"
+)
+
+var (
+	ErrEmpty      = errors.New("barcode is empty")
+	ErrMalformed  = errors.New("barcode must be 1 to 128 printable ascii characters, without spaces")
+	ErrCheckDigit = errors.New("barcode check digit is wrong")
+)
+
+// Barcode is a scan, normalized
+type Barcode struct {
+	Code string // the canonical form, to look up and save
+	Kind string // one of the barcode kinds, e.g., UPC_A
+}
+
+// IsGTIN reports whether the barcode is a retail product code (including
+// a book's), i.e., one with a check digit
+func (b *Barcode) IsGTIN() bool {
+	return b.Kind != OTHER
+}
+
+// IsISBN reports whether the barcode is a book's
+func (b *Barcode) IsISBN() bool {
+	return b.Kind == ISBN
+}
+
+// Parse validates and normalizes the scan. The surrounding whitespace and
+// control characters (e.g., the carriage return a keyboard-wedge scanner
+// ends each scan with) are trimmed first. Then, if it is all digits:
+//
+//   - 8 digits are a UPC-E (if its number system is 0 or 1, and its check
+//     digit matches), converted to its UPC-A, or an EAN-8
+//   - 10 digits (the last of which may be an X) are an ISBN-10 (if its
+//     check digit matches, as it must if it ends with an X), converted to
+//     its EAN-13
+//   - 12, 13, or 14 digits are a UPC-A, EAN-13, or GTIN-14, stripped of the
+//     leading zeros which pad it to a longer form (down to a UPC-A)
+//
+// each of which must have the right check digit (ErrCheckDigit otherwise).
+// Any other scan is returned as is, as OTHER, unless it is not printable
+// ascii, or too long (ErrMalformed), i.e., garbage.
+//
+// The 8 digits alone cannot tell a UPC-E from an EAN-8, so an EAN-8 which
+// starts with a 0 or a 1, and whose expansion as a UPC-E happens to have
+// the right check digit too, is taken for the UPC-E, and saved as its UPC-A
+// (e.g., 01234558 as 012345000058). The expansion of one whose seventh
+// digit is 5 to 9 always does, since it keeps each digit's weight.
+func Parse(raw string) (*Barcode, error) {
+	code := strings.TrimFunc(raw, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+	if code == "" {
+		return nil, ErrEmpty
+	}
+	for _, r := range code {
+		if r <= ' ' || r > '~' {
+			return nil, ErrMalformed
+		}
+	}
+	if len(code) > MAX_LENGTH {
+		return nil, ErrMalformed
+	}
+
+	if len(code) == 10 && allDigits(code[:9]) && (isDigit(code[9]) || code[9] == 'X' || code[9] == 'x') {
+		if b, err := parseISBN10(code); err == nil || !allDigits(code) {
+			return b, err
+		}
+		// otherwise, some other 10-digit code
+	}
+	if !allDigits(code) {
+		return &Barcode{Code: code, Kind: OTHER}, nil
+	}
+
+	switch len(code) {
+	case 8:
+		if upcA, err := UPCEToUPCA(code); err == nil && ValidCheckDigit(upcA) {
+			return &Barcode{Code: upcA, Kind: UPC_A}, nil
+		}
+		if !ValidCheckDigit(code) {
+			return nil, ErrCheckDigit
+		}
+		return &Barcode{Code: code, Kind: EAN_8}, nil
+	case 12, 13, 14:
+		if !ValidCheckDigit(code) {
+			return nil, ErrCheckDigit
+		}
+		return gtin(code), nil
+	}
+	return &Barcode{Code: code, Kind: OTHER}, nil
+}
+
+// Normalize returns the canonical form of the scan (see Parse)
+func Normalize(raw string) (string, error) {
+	b, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return b.Code, nil
+}
+
+// gtin returns the (valid) UPC-A, EAN-13, or GTIN-14, without the leading
+// zeros which pad it to a longer form, as the shortest of them, with its kind
+func gtin(code string) *Barcode {
+	for len(code) > 12 && code[0] == '0' {
+		code = code[1:]
+	}
+	switch {
+	case len(code) == 12:
+		return &Barcode{Code: code, Kind: UPC_A}
+	case len(code) == 14:
+		return &Barcode{Code: code, Kind: GTIN_14}
+	case strings.HasPrefix(code, ISBN_PREFIX) || strings.HasPrefix(code, ISBN_ALT_PREFIX):
+		return &Barcode{Code: code, Kind: ISBN}
+	}
+	return &Barcode{Code: code, Kind: EAN_13}
+}
+
+// ValidCheckDigit reports whether the last of the digits is the right check
+// digit for the rest, by the GS1 algorithm (shared by every UPC, EAN, and
+// GTIN, so that leading zeros never change it)
+func ValidCheckDigit(digits string) bool {
+	if len(digits) < 2 || !allDigits(digits) {
+		return false
+	}
+	last := len(digits) - 1
+	return checkDigit(digits[:last]) == digits[last]
+}
+
+// checkDigit returns the GS1 check digit for the digits: weighted 3 and 1,
+// alternately, from the rightmost
+func checkDigit(digits string) byte {
+	sum := 0
+	for j := 0; j < len(digits); j++ {
+		d := int(digits[len(digits)-1-j] - '0')
+		if j%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// UPCEToUPCA expands the 8-digit UPC-E (number system, six digits, check
+// digit) into the 12-digit UPC-A it stands for, with the same number system
+// and check digit, which the caller must still verify (see ValidCheckDigit).
+// Only number systems 0 and 1 have a UPC-E.
+func UPCEToUPCA(upcE string) (string, error) {
+	if len(upcE) != 8 || !allDigits(upcE) {
+		return "", ErrMalformed
+	}
+	if upcE[0] != '0' && upcE[0] != '1' {
+		return "", ErrMalformed
+	}
+
+	ns, d, check := upcE[:1], upcE[1:7], upcE[7:]
+	var manufacturer, product string
+	switch d[5] {
+	case '0', '1', '2':
+		manufacturer, product = d[0:2]+d[5:6]+"00", "00"+d[2:5]
+	case '3':
+		manufacturer, product = d[0:3]+"00", "000"+d[3:5]
+	case '4':
+		manufacturer, product = d[0:4]+"0", "0000"+d[4:5]
+	default:
+		manufacturer, product = d[0:5], "0000"+d[5:6]
+	}
+	return ns + manufacturer + product + check, nil
+}
+
+// parseISBN10 converts the ISBN-10 into its EAN-13 (978, its first nine
+// digits, and a new GS1 check digit), after verifying its own (mod 11)
+// check digit
+func parseISBN10(isbn string) (*Barcode, error) {
+	sum := 0
+	for j := 0; j < 10; j++ {
+		d := 10 // the check digit X
+		if isDigit(isbn[j]) {
+			d = int(isbn[j] - '0')
+		}
+		sum += (10 - j) * d
+	}
+	if sum%11 != 0 {
+		return nil, ErrCheckDigit
+	}
+
+	ean := ISBN_PREFIX + isbn[:9]
+	return &Barcode{Code: ean + string(checkDigit(ean)), Kind: ISBN}, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func allDigits(s string) bool {
+	for j := 0; j < len(s); j++ {
+		if !isDigit(s[j]) {
+			return false
+		}
+	}
+	return len(s) > 0
+}
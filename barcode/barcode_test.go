@@ -0,0 +1,131 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcode
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidCheckDigit(t *testing.T) {
+	for _, test := range []struct {
+		digits string
+		valid  bool
+	}{
+		{"036000291452", true},
+		{"036000291453", false},
+		{"0036000291452", true}, // leading zeros never change it
+		{"4006381333931", true},
+		{"96385074", true},
+		{"10036000291459", true},
+		{"0", false},
+		{"03600029145a", false},
+		{"", false},
+	} {
+		if valid := ValidCheckDigit(test.digits); valid != test.valid {
+			t.Errorf("ValidCheckDigit(%q) = %v, want %v", test.digits, valid, test.valid)
+		}
+	}
+}
+
+func TestUPCEToUPCA(t *testing.T) {
+	for _, test := range []struct {
+		upcE, upcA string
+		err        error
+	}{
+		// the last of the six digits is 0, 1, or 2
+		{"01234505", "012000003455", nil},
+		{"04252614", "042100005264", nil},
+		{"01234523", "012200003453", nil},
+		// 3
+		{"01234531", "012300000451", nil},
+		{"11234538", "112300000458", nil},
+		// 4
+		{"01234543", "012340000053", nil},
+		// 5 to 9
+		{"01234558", "012345000058", nil},
+		{"01234596", "012345000096", nil},
+		// only number systems 0 and 1 have a UPC-E
+		{"21234538", "", ErrMalformed},
+		{"0123455", "", ErrMalformed},
+		{"0123455x", "", ErrMalformed},
+	} {
+		upcA, err := UPCEToUPCA(test.upcE)
+		if upcA != test.upcA || !errors.Is(err, test.err) {
+			t.Errorf("UPCEToUPCA(%q) = %q, %v, want %q, %v", test.upcE, upcA, err, test.upcA, test.err)
+		}
+		if err == nil && !ValidCheckDigit(upcA) {
+			t.Errorf("UPCEToUPCA(%q) = %q, which has the wrong check digit", test.upcE, upcA)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		raw, code, kind string
+		err             error
+	}{
+		// trimmed, e.g., of a keyboard-wedge scanner's carriage return
+		{"036000291452\r\n", "036000291452", UPC_A, nil},
+		{" 4006381333931\t", "4006381333931", EAN_13, nil},
+
+		// zero-padded, down to the UPC-A
+		{"0036000291452", "036000291452", UPC_A, nil},
+		{"00036000291452", "036000291452", UPC_A, nil},
+		{"04006381333931", "4006381333931", EAN_13, nil},
+		{"10036000291459", "10036000291459", GTIN_14, nil},
+
+		// UPC-E, converted
+		{"04252614", "042100005264", UPC_A, nil},
+		{"01234531", "012300000451", UPC_A, nil},
+		// EAN-8, with a first digit which no UPC-E has
+		{"96385074", "96385074", EAN_8, nil},
+		// or one whose expansion as a UPC-E has the wrong check digit
+		{"00000017", "00000017", EAN_8, nil},
+		// but one whose expansion has the right check digit too is taken
+		// for the UPC-E (see Parse)
+		{"01234558", "012345000058", UPC_A, nil},
+
+		// ISBN-10, converted, including those with a check digit of X
+		{"0306406152", "9780306406157", ISBN, nil},
+		{"080442957X", "9780804429573", ISBN, nil},
+		{"080442957x", "9780804429573", ISBN, nil},
+		{"9780306406157", "9780306406157", ISBN, nil},
+		{"9791000000008", "9791000000008", ISBN, nil},
+		// a bad ISBN-10 check digit is only an error when it is an X
+		{"0804429574", "0804429574", OTHER, nil},
+		{"030640615X", "", "", ErrCheckDigit},
+
+		// wrong check digits
+		{"036000291453", "", "", ErrCheckDigit},
+		{"4006381333932", "", "", ErrCheckDigit},
+		{"96385075", "", "", ErrCheckDigit},
+		{"10036000291458", "", "", ErrCheckDigit},
+
+		// anything else, as is
+		{"https://example.org/", "https://example.org/", OTHER, nil},
+		{"12345", "12345", OTHER, nil},
+
+		// garbage
+		{"", "", "", ErrEmpty},
+		{" \r\n", "", "", ErrEmpty},
+		{"0360 00291452", "", "", ErrMalformed},
+		{"café", "", "", ErrMalformed},
+		{"03600\x0029145", "", "", ErrMalformed},
+		{strings.Repeat("7", MAX_LENGTH+1), "", "", ErrMalformed},
+	} {
+		b, err := Parse(test.raw)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Parse(%q) = %+v, %v, want %v", test.raw, b, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if b.Code != test.code || b.Kind != test.kind {
+			t.Errorf("Parse(%q) = %+v, want %s %s", test.raw, b, test.kind, test.code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package barcode
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// GS1 Application Identifiers (AIs)
+	AI_GTIN        = "01"
+	AI_BEST_BEFORE = "15"
+	AI_EXPIRATION  = "17"
+
+	// the date format of an ISO 8601 date label, e.g., from a label maker
+	ISO_DATE = "2006-01-02"
+
+	// the separator which ends a variable length element string
+	GS1_SEPARATOR = "\x1d"
+)
+
+var (
+	// the symbology identifiers a scanner may prefix a GS1 barcode with:
+	// GS1-128, GS1 DataBar, GS1 DataMatrix, and GS1 QR Code
+	GS1_SYMBOLOGIES = []string{"]C1", "]e0", "]d2", "]Q3"}
+
+	// the length of the data of each fixed length AI (any other one is read
+	// up to the next GS1_SEPARATOR, or the end of the barcode)
+	GS1_FIXED_LENGTHS = map[string]int{
+		"00": 18, "01": 14, "02": 14,
+		"11": 6, "12": 6, "13": 6, "15": 6, "16": 6, "17": 6,
+		"20": 2,
+	}
+
+	// an element string in the human readable form, e.g., (17)261031
+	GS1_ELEMENT = regexp.MustCompile(`\(([0-9]{2,4})\)([^(]*)`)
+)
+
+// Expiry is the date read from a date barcode (see ParseExpiry)
+type Expiry struct {
+	Date       time.Time // the day (at midnight, local time)
+	BestBefore bool      // whether it is a best before date, rather than an expiration date
+	GTIN       string    // the canonical form of the product's barcode, if it has one as well
+}
+
+// ParseExpiry reads the date from a scan which is a date barcode, reporting
+// whether it is one: either a GS1 barcode (e.g., the GS1 DataBar on fresh
+// food) with an expiration (AI 17), or best before (AI 15) date, written
+// in the human readable form, e.g., "(01)09501101020917(17)261031", or
+// prefixed with its symbology identifier (see GS1_SYMBOLOGIES), or else
+// starting with a GTIN (AI 01), or an ISO 8601 date, e.g., "2026-10-31",
+// as a label maker prints it
+func ParseExpiry(raw string) (*Expiry, bool) {
+	code := strings.TrimFunc(raw, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+	if day, err := time.ParseInLocation(ISO_DATE, code, time.Local); err == nil {
+		return &Expiry{Date: day}, true
+	}
+
+	elements, isGS1 := gs1Elements(code)
+	if !isGS1 {
+		return nil, false
+	}
+	e := new(Expiry)
+	date, found := elements[AI_EXPIRATION]
+	if !found {
+		date, found = elements[AI_BEST_BEFORE]
+		e.BestBefore = found
+	}
+	day, dateErr := gs1Date(date)
+	if !found || dateErr != nil {
+		return nil, false
+	}
+	e.Date = day
+	if gtin, hasGTIN := elements[AI_GTIN]; hasGTIN {
+		b, err := Parse(gtin)
+		if err != nil || !b.IsGTIN() {
+			return nil, false
+		}
+		e.GTIN = b.Code
+	}
+	return e, true
+}
+
+// gs1Elements splits the GS1 barcode into the data of each AI, reporting
+// whether it is one (see ParseExpiry for the forms it can take)
+func gs1Elements(code string) (map[string]string, bool) {
+	elements := make(map[string]string)
+	if strings.HasPrefix(code, "(") {
+		matches := GS1_ELEMENT.FindAllStringSubmatch(code, -1)
+		rest := code
+		for _, m := range matches {
+			rest = strings.Replace(rest, m[0], "", 1)
+			elements[m[1]] = strings.TrimSuffix(m[2], GS1_SEPARATOR)
+		}
+		// nothing but element strings
+		return elements, len(matches) > 0 && rest == ""
+	}
+
+	gs1 := false
+	for _, prefix := range GS1_SYMBOLOGIES {
+		if strings.HasPrefix(code, prefix) {
+			code, gs1 = strings.TrimPrefix(code, prefix), true
+			break
+		}
+	}
+	// otherwise, only a GTIN followed by more elements is safe to read as
+	// one, since a short one could be a product barcode (e.g., an EAN-8)
+	if !gs1 && !(strings.HasPrefix(code, AI_GTIN) && len(code) > 2+GS1_FIXED_LENGTHS[AI_GTIN]) {
+		return nil, false
+	}
+
+	for len(code) > 0 {
+		if len(code) < 2 || !allDigits(code[:2]) {
+			return nil, false
+		}
+		ai := code[:2]
+		code = code[2:]
+		if n, fixed := GS1_FIXED_LENGTHS[ai]; fixed {
+			if len(code) < n {
+				return nil, false
+			}
+			elements[ai], code = code[:n], strings.TrimPrefix(code[n:], GS1_SEPARATOR)
+			continue
+		}
+		// a variable length AI (e.g., a batch number), which only ends at
+		// a separator, so any AIs after it are read only if there is one
+		if end := strings.Index(code, GS1_SEPARATOR); end >= 0 {
+			elements[ai], code = code[:end], code[end+1:]
+		} else {
+			elements[ai], code = code, ""
+		}
+	}
+	return elements, true
+}
+
+// gs1Date converts the data of a GS1 date AI (YYMMDD) into the day it is,
+// where a day of 00 is the last day of the month
+func gs1Date(date string) (time.Time, error) {
+	if len(date) == 6 && strings.HasSuffix(date, "00") {
+		month, err := time.ParseInLocation("0601", date[:4], time.Local)
+		if err != nil {
+			return month, err
+		}
+		return month.AddDate(0, 1, -1), nil
+	}
+	return time.ParseInLocation("060102", date, time.Local)
+}
@@ -0,0 +1,519 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package api provides the http request handlers for the Pi client's JSON
+// api, so that other apps (e.g., on a phone, or a home-automation system)
+// can read and change the scanned items without going through the WebApp's
+// html. Every request is made on behalf of the Account whose api code it
+// carries, as a bearer token:
+//
+//	Authorization: Bearer <api_code>
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/barcode"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// urls
+	API_PREFIX     = "/api/v1/"
+	ITEMS_PATH     = "items"
+	ACCOUNTS_PATH  = "accounts"
+	FAVORITE_PATH  = "favorite"
+	PRICES_PATH    = "prices"
+	PURCHASES_PATH = "purchases"
+
+	AUTH_HEADER  = "Authorization"
+	AUTH_SCHEME  = "Bearer "
+	MIME_JSON    = "application/json"
+	ITEMS_SOURCE = "api" // the Source of the Items added through the api
+
+	// the largest request body accepted
+	MAX_BODY = 1 << 20
+)
+
+var (
+	ErrNoAPICode  = errors.New("missing api code: send it as 'Authorization: Bearer <api_code>'")
+	ErrBadAPICode = errors.New("unknown api code")
+	ErrNotFound   = errors.New("not found")
+	ErrBadMethod  = errors.New("method not allowed")
+	ErrBadParam   = errors.New("invalid query parameter")
+	ErrTooLarge   = errors.New("request body too large")
+)
+
+// Item is the api representation of a database.Item
+type Item struct {
+	Id        int64      `json:"id"`
+	Barcode   string     `json:"barcode"`
+	Desc      string     `json:"desc"`
+	Index     *int64     `json:"index,omitempty"`
+	Favorite  bool       `json:"favorite"`
+	Posted    time.Time  `json:"posted"`
+	Updated   time.Time  `json:"updated"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	ScanCount int64      `json:"scan_count"`
+	Note      string     `json:"note,omitempty"`
+	Quantity  int64      `json:"quantity"`
+	Source    string     `json:"source,omitempty"`
+	DeviceId  int64      `json:"device_id,omitempty"`
+}
+
+// ItemList is the reply to a list of Items: one page of them, and how many
+// there are in all (see database.QueryItemsPage)
+type ItemList struct {
+	Items []*Item `json:"items"`
+	Total int64   `json:"total"`
+}
+
+// NewItem is the request body which adds an Item
+type NewItem struct {
+	Barcode string `json:"barcode"`
+	Desc    string `json:"desc"`
+}
+
+// Account is the api representation of a database.Account (without its api
+// code, which the caller has already)
+type Account struct {
+	Id    int64  `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// Purchase is the api representation of a database.Purchase, with its
+// price as written, e.g., "3.49"
+type Purchase struct {
+	Id        int64     `json:"id"`
+	Barcode   string    `json:"barcode,omitempty"`
+	Desc      string    `json:"desc,omitempty"`
+	Price     string    `json:"price"`
+	Currency  string    `json:"currency"`
+	Store     string    `json:"store,omitempty"`
+	Quantity  int64     `json:"quantity"`
+	Purchased time.Time `json:"purchased"`
+}
+
+// NewPurchase is the request body which records a price paid: the price
+// is required, everything else (but one of barcode or desc) is optional
+type NewPurchase struct {
+	Barcode   string     `json:"barcode"`
+	Desc      string     `json:"desc"`
+	Price     string     `json:"price"`
+	Currency  string     `json:"currency"`
+	Store     string     `json:"store"`
+	Quantity  int64      `json:"quantity"`
+	Purchased *time.Time `json:"purchased"`
+}
+
+// PriceSummary is the api representation of a database.PriceSummary
+type PriceSummary struct {
+	Currency      string    `json:"currency"`
+	Purchases     int       `json:"purchases"`
+	Last          *Purchase `json:"last"`
+	Average       string    `json:"average"`
+	Lowest        *Purchase `json:"lowest"`
+	CheapestStore string    `json:"cheapest_store,omitempty"`
+	StoreAverage  string    `json:"store_average,omitempty"`
+}
+
+// PriceList is the reply to the prices of a barcode: what they add up to,
+// in each currency, and every one paid, most recent first
+type PriceList struct {
+	Barcode   string          `json:"barcode"`
+	Summaries []*PriceSummary `json:"summaries"`
+	History   []*Purchase     `json:"history"`
+}
+
+// Error is the reply to a request which failed
+type Error struct {
+	Error string `json:"err"`
+}
+
+func apiItem(i *database.Item) *Item {
+	return &Item{Id: i.Id,
+		Barcode:   i.Barcode,
+		Desc:      i.Desc,
+		Index:     i.Index,
+		Favorite:  i.IsFavorite,
+		Posted:    i.PostedTime,
+		Updated:   i.Updated,
+		Expires:   i.ExpiresAt,
+		ScanCount: i.ScanCount,
+		Note:      i.Note,
+		Quantity:  i.Quantity,
+		Source:    i.Source,
+		DeviceId:  i.DeviceId}
+}
+
+func apiAccount(a *database.Account) *Account {
+	return &Account{Id: a.Id, Email: a.Email, Name: a.Name}
+}
+
+func apiPurchase(p *database.Purchase) *Purchase {
+	return &Purchase{Id: p.Id,
+		Barcode:   p.Barcode,
+		Desc:      p.Desc,
+		Price:     p.FormattedPrice(),
+		Currency:  p.Currency,
+		Store:     p.Store,
+		Quantity:  p.Quantity,
+		Purchased: p.Purchased}
+}
+
+func apiPriceSummary(s *database.PriceSummary) *PriceSummary {
+	summary := &PriceSummary{Currency: s.Currency,
+		Purchases:     s.Purchases,
+		Last:          apiPurchase(s.Last),
+		Average:       s.FormattedAverage(),
+		Lowest:        apiPurchase(s.Lowest),
+		CheapestStore: s.CheapestStore}
+	if s.CheapestStore != "" {
+		summary.StoreAverage = s.FormattedStoreAverage()
+	}
+	return summary
+}
+
+// reply writes the value as the json body, with the status code
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(&Error{Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=utf-8", MIME_JSON))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// replyError writes the error as the json body, with the status code which
+// matches it
+func replyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNoAPICode), errors.Is(err, ErrBadAPICode):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrNotFound), errors.Is(err, database.ErrNoItem), errors.Is(err, database.ErrNotOwned), errors.Is(err, database.ErrNoPurchase):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrBadMethod):
+		status = http.StatusMethodNotAllowed
+	case errors.Is(err, ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadParam),
+		errors.Is(err, barcode.ErrEmpty), errors.Is(err, barcode.ErrMalformed), errors.Is(err, barcode.ErrCheckDigit), errors.Is(err, database.ErrBadBarcode),
+		errors.Is(err, database.ErrBadLimit), errors.Is(err, database.ErrBadOffset), errors.Is(err, database.ErrBadOrder),
+		errors.Is(err, database.ErrBadPrice), errors.Is(err, database.ErrBadCurrency), errors.Is(err, database.ErrBadPurchase):
+		status = http.StatusBadRequest
+	case errors.Is(err, database.ErrDiskFull):
+		status = http.StatusInsufficientStorage
+	}
+	reply(w, status, &Error{Error: err.Error()})
+}
+
+// decodeBody reads the json request body (no larger than MAX_BODY, see
+// Handler) into v
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return ErrTooLarge
+	case err != nil:
+		return fmt.Errorf("%s: %w", err, ErrBadParam)
+	}
+	return nil
+}
+
+// authenticate returns the Account whose api code the request carries
+func authenticate(r *http.Request, db *sqlite3.Conn) (*database.Account, error) {
+	header := r.Header.Get(AUTH_HEADER)
+	if !strings.HasPrefix(header, AUTH_SCHEME) {
+		return nil, ErrNoAPICode
+	}
+	code := strings.TrimSpace(strings.TrimPrefix(header, AUTH_SCHEME))
+	if !database.ValidAPICode(code) {
+		return nil, ErrBadAPICode
+	}
+	acc, err := database.GetAccountByAPICode(db, code)
+	if errors.Is(err, database.ErrNoAccount) {
+		return nil, ErrBadAPICode
+	}
+	return acc, err
+}
+
+// Handler returns the handler for every request under API_PREFIX:
+//
+//	GET    items                 the Account's Items (see itemQuery for the filters)
+//	POST   items                 add an Item (a NewItem)
+//	GET    items/{id}            one Item
+//	DELETE items/{id}            move the Item to the trash
+//	PUT    items/{id}/favorite   favorite the Item (POST works too)
+//	DELETE items/{id}/favorite   unfavorite the Item
+//	GET    accounts              the Account itself, as a list of one
+//	GET    prices/{barcode}      the prices the Account paid for the barcode (a PriceList)
+//	POST   purchases             record a price paid (a NewPurchase)
+//	DELETE purchases/{id}        delete one of the Account's prices (replying with just its id)
+//
+// connecting to the client db (as the WebApp handlers do) for each request
+func Handler(coords database.ConnCoordinates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := database.InitializeDB(coords)
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		defer db.Close()
+
+		acc, err := authenticate(r, db)
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+
+		// a larger body fails decodeBody, and closes the connection
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_BODY)
+		status, v, err := route(r, db, acc)
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		reply(w, status, v)
+	}
+}
+
+// route calls the handler for the request's path and method, returning the
+// reply's status code and body
+func route(r *http.Request, db *sqlite3.Conn, acc *database.Account) (int, interface{}, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == ACCOUNTS_PATH:
+		if r.Method != "GET" {
+			return 0, nil, ErrBadMethod
+		}
+		return http.StatusOK, []*Account{apiAccount(acc)}, nil
+
+	case len(parts) == 1 && parts[0] == ITEMS_PATH:
+		switch r.Method {
+		case "GET":
+			return listItems(r, db, acc)
+		case "POST":
+			return addItem(r, db, acc)
+		}
+		return 0, nil, ErrBadMethod
+
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == ITEMS_PATH:
+		id, idErr := strconv.ParseInt(parts[1], 10, 64)
+		if idErr != nil {
+			return 0, nil, ErrNotFound
+		}
+		item, err := database.GetSingleItem(db, acc, id)
+		if err != nil {
+			return 0, nil, err
+		}
+		if item.Id == database.BAD_PK {
+			return 0, nil, ErrNotFound
+		}
+
+		if len(parts) == 2 {
+			switch r.Method {
+			case "GET":
+				return http.StatusOK, apiItem(item), nil
+			case "DELETE":
+				if err := item.DeleteForAccount(db, acc); err != nil {
+					return 0, nil, err
+				}
+				return http.StatusOK, apiItem(item), nil
+			}
+			return 0, nil, ErrBadMethod
+		}
+
+		if parts[2] != FAVORITE_PATH {
+			return 0, nil, ErrNotFound
+		}
+		switch r.Method {
+		case "PUT", "POST":
+			err = item.Favorite(db)
+		case "DELETE":
+			err = item.Unfavorite(db)
+		default:
+			return 0, nil, ErrBadMethod
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return getItem(db, acc, item.Id, http.StatusOK)
+
+	case len(parts) == 2 && parts[0] == PRICES_PATH:
+		if r.Method != "GET" {
+			return 0, nil, ErrBadMethod
+		}
+		return listPrices(db, acc, parts[1])
+
+	case len(parts) == 1 && parts[0] == PURCHASES_PATH:
+		if r.Method != "POST" {
+			return 0, nil, ErrBadMethod
+		}
+		return addPurchase(r, db, acc)
+
+	case len(parts) == 2 && parts[0] == PURCHASES_PATH:
+		if r.Method != "DELETE" {
+			return 0, nil, ErrBadMethod
+		}
+		id, idErr := strconv.ParseInt(parts[1], 10, 64)
+		if idErr != nil {
+			return 0, nil, ErrNotFound
+		}
+		if err := database.DeletePurchase(db, acc, id); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]int64{"id": id}, nil
+	}
+	return 0, nil, ErrNotFound
+}
+
+// getItem replies with the Item as stored
+func getItem(db *sqlite3.Conn, acc *database.Account, id int64, status int) (int, interface{}, error) {
+	item, err := database.GetSingleItem(db, acc, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if item.Id == database.BAD_PK {
+		return 0, nil, ErrNotFound
+	}
+	return status, apiItem(item), nil
+}
+
+// itemQuery converts the request's query parameters into the filters of an
+// ItemQuery: favorite (true or false), since and until (RFC 3339 times),
+// tag, device (an id), q (searched for in the description or barcode),
+// limit, offset, and order (newest, oldest, description, or barcode)
+func itemQuery(r *http.Request) (database.ItemQuery, error) {
+	var q database.ItemQuery
+	params := r.URL.Query()
+	if v := params.Get("favorite"); v != "" {
+		favorite, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("favorite: %w", ErrBadParam)
+		}
+		q.Favorite = &favorite
+	}
+	for name, t := range map[string]**time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%s: %w", name, ErrBadParam)
+			}
+			*t = &parsed
+		}
+	}
+	for name, n := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if v := params.Get(name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				return q, fmt.Errorf("%s: %w", name, ErrBadParam)
+			}
+			*n = parsed
+		}
+	}
+	if v := params.Get("device"); v != "" {
+		device, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("device: %w", ErrBadParam)
+		}
+		q.Device = device
+	}
+	q.Tag = params.Get("tag")
+	q.Search = params.Get("q")
+	q.Order = params.Get("order")
+	return q, nil
+}
+
+// listItems replies with the page of the Account's Items which match the
+// query (see itemQuery)
+func listItems(r *http.Request, db *sqlite3.Conn, acc *database.Account) (int, interface{}, error) {
+	q, err := itemQuery(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	items, total, err := database.QueryItemsPage(db, acc, q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	list := &ItemList{Items: make([]*Item, 0, len(items)), Total: total}
+	for _, item := range items {
+		list.Items = append(list.Items, apiItem(item))
+	}
+	return http.StatusOK, list, nil
+}
+
+// addItem adds the Item in the request body (a NewItem) for the Account,
+// replying with the Item as stored (which may be one saved already, with
+// the same barcode and description, see database.Item.Add)
+func addItem(r *http.Request, db *sqlite3.Conn, acc *database.Account) (int, interface{}, error) {
+	var n NewItem
+	if err := decodeBody(r, &n); err != nil {
+		return 0, nil, err
+	}
+
+	item := &database.Item{Barcode: n.Barcode, Desc: n.Desc, UserContributed: n.Desc != "", Source: ITEMS_SOURCE}
+	id, err := item.Add(db, acc)
+	if err != nil {
+		return 0, nil, err
+	}
+	return getItem(db, acc, id, http.StatusCreated)
+}
+
+// listPrices replies with every price the Account paid for the barcode,
+// and what they add up to (see database.SummarizePrices)
+func listPrices(db *sqlite3.Conn, acc *database.Account, barcode string) (int, interface{}, error) {
+	history, err := database.GetAccountPriceHistory(db, acc, barcode)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	list := &PriceList{Barcode: barcode, Summaries: make([]*PriceSummary, 0), History: make([]*Purchase, 0, len(history))}
+	for _, summary := range database.SummarizePrices(history) {
+		list.Summaries = append(list.Summaries, apiPriceSummary(summary))
+	}
+	for _, p := range history {
+		list.History = append(list.History, apiPurchase(p))
+	}
+	return http.StatusOK, list, nil
+}
+
+// addPurchase records the price paid in the request body (a NewPurchase)
+// for the Account, replying with the Purchase as stored
+func addPurchase(r *http.Request, db *sqlite3.Conn, acc *database.Account) (int, interface{}, error) {
+	var n NewPurchase
+	if err := decodeBody(r, &n); err != nil {
+		return 0, nil, err
+	}
+	price, err := database.ParsePrice(n.Price)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	p := &database.Purchase{Barcode: n.Barcode,
+		Desc:     n.Desc,
+		Price:    price,
+		Currency: n.Currency,
+		Store:    n.Store,
+		Quantity: n.Quantity}
+	if n.Purchased != nil {
+		p.Purchased = *n.Purchased
+	}
+	if _, err := database.RecordPurchase(db, acc, p); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, apiPurchase(p), nil
+}
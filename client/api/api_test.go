@@ -0,0 +1,278 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package api
+
+import (
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const TEST_COLA = "036000291452"
+
+// newTestAPI returns the api Handler, on a db file in a temporary folder,
+// and a connection to that db, for the setup
+func newTestAPI(t *testing.T) (http.HandlerFunc, *sqlite3.Conn) {
+	t.Helper()
+	coords := database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE}
+	db, err := database.InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return Handler(coords), db
+}
+
+func newTestAccount(t *testing.T, db *sqlite3.Conn, email string) *database.Account {
+	t.Helper()
+	code, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&database.Account{Email: email, APICode: code}).Add(db); err != nil {
+		t.Fatal(err)
+	}
+	a, err := database.GetAccount(db, email)
+	if err != nil || a.Id == 0 {
+		t.Fatalf("GetAccount(%q) = %+v, %v", email, a, err)
+	}
+	return a
+}
+
+// call makes the request to the handler, with the api code (unless it is
+// empty), returning the reply
+func call(h http.Handler, method, path, code, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, API_PREFIX+path, strings.NewReader(body))
+	if code != "" {
+		r.Header.Set(AUTH_HEADER, AUTH_SCHEME+code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// decode reads the json reply into v, which must have the status code
+func decode(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: %v", w.Body, err)
+	}
+}
+
+func TestListPricesScoped(t *testing.T) {
+	h, db := newTestAPI(t)
+	alice := newTestAccount(t, db, "alice@example.org")
+	bob := newTestAccount(t, db, "bob@example.org")
+
+	var p Purchase
+	decode(t, call(h, "POST", PURCHASES_PATH, alice.APICode, `{"barcode": "`+TEST_COLA+`", "price": "1.99", "currency": "USD", "store": "Corner Shop"}`), http.StatusCreated, &p)
+
+	var list PriceList
+	decode(t, call(h, "GET", PRICES_PATH+"/"+TEST_COLA, alice.APICode, ""), http.StatusOK, &list)
+	if len(list.History) != 1 || list.History[0].Id != p.Id || len(list.Summaries) != 1 {
+		t.Errorf("alice's prices = %+v, want her purchase", list)
+	}
+
+	// bob sees none of them, nor their store
+	w := call(h, "GET", PRICES_PATH+"/"+TEST_COLA, bob.APICode, "")
+	list = PriceList{}
+	decode(t, w, http.StatusOK, &list)
+	if len(list.History) != 0 || len(list.Summaries) != 0 {
+		t.Errorf("bob's prices = %+v, want none", list)
+	}
+	if strings.Contains(w.Body.String(), "Corner Shop") {
+		t.Errorf("bob's prices include alice's store: %s", w.Body)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h, db := newTestAPI(t)
+	alice := newTestAccount(t, db, "alice@example.org")
+	other, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, header string
+	}{
+		{"no header", ""},
+		{"another scheme", "Basic " + alice.APICode},
+		{"an empty code", AUTH_SCHEME},
+		{"a malformed code", AUTH_SCHEME + "not a code"},
+		{"an unknown code", AUTH_SCHEME + other},
+	} {
+		r := httptest.NewRequest("GET", API_PREFIX+ITEMS_PATH, nil)
+		if test.header != "" {
+			r.Header.Set(AUTH_HEADER, test.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var e Error
+		decode(t, w, http.StatusUnauthorized, &e)
+		if e.Error == "" {
+			t.Errorf("%s: no error in the reply", test.name)
+		}
+	}
+
+	var accounts []*Account
+	decode(t, call(h, "GET", ACCOUNTS_PATH, alice.APICode, ""), http.StatusOK, &accounts)
+	if len(accounts) != 1 || accounts[0].Id != alice.Id || accounts[0].Email != alice.Email {
+		t.Errorf("accounts = %+v, want only alice", accounts)
+	}
+}
+
+func TestRouteStatus(t *testing.T) {
+	h, db := newTestAPI(t)
+	alice := newTestAccount(t, db, "alice@example.org")
+	bob := newTestAccount(t, db, "bob@example.org")
+	cola := &database.Item{Barcode: TEST_COLA, Desc: "Cola"}
+	if _, err := cola.Add(db, alice); err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.FormatInt(cola.Id, 10)
+
+	for _, test := range []struct {
+		method, path, code string
+		status             int
+	}{
+		{"GET", "nothing", alice.APICode, http.StatusNotFound},
+		{"GET", ITEMS_PATH + "/x", alice.APICode, http.StatusNotFound},
+		{"GET", ITEMS_PATH + "/0", alice.APICode, http.StatusNotFound},
+		{"GET", ITEMS_PATH + "/" + id + "/other", alice.APICode, http.StatusNotFound},
+		{"GET", ITEMS_PATH + "/" + id + "/" + FAVORITE_PATH + "/x", alice.APICode, http.StatusNotFound},
+		{"DELETE", PURCHASES_PATH + "/x", alice.APICode, http.StatusNotFound},
+		{"DELETE", PURCHASES_PATH + "/1", alice.APICode, http.StatusNotFound},
+		// someone else's Item is not found, whatever the method
+		{"GET", ITEMS_PATH + "/" + id, bob.APICode, http.StatusNotFound},
+		{"DELETE", ITEMS_PATH + "/" + id, bob.APICode, http.StatusNotFound},
+		{"PUT", ITEMS_PATH + "/" + id + "/" + FAVORITE_PATH, bob.APICode, http.StatusNotFound},
+
+		{"PUT", ACCOUNTS_PATH, alice.APICode, http.StatusMethodNotAllowed},
+		{"DELETE", ITEMS_PATH, alice.APICode, http.StatusMethodNotAllowed},
+		{"POST", ITEMS_PATH + "/" + id, alice.APICode, http.StatusMethodNotAllowed},
+		{"GET", ITEMS_PATH + "/" + id + "/" + FAVORITE_PATH, alice.APICode, http.StatusMethodNotAllowed},
+		{"POST", PRICES_PATH + "/" + TEST_COLA, alice.APICode, http.StatusMethodNotAllowed},
+		{"GET", PURCHASES_PATH, alice.APICode, http.StatusMethodNotAllowed},
+		{"GET", PURCHASES_PATH + "/1", alice.APICode, http.StatusMethodNotAllowed},
+
+		{"GET", ITEMS_PATH + "?favorite=maybe", alice.APICode, http.StatusBadRequest},
+		{"GET", ITEMS_PATH + "?limit=x", alice.APICode, http.StatusBadRequest},
+		{"GET", ITEMS_PATH + "?since=yesterday", alice.APICode, http.StatusBadRequest},
+	} {
+		w := call(h, test.method, test.path, test.code, "")
+		if w.Code != test.status {
+			t.Errorf("%s %s = %d, want %d: %s", test.method, test.path, w.Code, test.status, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, MIME_JSON) {
+			t.Errorf("%s %s replied with %q", test.method, test.path, ct)
+		}
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	h, db := newTestAPI(t)
+	alice := newTestAccount(t, db, "alice@example.org")
+
+	// as large as it can be is fine
+	body := `{"barcode": "` + TEST_COLA + `", "desc": "Cola"}`
+	body += strings.Repeat(" ", MAX_BODY-len(body))
+	var i Item
+	decode(t, call(h, "POST", ITEMS_PATH, alice.APICode, body), http.StatusCreated, &i)
+
+	// but any larger is refused, and nothing is added
+	large := `{"barcode": "` + TEST_COLA + `", "price": "1.99", "desc": "` + strings.Repeat("x", MAX_BODY) + `"}`
+	for _, path := range []string{ITEMS_PATH, PURCHASES_PATH} {
+		w := call(h, "POST", path, alice.APICode, large)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST %s of %d bytes = %d, want %d", path, len(large), w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	if items, err := database.GetItems(db, alice); err != nil || len(items) != 1 {
+		t.Errorf("GetItems() = %v, %v, want only the first", items, err)
+	}
+
+	// and the server closes the connection, rather than read the rest
+	server := httptest.NewServer(h)
+	defer server.Close()
+	r, err := http.NewRequest("POST", server.URL+API_PREFIX+ITEMS_PATH, strings.NewReader(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set(AUTH_HEADER, AUTH_SCHEME+alice.APICode)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !resp.Close {
+		t.Errorf("POST %s of %d bytes to the server = %d, closed %v, want %d, closed", ITEMS_PATH, len(large), resp.StatusCode, resp.Close, http.StatusRequestEntityTooLarge)
+	}
+
+	// which is not the same as a malformed one
+	if w := call(h, "POST", ITEMS_PATH, alice.APICode, "{"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST %s of malformed json = %d, want %d", ITEMS_PATH, w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestItemsRoundTrip(t *testing.T) {
+	h, db := newTestAPI(t)
+	alice := newTestAccount(t, db, "alice@example.org")
+
+	var added Item
+	decode(t, call(h, "POST", ITEMS_PATH, alice.APICode, `{"barcode": "`+TEST_COLA+`", "desc": "Cola"}`), http.StatusCreated, &added)
+	if added.Id == 0 || added.Barcode != TEST_COLA || added.Desc != "Cola" || added.Source != ITEMS_SOURCE || added.Favorite {
+		t.Errorf("POST %s = %+v", ITEMS_PATH, added)
+	}
+	path := ITEMS_PATH + "/" + strconv.FormatInt(added.Id, 10)
+
+	var got Item
+	decode(t, call(h, "GET", path, alice.APICode, ""), http.StatusOK, &got)
+	if got.Id != added.Id || got.Barcode != added.Barcode || got.Desc != added.Desc || !got.Posted.Equal(added.Posted) {
+		t.Errorf("GET %s = %+v, want %+v", path, got, added)
+	}
+	var list ItemList
+	decode(t, call(h, "GET", ITEMS_PATH, alice.APICode, ""), http.StatusOK, &list)
+	if list.Total != 1 || len(list.Items) != 1 || list.Items[0].Id != added.Id {
+		t.Errorf("GET %s = %+v, want the one added", ITEMS_PATH, list)
+	}
+
+	// favorite, and unfavorite
+	decode(t, call(h, "PUT", path+"/"+FAVORITE_PATH, alice.APICode, ""), http.StatusOK, &got)
+	if !got.Favorite {
+		t.Errorf("PUT %s/%s = %+v, want it favorited", path, FAVORITE_PATH, got)
+	}
+	list = ItemList{}
+	decode(t, call(h, "GET", ITEMS_PATH+"?favorite=true", alice.APICode, ""), http.StatusOK, &list)
+	if list.Total != 1 || len(list.Items) != 1 || !list.Items[0].Favorite {
+		t.Errorf("GET %s?favorite=true = %+v, want the favorite", ITEMS_PATH, list)
+	}
+	got = Item{}
+	decode(t, call(h, "DELETE", path+"/"+FAVORITE_PATH, alice.APICode, ""), http.StatusOK, &got)
+	if got.Id != added.Id || got.Favorite {
+		t.Errorf("DELETE %s/%s = %+v, want it unfavorited", path, FAVORITE_PATH, got)
+	}
+
+	// delete, after which it is gone
+	decode(t, call(h, "DELETE", path, alice.APICode, ""), http.StatusOK, &got)
+	if got.Id != added.Id {
+		t.Errorf("DELETE %s = %+v", path, got)
+	}
+	if w := call(h, "GET", path, alice.APICode, ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET %s after DELETE = %d, want %d", path, w.Code, http.StatusNotFound)
+	}
+	list = ItemList{}
+	decode(t, call(h, "GET", ITEMS_PATH, alice.APICode, ""), http.StatusOK, &list)
+	if list.Total != 0 || len(list.Items) != 0 {
+		t.Errorf("GET %s after DELETE = %+v, want none", ITEMS_PATH, list)
+	}
+}
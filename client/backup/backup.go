@@ -0,0 +1,237 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package backup takes online snapshots of the client db (with the sqlite
+// backup api, see database.BackupTo, so the scanner can keep writing
+// meanwhile) into a folder, on a cron-like schedule, keeping only the most
+// recent ones, and optionally uploading each one elsewhere (see Uploader),
+// since the SD card it is on will fail eventually. Any snapshot can be
+// restored in place (see Backups.Restore).
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/report"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// how many snapshots are kept, by default
+	DEFAULT_KEEP = 7
+
+	// when the snapshots are taken, by default: every night, at 3am
+	DEFAULT_SCHEDULE = "0 3 * * *"
+
+	// each snapshot is named for the db file, and when it was taken (UTC)
+	TIME_FORMAT     = "20060102T150405Z"
+	SNAPSHOT_SUFFIX = ".sqlite"
+)
+
+var (
+	ErrNoSnapshot = errors.New("no such backup")
+)
+
+// Snapshot is one backup of the db
+type Snapshot struct {
+	Name  string
+	Path  string
+	Taken time.Time
+	Size  int64
+}
+
+// Backups are the snapshots of the db at the coordinates, in the Folder,
+// of which only the most recent Keep are kept (or DEFAULT_KEEP), each
+// uploaded with the Uploader, if there is one
+type Backups struct {
+	Coords   database.ConnCoordinates
+	Folder   string
+	Keep     int
+	Uploader Uploader
+}
+
+// prefix is what every snapshot's name starts with: the db file's, without
+// its extension
+func (b *Backups) prefix() string {
+	return strings.TrimSuffix(b.Coords.DBFile, filepath.Ext(b.Coords.DBFile)) + "-"
+}
+
+func (b *Backups) keep() int {
+	if b.Keep > 0 {
+		return b.Keep
+	}
+	return DEFAULT_KEEP
+}
+
+// List returns the snapshots in the Folder, most recent first
+func (b *Backups) List() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(b.Folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Snapshot{}, nil
+		}
+		return nil, err
+	}
+	prefix := b.prefix()
+	snapshots := make([]*Snapshot, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, SNAPSHOT_SUFFIX) {
+			continue
+		}
+		taken, timeErr := time.Parse(TIME_FORMAT, strings.TrimSuffix(strings.TrimPrefix(name, prefix), SNAPSHOT_SUFFIX))
+		if timeErr != nil {
+			continue // not one of ours
+		}
+		info, infoErr := e.Info()
+		if infoErr != nil {
+			return nil, infoErr
+		}
+		snapshots = append(snapshots, &Snapshot{Name: name, Path: filepath.Join(b.Folder, name), Taken: taken, Size: info.Size()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Taken.After(snapshots[j].Taken) })
+	return snapshots, nil
+}
+
+// Find returns the snapshot with the name, which must be one of those
+// in the Folder (see List), or ErrNoSnapshot
+func (b *Backups) Find(name string) (*Snapshot, error) {
+	snapshots, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, ErrNoSnapshot
+}
+
+// snapshot writes a new snapshot of the db into the Folder
+func (b *Backups) snapshot() (*Snapshot, error) {
+	if err := os.MkdirAll(b.Folder, 0755); err != nil {
+		return nil, err
+	}
+	// two snapshots taken in the same second (e.g., one just before a
+	// restore) are named a second apart
+	taken := database.Now().UTC().Truncate(time.Second)
+	name := b.prefix() + taken.Format(TIME_FORMAT) + SNAPSHOT_SUFFIX
+	for {
+		if _, err := os.Stat(filepath.Join(b.Folder, name)); err != nil {
+			break
+		}
+		taken = taken.Add(time.Second)
+		name = b.prefix() + taken.Format(TIME_FORMAT) + SNAPSHOT_SUFFIX
+	}
+	s := &Snapshot{Name: name, Path: filepath.Join(b.Folder, name), Taken: taken}
+
+	db, err := database.OpenReadOnly(b.Coords)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err := database.BackupTo(db, s.Path); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(s.Path); err == nil {
+		s.Size = info.Size()
+	}
+	return s, nil
+}
+
+// Rotate deletes all but the most recent snapshots (see Keep), returning
+// how many it deleted
+func (b *Backups) Rotate() (int, error) {
+	snapshots, err := b.List()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for j := b.keep(); j < len(snapshots); j++ {
+		if err := os.Remove(snapshots[j].Path); err != nil {
+			return deleted, err
+		}
+		deleted += 1
+	}
+	return deleted, nil
+}
+
+// Take writes a new snapshot, deletes the oldest ones (see Rotate), and
+// uploads the new one, if there is an Uploader. A failed upload is
+// returned along with the snapshot, which is kept regardless.
+func (b *Backups) Take(ctx context.Context) (*Snapshot, error) {
+	s, err := b.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.Rotate(); err != nil {
+		return s, err
+	}
+	if b.Uploader != nil {
+		if err := b.Uploader.Upload(ctx, s.Path); err != nil {
+			return s, fmt.Errorf("%s upload of %s failed: %s", b.Uploader.Name(), s.Name, err)
+		}
+	}
+	return s, nil
+}
+
+// Restore replaces the db with the snapshot of the name (see Find, and
+// database.RestoreFromBackup), after taking one of the db as it is now, so
+// that the restore itself can be undone
+func (b *Backups) Restore(name string) (*Snapshot, error) {
+	s, err := b.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	undo, err := b.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := database.InitializeDB(b.Coords)
+	if err != nil {
+		return undo, err
+	}
+	defer db.Close()
+	if err := database.RestoreFromBackup(db, s.Path); err != nil {
+		return undo, err
+	}
+	log.Println(fmt.Sprintf("Restored the db from %s (it was backed up first, as %s)", s.Name, undo.Name))
+	return undo, nil
+}
+
+// Run takes a snapshot (see Take) each time the Schedule comes up, until
+// the context is done
+func (b *Backups) Run(ctx context.Context, schedule *report.Schedule) {
+	for {
+		next := schedule.Next(database.Now())
+		if next.IsZero() {
+			log.Println(fmt.Sprintf("The backup schedule %q never comes up", schedule.Spec))
+			return
+		}
+		timer := time.NewTimer(next.Sub(database.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s, err := b.Take(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+		if s != nil {
+			log.Println(fmt.Sprintf("Backed up the db to %s (%d bytes)", s.Path, s.Size))
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fixClock sets the database clock (by which the snapshots are named) to a
+// fixed time, which the test can move, restoring it after
+func fixClock(t *testing.T) *time.Time {
+	now := time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC)
+	saved := database.Now
+	database.Now = func() time.Time { return now }
+	t.Cleanup(func() { database.Now = saved })
+	return &now
+}
+
+// newTestBackups returns the Backups of a new db, in its own temporary
+// folder, with an Account, whose Items tell the snapshots apart
+func newTestBackups(t *testing.T, keep int) (*Backups, *database.Account) {
+	t.Helper()
+	b := &Backups{Coords: database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE}, Folder: t.TempDir(), Keep: keep}
+	db, err := database.InitializeDB(b.Coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	code, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&database.Account{Email: "alice@example.org", APICode: code}).Add(db); err != nil {
+		t.Fatal(err)
+	}
+	a, err := database.GetAccount(db, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, a
+}
+
+// countItems returns how many Items the Account has, in the db file
+func countItems(t *testing.T, coords database.ConnCoordinates, a *database.Account) int {
+	t.Helper()
+	db, err := database.OpenReadOnly(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items, err := database.GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(items)
+}
+
+func addItem(t *testing.T, b *Backups, a *database.Account, barcode string) {
+	t.Helper()
+	db, err := database.InitializeDB(b.Coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := (&database.Item{Barcode: barcode, Desc: barcode}).Add(db, a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	now := fixClock(t)
+	b, _ := newTestBackups(t, 3)
+	// nor are the other files in the folder touched
+	for _, name := range []string{"notes.txt", b.prefix() + "latest" + SNAPSHOT_SUFFIX} {
+		if err := os.WriteFile(filepath.Join(b.Folder, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken := make([]*Snapshot, 0)
+	for k := 0; k < 5; k++ {
+		s, err := b.Take(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken = append(taken, s)
+		*now = now.Add(time.Hour)
+	}
+
+	snapshots, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != b.keep() {
+		t.Fatalf("%d snapshots kept, want %d", len(snapshots), b.keep())
+	}
+	for j, s := range snapshots {
+		want := taken[len(taken)-1-j]
+		if s.Name != want.Name || !s.Taken.Equal(want.Taken) || s.Size == 0 {
+			t.Errorf("snapshot %d = %+v, want %+v", j, s, want)
+		}
+	}
+	for _, name := range []string{"notes.txt", b.prefix() + "latest" + SNAPSHOT_SUFFIX} {
+		if _, err := os.Stat(filepath.Join(b.Folder, name)); err != nil {
+			t.Errorf("%s was deleted: %v", name, err)
+		}
+	}
+
+	// keeping fewer deletes the oldest of them
+	b.Keep = 1
+	if n, err := b.Rotate(); err != nil || n != 2 {
+		t.Errorf("Rotate() = %d, %v, want 2", n, err)
+	}
+	if snapshots, err := b.List(); err != nil || len(snapshots) != 1 || snapshots[0].Name != taken[4].Name {
+		t.Errorf("List() after Rotate() = %v, %v, want only the newest", snapshots, err)
+	}
+	// and a Keep of zero is the default
+	b.Keep = 0
+	if b.keep() != DEFAULT_KEEP {
+		t.Errorf("keep() = %d, want %d", b.keep(), DEFAULT_KEEP)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	now := fixClock(t)
+	b, a := newTestBackups(t, 0)
+	addItem(t, b, a, "036000291452")
+	s, err := b.Take(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addItem(t, b, a, "4006381333931")
+
+	// in the same second, so the snapshot before the restore is one later
+	undo, err := b.Restore(s.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countItems(t, b.Coords, a); n != 1 {
+		t.Errorf("%d Items after the restore, want 1", n)
+	}
+	if undo.Name == s.Name || !undo.Taken.Equal(now.Add(time.Second)) {
+		t.Errorf("Restore() took %+v, after %+v", undo, s)
+	}
+	// which has the db as it was
+	if n := countItems(t, database.ConnCoordinates{DBPath: b.Folder, DBFile: undo.Name}, a); n != 2 {
+		t.Errorf("%d Items in the snapshot taken by Restore(), want 2", n)
+	}
+	// and so undoes it
+	if _, err := b.Restore(undo.Name); err != nil {
+		t.Fatal(err)
+	}
+	if n := countItems(t, b.Coords, a); n != 2 {
+		t.Errorf("%d Items after undoing the restore, want 2", n)
+	}
+
+	if _, err := b.Restore("missing" + SNAPSHOT_SUFFIX); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Restore() of a missing snapshot = %v, want ErrNoSnapshot", err)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package backup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SCP_COMMAND = "scp"
+
+	// the S3 region, when neither the target nor AWS_REGION has one
+	DEFAULT_S3_REGION = "us-east-1"
+
+	// the S3 request signing (https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html)
+	S3_ALGORITHM   = "AWS4-HMAC-SHA256"
+	S3_SERVICE     = "s3"
+	S3_DATE_FORMAT = "20060102T150405Z"
+)
+
+var (
+	ErrBadTarget     = errors.New("the backup upload target must be an scp://, s3://, webdav://, webdavs://, http://, or https:// url")
+	ErrNoCredentials = errors.New("the s3 upload needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY in its environment")
+)
+
+// Uploader copies each snapshot somewhere off the Pi
+type Uploader interface {
+	Name() string
+	Upload(ctx context.Context, file string) error
+}
+
+// ParseUploader returns the Uploader for the target url:
+//
+//	scp://user@host[:port]/folder[?identity=keyfile]
+//	s3://bucket[/prefix][?region=region&endpoint=url] (with the AWS_* credentials in the environment)
+//	webdav[s]://[user:password@]host/folder (or http[s]://)
+func ParseUploader(target string) (Uploader, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "scp":
+		return &SCPUploader{Host: u.Host, User: u.User.Username(), Folder: u.Path, Identity: u.Query().Get("identity")}, nil
+	case "s3":
+		s3 := &S3Uploader{Bucket: u.Host,
+			Prefix:       strings.TrimPrefix(u.Path, "/"),
+			Region:       u.Query().Get("region"),
+			Endpoint:     u.Query().Get("endpoint"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+		if s3.Region == "" {
+			s3.Region = os.Getenv("AWS_REGION")
+		}
+		if s3.AccessKey == "" || s3.SecretKey == "" {
+			return nil, ErrNoCredentials
+		}
+		return s3, nil
+	case "webdav", "webdavs", "http", "https":
+		dav := &WebDAVUploader{}
+		if u.User != nil {
+			dav.Username = u.User.Username()
+			dav.Password, _ = u.User.Password()
+			u.User = nil
+		}
+		switch u.Scheme {
+		case "webdav":
+			u.Scheme = "http"
+		case "webdavs":
+			u.Scheme = "https"
+		}
+		dav.URL = u.String()
+		return dav, nil
+	}
+	return nil, ErrBadTarget
+}
+
+// SCPUploader copies each snapshot with scp, which must be able to log in
+// without a password (i.e., with a key)
+type SCPUploader struct {
+	Host     string // may include the port
+	User     string
+	Folder   string
+	Identity string // the private key file (optional)
+}
+
+func (s *SCPUploader) Name() string {
+	return "scp"
+}
+
+func (s *SCPUploader) Upload(ctx context.Context, file string) error {
+	args := []string{"-q", "-B"} // batch mode: never prompt
+	host := s.Host
+	if h, port, found := strings.Cut(host, ":"); found {
+		host = h
+		args = append(args, "-P", port)
+	}
+	if s.Identity != "" {
+		args = append(args, "-i", s.Identity)
+	}
+	if s.User != "" {
+		host = s.User + "@" + host
+	}
+	folder := strings.TrimPrefix(s.Folder, "/")
+	if folder == "" {
+		folder = "."
+	}
+	args = append(args, file, host+":"+folder+"/")
+
+	out, err := exec.CommandContext(ctx, SCP_COMMAND, args...).CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// WebDAVUploader PUTs each snapshot into the folder at the URL (e.g., a
+// Nextcloud one), with basic authentication, if it has a Username
+type WebDAVUploader struct {
+	URL      string
+	Username string
+	Password string
+}
+
+func (w *WebDAVUploader) Name() string {
+	return "webdav"
+}
+
+func (w *WebDAVUploader) Upload(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	target := strings.TrimSuffix(w.URL, "/") + "/" + url.PathEscape(filepath.Base(file))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if w.Username != "" {
+		req.SetBasicAuth(w.Username, w.Password)
+	}
+	return send(req)
+}
+
+// S3Uploader PUTs each snapshot into the bucket (on AWS, or any service
+// compatible with it, e.g., MinIO, at the Endpoint), under the Prefix,
+// signing each request (Signature Version 4) without any SDK
+type S3Uploader struct {
+	Bucket       string
+	Prefix       string
+	Region       string
+	Endpoint     string // defaults to https://s3.<region>.amazonaws.com
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary credentials (optional)
+}
+
+func (s *S3Uploader) Name() string {
+	return "s3"
+}
+
+func (s *S3Uploader) region() string {
+	if s.Region != "" {
+		return s.Region
+	}
+	return DEFAULT_S3_REGION
+}
+
+func (s *S3Uploader) Upload(ctx context.Context, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region())
+	}
+	key := path.Join(s.Prefix, filepath.Base(file))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(endpoint, "/")+"/"+s.Bucket+"/"+key, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	s.sign(req, hex.EncodeToString(hash.Sum(nil)), time.Now().UTC())
+	return send(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds the Authorization header (and the headers it signs) of the
+// request, whose body has the (hex) sha256
+func (s *S3Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	stamp := now.Format(S3_DATE_FORMAT)
+	date := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	// the canonical request: header names lowercase, in order
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := strings.Join([]string{date, s.region(), S3_SERVICE, "aws4_request"}, "/")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{S3_ALGORITHM, stamp, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, S3_SERVICE)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", S3_ALGORITHM, s.AccessKey, scope, signedHeaders, signature))
+}
+
+// send makes the request, returning an error unless the reply is a success
+func send(req *http.Request) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
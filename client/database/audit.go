@@ -0,0 +1,110 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// Item history (for existing db files; see also tables.sql)
+	CREATE_ITEM_AUDIT = `CREATE TABLE IF NOT EXISTS item_audit (
+	id           integer primary key AUTOINCREMENT,
+	product      integer NOT NULL,
+	account      integer REFERENCES account(id),
+	event        text NOT NULL,
+	logged       datetime DEFAULT (datetime('now'))
+)`
+
+	// The triggers which write to item_audit, while it is enabled: each
+	// runs as part of the statement which fired it, so the history is
+	// written in the same transaction as the change itself
+	AUDIT_TRIGGER = "CREATE TRIGGER IF NOT EXISTS %s AFTER %s ON product %s BEGIN INSERT INTO item_audit (product, account, event) VALUES (%s.id, %s.account, '%s'); END"
+	DROP_TRIGGER  = "DROP TRIGGER IF EXISTS %s"
+
+	// Prepared Statements
+	GET_ITEM_HISTORY = "select id, product, account, event, strftime('%s', logged) from item_audit where product = $i order by id"
+)
+
+// AuditTrigger defines one of the triggers which write to item_audit
+type AuditTrigger struct {
+	Name  string
+	Event string // "INSERT", "DELETE", or "UPDATE OF [columns]"
+	When  string // the optional WHEN clause
+	Row   string // "new" or "old"
+	Kind  string // the Item change kind logged
+}
+
+var (
+	// updates of product.updated alone (e.g., by the product_updated
+	// trigger) are not logged
+	AUDIT_TRIGGERS = []*AuditTrigger{
+		{Name: "audit_product_insert", Event: "INSERT", Row: "new", Kind: ITEM_ADDED},
+		{Name: "audit_product_delete", Event: "DELETE", Row: "old", Kind: ITEM_DELETED},
+		{Name: "audit_product_favorite", Event: "UPDATE OF is_favorite", When: "FOR EACH ROW WHEN new.is_favorite = 1 AND old.is_favorite = 0", Row: "new", Kind: ITEM_FAVORITED},
+		{Name: "audit_product_unfavorite", Event: "UPDATE OF is_favorite", When: "FOR EACH ROW WHEN new.is_favorite = 0 AND old.is_favorite = 1", Row: "new", Kind: ITEM_UNFAVORITED},
+		{Name: "audit_product_update", Event: "UPDATE OF barcode, product_desc, product_ind, is_edit, expires, account, scan_count, note", Row: "new", Kind: ITEM_UPDATED},
+	}
+)
+
+// ItemEvent is one entry in the history of an Item
+type ItemEvent struct {
+	Id        int64
+	ItemId    int64
+	AccountId int64
+	Kind      string // one of the Item change kinds
+	Logged    time.Time
+}
+
+// EnableItemAudit turns the item_audit history on (or off) for the db, by
+// creating (or dropping) its triggers. It is off by default, since every
+// change to an Item then costs an additional insert. The setting is kept in
+// the db file itself, so it applies to every connection, and persists.
+// Events are logged according to sqlite's clock, not Now.
+func EnableItemAudit(db *sqlite3.Conn, enabled bool) (err error) {
+	defer wrapError("EnableItemAudit", &err)
+	return withTransaction(db, func() error {
+		for _, t := range AUDIT_TRIGGERS {
+			sql := fmt.Sprintf(DROP_TRIGGER, t.Name)
+			if enabled {
+				sql = fmt.Sprintf(AUDIT_TRIGGER, t.Name, t.Event, t.When, t.Row, t.Row, t.Kind)
+			}
+			if err := db.Exec(sql); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetItemHistory returns everything logged in item_audit for the Item id,
+// oldest first (which still includes its history once it has been deleted)
+func GetItemHistory(db *sqlite3.Conn, itemId int64) (_ []*ItemEvent, err error) {
+	defer wrapError("GetItemHistory", &err)
+	results := make([]*ItemEvent, 0)
+
+	args := sqlite3.NamedArgs{"$i": itemId}
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_ITEM_HISTORY, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := new(ItemEvent)
+		result.Id = rowid
+		result.ItemId, _ = row["product"].(int64)
+		result.AccountId, _ = row["account"].(int64)
+		result.Kind, _ = row["event"].(string)
+		if logged, found := row["strftime('%s', logged)"].(string); found {
+			result.Logged, _ = unixTime(logged)
+		}
+		results = append(results, result)
+	}
+
+	return results, queryError(err)
+}
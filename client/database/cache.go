@@ -0,0 +1,193 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"container/list"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"sync"
+)
+
+// itemCache is a least-recently-used cache of Items, keyed by id
+type itemCache struct {
+	sync.Mutex
+	size  int
+	order *list.List // of *Item, most recently used first
+	items map[int64]*list.Element
+
+	// the ids being read after a miss, with how many reads of each are in
+	// progress, and the generation of each, which remove bumps, so that a
+	// read which an invalidation overtook is not cached (see fill)
+	reads       map[int64]int
+	generations map[int64]uint64
+}
+
+func newItemCache(size int) *itemCache {
+	return &itemCache{size: size,
+		order:       list.New(),
+		items:       make(map[int64]*list.Element),
+		reads:       make(map[int64]int),
+		generations: make(map[int64]uint64)}
+}
+
+// get returns the cached Item with the id, if there is one
+func (c *itemCache) get(id int64) (*Item, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, found := c.items[id]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*Item), true
+}
+
+// put caches the Item, evicting the least recently used one if full
+func (c *itemCache) put(i *Item) {
+	c.Lock()
+	defer c.Unlock()
+	c.add(i)
+}
+
+// add is put, with the lock held
+func (c *itemCache) add(i *Item) {
+	if e, found := c.items[i.Id]; found {
+		e.Value = i
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[i.Id] = c.order.PushFront(i)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*Item).Id)
+	}
+}
+
+// remove drops the Item with the id from the cache, if it is there
+func (c *itemCache) remove(id int64) {
+	c.Lock()
+	defer c.Unlock()
+	if e, found := c.items[id]; found {
+		c.order.Remove(e)
+		delete(c.items, id)
+	}
+	if c.reads[id] > 0 {
+		c.generations[id]++
+	}
+}
+
+// begin is called before reading the Item with the id after a miss,
+// returning the generation to pass to fill, once it is read
+func (c *itemCache) begin(id int64) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	c.reads[id]++
+	return c.generations[id]
+}
+
+// fill ends the read which begin started, caching the Item (if it is not
+// nil), unless the id was removed in the meantime, since the Item read may
+// then be older than the change which removed it
+func (c *itemCache) fill(id int64, generation uint64, i *Item) {
+	c.Lock()
+	defer c.Unlock()
+	if i != nil && c.generations[id] == generation {
+		c.add(i)
+	}
+	if c.reads[id]--; c.reads[id] == 0 {
+		delete(c.reads, id)
+		delete(c.generations, id)
+	}
+}
+
+// SetItemCacheSize makes GetItem cache up to size Items (the least recently
+// used are evicted first), or, if size is zero, turns the cache off, which
+// is the default. Any Items already cached are dropped.
+func (d *DB) SetItemCacheSize(size int) {
+	d.cacheMutex.Lock()
+	defer d.cacheMutex.Unlock()
+	if size > 0 {
+		d.cache = newItemCache(size)
+	} else {
+		d.cache = nil
+	}
+}
+
+// itemCache returns the current cache, or nil if it is off
+func (d *DB) itemCache() *itemCache {
+	d.cacheMutex.RLock()
+	defer d.cacheMutex.RUnlock()
+	return d.cache
+}
+
+// GetItem is GetSingleItem, on the read connection, but served from the
+// cache, if it is on (see SetItemCacheSize) and has the Item. The cache only
+// sees the changes made through the DB (UpdateItem, DeleteItem, FavoriteItem,
+// UnfavoriteItem), so any other change to an Item must be followed by
+// InvalidateItem, or GetItem may keep returning its old state.
+func (d *DB) GetItem(a *Account, id int64) (*Item, error) {
+	cache := d.itemCache()
+	if cache != nil {
+		if i, found := cache.get(id); found && i.AccountId == a.Id {
+			copied := *i
+			return &copied, nil
+		}
+	}
+
+	var generation uint64
+	if cache != nil {
+		generation = cache.begin(id)
+	}
+	var item *Item
+	err := d.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		item, err = GetSingleItem(db, a, id)
+		return err
+	})
+	if cache != nil {
+		var cached *Item
+		if err == nil && item.Id != BAD_PK {
+			copied := *item
+			cached = &copied
+		}
+		cache.fill(id, generation, cached)
+	}
+	return item, err
+}
+
+// InvalidateItem drops the Item with the id from the cache (if it is on)
+func (d *DB) InvalidateItem(id int64) {
+	if cache := d.itemCache(); cache != nil {
+		cache.remove(id)
+	}
+}
+
+// UpdateItem is Item.Update, on the write connection, keeping the cache current
+func (d *DB) UpdateItem(i *Item, newDesc string, newIndex int64) error {
+	defer d.InvalidateItem(i.Id)
+	return d.WithWrite(func(db *sqlite3.Conn) error {
+		return i.Update(db, newDesc, newIndex)
+	})
+}
+
+// DeleteItem is Item.Delete, on the write connection, keeping the cache current
+func (d *DB) DeleteItem(i *Item) error {
+	defer d.InvalidateItem(i.Id)
+	return d.WithWrite(i.Delete)
+}
+
+// FavoriteItem is Item.Favorite, on the write connection, keeping the cache current
+func (d *DB) FavoriteItem(i *Item) error {
+	defer d.InvalidateItem(i.Id)
+	return d.WithWrite(i.Favorite)
+}
+
+// UnfavoriteItem is Item.Unfavorite, on the write connection, keeping the cache current
+func (d *DB) UnfavoriteItem(i *Item) error {
+	defer d.InvalidateItem(i.Id)
+	return d.WithWrite(i.Unfavorite)
+}
@@ -0,0 +1,191 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestItemCacheEviction(t *testing.T) {
+	c := newItemCache(2)
+	c.put(&Item{Id: 1})
+	c.put(&Item{Id: 2})
+	// using the first makes the second the least recently used
+	if _, found := c.get(1); !found {
+		t.Fatal("get(1) missed")
+	}
+	c.put(&Item{Id: 3})
+	if _, found := c.get(2); found {
+		t.Error("get(2) hit, after it was evicted")
+	}
+	for _, id := range []int64{1, 3} {
+		if i, found := c.get(id); !found || i.Id != id {
+			t.Errorf("get(%d) = %v, %v", id, i, found)
+		}
+	}
+
+	// a put of a cached id replaces it, rather than evicting another
+	c.put(&Item{Id: 1, Desc: "again"})
+	if i, found := c.get(1); !found || i.Desc != "again" {
+		t.Errorf("get(1) after a second put = %v, %v", i, found)
+	}
+	if _, found := c.get(3); !found {
+		t.Error("get(3) missed, after a second put of 1")
+	}
+	c.remove(3)
+	if _, found := c.get(3); found {
+		t.Error("get(3) hit, after it was removed")
+	}
+}
+
+// adHocUpdate changes the Item's description behind the DB's back, i.e.,
+// without invalidating it in the cache
+func adHocUpdate(t *testing.T, d *DB, i *Item, desc string) {
+	t.Helper()
+	if err := d.Write().Exec("update product set product_desc = ? where id = ?", desc, i.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBGetItemCache(t *testing.T) {
+	d := newTestFileDB(t)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	b := newTestAccount(t, d.Write(), "bob@example.org")
+	cola := addTestItem(t, d.Write(), a, TEST_COLA, "Cola")
+
+	// off by default, so every change shows
+	adHocUpdate(t, d, cola, "Cola, 1l")
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Desc != "Cola, 1l" {
+		t.Errorf("GetItem() without the cache = %+v, %v", i, err)
+	}
+
+	d.SetItemCacheSize(10)
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Desc != "Cola, 1l" {
+		t.Fatalf("GetItem() = %+v, %v", i, err)
+	}
+	// served from the cache, which the caller cannot change
+	adHocUpdate(t, d, cola, "Cola, 2l")
+	i, err := d.GetItem(a, cola.Id)
+	if err != nil || i.Desc != "Cola, 1l" {
+		t.Errorf("GetItem() from the cache = %+v, %v, want the cached one", i, err)
+	}
+	i.Desc = "changed by the caller"
+	if i, _ := d.GetItem(a, cola.Id); i.Desc != "Cola, 1l" {
+		t.Errorf("GetItem() returned the cached Item itself")
+	}
+	// but only for its own Account
+	if i, err := d.GetItem(b, cola.Id); err != nil || i.Id != BAD_PK {
+		t.Errorf("GetItem() for another account = %+v, %v, want none", i, err)
+	}
+
+	// each change through the DB invalidates it
+	if err := d.UpdateItem(cola, "Cola, 3l", 0); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Desc != "Cola, 3l" {
+		t.Errorf("GetItem() after UpdateItem() = %+v, %v", i, err)
+	}
+	if err := d.FavoriteItem(cola); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := d.GetItem(a, cola.Id); err != nil || !i.IsFavorite {
+		t.Errorf("GetItem() after FavoriteItem() = %+v, %v, want a favorite", i, err)
+	}
+	if err := d.UnfavoriteItem(cola); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.IsFavorite {
+		t.Errorf("GetItem() after UnfavoriteItem() = %+v, %v, want no favorite", i, err)
+	}
+	adHocUpdate(t, d, cola, "Cola, 4l")
+	d.InvalidateItem(cola.Id)
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Desc != "Cola, 4l" {
+		t.Errorf("GetItem() after InvalidateItem() = %+v, %v", i, err)
+	}
+	if err := d.DeleteItem(cola); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Id != BAD_PK {
+		t.Errorf("GetItem() after DeleteItem() = %+v, %v, want none", i, err)
+	}
+}
+
+func TestItemCacheFill(t *testing.T) {
+	c := newItemCache(2)
+	// a read which nothing overtook is cached
+	g := c.begin(1)
+	c.fill(1, g, &Item{Id: 1, Desc: "Cola"})
+	if i, found := c.get(1); !found || i.Desc != "Cola" {
+		t.Errorf("get(1) after fill() = %v, %v", i, found)
+	}
+
+	// but not one which an invalidation overtook, even with another read
+	// of the same id in progress
+	g = c.begin(2)
+	other := c.begin(2)
+	c.remove(2)
+	c.fill(2, g, &Item{Id: 2, Desc: "stale"})
+	if i, found := c.get(2); found {
+		t.Errorf("get(2) after an overtaken fill() = %v, want a miss", i)
+	}
+	c.fill(2, other, &Item{Id: 2, Desc: "stale"})
+	if i, found := c.get(2); found {
+		t.Errorf("get(2) after the other overtaken fill() = %v, want a miss", i)
+	}
+	if len(c.reads) != 0 || len(c.generations) != 0 {
+		t.Errorf("%d reads, %d generations left after the fills", len(c.reads), len(c.generations))
+	}
+
+	// a remove with no read in progress is not remembered
+	c.remove(3)
+	g = c.begin(3)
+	c.fill(3, g, &Item{Id: 3})
+	if _, found := c.get(3); !found {
+		t.Error("get(3) missed, after a fill() which nothing overtook")
+	}
+}
+
+func TestDBGetItemDuringUpdate(t *testing.T) {
+	d := newTestFileDB(t)
+	d.SetItemCacheSize(4)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	cola := addTestItem(t, d.Write(), a, TEST_COLA, "Cola")
+
+	// the readers keep missing, since each update invalidates the Item,
+	// and any read which an update overtakes must not be cached
+	const UPDATES = 200
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := d.GetItem(a, cola.Id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for u := 1; u <= UPDATES; u++ {
+		if err := d.UpdateItem(cola, fmt.Sprintf("Cola %d", u), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	want := fmt.Sprintf("Cola %d", UPDATES)
+	if i, err := d.GetItem(a, cola.Id); err != nil || i.Desc != want {
+		t.Errorf("GetItem() after the updates = %+v, %v, want %q", i, err, want)
+	}
+}
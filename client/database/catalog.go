@@ -0,0 +1,141 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// The products looked up by a Provider (for existing db files; see
+	// also tables.sql), including the barcodes it did not find
+	CREATE_CATALOG = `CREATE TABLE IF NOT EXISTS product_catalog (
+	barcode      text primary key,
+	product_desc text,
+	brand        text,
+	provider     text NOT NULL,
+	fetched      datetime DEFAULT (datetime('now'))
+)`
+
+	// how long a barcode which no Provider found is remembered as unknown,
+	// before it is looked up again (e.g., once someone has added it to
+	// Open Food Facts)
+	CATALOG_RETRY = 7 * 24 * time.Hour
+
+	// Prepared Statements
+	// Product catalog
+	GET_CATALOG_ENTRY = "select barcode, product_desc, brand, provider, strftime('%s', fetched) from product_catalog where barcode = $b"
+	SAVE_CATALOG      = "insert or replace into product_catalog (barcode, product_desc, brand, provider, fetched) values ($b, $d, $r, $p, $t)"
+)
+
+var (
+	ErrNotInCatalog = errors.New("barcode not found by the product provider")
+)
+
+// CatalogEntry is what a Provider knows about a barcode: an empty Desc
+// means it did not find the barcode
+type CatalogEntry struct {
+	Barcode  string
+	Desc     string
+	Brand    string
+	Provider string // the Name of the Provider which found it (or not)
+	Fetched  time.Time
+}
+
+// Provider looks up products by barcode in some catalog of products, e.g.,
+// a dump of the Open Product Database, or the Open Food Facts api, returning
+// nil (without an error) if it does not have the barcode
+type Provider interface {
+	Name() string
+	Lookup(barcode string) (*CatalogEntry, error)
+}
+
+// GetCatalogEntry returns the product_catalog entry for the barcode, or nil
+// if it has not been looked up (see LookupCatalog)
+func GetCatalogEntry(db *sqlite3.Conn, barcode string) (_ *CatalogEntry, err error) {
+	defer wrapError("GetCatalogEntry", &err)
+	var entry *CatalogEntry
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_CATALOG_ENTRY, sqlite3.NamedArgs{"$b": barcode})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+
+		entry = &CatalogEntry{Barcode: barcode}
+		entry.Desc, _ = row["product_desc"].(string)
+		entry.Brand, _ = row["brand"].(string)
+		entry.Provider, _ = row["provider"].(string)
+		if fetched, found := row["strftime('%s', fetched)"].(string); found {
+			entry.Fetched, _ = unixTime(fetched)
+		}
+	}
+	return entry, queryError(err)
+}
+
+// SaveCatalogEntry caches the entry in product_catalog, replacing any entry
+// for the same barcode, as fetched now
+func SaveCatalogEntry(db *sqlite3.Conn, e *CatalogEntry) (err error) {
+	defer wrapError("SaveCatalogEntry", &err)
+	e.Desc = SanitizeDescription(e.Desc)
+	e.Fetched = Now()
+	args := sqlite3.NamedArgs{"$b": e.Barcode,
+		"$d": sqliteText(e.Desc),
+		"$r": sqliteText(e.Brand),
+		"$p": e.Provider,
+		"$t": sqliteTime(&e.Fetched)}
+	return db.Exec(SAVE_CATALOG, args)
+}
+
+// LookupCatalog returns what the Provider knows about the barcode, from the
+// product_catalog cache if it was looked up already, or from the Provider
+// itself, caching the result, whether it found the barcode or not (so an
+// unknown barcode is only looked up again after CATALOG_RETRY). It returns
+// nil if the barcode is unknown.
+func LookupCatalog(db *sqlite3.Conn, p Provider, barcode string) (_ *CatalogEntry, err error) {
+	defer wrapError("LookupCatalog", &err)
+	entry, err := GetCatalogEntry(db, barcode)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || (entry.Desc == "" && Now().Sub(entry.Fetched) > CATALOG_RETRY) {
+		if entry, err = p.Lookup(barcode); err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			entry = &CatalogEntry{Barcode: barcode}
+		}
+		entry.Barcode = barcode
+		if entry.Provider == "" {
+			entry.Provider = p.Name()
+		}
+		if err = SaveCatalogEntry(db, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if entry.Desc == "" {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// CatalogResolver returns the BarcodeResolver which describes each barcode
+// from the Provider (through the product_catalog cache, see LookupCatalog),
+// e.g., for AddResolved to fill in the description of each Item scanned,
+// failing with ErrNotInCatalog for a barcode the Provider does not have
+func CatalogResolver(db *sqlite3.Conn, p Provider) BarcodeResolver {
+	return func(barcode string) (string, int64, error) {
+		entry, err := LookupCatalog(db, p, barcode)
+		if err != nil {
+			return "", 0, err
+		}
+		if entry == nil {
+			return "", 0, ErrNotInCatalog
+		}
+		return entry.Desc, 0, nil
+	}
+}
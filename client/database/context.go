@@ -0,0 +1,125 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"context"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// WithContext calls the function with the connection, interrupting whatever
+// statement it is running as soon as the context is done (e.g., an http
+// request whose client went away, or whose deadline passed while the SD
+// card was slow), in which case it returns the context's error, rather than
+// sqlite's. Any of the package's functions can be made cancellable this
+// way; the ...Context variants below are the common ones. With a DB, call it
+// inside WithRead or WithWrite.
+//
+// A function which is interrupted partway is not undone, unless it ran in a
+// transaction (as, e.g., AddItems does): wrap a series of writes in one.
+func WithContext(ctx context.Context, db *sqlite3.Conn, fn func(db *sqlite3.Conn) error) (err error) {
+	defer wrapError("WithContext", &err)
+	return withContext(ctx, db, fn)
+}
+
+// withContext is WithContext, leaving the context's error unwrapped, for the
+// ...Context variants to wrap with their own operation
+func withContext(ctx context.Context, db *sqlite3.Conn, fn func(db *sqlite3.Conn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			db.Interrupt()
+		case <-done:
+		}
+	}()
+
+	err := fn(db)
+	close(done)
+	// an interrupt must not outlive the function, so wait for the
+	// watcher, before anything else can run on the connection
+	<-stopped
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// GetItemsContext is GetItems, cancelled when the context is done (see
+// WithContext)
+func GetItemsContext(ctx context.Context, db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetItemsContext", &err)
+	var items []*Item
+	err = withContext(ctx, db, func(db *sqlite3.Conn) error {
+		var err error
+		items, err = GetItems(db, a)
+		return err
+	})
+	return items, err
+}
+
+// QueryItemsFilteredContext is QueryItemsFiltered, cancelled when the
+// context is done (see WithContext)
+func QueryItemsFilteredContext(ctx context.Context, db *sqlite3.Conn, a *Account, q ItemQuery) (_ []*Item, err error) {
+	defer wrapError("QueryItemsFilteredContext", &err)
+	var items []*Item
+	err = withContext(ctx, db, func(db *sqlite3.Conn) error {
+		var err error
+		items, err = QueryItemsFiltered(db, a, q)
+		return err
+	})
+	return items, err
+}
+
+// GetAccountContext is GetAccount, cancelled when the context is done (see
+// WithContext)
+func GetAccountContext(ctx context.Context, db *sqlite3.Conn, email string) (_ *Account, err error) {
+	defer wrapError("GetAccountContext", &err)
+	var a *Account
+	err = withContext(ctx, db, func(db *sqlite3.Conn) error {
+		var err error
+		a, err = GetAccount(db, email)
+		return err
+	})
+	return a, err
+}
+
+// AddContext is Add, cancelled when the context is done (see WithContext).
+// The duplicate check and the insert run in one transaction, which is rolled
+// back if the context is done before it commits, so a cancelled Add never
+// leaves the Item half-saved, nor saved twice.
+func (i *Item) AddContext(ctx context.Context, db *sqlite3.Conn, a *Account) (_ int64, err error) {
+	defer wrapError("Item.AddContext", &err)
+	id := i.Id
+	var added bool
+	err = withContext(ctx, db, func(db *sqlite3.Conn) error {
+		return withTransaction(db, func() error {
+			_, isNew, err := i.insert(db, a)
+			if err != nil {
+				return err
+			}
+			added = isNew
+			return ctx.Err()
+		})
+	})
+	if err != nil {
+		i.Id = id
+		return BAD_PK, err
+	}
+
+	if added {
+		countItems(ITEM_ADDED, 1)
+		notifyItemChange(a.Id, ITEM_ADDED)
+	}
+	return i.Id, nil
+}
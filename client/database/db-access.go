@@ -6,15 +6,26 @@
 package database
 
 import (
+	"context"
+	_ "embed"
+	"errors"
 	"fmt"
-	"github.com/Banrai/PiScan/server/database/barcodes"
+	"github.com/Banrai/PiScan/barcode"
 	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
 	"io/ioutil"
 	"math"
+	"net/url"
+	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -25,42 +36,320 @@ const (
 	// Default sql definitions file
 	TABLE_SQL_DEFINITIONS = "tables.sql"
 
+	// The folder, under the user's config dir, for the database file when
+	// SQLITE_PATH does not exist (i.e., anywhere but on the Pi)
+	USER_CONFIG_FOLDER = "PiScan"
+
+	// Retrying the open, if the db file is busy (e.g., at boot)
+	DEFAULT_OPEN_ATTEMPTS    = 3
+	DEFAULT_OPEN_RETRY_DELAY = 250 * time.Millisecond
+	PROBE_DB                 = "select count(*) from sqlite_master"
+
+	// How long each statement waits for another connection's lock on the
+	// db file (e.g., the WebApp's, while the scanner writes) to be released,
+	// before failing with the sqlite BUSY error
+	DEFAULT_BUSY_TIMEOUT = 5 * time.Second
+
+	// In-memory database (for tests)
+	SQLITE_MEMORY = ":memory:"
+
 	// Execution constants
 	BAD_PK = -1
 
+	// The sqlite datetime() text format, for binding time.Time values
+	SQLITE_DATETIME = "2006-01-02 15:04:05"
+
+	// Read-only connections
+	QUERY_ONLY = "pragma query_only = 1"
+
+	// Page cache size, per connection (a negative value is in KiB)
+	CACHE_SIZE = "pragma cache_size = -%d"
+
+	// Schema version (the number of SCHEMA_MIGRATIONS applied to the db)
+	GET_USER_VERSION = "pragma user_version"
+	SET_USER_VERSION = "pragma user_version = %d"
+
+	// Product table rebuilds (see rebuildProduct), for the changes to its
+	// definition which sqlite cannot alter in place
+	GET_PRODUCT_TABLE    = "select sql from sqlite_master where type = 'table' and name = 'product'"
+	GET_PRODUCT_SCHEMA   = "select sql from sqlite_master where type in ('index', 'trigger') and tbl_name = 'product' and sql is not null"
+	GET_PRODUCT_SEQUENCE = "select seq from sqlite_sequence where name = 'product'"
+	SET_PRODUCT_SEQUENCE = "update sqlite_sequence set seq = $s where name = 'product'"
+	CREATE_PRODUCT       = "CREATE TABLE product_rebuilt "
+	COPY_PRODUCT         = "insert into product_rebuilt select * from product; drop table product; alter table product_rebuilt rename to product"
+
+	// The product table's unique constraint, before and since each Account
+	// has its own products (see Item.Add)
+	PRODUCT_UNIQUE_GLOBAL  = "UNIQUE(barcode, product_desc)"
+	PRODUCT_UNIQUE_ACCOUNT = "UNIQUE(account, barcode, product_desc)"
+
+	// Health checks
+	PING = "select 1"
+
+	// The number of scans tracked by the debounce (see SetScanDebounce)
+	// above which any expired ones are removed
+	LAST_SCANS_PRUNED = 128
+
+	// Item change kinds (reported to the OnItemChange observer)
+	ITEM_ADDED       = "add"
+	ITEM_DELETED     = "delete"
+	ITEM_FAVORITED   = "favorite"
+	ITEM_UNFAVORITED = "unfavorite"
+	ITEM_UPDATED     = "update"
+
+	// The longest Item description stored, in characters (the size of the
+	// product description columns in the server database)
+	MAX_DESC_LENGTH = 512
+
+	// The most values bound to a single "in (...)" clause, well within
+	// sqlite's default limit of 999 parameters per statement
+	MAX_IN_VALUES = 500
+
 	// Default Account (for those who don't want to register)
 	ANONYMOUS_EMAIL = "anonymous@example.org"
 
 	// Prepared Statements
 	// User accounts
-	ADD_ACCOUNT    = "insert into account (email, api_code) values ($e, $a)"
-	GET_ACCOUNT    = "select id, api_code from account where email = $e"
-	GET_ACCOUNTS   = "select id, email, api_code from account"
-	UPDATE_ACCOUNT = "update account set email = $e, api_code = $a where id = $i"
+	ADD_ACCOUNT         = "insert into account (email, api_code, name) values ($e, $a, $n)"
+	ADD_ACCOUNT_ONCE    = "insert or ignore into account (email, api_code, name) values ($e, $a, $n)"
+	GET_ACCOUNT         = "select id, api_code, name from account where email = $e collate nocase"
+	GET_ACCOUNT_BY_CODE = "select id, email, api_code, name from account where api_code = $a"
+	GET_ACCOUNTS        = "select id, email, api_code, name from account"
+	GET_DOMAIN_ACCOUNTS = "select id, email, api_code, name from account where email like $d escape '\\' order by email"
+	ACCOUNT_EXISTS      = "select count(*) from account where id = $i"
+	GET_ACCOUNTS_BY_ID  = "select id, email, api_code, name from account where id in ($ids)"
+	SEARCH_ACCOUNTS     = "select id, email, api_code, name from account where email like $q escape '\\' order by email like $p escape '\\' desc, email"
+	UPDATE_ACCOUNT      = "update account set email = $e, api_code = $a, verified_at = case when email = $e then verified_at end, verify_token = case when email = $e then verify_token end where id = $i"
+	SET_ACCOUNT_NAME    = "update account set name = $n where id = $i"
+	DELETE_ACCOUNT      = "delete from account where id = $a and lower(trim(email)) <> $e"
+	DELETE_LISTS        = "delete from list where account = $a"
+	DELETE_TOMBSTONES   = "delete from product_tombstone where account = $a"
+	DELETE_SCAN_LOG     = "delete from scan_log where account = $a"
+	ACCOUNT_CODE_INDEX  = "CREATE INDEX IF NOT EXISTS account_api_code ON account(api_code)"
 
 	// Products
-	ADD_ITEM           = "insert into product (barcode, product_desc, product_ind, is_edit, account) values ($b, $d, $i, $e, $a)"
-	UPDATE_ITEM        = "update product set product_desc = $d, product_ind = $n, is_edit = $e where id = $i"
-	GET_EXISTING_ITEM  = "select id from product where barcode = $b and product_desc = $d"
-	GET_ITEMS          = "select id, barcode, product_desc, product_ind, strftime('%s', posted) from product where account = $a order by posted desc"
-	GET_FAVORITE_ITEMS = "select id, barcode, product_desc, product_ind, strftime('%s', posted) from product where is_favorite = 1 and account = $a order by posted desc"
+	ITEM_COLUMNS       = "id, barcode, product_desc, product_ind, strftime('%s', posted), strftime('%s', expires), account, scan_count, strftime('%s', updated), note, raw_payload, is_favorite, quantity, source, device"
+	ADD_ITEM           = "insert into product (barcode, product_desc, product_ind, is_edit, account, expires, posted, updated, raw_payload, source, device) values ($b, $d, $i, $e, $a, $x, $t, $t, $r, $s, $v)"
+	UPDATE_ITEM        = "update product set product_desc = $d, product_ind = $n, is_edit = $e, updated = $t where id = $i and deleted_at is null"
+	UPDATE_DESC        = "update product set product_desc = $d, updated = $t where id = $i and deleted_at is null"
+	UPDATE_FIELDS      = "update product set product_desc = coalesce($d, product_desc), product_ind = coalesce($n, product_ind), expires = coalesce($x, expires), note = coalesce($o, note), updated = $t where id = $i and deleted_at is null"
+	GET_EXISTING_ITEM  = "select id from product where account = $a and barcode = $b and product_desc = $d"
+	GET_ITEM_ACCOUNT   = "select id, account from product where id = $i"
+	GET_ITEM           = "select " + ITEM_COLUMNS + " from product where id = $i and deleted_at is null"
+	COUNT_BARCODE      = "select count(*) from product where account = $a and deleted_at is null and barcode = $b"
+	GET_BARCODE_ITEM   = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and barcode = $b order by posted desc, id desc limit 1"
+	GET_ITEMS          = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null order by posted desc"
+	GET_RECENT_ITEMS   = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null order by posted desc, id desc limit $l"
+	GET_ITEMS_PAGE     = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null order by posted desc, id desc limit $l offset $o"
+	COUNT_ITEMS        = "select count(*) from product where account = $a and deleted_at is null"
+	GET_ITEMS_AFTER    = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and (posted < datetime($p, 'unixepoch') or (posted = datetime($p, 'unixepoch') and id < $i)) order by posted desc, id desc limit $l"
+	GET_ITEM_IDS       = "select id from product where account = $a and deleted_at is null order by id"
+	EXISTING_BARCODES  = "select distinct barcode from product where account = $a and deleted_at is null and barcode in ($ids)"
+	GET_FAVORITE_ITEMS = "select " + ITEM_COLUMNS + " from product where is_favorite = 1 and account = $a and deleted_at is null order by posted desc"
+	GET_ITEMS_BY_DESC  = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and product_desc = $d collate nocase order by posted desc"
+	GET_UNDESCRIBED    = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and (product_desc is null or product_desc = '') order by posted"
+	GET_FAV_NO_DESC    = "select " + ITEM_COLUMNS + " from product where is_favorite = 1 and account = $a and deleted_at is null and (product_desc is null or product_desc = '') order by posted desc"
+	GET_ITEMS_SINCE    = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and posted >= datetime($s, 'unixepoch') order by posted desc"
+	GET_ALL_FAVORITES  = "select " + ITEM_COLUMNS + " from product where is_favorite = 1 and deleted_at is null order by posted desc limit $l"
+	GET_ACCOUNTS_ITEMS = "select " + ITEM_COLUMNS + " from product where account in ($ids) and deleted_at is null order by posted desc limit $l"
+	RECORD_REPEAT_SCAN = "update product set scan_count = scan_count + 1, posted = $t, updated = $t, deleted_at = null where id = (select id from product where account = $a and barcode = $b order by posted desc limit 1)"
+	RECORD_FIRST_SCAN  = "insert into product (barcode, product_desc, product_ind, account, scan_count, posted, updated) select $b, $d, $i, $a, 1, $t, $t where not exists (select 1 from product where account = $a and barcode = $b)"
+	DELETE_ITEMS       = "update product set deleted_at = $t, updated = $t where account = $a and deleted_at is null and id in ($ids)"
+	EVICT_OLDEST_ITEMS = "delete from product where account = $a and id in (select id from product where account = $a and is_favorite = 0 and deleted_at is null order by posted desc, id desc limit -1 offset $m)"
+	FAVORITE_ITEMS     = "update product set is_favorite = $f, updated = $t where account = $a and deleted_at is null and id in ($ids)"
 	DELETE_ITEM        = "delete from product where id = $i"
-	FAVORITE_ITEM      = "update product set is_favorite = 1 where id = $i"
-	UNFAVORITE_ITEM    = "update product set is_favorite = 0 where id = $i"
+	FAVORITE_ITEM      = "update product set is_favorite = 1, updated = $t where id = $i and deleted_at is null"
+	UNFAVORITE_ITEM    = "update product set is_favorite = 0, updated = $t where id = $i and deleted_at is null"
+	MOVE_ITEM          = "update product set account = $a, updated = $t where id = $i"
+	HAS_SAME_ITEM      = "select count(*) from product p where account = $a and exists (select 1 from product where id = $i and barcode = p.barcode and product_desc = p.product_desc)"
+	FAVORITE_WITH_NOTE = "update product set is_favorite = 1, note = $n, updated = $t where id = $i and deleted_at is null"
+	INCREMENT_QUANTITY = "update product set quantity = quantity + $q, updated = $t where id = $i and deleted_at is null and quantity + $q >= 0"
+	GET_ITEM_QUANTITY  = "select quantity from product where id = $i and deleted_at is null"
+	BARCODE_INDEX      = "CREATE INDEX IF NOT EXISTS product_account_barcode ON product(account, barcode)"
+	POSTED_INDEX       = "CREATE INDEX IF NOT EXISTS product_account_posted ON product(account, posted)"
+	FAVORITES_INDEX    = "CREATE INDEX IF NOT EXISTS product_favorite_posted ON product(account, posted) WHERE is_favorite = 1"
+	FAV_BARCODE_INDEX  = "CREATE INDEX IF NOT EXISTS product_account_favorite_barcode ON product(account, is_favorite, barcode)"
 
 	// Commerce
 	ADD_VENDOR         = "insert into vendor (vendor_id, display_name) values ($v, $n)"
 	ADD_VENDOR_PRODUCT = "insert into product_availability (vendor, product_code, product) values ($v, $p, $i)"
+	AVAILABILITY_INDEX = "CREATE INDEX IF NOT EXISTS product_availability_product ON product_availability(product)"
 	GET_VENDOR         = "select id, vendor_id, display_name from vendor where id = $i"
 	GET_VENDORS        = "select distinct id, vendor_id, display_name from vendor"
 	GET_VENDOR_PRODUCT = "select pa.id, v.id, pa.product_code from vendor v, product_availability pa where v.id = pa.vendor and pa.product = $i"
 )
 
+// the table definitions file, as compiled into the package
+//
+//go:embed tables.sql
+var embeddedTables string
+
+var (
+	// The sqlite uri parameters (https://www.sqlite.org/uri.html) which may
+	// be passed in ConnCoordinates.Options, and their acceptable values
+	URI_OPTIONS = map[string][]string{
+		"cache":     {"shared", "private"},
+		"mode":      {"ro", "rw", "rwc", "memory"},
+		"immutable": {"0", "1"},
+	}
+
+	// Errors
+	ErrBadLimit  = errors.New("limit must be greater than zero")
+	ErrNotOwned  = errors.New("item does not belong to this account")
+	ErrNoItem    = errors.New("no such item")
+	ErrNoAccount = errors.New("no such account")
+
+	ErrDuplicateItem = errors.New("the account already has this item")
+
+	ErrEmptyQuery = errors.New("search query must not be empty")
+
+	ErrAnonymousDisabled = errors.New("the anonymous account is disabled")
+	ErrAnonymousDelete   = errors.New("the anonymous account cannot be deleted")
+	ErrDuplicateEmail    = errors.New("an account with this email already exists")
+
+	ErrNegativeQuantity = errors.New("item quantity cannot be less than zero")
+
+	ErrBadVersion   = errors.New("no such schema version")
+	ErrIrreversible = errors.New("schema migration cannot be reverted")
+
+	ErrDiskFull = errors.New("the disk is full: free some space, or delete old items")
+
+	ErrBadAPICode = errors.New("api code must be a uuid, either dashed (8-4-4-4-12) or undashed (32 hex digits)")
+	ErrBadBarcode = errors.New("barcode must be 1 to 128 printable ascii characters, without spaces")
+
+	// the formats generated by barcodes.DashedUUID and UndashedUUID
+	API_CODE_FORMAT = regexp.MustCompile(`^([0-9a-f]{32}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`)
+
+	// anything a scanner can send as a barcode (see ValidBarcode)
+	BARCODE_FORMAT = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+)
+
 var (
+	// Now is the clock used for every timestamp the package writes or
+	// compares against (rather than sqlite's own 'now'), so that it can be
+	// replaced with a fixed time, e.g., for testing
+	Now = time.Now
+
 	INTERVALS   = []string{"year", "month", "day", "hour", "minute"}
 	SECONDS_PER = map[string]int64{"minute": 60, "hour": 3600, "day": 86400, "month": 2592000, "year": 31536000}
+
+	// columns added to the table definitions after the first release,
+	// which need to be added to existing db files
+	COLUMN_MIGRATIONS = []*ColumnMigration{
+		{Table: "product", Column: "expires", Definition: "datetime"},
+		{Table: "product", Column: "scan_count", Definition: "integer DEFAULT 1"},
+		{Table: "product", Column: "updated", Definition: "datetime", Backfill: "update product set updated = posted"},
+		{Table: "product", Column: "note", Definition: "text"},
+		{Table: "product", Column: "raw_payload", Definition: "text DEFAULT ''"},
+		{Table: "product", Column: "quantity", Definition: "integer DEFAULT 1"},
+		{Table: "product", Column: "deleted_at", Definition: "datetime"},
+		{Table: "product", Column: "source", Definition: "text"},
+		{Table: "product", Column: "device", Definition: "integer REFERENCES device(id)"},
+		{Table: "scan_log", Column: "device", Definition: "integer REFERENCES device(id)"},
+		{Table: "account", Column: "scan_mode", Definition: "text DEFAULT 'restock'"},
+		{Table: "account", Column: "name", Definition: "text", Backfill: "update account set name = case when instr(email, '@') > 0 then substr(email, 1, instr(email, '@') - 1) else email end"},
+		{Table: "account", Column: "verified_at", Definition: "datetime"},
+		{Table: "account", Column: "verify_token", Definition: "text"},
+		{Table: "account", Column: "verify_sent", Definition: "datetime"},
+		{Table: "account", Column: "pin_hash", Definition: "text"},
+		{Table: "account", Column: "is_admin", Definition: "integer DEFAULT 0"},
+	}
+
+	// tables (and triggers, indexes) added to the table definitions after the
+	// first release, which need to be created in existing db files
+	TABLE_MIGRATIONS = []string{CREATE_DEVICES, CREATE_TOMBSTONES, CREATE_UPDATED_TRIGGER, CREATE_ITEM_AUDIT, CREATE_LISTS, CREATE_ITEM_LISTS, CREATE_PENDING_SYNC, CREATE_CATALOG, ACCOUNT_CODE_INDEX, BARCODE_INDEX, POSTED_INDEX, FAVORITES_INDEX, CREATE_PRODUCT_SEARCH, CREATE_SEARCH_INSERT, CREATE_SEARCH_DELETE, CREATE_SEARCH_UNINDEX, CREATE_SEARCH_REINDEX, CREATE_SCAN_LOG, SCAN_LOG_INDEX, CREATE_LOG_INSERT, CREATE_LOG_RESCAN, CREATE_LOG_DELETE, CREATE_LOG_TRASH, CREATE_LOG_RESTORE, CREATE_LOG_FAVORITE, CREATE_LOG_UNFAVORITE, CREATE_SESSIONS, CREATE_SHOPPING_LISTS, SHOPPING_LIST_OPEN_INDEX, CREATE_SHOPPING_ITEMS, CREATE_PURCHASES, PURCHASE_BARCODE_INDEX, EXPIRES_INDEX, CREATE_EXPIRY_WARNINGS, FAV_BARCODE_INDEX, AVAILABILITY_INDEX}
+
+	// changes to existing db files which cannot simply be re-run, e.g.,
+	// to convert data, in order: each one is applied once, in the same
+	// transaction as the bump of the db's user_version to its index + 1,
+	// so new steps must only ever be appended
+	SCHEMA_MIGRATIONS = []*SchemaMigration{
+		// api codes are compared in their normalized form (see ValidAPICode)
+		{Up: "update account set api_code = lower(trim(api_code))", Irreversible: true},
+		// index the descriptions saved before product_search existed
+		{Up: REBUILD_PRODUCT_SEARCH},
+		// each Account has its own products, so another Account may have
+		// the same barcode, and description (older releases need nothing
+		// reverted, since the per Account constraint is the looser one)
+		{Apply: func(db *sqlite3.Conn) error {
+			return rebuildProduct(db, PRODUCT_UNIQUE_GLOBAL, PRODUCT_UNIQUE_ACCOUNT)
+		}},
+	}
+
+	// the columns selected by ITEM_COLUMNS, in the same order, each
+	// with the expression which selects it
+	ITEM_COLUMN_EXPRESSIONS = []*ColumnExpression{
+		{Column: "id", Expression: "id"},
+		{Column: "barcode", Expression: "barcode"},
+		{Column: "product_desc", Expression: "product_desc"},
+		{Column: "product_ind", Expression: "product_ind"},
+		{Column: "posted", Expression: "strftime('%s', posted)"},
+		{Column: "expires", Expression: "strftime('%s', expires)"},
+		{Column: "account", Expression: "account"},
+		{Column: "scan_count", Expression: "scan_count"},
+		{Column: "updated", Expression: "strftime('%s', updated)"},
+		{Column: "note", Expression: "note"},
+		{Column: "raw_payload", Expression: "raw_payload"},
+		{Column: "is_favorite", Expression: "is_favorite"},
+		{Column: "quantity", Expression: "quantity"},
+		{Column: "source", Expression: "source"},
+		{Column: "device", Expression: "device"},
+	}
+
+	// the product columns found in each db file by this process (see
+	// productColumns), reset whenever InitializeDB migrates the file
+	productColumnsFound      = make(map[string]map[string]bool)
+	productColumnsFoundMutex sync.Mutex
+
+	// the db files whose table definitions and migrations have
+	// already been applied by this process, so InitializeDB can
+	// skip them, by full path, with the file they were applied to
+	// (see isInitialized)
+	initializedFiles      = make(map[string]os.FileInfo)
+	initializedFilesMutex sync.Mutex
+
+	// the (optional) window within which RecordScan ignores a repeated
+	// scan of the same barcode by the same account, and the time of the
+	// last accepted scan of each
+	scanDebounce   time.Duration
+	lastScans      = make(map[scanKey]time.Time)
+	lastScansMutex sync.Mutex
+
+	// whether FetchOrCreateDefaultAccount refuses to provide the
+	// anonymous account, only ever accessed atomically
+	anonymousDisabled int32
+
+	// the (optional) observer of Item changes
+	itemChangeFn    func(accountId int64, kind string)
+	itemChangeMutex sync.RWMutex
 )
 
+// OnItemChange registers the function to be invoked after every successful
+// Item Add, Delete, Favorite, or Unfavorite, with the affected account id
+// and the kind of change (ITEM_ADDED, ITEM_DELETED, etc.). It is called
+// synchronously, so it must not block: hand off any real work (e.g., a UI
+// refresh) to another goroutine. Passing nil removes the observer.
+func OnItemChange(fn func(accountId int64, kind string)) {
+	itemChangeMutex.Lock()
+	defer itemChangeMutex.Unlock()
+	itemChangeFn = fn
+}
+
+func hasItemObserver() bool {
+	itemChangeMutex.RLock()
+	defer itemChangeMutex.RUnlock()
+	return itemChangeFn != nil
+}
+
+func notifyItemChange(accountId int64, kind string) {
+	itemChangeMutex.RLock()
+	fn := itemChangeFn
+	itemChangeMutex.RUnlock()
+	if fn != nil {
+		fn(accountId, kind)
+	}
+}
+
 func calculateTimeSince(posted string) string {
 	result := "just now" // default reply
 
@@ -72,7 +361,7 @@ func calculateTimeSince(posted string) string {
 		// calculate the time since posted
 		// and return a human readable
 		// '[interval] ago' string
-		duration := time.Since(tm)
+		duration := Now().Sub(tm)
 		if duration.Seconds() < 60.0 {
 			if duration.Seconds() == 1.0 {
 				result = fmt.Sprintf("%2.0f second ago", duration.Seconds())
@@ -98,6 +387,118 @@ func calculateTimeSince(posted string) string {
 	return result
 }
 
+// safeLike escapes the LIKE metacharacters in the given string, so that
+// user input can only ever be matched literally, when bound as a NamedArg
+// in a "like ... escape '\'" clause
+func safeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// unixTime converts the result of "strftime('%s', [column])" into a UTC time
+func unixTime(seconds string) (time.Time, error) {
+	i, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(i, 0).UTC(), nil
+}
+
+// sqliteInt converts the (optional) integer into the arg to bind to an
+// integer column, i.e., nil (NULL) or its value
+func sqliteInt(n *int64) interface{} {
+	if n == nil {
+		return nil
+	}
+	return *n
+}
+
+// sqliteTime converts the (optional) time into the arg to bind to a
+// datetime column, i.e., nil (NULL) or UTC text in the sqlite format
+func sqliteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(SQLITE_DATETIME)
+}
+
+// currentTime is the arg to bind to a datetime column for the current
+// time, according to the Now clock
+func currentTime() interface{} {
+	t := Now()
+	return sqliteTime(&t)
+}
+
+// WithTransaction runs fn inside a transaction on the connection, which is
+// committed if fn succeeds, and rolled back otherwise, so that a series of
+// the package's functions (e.g., a delete and a re-add) is all or nothing,
+// and is synced to the SD card only once. The package's own multi-step
+// functions (e.g., AddItems, for a whole pantry inventory) join it, rather
+// than committing separately.
+func WithTransaction(db *sqlite3.Conn, fn func() error) (err error) {
+	defer wrapError("WithTransaction", &err)
+	return withTransaction(db, fn)
+}
+
+// withTransaction runs fn inside a transaction, which is committed if fn
+// succeeds, and rolled back otherwise. If db is already in a transaction,
+// fn simply runs as part of it, and the outermost caller decides the result.
+func withTransaction(db *sqlite3.Conn, fn func() error) error {
+	if !db.AutoCommit() {
+		return fn()
+	}
+
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		db.Rollback()
+		return err
+	}
+	return db.Commit()
+}
+
+// queryError is the error which ended the loop over the rows of a query:
+// nil, if it is io.EOF (i.e., all the rows were read), otherwise the error
+// itself (e.g., the db file is corrupt, or a table is missing), counted
+func queryError(err error) error {
+	if err == nil || err == io.EOF {
+		return nil
+	}
+	countQueryError()
+	return err
+}
+
+// buildInClause generates the list of placeholders for an "in (...)" clause,
+// since go-sqlite has no list binding: one named arg per id, i.e., prefix0,
+// prefix1, etc., returned along with the matching args, so the ids are never
+// written into the sql statement itself
+func buildInClause(prefix string, ids []int64) (string, sqlite3.NamedArgs) {
+	args := make(sqlite3.NamedArgs, len(ids))
+	placeholders := make([]string, len(ids))
+	for j, id := range ids {
+		placeholders[j] = fmt.Sprintf("%s%d", prefix, j)
+		args[placeholders[j]] = id
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// buildTextInClause is buildInClause, for a list of text values
+func buildTextInClause(prefix string, values []string) (string, sqlite3.NamedArgs) {
+	args := make(sqlite3.NamedArgs, len(values))
+	placeholders := make([]string, len(values))
+	for j, v := range values {
+		placeholders[j] = fmt.Sprintf("%s%d", prefix, j)
+		args[placeholders[j]] = v
+	}
+	return strings.Join(placeholders, ", "), args
+}
+
+// inClause substitutes the list of placeholders from buildInClause for the
+// "$ids" marker in the sql statement
+func inClause(sql, placeholders string) string {
+	return strings.Replace(sql, "$ids", placeholders, 1)
+}
+
 func getPK(db *sqlite3.Conn, table string) int64 {
 	// find and return the most recently-inserted
 	// primary key, based on the table name
@@ -110,16 +511,318 @@ func getPK(db *sqlite3.Conn, table string) int64 {
 	return rowid
 }
 
+type ColumnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+	Backfill   string // optional statement to set the new column in existing rows
+}
+
+// SchemaMigration is one of the SCHEMA_MIGRATIONS: the statement which
+// applies it, and the one which reverts it (an empty Down means there is
+// nothing to revert), unless it is Irreversible (e.g., it discards data).
+// Apply, if defined, applies it instead of Up, for a change which depends
+// on what the db has (e.g., to rebuild a table, along with its triggers).
+type SchemaMigration struct {
+	Up           string
+	Down         string
+	Irreversible bool
+	Apply        func(db *sqlite3.Conn) error
+}
+
+// getColumns returns the set of column names defined for the given table,
+// which is empty if the table does not exist
+func getColumns(db *sqlite3.Conn, table string) map[string]bool {
+	results := make(map[string]bool)
+
+	// (with queryRows, which finalizes the statement, since every
+	// connection InitializeDB opens runs it, see isInitialized)
+	row := make(sqlite3.RowMap)
+	sql := fmt.Sprintf(TABLE_INFO, table)
+	queryRows(db, sql, func(s *sqlite3.Stmt) error {
+		var cid int64
+		s.Scan(&cid, row)
+		if name, found := row["name"]; found {
+			results[name.(string)] = true
+		}
+		return nil
+	})
+	return results
+}
+
+// ColumnExpression is a column of a table, and the expression which
+// selects it
+type ColumnExpression struct {
+	Column     string
+	Expression string
+}
+
+// productColumns returns the columns of the product table in the db file,
+// reading them only the first time, for the files which are not in memory
+func productColumns(db *sqlite3.Conn) map[string]bool {
+	file := db.Path("main")
+	if len(file) == 0 {
+		return getColumns(db, "product")
+	}
+
+	productColumnsFoundMutex.Lock()
+	defer productColumnsFoundMutex.Unlock()
+	columns, found := productColumnsFound[file]
+	if !found {
+		columns = getColumns(db, "product")
+		productColumnsFound[file] = columns
+	}
+	return columns
+}
+
+// itemSelect adjusts the sql selecting ITEM_COLUMNS to the product columns
+// which are actually present in the db, selecting null instead of each one
+// which is missing (i.e., if the db has not been migrated yet), which
+// fetchItems then treats as the default value
+func itemSelect(db *sqlite3.Conn, sql string) string {
+	columns := productColumns(db)
+	if len(columns) == 0 || !strings.Contains(sql, ITEM_COLUMNS) {
+		return sql
+	}
+
+	missing := false
+	expressions := make([]string, 0, len(ITEM_COLUMN_EXPRESSIONS))
+	for _, c := range ITEM_COLUMN_EXPRESSIONS {
+		if columns[c.Column] {
+			expressions = append(expressions, c.Expression)
+		} else {
+			expressions = append(expressions, "null")
+			missing = true
+		}
+	}
+	if !missing {
+		return sql
+	}
+	return strings.Replace(sql, ITEM_COLUMNS, strings.Join(expressions, ", "), 1)
+}
+
+// migrateColumns adds each of the COLUMN_MIGRATIONS which are missing
+// from the (existing) tables in the db, and, if the db has its tables
+// already, then creates any of the TABLE_MIGRATIONS which are missing
+func migrateColumns(db *sqlite3.Conn) error {
+	hasTables := len(getColumns(db, "product")) > 0
+
+	for _, m := range COLUMN_MIGRATIONS {
+		columns := getColumns(db, m.Table)
+		if len(columns) > 0 && !columns[m.Column] {
+			sql := fmt.Sprintf("alter table %s add column %s %s", m.Table, m.Column, m.Definition)
+			if err := db.Exec(sql); err != nil {
+				return err
+			}
+			if len(m.Backfill) > 0 {
+				if err := db.Exec(m.Backfill); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if hasTables {
+		for _, table := range TABLE_MIGRATIONS {
+			if err := db.Exec(table); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queryStrings returns the first column of every row the query selects
+func queryStrings(db *sqlite3.Conn, sql string) ([]string, error) {
+	results := make([]string, 0)
+	err := queryRows(db, sql, func(s *sqlite3.Stmt) error {
+		var result string
+		err := s.Scan(&result)
+		results = append(results, result)
+		return err
+	})
+	return results, err
+}
+
+// rebuildProduct replaces the unique constraint of the product table, which
+// sqlite cannot alter in place, by copying its rows (with their ids) to a new
+// table with the same definition otherwise, which then replaces it, along
+// with all the indexes and triggers the db had on it (e.g., item_audit's),
+// and its AUTOINCREMENT sequence, so no id is ever reused. Foreign keys are
+// not enforced (see execProducts), so the rows which refer to the products
+// are left as they are. A table without the old constraint (e.g., defined
+// by a TABLE_SQL_DEFINITIONS file) is left alone.
+func rebuildProduct(db *sqlite3.Conn, oldUnique, newUnique string) error {
+	tables, err := queryStrings(db, GET_PRODUCT_TABLE)
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+	// (the name is quoted once the table was renamed, so only what follows
+	// it is kept)
+	table := tables[0]
+	columns := strings.Index(table, "(")
+	if columns < 0 || !strings.Contains(table, oldUnique) {
+		return nil
+	}
+	schema, err := queryStrings(db, GET_PRODUCT_SCHEMA)
+	if err != nil {
+		return err
+	}
+	var sequence int64
+	err = queryRows(db, GET_PRODUCT_SEQUENCE, func(s *sqlite3.Stmt) error {
+		return s.Scan(&sequence)
+	})
+	if err != nil {
+		return err
+	}
+
+	table = CREATE_PRODUCT + strings.Replace(table[columns:], oldUnique, newUnique, 1)
+	if err := db.Exec(table); err != nil {
+		return err
+	}
+	if err := db.Exec(COPY_PRODUCT); err != nil {
+		return err
+	}
+	for _, sql := range schema {
+		if err := db.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return db.Exec(SET_PRODUCT_SEQUENCE, sqlite3.NamedArgs{"$s": sequence})
+}
+
+// schemaVersion returns the db's user_version, i.e., how many of the
+// SCHEMA_MIGRATIONS it has had applied
+func schemaVersion(db *sqlite3.Conn) (int, error) {
+	var version int64
+	s, err := db.Query(GET_USER_VERSION)
+	for ; err == nil; err = s.Next() {
+		s.Scan(&version)
+	}
+	return int(version), queryError(err)
+}
+
+// setSchemaVersion sets the db's user_version, i.e., records that it has
+// had all the SCHEMA_MIGRATIONS applied up to the version
+func setSchemaVersion(db *sqlite3.Conn, version int) error {
+	return db.Exec(fmt.Sprintf(SET_USER_VERSION, version))
+}
+
+// migrateVersions applies the SCHEMA_MIGRATIONS which are more recent than
+// the db's version (see MigrateTo), leaving alone a db which is up to date,
+// or newer (i.e., written by a later release)
+func migrateVersions(db *sqlite3.Conn) error {
+	version, err := schemaVersion(db)
+	if err != nil || version >= len(SCHEMA_MIGRATIONS) {
+		return err
+	}
+	return migrateTo(db, len(SCHEMA_MIGRATIONS))
+}
+
+// migrateTo applies (or reverts) the SCHEMA_MIGRATIONS between the db's
+// version and the given one, in a single transaction, so that a failure
+// leaves the db as it was, and a db already at the version is left alone
+func migrateTo(db *sqlite3.Conn, target int) error {
+	if target < 0 || target > len(SCHEMA_MIGRATIONS) {
+		return ErrBadVersion
+	}
+	version, err := schemaVersion(db)
+	if err != nil || version == target {
+		return err
+	}
+	if version > len(SCHEMA_MIGRATIONS) {
+		// written by a newer release, whose migrations are unknown here
+		return ErrBadVersion
+	}
+	if target < version {
+		for _, m := range SCHEMA_MIGRATIONS[target:version] {
+			if m.Irreversible {
+				return ErrIrreversible
+			}
+		}
+	}
+
+	return withTransaction(db, func() error {
+		for version < target {
+			m := SCHEMA_MIGRATIONS[version]
+			apply := m.Apply
+			if apply == nil {
+				apply = func(db *sqlite3.Conn) error { return db.Exec(m.Up) }
+			}
+			if err := apply(db); err != nil {
+				return err
+			}
+			version++
+			if err := setSchemaVersion(db, version); err != nil {
+				return err
+			}
+		}
+		for version > target {
+			version--
+			if down := SCHEMA_MIGRATIONS[version].Down; down != "" {
+				if err := db.Exec(down); err != nil {
+					return err
+				}
+			}
+			if err := setSchemaVersion(db, version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SchemaVersion returns the db's schema version, i.e., how many of the
+// SCHEMA_MIGRATIONS it has had applied (all of them, once it has been
+// opened with InitializeDB, or brought up to date with InitializeSchema)
+func SchemaVersion(db *sqlite3.Conn) (_ int, err error) {
+	defer wrapError("SchemaVersion", &err)
+	return schemaVersion(db)
+}
+
+// MigrateTo applies, or reverts, the SCHEMA_MIGRATIONS needed to bring the
+// db to the given schema version (e.g., before going back to an older
+// release, which knows only that many of them), all or nothing. Reverting
+// past an Irreversible one is ErrIrreversible, and leaves the db as it was.
+// Note that InitializeDB, and InitializeSchema, always bring the db back up
+// to the latest version.
+func MigrateTo(db *sqlite3.Conn, version int) (err error) {
+	defer wrapError("MigrateTo", &err)
+	return migrateTo(db, version)
+}
+
 type ConnCoordinates struct {
 	DBPath       string
 	DBFile       string
-	DBTablesPath string
+	DBTablesPath string // the folder of a TABLE_SQL_DEFINITIONS file which replaces the compiled in one (optional)
+
+	// How many times to try opening the db file while it is busy or
+	// locked, and how long to wait before the first retry (doubling after
+	// each one); zero values mean DEFAULT_OPEN_ATTEMPTS and
+	// DEFAULT_OPEN_RETRY_DELAY
+	OpenAttempts   int
+	OpenRetryDelay time.Duration
+
+	// Optional sqlite uri parameters (e.g., "cache": "shared"), limited to
+	// those in URI_OPTIONS; if empty, the db file is opened as a plain path
+	Options map[string]string
+
+	// The page cache size of each connection, in KiB; zero means sqlite's
+	// default (about 2MB). Since every open connection has its own cache,
+	// too large a value can exhaust the memory of a small Pi.
+	CacheSizeKB int
+
+	// How long each statement waits for a lock held by another connection
+	// (see DEFAULT_BUSY_TIMEOUT, the default for zero); negative means not
+	// at all, i.e., the BUSY error is returned at once
+	BusyTimeout time.Duration
 }
 
 type Account struct {
 	Id      int64
 	Email   string
 	APICode string
+	Name    string
 }
 
 type Vendor struct {
@@ -138,18 +841,29 @@ type Item struct {
 	Id              int64
 	Desc            string
 	Barcode         string
-	Index           int64
-	Since           string
+	Index           *int64    // nil if the product has no indicator
+	Since           string    // how long ago the item was posted, for display
+	PostedTime      time.Time // when the item was posted (zero if unknown)
 	UserContributed bool
+	AccountId       int64
+	ScanCount       int64
+	Updated         time.Time  // when the item was last changed
+	ExpiresAt       *time.Time // nil if the item never expires
+	Note            string
+	RawPayload      string // the whole scan, if the barcode is only part of it (e.g., a QR code)
+	IsFavorite      bool
+	Quantity        int64  // how many of the product the user has (see IncrementQuantity)
+	Source          string // where it was scanned (e.g., the WebApp, or a scanner), if known
+	DeviceId        int64  // the Device which scanned it, zero if unknown (see RegisterDevice)
 	ForSale         []*VendorProduct
 }
 
-func getExistingItem(db *sqlite3.Conn, barcode, desc string) int64 {
+func getExistingItem(db *sqlite3.Conn, a *Account, barcode, desc string) int64 {
 	// lookup the barcode and product desc
 	// combination and return the primary key,
-	// if the product has already been saved
+	// if the Account has already saved the product
 
-	args := sqlite3.NamedArgs{"$b": barcode, "$d": desc}
+	args := sqlite3.NamedArgs{"$a": a.Id, "$b": barcode, "$d": desc}
 
 	var rowid int64
 	rowid = BAD_PK // default value, in case no match
@@ -159,268 +873,1304 @@ func getExistingItem(db *sqlite3.Conn, barcode, desc string) int64 {
 	return rowid
 }
 
-func (i *Item) Add(db *sqlite3.Conn, a *Account) (int64, error) {
-	// insert the Item object
+// SanitizeDescription returns the description without any control
+// characters (each tab or line break becomes a space, the rest are
+// removed), trimmed, and cut to at most MAX_DESC_LENGTH characters
+func SanitizeDescription(s string) string {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case unicode.IsControl(r) || r == utf8.RuneError:
+			return -1
+		}
+		return r
+	}, s)
+	clean = strings.TrimSpace(clean)
+
+	if utf8.RuneCountInString(clean) > MAX_DESC_LENGTH {
+		clean = strings.TrimSpace(string([]rune(clean)[:MAX_DESC_LENGTH]))
+	}
+	return clean
+}
+
+// Add inserts the Item for the Account, unless the Account has already
+// saved the same barcode and description, and sets its Id (and returns it)
+// to the row id of the new Item, or of the one already saved. The barcode
+// is saved in its canonical form (see barcode.Parse), so a malformed one
+// (e.g., with the wrong check digit) is rejected, and nothing is saved.
+func (i *Item) Add(db *sqlite3.Conn, a *Account) (_ int64, err error) {
+	defer wrapError("Item.Add", &err)
+	pk, added, err := i.insert(db, a)
+	if added {
+		countItems(ITEM_ADDED, 1)
+		notifyItemChange(a.Id, ITEM_ADDED)
+	}
+	return pk, err
+}
+
+// insert is Add, without counting or reporting the change, setting and
+// returning its pk, and whether it is new (false if it is a duplicate, or
+// on error)
+func (i *Item) insert(db *sqlite3.Conn, a *Account) (int64, bool, error) {
+	if err := i.normalizeBarcode(); err != nil {
+		return BAD_PK, false, err
+	}
+	i.Desc = SanitizeDescription(i.Desc)
 
-	// but first check if it's a duplicate or not
-	itemPk := getExistingItem(db, i.Barcode, i.Desc)
+	// but first check if it's a duplicate or not (one which was
+	// deleted, but not purged yet, is restored instead)
+	itemPk := getExistingItem(db, a, i.Barcode, i.Desc)
 	if itemPk != BAD_PK {
-		return itemPk, nil
+		i.Id = itemPk
+		restored, err := restoreItem(db, a, itemPk)
+		return itemPk, restored, err
 	}
 
 	args := sqlite3.NamedArgs{"$b": i.Barcode,
 		"$d": i.Desc,
-		"$i": i.Index,
+		"$i": sqliteInt(i.Index),
 		"$e": i.UserContributed,
-		"$a": a.Id}
-	result := db.Exec(ADD_ITEM, args)
-	if result == nil {
-		pk := getPK(db, "product")
-		return pk, result
+		"$a": a.Id,
+		"$x": sqliteTime(i.ExpiresAt),
+		"$t": currentTime(),
+		"$r": i.RawPayload,
+		"$s": sqliteText(i.Source),
+		"$v": sqliteId(i.DeviceId)}
+	if err := db.Exec(ADD_ITEM, args); err != nil {
+		return BAD_PK, false, err
 	}
+	i.Id = db.LastInsertId()
+	return i.Id, true, nil
+}
 
-	return BAD_PK, result
+// AddItems adds all the Items for the Account (see Add), in order, in a
+// single transaction (e.g., for an import, which would otherwise commit,
+// i.e., sync to the SD card, once per Item), setting the Id of each. If any
+// of them fails, none of them is added.
+func AddItems(db *sqlite3.Conn, a *Account, items []*Item) (err error) {
+	defer wrapError("AddItems", &err)
+	var added int64
+	err = withTransaction(db, func() error {
+		for _, i := range items {
+			_, isNew, err := i.insert(db, a)
+			if err != nil {
+				return err
+			}
+			if isNew {
+				added++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	countItems(ITEM_ADDED, added)
+	if added > 0 {
+		notifyItemChange(a.Id, ITEM_ADDED)
+	}
+	return nil
 }
 
-func (i *Item) Update(db *sqlite3.Conn) error {
-	// update the Item with with user contribution (description)
-	args := sqlite3.NamedArgs{"$d": i.Desc,
-		"$n": i.Index,
-		"$e": i.UserContributed,
-		"$i": i.Id}
-	return db.Exec(UPDATE_ITEM, args)
+func countBarcode(db *sqlite3.Conn, a *Account, barcode string) int64 {
+	// count how many times this account has saved the barcode
+	args := sqlite3.NamedArgs{"$a": a.Id, "$b": barcode}
+
+	var count int64
+	for s, err := db.Query(COUNT_BARCODE, args); err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count
 }
 
-func (i *Item) Delete(db *sqlite3.Conn) error {
-	// delete the Item
-	args := sqlite3.NamedArgs{"$i": i.Id}
-	return db.Exec(DELETE_ITEM, args)
+// AddChecked inserts the Item like Add (which sets its Id), and reports
+// whether an Item with the same barcode had already been saved for this
+// Account (e.g., so the UI can warn about a repeated scan). The check and
+// the insert run in the same transaction, so two concurrent scans of the
+// same barcode cannot both be reported as new.
+func (i *Item) AddChecked(db *sqlite3.Conn, a *Account) (_ bool, err error) {
+	defer wrapError("Item.AddChecked", &err)
+	var exists bool
+	err = withTransaction(db, func() error {
+		if err := i.normalizeBarcode(); err != nil {
+			return err
+		}
+		exists = countBarcode(db, a, i.Barcode) > 0
+		_, addErr := i.Add(db, a)
+		return addErr
+	})
+	return exists, err
 }
 
-func (i *Item) Favorite(db *sqlite3.Conn) error {
-	// update the Item, to show it is a favorite for this Account
-	args := sqlite3.NamedArgs{"$i": i.Id}
-	return db.Exec(FAVORITE_ITEM, args)
+// scanKey identifies the barcode scans debounced by RecordScan
+type scanKey struct {
+	account int64
+	barcode string
 }
 
-func (i *Item) Unfavorite(db *sqlite3.Conn) error {
-	// update the Item, to show it is not a favorite for this Account
-	args := sqlite3.NamedArgs{"$i": i.Id}
-	return db.Exec(UNFAVORITE_ITEM, args)
+// SetScanDebounce makes RecordScan ignore any scan of the same barcode for
+// the same Account within the window after the last one it accepted (e.g.,
+// a handheld scanner firing several times for a single trigger pull). The
+// scans are tracked in memory, by this process only. Zero turns it off.
+func SetScanDebounce(window time.Duration) {
+	lastScansMutex.Lock()
+	defer lastScansMutex.Unlock()
+	scanDebounce = window
 }
 
-func fetchItems(db *sqlite3.Conn, a *Account, sql string) ([]*Item, error) {
-	// find all the items for this account
-	results := make([]*Item, 0)
+// debounceScan reports whether the scan should be recorded, and if so,
+// tracks it as the last one accepted
+func debounceScan(a *Account, barcode string) bool {
+	lastScansMutex.Lock()
+	defer lastScansMutex.Unlock()
+	if scanDebounce <= 0 {
+		return true
+	}
 
-	args := sqlite3.NamedArgs{"$a": a.Id}
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(sql, args); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
+	now := Now()
+	key := scanKey{a.Id, barcode}
+	if last, found := lastScans[key]; found && now.Sub(last) < scanDebounce {
+		return false
+	}
+	lastScans[key] = now
 
-		barcode, barcodeFound := row["barcode"]
-		desc, descFound := row["product_desc"]
-		ind, indFound := row["product_ind"]
-		since, sinceFound := row["strftime('%s', posted)"]
-		if barcodeFound {
-			result := new(Item)
-			result.Id = rowid
-			result.Barcode = barcode.(string)
-			if descFound {
-				result.Desc = desc.(string)
+	if len(lastScans) > LAST_SCANS_PRUNED {
+		for k, last := range lastScans {
+			if now.Sub(last) >= scanDebounce {
+				delete(lastScans, k)
 			}
-			if indFound {
-				result.Index = ind.(int64)
-			}
-			if sinceFound {
-				result.Since = calculateTimeSince(since.(string))
-			}
-			result.ForSale = GetVendorProducts(db, rowid)
-			results = append(results, result)
 		}
 	}
-
-	return results, nil
+	return true
 }
 
-func GetItems(db *sqlite3.Conn, a *Account) ([]*Item, error) {
-	return fetchItems(db, a, GET_ITEMS)
-}
+// RecordScan is the alternative to Item.Add, for keeping a single row per
+// barcode with a count of how often it was scanned: if the Account already
+// has the barcode, its scan_count is incremented and its posted time is
+// updated (to the most recent row, if Add saved several products for it),
+// otherwise it is inserted with a scan_count of one. It returns false (and
+// records nothing) if the scan is a repeat within the SetScanDebounce window.
+// The barcode is normalized, or rejected if malformed, as by Add.
+//
+// The single row per barcode is kept by RecordScan itself, which inserts
+// only if the Account has no row with the barcode, rather than by a unique
+// index on (account, barcode): Add keeps a row per product, i.e., per
+// barcode and description, so the same Account may have several rows of a
+// barcode, if it uses both.
+func RecordScan(db *sqlite3.Conn, a *Account, barcode, desc string, ind int64) (_ bool, err error) {
+	defer wrapError("RecordScan", &err)
+	if barcode, err = normalizedBarcode(barcode); err != nil {
+		return false, err
+	}
+	if !debounceScan(a, barcode) {
+		return false, nil
+	}
 
-func GetFavoriteItems(db *sqlite3.Conn, a *Account) ([]*Item, error) {
-	return fetchItems(db, a, GET_FAVORITE_ITEMS)
-}
+	err = withTransaction(db, func() error {
+		args := sqlite3.NamedArgs{"$a": a.Id, "$b": barcode, "$t": currentTime()}
+		err := db.Exec(RECORD_REPEAT_SCAN, args)
+		if err != nil || db.RowsAffected() > 0 {
+			return err
+		}
 
-func GetSingleItem(db *sqlite3.Conn, a *Account, id int64) (*Item, error) {
-	item := new(Item)
-	item.Id = BAD_PK // if not found
-	items, err := GetItems(db, a)
-	for _, i := range items {
-		if i.Id == id {
-			return i, err
+		args["$d"] = SanitizeDescription(desc)
+		args["$i"] = ind
+		err = db.Exec(RECORD_FIRST_SCAN, args)
+		if err != nil || db.RowsAffected() > 0 {
+			return err
 		}
+		// the first scan was recorded in between (on another connection)
+		return db.Exec(RECORD_REPEAT_SCAN, args)
+	})
+	if err == nil {
+		countItems(ITEM_ADDED, 1)
+		notifyItemChange(a.Id, ITEM_ADDED)
 	}
-	return item, err
+	return err == nil, err
 }
 
-func AddVendor(db *sqlite3.Conn, vendorId, vendorDisplayName string) (int64, error) {
-	args := sqlite3.NamedArgs{"$v": vendorId,
-		"$n": vendorDisplayName}
-	result := db.Exec(ADD_VENDOR, args)
-	if result == nil {
-		pk := getPK(db, "vendor")
-		return pk, result
+// Update replaces the Item's description and index (e.g., to correct a
+// wrong description), along with its UserContributed flag, leaving its
+// posted time, barcode, account, and favorite flag as they are, and sets the
+// Item's Desc and Index fields to the new (sanitized) values, on success. It
+// returns ErrNoItem if there is no such Item, or it is in the trash.
+func (i *Item) Update(db *sqlite3.Conn, newDesc string, newIndex int64) (err error) {
+	defer wrapError("Item.Update", &err)
+	newDesc = SanitizeDescription(newDesc)
+	args := sqlite3.NamedArgs{"$d": newDesc,
+		"$n": newIndex,
+		"$e": i.UserContributed,
+		"$i": i.Id,
+		"$t": currentTime()}
+	if err = db.Exec(UPDATE_ITEM, args); err != nil {
+		return err
 	}
-	return BAD_PK, result
+	if db.RowsAffected() == 0 {
+		return ErrNoItem
+	}
+	i.Desc = newDesc
+	i.Index = &newIndex
+	return nil
 }
 
-func AddVendorProduct(db *sqlite3.Conn, productCode string, vendorId, itemId int64) error {
-	args := sqlite3.NamedArgs{"$v": vendorId,
-		"$p": productCode,
-		"$i": itemId}
-	return db.Exec(ADD_VENDOR_PRODUCT, args)
+// sqliteText converts the string into the arg to bind to a text column,
+// i.e., nil (NULL) if it is empty, or the string itself
+func sqliteText(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
 }
 
-func GetVendor(db *sqlite3.Conn, vendorId int64) *Vendor {
-	result := new(Vendor)
-	row := make(sqlite3.RowMap)
-	args := sqlite3.NamedArgs{"$i": vendorId}
-	for s, err := db.Query(GET_VENDOR, args); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
-		vendor, vendorFound := row["vendor_id"]
-		vendorName, vendorNameFound := row["display_name"]
-		if vendorFound && vendorNameFound {
-			result.Id = rowid
-			result.VendorId = vendor.(string)
-			result.DisplayName = vendorName.(string)
-		}
+// sqliteId converts the (optional) row id into the arg to bind to a
+// foreign key column, i.e., nil (NULL) if it is zero
+func sqliteId(id int64) interface{} {
+	if id == 0 {
+		return nil
 	}
-	return result
+	return id
 }
 
-func GetAllVendors(db *sqlite3.Conn) []*Vendor {
-	results := make([]*Vendor, 0)
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(GET_VENDORS); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
-		vendor, vendorFound := row["vendor_id"]
-		vendorName, vendorNameFound := row["display_name"]
-		if vendorFound && vendorNameFound {
-			v := Vendor{Id: rowid, VendorId: vendor.(string), DisplayName: vendorName.(string)}
-			results = append(results, &v)
+// UpdateItems applies the fields set in each Item (its Desc, Index,
+// ExpiresAt, and Note, if not empty/nil) to the Item with the given id,
+// leaving the others as they are, all in a single transaction. Ids which
+// do not exist (or are in the trash) are skipped, and the number of Items
+// updated is returned.
+func UpdateItems(db *sqlite3.Conn, updates map[int64]Item) (_ int64, err error) {
+	defer wrapError("UpdateItems", &err)
+	var n int64
+	now := currentTime()
+	err = withTransaction(db, func() error {
+		for id, item := range updates {
+			args := sqlite3.NamedArgs{"$d": sqliteText(SanitizeDescription(item.Desc)),
+				"$n": sqliteInt(item.Index),
+				"$x": sqliteTime(item.ExpiresAt),
+				"$o": sqliteText(item.Note),
+				"$i": id,
+				"$t": now}
+			if err := db.Exec(UPDATE_FIELDS, args); err != nil {
+				return err
+			}
+			n += int64(db.RowsAffected())
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return results
+	return n, nil
 }
 
-func GetVendorProducts(db *sqlite3.Conn, itemId int64) []*VendorProduct {
-	results := make([]*VendorProduct, 0)
-
-	row := make(sqlite3.RowMap)
-	args := sqlite3.NamedArgs{"$i": itemId}
-	for s, err := db.Query(GET_VENDOR_PRODUCT, args); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
+// SetDescription updates only the description of the Item with the given
+// id, e.g., once an asynchronous lookup resolves a barcode which was added
+// with an empty description, returning ErrNoItem if there is no such Item
+// (or it is in the trash)
+func SetDescription(db *sqlite3.Conn, id int64, desc string) (err error) {
+	defer wrapError("SetDescription", &err)
+	args := sqlite3.NamedArgs{"$d": SanitizeDescription(desc), "$i": id, "$t": currentTime()}
+	if err := db.Exec(UPDATE_DESC, args); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoItem
+	}
+	return nil
+}
 
-		vendorPk, vendorPkFound := row["id"]
-		productCode, productCodeFound := row["product_code"]
-		if vendorPkFound && productCodeFound {
-			result := new(VendorProduct)
-			result.Id = rowid
-			result.ProductCode = productCode.(string)
-			result.Vendor = GetVendor(db, vendorPk.(int64))
-			results = append(results, result)
+// UpdateDescriptions writes back the descriptions resolved for many Items
+// at once (e.g., by a bulk lookup on the remote product service), keyed by
+// Item id, in a single transaction. Ids which do not exist (or are in the
+// trash) are skipped, and the number of Items actually updated is returned.
+func UpdateDescriptions(db *sqlite3.Conn, updates map[int64]string) (_ int64, err error) {
+	defer wrapError("UpdateDescriptions", &err)
+	var n int64
+	now := currentTime()
+	err = withTransaction(db, func() error {
+		for id, desc := range updates {
+			args := sqlite3.NamedArgs{"$d": SanitizeDescription(desc), "$i": id, "$t": now}
+			if err := db.Exec(UPDATE_DESC, args); err != nil {
+				return err
+			}
+			n += int64(db.RowsAffected())
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-
-	return results
+	return n, nil
 }
 
-func (a *Account) Add(db *sqlite3.Conn) error {
-	// insert the Account object
-	args := sqlite3.NamedArgs{"$e": a.Email, "$a": a.APICode}
+func getItemAccount(db *sqlite3.Conn, id int64) int64 {
+	// lookup the account which owns the given item id
+	args := sqlite3.NamedArgs{"$i": id}
+
+	var rowid, account int64
+	account = BAD_PK // default value, in case no match
+	for s, err := db.Query(GET_ITEM_ACCOUNT, args); err == nil; err = s.Next() {
+		s.Scan(&rowid, &account)
+	}
+	return account
+}
+
+// execItemChange runs the sql statement against the given Item id (with
+// any additional args), returning the number of Items affected, and reports
+// the change to the OnItemChange observer, if there is one
+func execItemChange(db *sqlite3.Conn, sql string, id int64, args sqlite3.NamedArgs, kind string) (int64, error) {
+	var account int64 = BAD_PK
+	if hasItemObserver() {
+		// must be done first, in case the statement is a delete
+		account = getItemAccount(db, id)
+	}
+
+	itemArgs := sqlite3.NamedArgs{"$i": id}
+	for k, v := range args {
+		itemArgs[k] = v
+	}
+	n, err := execProducts(db, sql, itemArgs)
+	if err == nil {
+		countItems(kind, n)
+	}
+	if err == nil && n > 0 && account != BAD_PK {
+		notifyItemChange(account, kind)
+	}
+	return n, err
+}
+
+// Delete moves the Item to the trash: it is hidden from every query, but
+// kept (along with its lists) until PurgeDeleted, so that Restore can undo
+// a mistaken delete. See Purge, to delete it for good right away.
+func (i *Item) Delete(db *sqlite3.Conn) (err error) {
+	defer wrapError("Item.Delete", &err)
+	_, err = execItemChange(db, SOFT_DELETE_ITEM, i.Id, nil, ITEM_DELETED)
+	return err
+}
+
+// DeleteForAccount moves the Item to the trash, like Delete, only if it
+// belongs to the given Account, returning ErrNotOwned otherwise (or if there
+// is no such Item, or it is already deleted), so ownership is enforced at
+// the db level, even if the caller forgot to check it
+func (i *Item) DeleteForAccount(db *sqlite3.Conn, a *Account) (err error) {
+	defer wrapError("Item.DeleteForAccount", &err)
+	args := sqlite3.NamedArgs{"$i": i.Id, "$a": a.Id}
+	n, err := execProducts(db, SOFT_DELETE_OWNED, args)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotOwned
+	}
+	countItems(ITEM_DELETED, n)
+	notifyItemChange(a.Id, ITEM_DELETED)
+	return nil
+}
+
+// accountExists reports whether there is an account with the given id
+func accountExists(db *sqlite3.Conn, id int64) bool {
+	args := sqlite3.NamedArgs{"$i": id}
+
+	var count int64
+	for s, err := db.Query(ACCOUNT_EXISTS, args); err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count > 0
+}
+
+// hasSameItem reports whether the Account $a already has an Item with the
+// barcode and description of the Item $i
+func hasSameItem(db *sqlite3.Conn, args sqlite3.NamedArgs) bool {
+	var count int64
+	for s, err := db.Query(HAS_SAME_ITEM, args); err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count > 0
+}
+
+// MoveToAccount re-assigns the Item to another Account (e.g., if it was
+// scanned under the wrong one), returning ErrNoAccount if there is no such
+// Account, ErrNoItem if there is no such Item, or ErrDuplicateItem if the
+// other Account already has the same barcode and description
+func (i *Item) MoveToAccount(db *sqlite3.Conn, to *Account) (err error) {
+	defer wrapError("Item.MoveToAccount", &err)
+	if !accountExists(db, to.Id) {
+		return ErrNoAccount
+	}
+	from := getItemAccount(db, i.Id)
+	if from == BAD_PK {
+		return ErrNoItem
+	}
+
+	args := sqlite3.NamedArgs{"$a": to.Id, "$i": i.Id}
+	if from != to.Id && hasSameItem(db, args) {
+		return ErrDuplicateItem
+	}
+	n, err := execProducts(db, MOVE_ITEM, args)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoItem
+	}
+
+	i.AccountId = to.Id
+	notifyItemChange(from, ITEM_DELETED)
+	notifyItemChange(to.Id, ITEM_ADDED)
+	return nil
+}
+
+func (i *Item) Favorite(db *sqlite3.Conn) (err error) {
+	// update the Item, to show it is a favorite for this Account
+	defer wrapError("Item.Favorite", &err)
+	_, err = execItemChange(db, FAVORITE_ITEM, i.Id, nil, ITEM_FAVORITED)
+	return err
+}
+
+// FavoriteWithNote marks the Item as a favorite and saves the note with it,
+// in the same (single) update, returning ErrNoItem if there is no such Item
+func (i *Item) FavoriteWithNote(db *sqlite3.Conn, note string) (err error) {
+	defer wrapError("Item.FavoriteWithNote", &err)
+	args := sqlite3.NamedArgs{"$n": note}
+	n, err := execItemChange(db, FAVORITE_WITH_NOTE, i.Id, args, ITEM_FAVORITED)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoItem
+	}
+	i.Note = note
+	return nil
+}
+
+// IncrementQuantity adds the delta (which may be negative, e.g., when one
+// is used up) to the Item's stored quantity, and sets its Quantity to the
+// result, returning ErrNegativeQuantity (and changing nothing) if that would
+// be less than zero, or ErrNoItem if there is no such Item (or it is in the
+// trash)
+func (i *Item) IncrementQuantity(db *sqlite3.Conn, delta int64) (err error) {
+	defer wrapError("Item.IncrementQuantity", &err)
+	return withTransaction(db, func() error {
+		args := sqlite3.NamedArgs{"$q": delta}
+		n, err := execItemChange(db, INCREMENT_QUANTITY, i.Id, args, ITEM_UPDATED)
+		if err != nil {
+			return err
+		}
+
+		var quantity int64
+		found := false
+		err = queryRows(db, GET_ITEM_QUANTITY, func(s *sqlite3.Stmt) error {
+			found = true
+			return s.Scan(&quantity)
+		}, sqlite3.NamedArgs{"$i": i.Id})
+		switch {
+		case err != nil:
+			return err
+		case !found:
+			return ErrNoItem
+		case n == 0:
+			return ErrNegativeQuantity
+		}
+		i.Quantity = quantity
+		return nil
+	})
+}
+
+func (i *Item) Unfavorite(db *sqlite3.Conn) (err error) {
+	// update the Item, to show it is not a favorite for this Account
+	defer wrapError("Item.Unfavorite", &err)
+	_, err = execItemChange(db, UNFAVORITE_ITEM, i.Id, nil, ITEM_UNFAVORITED)
+	return err
+}
+
+// scanItem converts the statement's current row (selected with
+// ITEM_COLUMNS) into an Item, scanning each column into a typed destination
+// (where a null is the zero value), except for the index and the quantity,
+// which only have a value if they are not null
+func scanItem(db *sqlite3.Conn, s *sqlite3.Stmt) (*Item, error) {
+	var (
+		id, account, scans, favorite, device                          int64
+		barcode, desc, since, expires, updated, note, payload, source string
+		ind, quantity                                                 interface{}
+	)
+	err := s.Scan(&id, &barcode, &desc, &ind, &since, &expires, &account, &scans, &updated, &note, &payload, &favorite, &quantity, &source, &device)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(Item)
+	result.Id = id
+	result.Barcode = barcode
+	result.Desc = desc // empty for an unknown item
+	if index, indFound := ind.(int64); indFound {
+		result.Index = &index
+	}
+	if since != "" {
+		result.Since = calculateTimeSince(since)
+		result.PostedTime, _ = unixTime(since)
+	}
+	result.AccountId = account
+	result.ScanCount = scans
+	if updated != "" {
+		result.Updated, _ = unixTime(updated)
+	}
+	if expires != "" {
+		if t, err := unixTime(expires); err == nil {
+			result.ExpiresAt = &t
+		}
+	}
+	result.Note = note
+	result.RawPayload = payload
+	result.IsFavorite = (favorite == 1)
+	result.Quantity = 1 // the column default
+	if q, quantityFound := quantity.(int64); quantityFound {
+		result.Quantity = q
+	}
+	result.Source = source   // empty if unknown
+	result.DeviceId = device // zero if unknown
+	result.ForSale = GetVendorProducts(db, id)
+	return result, nil
+}
+
+func fetchItems(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) ([]*Item, error) {
+	// find all the items matching the query
+	results := make([]*Item, 0)
+
+	err := queryRows(db, itemSelect(db, sql), func(s *sqlite3.Stmt) error {
+		result, err := scanItem(db, s)
+		if err == nil {
+			results = append(results, result)
+		}
+		return err
+	}, args)
+
+	return results, err
+}
+
+func GetItems(db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetItems", &err)
+	return fetchItems(db, GET_ITEMS, sqlite3.NamedArgs{"$a": a.Id})
+}
+
+// GetRecentItems returns only the newest n Items for this Account (e.g., for
+// a ticker of the latest scans), most recent first
+func GetRecentItems(db *sqlite3.Conn, a *Account, n int) (_ []*Item, err error) {
+	defer wrapError("GetRecentItems", &err)
+	if n <= 0 {
+		return nil, ErrBadLimit
+	}
+	args := sqlite3.NamedArgs{"$a": a.Id, "$l": n}
+	return fetchItems(db, GET_RECENT_ITEMS, args)
+}
+
+// GetItemsPaged returns one page of the Items for this Account: at most
+// limit Items, after skipping the first offset, most recent first (an offset
+// past the last Item returns an empty list). See also CountItems, for the
+// number of pages, and GetItemsAfter, for pages which do not shift when new
+// Items are added.
+func GetItemsPaged(db *sqlite3.Conn, a *Account, limit, offset int) (_ []*Item, err error) {
+	defer wrapError("GetItemsPaged", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	if offset < 0 {
+		return nil, ErrBadOffset
+	}
+	args := sqlite3.NamedArgs{"$a": a.Id, "$l": limit, "$o": offset}
+	return fetchItems(db, GET_ITEMS_PAGE, args)
+}
+
+// CountItems returns how many Items this Account has
+func CountItems(db *sqlite3.Conn, a *Account) (_ int64, err error) {
+	defer wrapError("CountItems", &err)
+	var count int64
+	s, err := db.Query(COUNT_ITEMS, sqlite3.NamedArgs{"$a": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count, queryError(err)
+}
+
+// GetItemsAfter returns a page of at most limit Items for this Account,
+// along with the cursor (the posted time, as unix seconds, and the id of
+// the last Item in the page) to pass for the next page. Pages are in the
+// same order as GetRecentItems, most recent first (i.e., by posted desc,
+// then id desc, which makes the order total), and each one starts right
+// after the cursor, rather than at an offset, so that Items added in the
+// meantime do not shift the pages. A zero afterId starts with the newest
+// Item, and an empty page returns the cursor as-is, meaning there are no
+// more Items.
+func GetItemsAfter(db *sqlite3.Conn, a *Account, afterPosted int64, afterId int64, limit int) (_ []*Item, _ int64, _ int64, err error) {
+	defer wrapError("GetItemsAfter", &err)
+	if limit <= 0 {
+		return nil, afterPosted, afterId, ErrBadLimit
+	}
+
+	var items []*Item
+	if afterId == 0 {
+		items, err = fetchItems(db, GET_RECENT_ITEMS, sqlite3.NamedArgs{"$a": a.Id, "$l": limit})
+	} else {
+		args := sqlite3.NamedArgs{"$a": a.Id, "$p": afterPosted, "$i": afterId, "$l": limit}
+		items, err = fetchItems(db, GET_ITEMS_AFTER, args)
+	}
+	if err != nil || len(items) == 0 {
+		return items, afterPosted, afterId, err
+	}
+
+	last := items[len(items)-1]
+	return items, last.PostedTime.Unix(), last.Id, nil
+}
+
+// GetItemIds returns just the ids of all the Items for this Account, in
+// ascending order, which is much cheaper than GetItems when all that is
+// needed is to compare the local and remote sets
+func GetItemIds(db *sqlite3.Conn, a *Account) (_ []int64, err error) {
+	defer wrapError("GetItemIds", &err)
+	results := make([]int64, 0)
+
+	args := sqlite3.NamedArgs{"$a": a.Id}
+	s, err := db.Query(GET_ITEM_IDS, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid)
+		results = append(results, rowid)
+	}
+
+	return results, queryError(err)
+}
+
+// ExistingBarcodes reports which of the barcodes this Account has already
+// scanned (e.g., to diff a server payload before importing it), with one
+// query per MAX_IN_VALUES barcodes. Every barcode given is in the map, as
+// given, but matched in its canonical form (as Add saves it), and mapped to
+// false if the Account has no Item with it (or if it is malformed).
+func ExistingBarcodes(db *sqlite3.Conn, a *Account, barcodes []string) (_ map[string]bool, err error) {
+	defer wrapError("ExistingBarcodes", &err)
+	results := make(map[string]bool, len(barcodes))
+	given := make(map[string][]string, len(barcodes))
+	codes := make([]string, 0, len(barcodes))
+	for _, b := range barcodes {
+		results[b] = false
+		code, err := normalizedBarcode(b)
+		if err != nil {
+			continue
+		}
+		if _, found := given[code]; !found {
+			codes = append(codes, code)
+		}
+		given[code] = append(given[code], b)
+	}
+
+	row := make(sqlite3.RowMap)
+	for start := 0; start < len(codes); start += MAX_IN_VALUES {
+		end := start + MAX_IN_VALUES
+		if end > len(codes) {
+			end = len(codes)
+		}
+
+		in, args := buildTextInClause("$b", codes[start:end])
+		args["$a"] = a.Id
+		s, err := db.Query(inClause(EXISTING_BARCODES, in), args)
+		for ; err == nil; err = s.Next() {
+			s.Scan(row)
+			if code, found := row["barcode"].(string); found {
+				for _, b := range given[code] {
+					results[b] = true
+				}
+			}
+		}
+		if err = queryError(err); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// GetFavoriteItems is GetItems, for only the Items this Account has
+// favorited (an empty list, not nil, if there are none)
+func GetFavoriteItems(db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetFavoriteItems", &err)
+	return fetchItems(db, GET_FAVORITE_ITEMS, sqlite3.NamedArgs{"$a": a.Id})
+}
+
+// GetItemsByDesc returns the Items for this Account whose description is
+// exactly the given one (trimmed), ignoring case (of ascii letters only),
+// e.g., to find the same product saved under different barcodes
+func GetItemsByDesc(db *sqlite3.Conn, a *Account, desc string) (_ []*Item, err error) {
+	defer wrapError("GetItemsByDesc", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$d": strings.TrimSpace(desc)}
+	return fetchItems(db, GET_ITEMS_BY_DESC, args)
+}
+
+// GetUndescribedItems returns the Items for this Account which do not have a
+// description yet (i.e., are waiting for a barcode lookup, after which the
+// description is set with SetDescription), oldest first
+func GetUndescribedItems(db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetUndescribedItems", &err)
+	return fetchItems(db, GET_UNDESCRIBED, sqlite3.NamedArgs{"$a": a.Id})
+}
+
+// GetFavoritedUndescribed returns the favorite Items for this Account which
+// still have no description, i.e., the ones most worth a manual edit or
+// another lookup, most recent first
+func GetFavoritedUndescribed(db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetFavoritedUndescribed", &err)
+	return fetchItems(db, GET_FAV_NO_DESC, sqlite3.NamedArgs{"$a": a.Id})
+}
+
+// GetAllFavoriteItems returns the most recently favorited Items across every
+// Account, up to the limit, with the AccountId of each Item set. This is
+// strictly an admin/debug tool: it ignores Account scoping entirely.
+func GetAllFavoriteItems(db *sqlite3.Conn, limit int) (_ []*Item, err error) {
+	defer wrapError("GetAllFavoriteItems", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	return fetchItems(db, GET_ALL_FAVORITES, sqlite3.NamedArgs{"$l": limit})
+}
+
+// GetItemsSince returns the Items for this Account which were posted within
+// the given duration of the current time (e.g., the last 24 hours). The
+// posted timestamps are stored as UTC, so the cutoff is converted to a UTC
+// datetime in the db, regardless of the Pi's local timezone, and compared
+// with posted as-is, so that the product_account_posted index applies. A
+// zero or negative duration matches nothing.
+func GetItemsSince(db *sqlite3.Conn, a *Account, d time.Duration) (_ []*Item, err error) {
+	defer wrapError("GetItemsSince", &err)
+	if d <= 0 {
+		return make([]*Item, 0), nil
+	}
+	args := sqlite3.NamedArgs{"$a": a.Id, "$s": Now().Add(-d).Unix()}
+	return fetchItems(db, GET_ITEMS_SINCE, args)
+}
+
+// GetItemsForAccounts returns the most recent Items across all the given
+// Accounts (e.g., for an admin dashboard), up to the limit, using the
+// AccountId of each Item to tell them apart
+func GetItemsForAccounts(db *sqlite3.Conn, accountIds []int64, limit int) (_ []*Item, err error) {
+	defer wrapError("GetItemsForAccounts", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	if len(accountIds) == 0 {
+		return make([]*Item, 0), nil
+	}
+
+	in, args := buildInClause("$id", accountIds)
+	args["$l"] = limit
+
+	return fetchItems(db, inClause(GET_ACCOUNTS_ITEMS, in), args)
+}
+
+// execItemsChange runs the sql statement against the list of Item ids
+// belonging to the Account, returning the number of Items affected
+func execItemsChange(db *sqlite3.Conn, a *Account, sql string, ids []int64, args sqlite3.NamedArgs, kind string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	in, inArgs := buildInClause("$id", ids)
+	for k, v := range args {
+		inArgs[k] = v
+	}
+	inArgs["$a"] = a.Id
+
+	n, err := execProducts(db, inClause(sql, in), inArgs)
+	if err != nil {
+		return 0, err
+	}
+	countItems(kind, n)
+	if n > 0 {
+		notifyItemChange(a.Id, kind)
+	}
+	return n, nil
+}
+
+// DeleteItems moves all the Items in the list of ids which belong to the
+// Account to the trash (like Item.Delete), in a single statement, returning
+// the number of Items deleted (those already in the trash are not counted)
+func DeleteItems(db *sqlite3.Conn, a *Account, ids []int64) (_ int64, err error) {
+	defer wrapError("DeleteItems", &err)
+	return execItemsChange(db, a, DELETE_ITEMS, ids, nil, ITEM_DELETED)
+}
+
+// EnforceItemLimit caps the history of the Account, like a ring buffer, by
+// removing its oldest Items beyond the newest max non-favorites, returning
+// the number of Items removed. Favorites are never removed (nor counted),
+// and neither are the Items in the trash (see PurgeDeleted).
+func EnforceItemLimit(db *sqlite3.Conn, a *Account, max int) (_ int64, err error) {
+	defer wrapError("EnforceItemLimit", &err)
+	if max <= 0 {
+		return 0, ErrBadLimit
+	}
+
+	args := sqlite3.NamedArgs{"$a": a.Id, "$m": max}
+	n, err := execProducts(db, EVICT_OLDEST_ITEMS, args)
+	if err != nil {
+		return 0, err
+	}
+	countItems(ITEM_DELETED, n)
+	if n > 0 {
+		notifyItemChange(a.Id, ITEM_DELETED)
+	}
+	return n, nil
+}
+
+// FavoriteItems marks all the Items in the list of ids which belong to the
+// Account as favorites (or not, if favorite is false), in a single
+// statement, returning the number of Items updated
+func FavoriteItems(db *sqlite3.Conn, a *Account, ids []int64, favorite bool) (_ int64, err error) {
+	defer wrapError("FavoriteItems", &err)
+	kind := ITEM_FAVORITED
+	if !favorite {
+		kind = ITEM_UNFAVORITED
+	}
+	return execItemsChange(db, a, FAVORITE_ITEMS, ids, sqlite3.NamedArgs{"$f": favorite}, kind)
+}
+
+// GetSingleItem returns the Item corresponding to the id, provided it
+// belongs to the given Account, and is not in the trash (see
+// GetDeletedItems); otherwise, the Item Id is BAD_PK
+func GetSingleItem(db *sqlite3.Conn, a *Account, id int64) (_ *Item, err error) {
+	defer wrapError("GetSingleItem", &err)
+	item := new(Item)
+	item.Id = BAD_PK // if not found
+	items, err := fetchItems(db, GET_ITEM, sqlite3.NamedArgs{"$i": id})
+	for _, i := range items {
+		if i.Id == id && i.AccountId == a.Id {
+			return i, err
+		}
+	}
+	return item, err
+}
+
+// GetItemByBarcode returns the Account's Item with the barcode (the most
+// recent one, if Add saved several products for it), or nil, if the Account
+// has not scanned it, e.g., to check for a repeated scan before inserting.
+// The barcode is normalized first, or rejected if malformed, as by Add.
+func GetItemByBarcode(db *sqlite3.Conn, a *Account, barcode string) (_ *Item, err error) {
+	defer wrapError("GetItemByBarcode", &err)
+	if barcode, err = normalizedBarcode(barcode); err != nil {
+		return nil, err
+	}
+	args := sqlite3.NamedArgs{"$a": a.Id, "$b": barcode}
+	items, err := fetchItems(db, GET_BARCODE_ITEM, args)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+func AddVendor(db *sqlite3.Conn, vendorId, vendorDisplayName string) (_ int64, err error) {
+	defer wrapError("AddVendor", &err)
+	args := sqlite3.NamedArgs{"$v": vendorId,
+		"$n": vendorDisplayName}
+	result := db.Exec(ADD_VENDOR, args)
+	if result == nil {
+		pk := getPK(db, "vendor")
+		return pk, result
+	}
+	return BAD_PK, result
+}
+
+func AddVendorProduct(db *sqlite3.Conn, productCode string, vendorId, itemId int64) (err error) {
+	defer wrapError("AddVendorProduct", &err)
+	args := sqlite3.NamedArgs{"$v": vendorId,
+		"$p": productCode,
+		"$i": itemId}
+	return db.Exec(ADD_VENDOR_PRODUCT, args)
+}
+
+func GetVendor(db *sqlite3.Conn, vendorId int64) *Vendor {
+	result := new(Vendor)
+	args := sqlite3.NamedArgs{"$i": vendorId}
+	queryRows(db, GET_VENDOR, func(s *sqlite3.Stmt) error {
+		return s.Scan(&result.Id, &result.VendorId, &result.DisplayName)
+	}, args)
+	return result
+}
+
+func GetAllVendors(db *sqlite3.Conn) []*Vendor {
+	results := make([]*Vendor, 0)
+	row := make(sqlite3.RowMap)
+	for s, err := db.Query(GET_VENDORS); err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+		vendor, vendorFound := row["vendor_id"]
+		vendorName, vendorNameFound := row["display_name"]
+		if vendorFound && vendorNameFound {
+			v := Vendor{Id: rowid, VendorId: vendor.(string), DisplayName: vendorName.(string)}
+			results = append(results, &v)
+		}
+	}
+	return results
+}
+
+func GetVendorProducts(db *sqlite3.Conn, itemId int64) []*VendorProduct {
+	results := make([]*VendorProduct, 0)
+
+	args := sqlite3.NamedArgs{"$i": itemId}
+	queryRows(db, GET_VENDOR_PRODUCT, func(s *sqlite3.Stmt) error {
+		var vendorPk int64
+		result := new(VendorProduct)
+		if err := s.Scan(&result.Id, &vendorPk, &result.ProductCode); err != nil {
+			return err
+		}
+		result.Vendor = GetVendor(db, vendorPk)
+		results = append(results, result)
+		return nil
+	}, args)
+
+	return results
+}
+
+// normalizeAPICode returns the api code in the canonical (lowercase) form
+func normalizeAPICode(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// ValidAPICode reports whether the api code is a uuid (see API_CODE_FORMAT),
+// once normalized
+func ValidAPICode(s string) bool {
+	return API_CODE_FORMAT.MatchString(normalizeAPICode(s))
+}
+
+// ValidBarcode reports whether the barcode is one which a scanner could
+// have read (see BARCODE_FORMAT), e.g., before importing it
+func ValidBarcode(s string) bool {
+	return BARCODE_FORMAT.MatchString(s)
+}
+
+// normalizedBarcode is barcode.Normalize, for the functions whose barcode
+// arg hides the package
+func normalizedBarcode(s string) (string, error) {
+	return barcode.Normalize(s)
+}
+
+// normalizeBarcode replaces the Item's barcode with its canonical form
+// (see barcode.Parse), keeping the barcode as scanned in its RawPayload (if
+// it has none) when they differ, or returns the barcode package's error
+// (e.g., barcode.ErrCheckDigit) if it is malformed
+func (i *Item) normalizeBarcode() error {
+	code, err := barcode.Normalize(i.Barcode)
+	if err != nil {
+		return err
+	}
+	if scanned := strings.TrimSpace(i.Barcode); code != scanned && i.RawPayload == "" {
+		i.RawPayload = scanned
+	}
+	i.Barcode = code
+	return nil
+}
+
+func (a *Account) Add(db *sqlite3.Conn) (err error) {
+	// insert the Account object, provided its api code is valid
+	defer wrapError("Account.Add", &err)
+	a.APICode = normalizeAPICode(a.APICode)
+	if !ValidAPICode(a.APICode) && !a.IsAnonymous() {
+		return ErrBadAPICode
+	}
+
+	// and its email is not taken, in any case
+	a.Email = normalizeEmail(a.Email)
+	existing, err := GetAccount(db, a.Email)
+	if err != nil {
+		return err
+	}
+	if existing.Email != "" {
+		return ErrDuplicateEmail
+	}
+
+	name := a.Name
+	if name == "" {
+		name = defaultAccountName(a.Email)
+	}
+	args := sqlite3.NamedArgs{"$e": a.Email, "$a": a.APICode, "$n": name}
 	return db.Exec(ADD_ACCOUNT, args)
 }
 
-func (a *Account) Update(db *sqlite3.Conn, newEmail, newApi string) error {
-	// update this Account's email and API code
+func (a *Account) Update(db *sqlite3.Conn, newEmail, newApi string) (err error) {
+	// update this Account's email and API code, provided the code is valid
+	// (or is the one the anonymous account already had)
+	defer wrapError("Account.Update", &err)
+	newApi = normalizeAPICode(newApi)
+	if !ValidAPICode(newApi) && !(a.IsAnonymous() && newApi == normalizeAPICode(a.APICode)) {
+		return ErrBadAPICode
+	}
+
+	// and the new email is not another Account's, in any case
+	newEmail = normalizeEmail(newEmail)
+	existing, err := GetAccount(db, newEmail)
+	if err != nil {
+		return err
+	}
+	if existing.Email != "" && existing.Id != a.Id {
+		return ErrDuplicateEmail
+	}
+
 	args := sqlite3.NamedArgs{"$i": a.Id, "$e": newEmail, "$a": newApi}
 	return db.Exec(UPDATE_ACCOUNT, args)
 }
 
-func GetAccount(db *sqlite3.Conn, email string) (*Account, error) {
-	// get the account corresponding to this email
+// normalizeEmail returns the email in the canonical (lowercase) form, in
+// which Add and Update store it, so that no two Accounts differ only in the
+// case of their emails
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// defaultAccountName is the display name for an Account which does not have
+// one of its own, i.e., the local part of its email
+func defaultAccountName(email string) string {
+	if at := strings.Index(email, "@"); at >= 0 {
+		return email[:at]
+	}
+	return email
+}
+
+// accountName returns the display name, or the default for the email, if
+// it is not set
+func accountName(name, email string) string {
+	if name != "" {
+		return name
+	}
+	return defaultAccountName(email)
+}
+
+// SetName changes the display name of this Account, or resets it to the
+// default (see defaultAccountName), if the name is empty
+func (a *Account) SetName(db *sqlite3.Conn, name string) (err error) {
+	defer wrapError("Account.SetName", &err)
+	if name == "" {
+		name = defaultAccountName(a.Email)
+	}
+	args := sqlite3.NamedArgs{"$i": a.Id, "$n": name}
+	err = db.Exec(SET_ACCOUNT_NAME, args)
+	if err == nil {
+		a.Name = name
+	}
+	return err
+}
+
+// Delete removes this Account, along with all of its Items and lists (and
+// any tombstones of its Items, which nothing can sync anymore), in a single
+// transaction, returning ErrNoAccount if there is no such Account. The
+// anonymous account cannot be deleted, since the client relies on it (see
+// FetchOrCreateDefaultAccount), even by an Account with only its Id set.
+func (a *Account) Delete(db *sqlite3.Conn) (err error) {
+	defer wrapError("Account.Delete", &err)
+	if a.IsAnonymous() {
+		return ErrAnonymousDelete
+	}
+
+	var n int64
+	args := sqlite3.NamedArgs{"$a": a.Id, "$e": ANONYMOUS_EMAIL}
+	err = withTransaction(db, func() error {
+		var itemsErr error
+		n, itemsErr = execProducts(db, DELETE_ACCOUNT_ITEMS, args)
+		if itemsErr != nil {
+			return itemsErr
+		}
+		for _, sql := range []string{DELETE_LISTS, DELETE_TOMBSTONES, DELETE_SCAN_LOG, DELETE_SESSIONS, DELETE_SHOPPING_ITEMS, DELETE_SHOPPING_LISTS, DELETE_PURCHASES, DELETE_EXPIRY_WARNINGS, DELETE_ACCOUNT} {
+			if err := db.Exec(sql, args); err != nil {
+				return err
+			}
+		}
+		if db.RowsAffected() == 0 {
+			return ErrNoAccount
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	countItems(ITEM_DELETED, n)
+	if n > 0 {
+		notifyItemChange(a.Id, ITEM_DELETED)
+	}
+	return nil
+}
+
+// IsAnonymous reports whether this is the local client's default account
+// (see FetchOrCreateDefaultAccount), regardless of the case or any
+// surrounding whitespace in its email. Its api code is generated per client,
+// so the email is the only part of the identity which is well-known.
+func (a *Account) IsAnonymous() bool {
+	return normalizeEmail(a.Email) == ANONYMOUS_EMAIL
+}
+
+func GetAccount(db *sqlite3.Conn, email string) (_ *Account, err error) {
+	// get the account corresponding to this email (in any case, which
+	// also matches those stored before emails were normalized)
+	defer wrapError("GetAccount", &err)
 	result := new(Account)
 
+	email = normalizeEmail(email)
 	args := sqlite3.NamedArgs{"$e": email}
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(GET_ACCOUNT, args); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
-
-		api, apiFound := row["api_code"]
-		if apiFound {
-			result.APICode = api.(string)
-			result.Id = rowid
+	found := false
+	err = queryRows(db, GET_ACCOUNT, func(s *sqlite3.Stmt) error {
+		if found {
+			return nil
+		}
+		var name string
+		err := s.Scan(&result.Id, &result.APICode, &name)
+		if err == nil {
+			found = true
 			result.Email = email
-			break
+			result.Name = accountName(name, email)
 		}
+		return err
+	}, args)
+
+	return result, err
+}
+
+// GetAccountByAPICode returns the account with the api code (e.g., to
+// authenticate a request which carries only the code), or ErrNoAccount, if
+// there is none
+func GetAccountByAPICode(db *sqlite3.Conn, apiCode string) (_ *Account, err error) {
+	defer wrapError("GetAccountByAPICode", &err)
+	args := sqlite3.NamedArgs{"$a": normalizeAPICode(apiCode)}
+	accounts, err := fetchAccounts(db, GET_ACCOUNT_BY_CODE, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, ErrNoAccount
 	}
+	return accounts[0], nil
+}
 
-	return result, nil
+func fetchAccounts(db *sqlite3.Conn, sql string, args ...interface{}) ([]*Account, error) {
+	// find all the accounts matching the query
+	results := make([]*Account, 0)
+
+	err := queryRows(db, sql, func(s *sqlite3.Stmt) error {
+		var name string
+		result := new(Account)
+		if err := s.Scan(&result.Id, &result.Email, &result.APICode, &name); err != nil {
+			return err
+		}
+		result.Name = accountName(name, result.Email)
+		results = append(results, result)
+		return nil
+	}, args...)
+
+	return results, err
 }
 
-func GetAllAccounts(db *sqlite3.Conn) ([]*Account, error) {
+func GetAllAccounts(db *sqlite3.Conn) (_ []*Account, err error) {
 	// find all the accounts currently registered
-	results := make([]*Account, 0)
+	defer wrapError("GetAllAccounts", &err)
+	return fetchAccounts(db, GET_ACCOUNTS)
+}
 
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(GET_ACCOUNTS); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
+// GetAccountsByDomain returns all the accounts whose email address belongs
+// to the given domain (e.g., "example.org")
+func GetAccountsByDomain(db *sqlite3.Conn, domain string) (_ []*Account, err error) {
+	defer wrapError("GetAccountsByDomain", &err)
+	args := sqlite3.NamedArgs{"$d": "%@" + safeLike(domain)}
+	return fetchAccounts(db, GET_DOMAIN_ACCOUNTS, args)
+}
 
-		email, emailFound := row["email"]
-		api, apiFound := row["api_code"]
-		if emailFound && apiFound {
-			result := new(Account)
-			result.APICode = api.(string)
-			result.Id = rowid
-			result.Email = email.(string)
-			results = append(results, result)
-		}
+// GetAccountsMap returns all the accounts in the list of ids, keyed by id,
+// in a single query (e.g., to show the owner of each of the Items returned
+// by GetItemsForAccounts). Ids which do not exist are not in the map.
+func GetAccountsMap(db *sqlite3.Conn, ids []int64) (_ map[int64]*Account, err error) {
+	defer wrapError("GetAccountsMap", &err)
+	results := make(map[int64]*Account)
+	if len(ids) == 0 {
+		return results, nil
 	}
 
+	in, args := buildInClause("$id", ids)
+	accounts, err := fetchAccounts(db, inClause(GET_ACCOUNTS_BY_ID, in), args)
+	if err != nil {
+		return results, err
+	}
+	for _, a := range accounts {
+		results[a.Id] = a
+	}
 	return results, nil
 }
 
-// FetchOrCreateDefaultAccount returns the existing local client account
-// (in single-user mode), or creates it, if it does not exist yet
-func FetchOrCreateDefaultAccount(db *sqlite3.Conn) (*Account, error) {
-	// return the existing local client account
-	anon, anonErr := GetAccount(db, ANONYMOUS_EMAIL)
+// SearchAccounts returns all the accounts whose email contains the query
+// (e.g., for an admin looking up a user), with those whose email starts
+// with it ahead of the rest, and each group in alphabetical order
+func SearchAccounts(db *sqlite3.Conn, query string) (_ []*Account, err error) {
+	defer wrapError("SearchAccounts", &err)
+	q := safeLike(query)
+	args := sqlite3.NamedArgs{"$q": "%" + q + "%", "$p": q + "%"}
+	return fetchAccounts(db, SEARCH_ACCOUNTS, args)
+}
 
-	// or create it, if it does not exist yet
-	if anon.Email == "" && anonErr == nil {
-		anon = new(Account)
-		anon.Email = ANONYMOUS_EMAIL
-		anon.APICode = barcodes.GenerateUUID(barcodes.UndashedUUID)
-		anonErr = anon.Add(db)
-		if anonErr == nil {
-			// make sure the Id value is correct
-			return GetAccount(db, ANONYMOUS_EMAIL)
+// DisableAnonymous makes FetchOrCreateDefaultAccount (and therefore
+// GetDesignatedAccount, when there is no other account) return
+// ErrAnonymousDisabled rather than the anonymous account, for deployments
+// which require every user to register. It is enabled by default.
+func DisableAnonymous(disabled bool) {
+	var flag int32
+	if disabled {
+		flag = 1
+	}
+	atomic.StoreInt32(&anonymousDisabled, flag)
+}
+
+// FetchOrCreateDefault returns the existing account for the email (e.g.,
+// the default "walk-in" account of one kiosk among several), or creates it,
+// with the api code (or a new one, if it is empty), if it does not exist
+// yet, reporting whether it had to be created
+func FetchOrCreateDefault(db *sqlite3.Conn, email, apiCode string) (_ *Account, _ bool, err error) {
+	defer wrapError("FetchOrCreateDefault", &err)
+	email = normalizeEmail(email)
+	a, err := GetAccount(db, email)
+	if err != nil || a.Email != "" {
+		return a, false, err
+	}
+
+	// create it: another conn may be doing the same concurrently, in
+	// which case the first insert wins and this one is ignored, rather
+	// than failing on UNIQUE(email)
+	if apiCode == "" {
+		if apiCode, err = NewAPICode(); err != nil {
+			return a, false, err
 		}
 	}
+	apiCode = normalizeAPICode(apiCode)
+	if !ValidAPICode(apiCode) {
+		return a, false, ErrBadAPICode
+	}
+	args := sqlite3.NamedArgs{"$e": email, "$a": apiCode, "$n": defaultAccountName(email)}
+	if err = db.Exec(ADD_ACCOUNT_ONCE, args); err != nil {
+		return a, false, err
+	}
+	created := db.RowsAffected() > 0
 
-	return anon, anonErr
+	// make sure the Id and APICode values are the stored ones
+	a, err = GetAccount(db, email)
+	return a, created, err
+}
+
+// FetchOrCreateDefaultAccount returns the existing local client account
+// (in single-user mode), or creates it, if it does not exist yet (see
+// FetchOrCreateDefault)
+func FetchOrCreateDefaultAccount(db *sqlite3.Conn) (_ *Account, err error) {
+	defer wrapError("FetchOrCreateDefaultAccount", &err)
+	if atomic.LoadInt32(&anonymousDisabled) == 1 {
+		return new(Account), ErrAnonymousDisabled
+	}
+
+	anon, _, err := FetchOrCreateDefault(db, ANONYMOUS_EMAIL, "")
+	return anon, err
 }
 
 // GetDesignatedAccount implements single-user mode (for now): it returns
 // either the anonymous account, or the first non-anonymous account found
 // on the sqlite database
-func GetDesignatedAccount(db *sqlite3.Conn) (*Account, error) {
+func GetDesignatedAccount(db *sqlite3.Conn) (_ *Account, err error) {
+	defer wrapError("GetDesignatedAccount", &err)
 	accounts, listErr := GetAllAccounts(db)
 	if len(accounts) == 0 {
 		return FetchOrCreateDefaultAccount(db)
@@ -428,29 +2178,487 @@ func GetDesignatedAccount(db *sqlite3.Conn) (*Account, error) {
 	return accounts[0], listErr
 }
 
-func InitializeDB(coords ConnCoordinates) (*sqlite3.Conn, error) {
+// isBusy reports whether the error means another connection (e.g., an
+// instance of the scanner which has not yet exited) holds a lock on the db
+func isBusy(err error) bool {
+	var e *sqlite3.Error
+	if errors.As(err, &e) {
+		// mask any extended result code
+		code := e.Code() & 0xff
+		return code == sqlite3.BUSY || code == sqlite3.LOCKED
+	}
+	return false
+}
+
+// openWithRetry opens the sqlite db file and confirms it can be read,
+// retrying with backoff while it is busy or locked, but failing immediately
+// on any other error (e.g., the file is not a database)
+func openWithRetry(file string, coords ConnCoordinates) (*sqlite3.Conn, error) {
+	attempts := coords.OpenAttempts
+	if attempts <= 0 {
+		attempts = DEFAULT_OPEN_ATTEMPTS
+	}
+	delay := coords.OpenRetryDelay
+	if delay <= 0 {
+		delay = DEFAULT_OPEN_RETRY_DELAY
+	}
+
+	name, err := connString(file, coords.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		var db *sqlite3.Conn
+		db, err = sqlite3.Open(name)
+		if err == nil {
+			err = db.Exec(PROBE_DB)
+			if err == nil {
+				return db, nil
+			}
+			db.Close()
+		}
+		if attempt >= attempts || !isBusy(err) {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return nil, err
+}
+
+// splitStatements splits the sql into its individual statements, on each
+// ";" which is not inside a quoted string or identifier, a comment, or the
+// BEGIN ... END body of a trigger, dropping any empty statements
+func splitStatements(sql string) []string {
+	statements := make([]string, 0)
+
+	var (
+		start     int    // where the current statement begins
+		quote     rune   // the open quote character, if any
+		comment   string // the open comment, "--" or "/*", if any
+		word      []rune // the current keyword (or identifier)
+		isTrigger bool   // whether the current statement creates a trigger
+		blocks    int    // the depth of BEGIN (in a trigger) and CASE
+	)
+
+	endWord := func() {
+		switch strings.ToUpper(string(word)) {
+		case "TRIGGER":
+			isTrigger = true
+		case "BEGIN":
+			if isTrigger {
+				blocks++
+			}
+		case "CASE":
+			blocks++
+		case "END":
+			if blocks > 0 {
+				blocks--
+			}
+		}
+		word = word[:0]
+	}
+
+	runes := []rune(sql)
+	for j := 0; j < len(runes); j++ {
+		r := runes[j]
+		next := rune(0)
+		if j+1 < len(runes) {
+			next = runes[j+1]
+		}
+
+		switch {
+		case comment == "--":
+			if r == '\n' {
+				comment = ""
+			}
+		case comment == "/*":
+			if r == '*' && next == '/' {
+				comment = ""
+				j++
+			}
+		case quote != 0:
+			// a doubled quote is an escaped one, which simply
+			// closes and reopens the string
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			endWord()
+			quote = r
+		case r == '[':
+			endWord()
+			quote = ']'
+		case r == '-' && next == '-':
+			endWord()
+			comment = "--"
+			j++
+		case r == '/' && next == '*':
+			endWord()
+			comment = "/*"
+			j++
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			word = append(word, r)
+		default:
+			endWord()
+			if r == ';' && blocks == 0 {
+				statement := string(runes[start:j])
+				if strings.TrimSpace(statement) != "" {
+					statements = append(statements, statement)
+				}
+				start = j + 1
+				isTrigger = false
+			}
+		}
+	}
+	if statement := string(runes[start:]); strings.TrimSpace(statement) != "" {
+		statements = append(statements, statement)
+	}
+
+	return statements
+}
+
+// createTables runs each of the table definitions statements
+func createTables(db *sqlite3.Conn, definitions string) error {
+	// attempt to create (if not exists) each table
+	tables := splitStatements(definitions)
+	for _, table := range tables {
+		err := db.Exec(table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBusyTimeout applies coords.BusyTimeout (or DEFAULT_BUSY_TIMEOUT) to
+// the connection
+func setBusyTimeout(db *sqlite3.Conn, coords ConnCoordinates) {
+	timeout := coords.BusyTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_BUSY_TIMEOUT
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	db.BusyTimeout(timeout)
+}
+
+// setCacheSize applies coords.CacheSizeKB to the connection, if defined
+func setCacheSize(db *sqlite3.Conn, coords ConnCoordinates) error {
+	if coords.CacheSizeKB <= 0 {
+		return nil
+	}
+	return db.Exec(fmt.Sprintf(CACHE_SIZE, coords.CacheSizeKB))
+}
+
+// InitializeSchema brings the tables of an already-open connection (e.g.,
+// one managed by a larger app embedding this package) up to date with the
+// migrations (see COLUMN_MIGRATIONS, TABLE_MIGRATIONS, SCHEMA_MIGRATIONS),
+// and then runs the schema definitions (if any) against it
+func InitializeSchema(db *sqlite3.Conn, schema string) (err error) {
+	defer wrapError("InitializeSchema", &err)
+	hasTables := len(getColumns(db, "product")) > 0
+
+	// bring any tables created by an earlier release up to date
+	// (first, since the definitions may refer to the new columns)
+	if err := migrateColumns(db); err != nil {
+		return err
+	}
+	if hasTables {
+		if err := migrateVersions(db); err != nil {
+			return err
+		}
+	}
+
+	if len(schema) > 0 {
+		if err := createTables(db, schema); err != nil {
+			return err
+		}
+		if !hasTables {
+			// new tables need none of the migrations
+			return setSchemaVersion(db, len(SCHEMA_MIGRATIONS))
+		}
+	}
+	return nil
+}
+
+// DefaultCoordinates returns the coordinates of the database on this
+// platform, for the caller to override as needed: SQLITE_FILE in SQLITE_PATH
+// on the Pi (or anywhere that path exists), or else in USER_CONFIG_FOLDER
+// under the user's config dir (e.g., ~/.config on Linux). The definitions
+// file replaces the one compiled into the package only if there is a
+// TABLE_SQL_DEFINITIONS in the same folder.
+func DefaultCoordinates() ConnCoordinates {
+	folder := SQLITE_PATH
+	if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+		if config, configErr := os.UserConfigDir(); configErr == nil {
+			folder = path.Join(config, USER_CONFIG_FOLDER)
+		}
+	}
+
+	coords := ConnCoordinates{DBPath: folder, DBFile: SQLITE_FILE}
+	if _, err := os.Stat(path.Join(folder, TABLE_SQL_DEFINITIONS)); err == nil {
+		coords.DBTablesPath = folder
+	}
+	return coords
+}
+
+// InitializeDBCreated is InitializeDB, but also reports whether the db file
+// is brand new, i.e., did not exist before this call (e.g., to show the
+// onboarding on the very first run), regardless of what the tables contain
+func InitializeDBCreated(coords ConnCoordinates) (_ *sqlite3.Conn, _ bool, err error) {
+	defer wrapError("InitializeDBCreated", &err)
+	created := true // an in-memory db always is
+	if coords.DBFile != SQLITE_MEMORY {
+		_, err := os.Stat(path.Join(coords.DBPath, coords.DBFile))
+		created = os.IsNotExist(err)
+	}
+
+	db, err := InitializeDB(coords)
+	return db, created, err
+}
+
+// InitializeDB opens a new connection to the sqlite db file, creating the
+// tables the first time it is called for a given file by this process (or
+// for a file which replaced it since, see isInitialized), from the
+// definitions compiled into the package, or else from the
+// TABLE_SQL_DEFINITIONS file in coords.DBTablesPath, if it is defined (so
+// that the binary needs no files beside it). Every call
+// returns a distinct connection, owned by the caller, which must Close() it
+// when done, e.g., before re-initializing after a configuration reload (on
+// an error, there is no connection to close).
+func InitializeDB(coords ConnCoordinates) (_ *sqlite3.Conn, err error) {
+	defer wrapError("InitializeDB", &err)
+	file := path.Join(coords.DBPath, coords.DBFile)
+
 	// attempt to open the sqlite db file
-	db, dbErr := sqlite3.Open(path.Join(coords.DBPath, coords.DBFile))
+	db, dbErr := openWithRetry(file, coords)
 	if dbErr != nil {
-		return db, dbErr
+		return nil, dbErr
+	}
+	setBusyTimeout(db, coords)
+	if err := setCacheSize(db, coords); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	// load the table definitions file, if coords.DBTablesPath is defined
+	initializedFilesMutex.Lock()
+	defer initializedFilesMutex.Unlock()
+	name := db.Path("main")
+	if isInitialized(db, name) {
+		return db, nil
+	}
+
+	// load the table definitions file instead, if coords.DBTablesPath is
+	// defined
+	schema := embeddedTables
 	if len(coords.DBTablesPath) > 0 {
 		content, err := ioutil.ReadFile(path.Join(coords.DBTablesPath, TABLE_SQL_DEFINITIONS))
 		if err != nil {
-			return db, err
+			db.Close()
+			return nil, err
 		}
+		schema = string(content)
+	}
 
-		// attempt to create (if not exists) each table
-		tables := strings.Split(string(content), ";")
-		for _, table := range tables {
-			err = db.Exec(table)
-			if err != nil {
-				return db, err
+	if err := InitializeSchema(db, schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// the migrations may have added product columns
+	productColumnsFoundMutex.Lock()
+	delete(productColumnsFound, name)
+	productColumnsFoundMutex.Unlock()
+
+	if info, err := os.Stat(name); err == nil {
+		initializedFiles[name] = info
+	}
+
+	return db, nil
+}
+
+// isInitialized reports whether InitializeDB has already applied the table
+// definitions to the db file, i.e., to the very same file (not one which
+// replaced it since, e.g., after it was deleted, or restored from a copy),
+// which still has its tables. An in-memory db (whose path is empty) is new
+// to every connection, so it never is. The caller holds the
+// initializedFilesMutex.
+func isInitialized(db *sqlite3.Conn, name string) bool {
+	known, found := initializedFiles[name]
+	if !found {
+		return false
+	}
+	info, err := os.Stat(name)
+	return err == nil && os.SameFile(known, info) && len(getColumns(db, "product")) > 0
+}
+
+// forgetInitialized removes the db file from the ones InitializeDB has
+// initialized, so that the next connection checks its tables again (e.g.,
+// once the DB using it is closed, in case the file is then replaced)
+func forgetInitialized(name string) {
+	initializedFilesMutex.Lock()
+	defer initializedFilesMutex.Unlock()
+	delete(initializedFiles, name)
+}
+
+// NewTestDB returns a connection to a new, private, in-memory sqlite db,
+// with all the tables created from the table definitions compiled into
+// this package, so that tests need no filesystem setup. All the data is
+// lost when the connection is closed. Every timestamp the package writes
+// comes from Now, so a test which checks them can replace it with a fixed
+// clock first (and restore time.Now after).
+func NewTestDB() (_ *sqlite3.Conn, err error) {
+	defer wrapError("NewTestDB", &err)
+	db, dbErr := sqlite3.Open(SQLITE_MEMORY)
+	if dbErr != nil {
+		return db, dbErr
+	}
+
+	if err := InitializeSchema(db, embeddedTables); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewTempDB is NewTestDB, but for a db file in a new temporary folder, for
+// tests which need to reopen the same file (its path is db.Path("main")).
+// The cleanup function closes the connection, and removes the folder, along
+// with the db file and any of its sidecar (e.g., WAL) files.
+func NewTempDB() (_ *sqlite3.Conn, _ func(), err error) {
+	defer wrapError("NewTempDB", &err)
+	folder, err := ioutil.TempDir("", USER_CONFIG_FOLDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	removeFolder := func() {
+		os.RemoveAll(folder)
+	}
+
+	db, err := sqlite3.Open(path.Join(folder, SQLITE_FILE))
+	if err != nil {
+		removeFolder()
+		return nil, nil, err
+	}
+	if err = InitializeSchema(db, embeddedTables); err != nil {
+		db.Close()
+		removeFolder()
+		return nil, nil, err
+	}
+
+	return db, func() {
+		db.Close()
+		removeFolder()
+	}, nil
+}
+
+// sqliteURI converts the file path into the sqlite URI form, escaping
+// any characters which would otherwise be parsed as query parameters
+func sqliteURI(file, query string) string {
+	u := url.URL{Scheme: "file", Opaque: (&url.URL{Path: file}).EscapedPath(), RawQuery: query}
+	return u.String()
+}
+
+// connString returns the name to pass to sqlite3.Open(): the file path
+// itself, or, if there are any options, the sqlite uri with the options
+// as its parameters, provided they are all permitted by URI_OPTIONS
+func connString(file string, options map[string]string) (string, error) {
+	if len(options) == 0 {
+		return file, nil
+	}
+
+	params := url.Values{}
+	for k, v := range options {
+		permitted := false
+		for _, allowed := range URI_OPTIONS[k] {
+			if v == allowed {
+				permitted = true
+				break
 			}
 		}
+		if !permitted {
+			return "", fmt.Errorf("unsupported sqlite uri option: %s=%s", k, v)
+		}
+		params.Set(k, v)
+	}
+	return sqliteURI(file, params.Encode()), nil
+}
+
+// OpenReadOnly connects to an existing sqlite db file without write access,
+// and without running any of the table definitions, so that it can be
+// safely shared with the scanner and WebApp (e.g., by a reporting process).
+// Any attempt to write to the returned connection fails with the sqlite
+// READONLY error.
+func OpenReadOnly(coords ConnCoordinates) (_ *sqlite3.Conn, err error) {
+	defer wrapError("OpenReadOnly", &err)
+	file := path.Join(coords.DBPath, coords.DBFile)
+	if _, err := os.Stat(file); err != nil {
+		// sqlite would otherwise report a less obvious error
+		return nil, err
+	}
+
+	options := map[string]string{"mode": "ro"}
+	for k, v := range coords.Options {
+		if k != "mode" {
+			options[k] = v
+		}
+	}
+	name, nameErr := connString(file, options)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+
+	db, dbErr := sqlite3.Open(name)
+	if dbErr != nil {
+		return db, dbErr
+	}
+
+	setBusyTimeout(db, coords)
+	if err := setCacheSize(db, coords); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// enforce it at the connection level, too
+	if err := db.Exec(QUERY_ONLY); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
 }
+
+// Ping confirms the db is responsive, with the cheapest possible query,
+// e.g., for a readiness check
+func Ping(db *sqlite3.Conn) (err error) {
+	defer wrapError("Ping", &err)
+	s, err := db.Query(PING)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// PingContext is Ping, but gives up (interrupting the query) and returns
+// the context error if the context is done before the db responds. The
+// conn must not be used by anything else until PingContext returns.
+func PingContext(ctx context.Context, db *sqlite3.Conn) (err error) {
+	defer wrapError("PingContext", &err)
+	result := make(chan error, 1)
+	go func() {
+		result <- Ping(db)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		db.Interrupt()
+		<-result
+		return ctx.Err()
+	}
+}
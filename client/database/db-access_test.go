@@ -0,0 +1,1731 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	// valid barcodes, already in their canonical form (see barcode.Parse)
+	TEST_COLA  = "036000291452"
+	TEST_PENS  = "4006381333931"
+	TEST_GUM   = "96385074"
+	TEST_BOOK  = "9780306406157"
+	TEST_WATER = "5449000000996"
+)
+
+var (
+	// the time the test clock starts at (see fixClock)
+	testTime = time.Date(2015, time.March, 14, 9, 26, 53, 0, time.UTC)
+)
+
+// newTestDB returns a new in-memory db (see NewTestDB), closed once the
+// test is over
+func newTestDB(t testing.TB) *sqlite3.Conn {
+	t.Helper()
+	db, err := NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestFileDB returns a new DB (see OpenDB), on a db file in a temporary
+// folder, closed once the test is over
+func newTestFileDB(t testing.TB) *DB {
+	t.Helper()
+	d, err := OpenDB(ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// fixClock replaces Now with a clock stopped at testTime, until the test is
+// over, and returns the time it reads, for the test to move forward
+func fixClock(t testing.TB) *time.Time {
+	now := testTime
+	saved := Now
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = saved })
+	return &now
+}
+
+// newTestAccount adds the Account with the email, and a new api code, and
+// returns it as stored (i.e., with its Id)
+func newTestAccount(t testing.TB, db *sqlite3.Conn, email string) *Account {
+	t.Helper()
+	code, err := NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Account{Email: email, APICode: code}).Add(db); err != nil {
+		t.Fatal(err)
+	}
+	a, err := GetAccount(db, email)
+	if err != nil || a.Id == 0 {
+		t.Fatalf("GetAccount(%q) = %+v, %v", email, a, err)
+	}
+	return a
+}
+
+// addTestItem adds the Item with the barcode and description to the
+// Account, and returns it (with its Id)
+func addTestItem(t testing.TB, db *sqlite3.Conn, a *Account, barcode, desc string) *Item {
+	t.Helper()
+	i := &Item{Barcode: barcode, Desc: desc}
+	if _, err := i.Add(db, a); err != nil {
+		t.Fatalf("Add(%q, %q) = %v", barcode, desc, err)
+	}
+	return i
+}
+
+// countRows returns the single number the query selects, read directly,
+// so that it does not depend on the functions under test
+func countRows(t testing.TB, db *sqlite3.Conn, sql string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	s, err := db.Query(sql, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	defer s.Close()
+	if err := s.Scan(&n); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return n
+}
+
+func TestNewTestDB(t *testing.T) {
+	db := newTestDB(t)
+	tables, err := ListTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, table := range tables {
+		found[table] = true
+	}
+	for _, table := range []string{"account", "product", "vendor", "product_availability"} {
+		if !found[table] {
+			t.Errorf("table %s is missing, in %v", table, tables)
+		}
+	}
+
+	version, err := SchemaVersion(db)
+	if err != nil || version != len(SCHEMA_MIGRATIONS) {
+		t.Errorf("SchemaVersion() = %d, %v, want %d", version, err, len(SCHEMA_MIGRATIONS))
+	}
+}
+
+func TestNewTestDBPrivate(t *testing.T) {
+	first := newTestDB(t)
+	second := newTestDB(t)
+	addTestItem(t, first, newTestAccount(t, first, "alice@example.org"), TEST_COLA, "Cola")
+	if n := countRows(t, second, "select count(*) from product"); n != 0 {
+		t.Errorf("the other in-memory db has %d products, want none", n)
+	}
+	if name := first.Path("main"); name != "" {
+		t.Errorf("the in-memory db is at %q", name)
+	}
+
+	// a pragma which only applies to a file (see OpenDB) is harmless
+	if err := first.Exec(JOURNAL_WAL); err != nil {
+		t.Errorf("%s on the in-memory db = %v", JOURNAL_WAL, err)
+	}
+	if n := countRows(t, first, "select count(*) from product"); n != 1 {
+		t.Errorf("%d products after %s, want 1", n, JOURNAL_WAL)
+	}
+}
+
+func TestNewTempDB(t *testing.T) {
+	db, cleanup, err := NewTempDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	file := db.Path("main")
+	if file == "" {
+		t.Fatal("NewTempDB() is in memory")
+	}
+	if err := db.Exec(JOURNAL_WAL); err != nil {
+		t.Fatal(err)
+	}
+	addTestItem(t, db, newTestAccount(t, db, "alice@example.org"), TEST_COLA, "Cola")
+
+	// the same file, reopened, while the WAL and SHM files are in use
+	reopened, err := sqlite3.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, reopened, "select count(*) from product"); n != 1 {
+		t.Errorf("the reopened db has %d products, want 1", n)
+	}
+	reopened.Close()
+	for _, sidecar := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(file + sidecar); err != nil {
+			t.Errorf("no %s file: %v", sidecar, err)
+		}
+	}
+
+	cleanup()
+	entries, err := filepath.Glob(file + "*")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("cleanup() left %v, %v", entries, err)
+	}
+	if _, err := os.Stat(filepath.Dir(file)); !os.IsNotExist(err) {
+		t.Errorf("cleanup() left the folder: %v", err)
+	}
+}
+
+func TestItemAdd(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	*now = now.Add(time.Minute)
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+	if cola.Id <= 0 || pens.Id <= 0 || cola.Id == pens.Id {
+		t.Fatalf("Add() set the ids %d and %d", cola.Id, pens.Id)
+	}
+
+	items, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("GetItems() returned %d items, want 2", len(items))
+	}
+	// the newest first
+	got := items[0]
+	if got.Id != pens.Id || got.Barcode != TEST_PENS || got.Desc != "Pens" || got.AccountId != a.Id {
+		t.Errorf("GetItems()[0] = %+v, want the pens", got)
+	}
+	if !got.PostedTime.Equal(*now) || !got.Updated.Equal(*now) {
+		t.Errorf("the pens were posted at %s, updated at %s, want %s", got.PostedTime, got.Updated, *now)
+	}
+	if !items[1].PostedTime.Equal(testTime) {
+		t.Errorf("the cola was posted at %s, want %s", items[1].PostedTime, testTime)
+	}
+	if got.IsFavorite || got.Quantity != 1 || got.ScanCount != 1 {
+		t.Errorf("GetItems()[0] = %+v, want the column defaults", got)
+	}
+}
+
+func TestItemAddId(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	i := &Item{Barcode: TEST_COLA, Desc: "Cola"}
+	pk, err := i.Add(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Id <= 0 || pk != i.Id {
+		t.Fatalf("Add() = %d, and set the id %d", pk, i.Id)
+	}
+	got, err := GetItemByBarcode(db, a, TEST_COLA)
+	if err != nil || got == nil || got.Id != i.Id {
+		t.Errorf("GetItemByBarcode() = %+v, %v, want the id %d", got, err, i.Id)
+	}
+	// so that it can be used right away
+	if err := i.Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+	if favorites, err := GetFavoriteItems(db, a); err != nil || len(favorites) != 1 || favorites[0].Id != i.Id {
+		t.Errorf("GetFavoriteItems() = %v, %v, want the cola", favorites, err)
+	}
+}
+
+func TestItemSince(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, TEST_COLA, "Cola")
+
+	// how long ago is measured against the test clock, not the wall clock
+	*now = now.Add(3 * time.Hour)
+	items, err := GetItems(db, a)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetItems() = %v, %v", items, err)
+	}
+	if got := strings.TrimSpace(items[0].Since); got != "3 hours ago" {
+		t.Errorf("Since = %q, want %q", got, "3 hours ago")
+	}
+	// GetItemsSince too
+	if items, err := GetItemsSince(db, a, 2*time.Hour); err != nil || len(items) != 0 {
+		t.Errorf("GetItemsSince(2h) = %v, %v, want none", items, err)
+	}
+	if items, err := GetItemsSince(db, a, 4*time.Hour); err != nil || len(items) != 1 {
+		t.Errorf("GetItemsSince(4h) = %v, %v, want the cola", items, err)
+	}
+}
+
+func TestProductUpdatedTrigger(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+
+	// an ad-hoc update, which does not set updated, gets sqlite's time
+	before := time.Now().UTC().Truncate(time.Second)
+	if err := db.Exec("update product set note = 'ad hoc' where id = ?", cola.Id); err != nil {
+		t.Fatal(err)
+	}
+	items, err := GetItems(db, a)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetItems() = %v, %v", items, err)
+	}
+	if items[0].Updated.Before(before) {
+		t.Errorf("the ad-hoc update left updated at %s, want at least %s", items[0].Updated, before)
+	}
+
+	// while the package's own updates keep the time they set
+	*now = now.Add(time.Hour)
+	if err := cola.Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+	items, err = GetItems(db, a)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetItems() = %v, %v", items, err)
+	}
+	if !items[0].Updated.Equal(*now) {
+		t.Errorf("Favorite() left updated at %s, want %s", items[0].Updated, *now)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	// a db without any of the tables
+	db, err := sqlite3.Open(SQLITE_MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a := &Account{Id: 1, Email: "alice@example.org"}
+
+	if items, err := GetItems(db, a); err == nil {
+		t.Errorf("GetItems() without a product table = %v, want an error", items)
+	}
+	if got, err := GetAccount(db, a.Email); err == nil {
+		t.Errorf("GetAccount() without an account table = %+v, want an error", got)
+	}
+	if accounts, err := GetAllAccounts(db); err == nil {
+		t.Errorf("GetAllAccounts() without an account table = %v, want an error", accounts)
+	}
+
+	// while no rows at all is not an error
+	db = newTestDB(t)
+	if items, err := GetItems(db, a); err != nil || len(items) != 0 {
+		t.Errorf("GetItems() = %v, %v, want none", items, err)
+	}
+	if got, err := GetAccount(db, a.Email); err != nil || got.Id != 0 {
+		t.Errorf("GetAccount() = %+v, %v, want none", got, err)
+	}
+	if accounts, err := GetAllAccounts(db); err != nil || len(accounts) != 0 {
+		t.Errorf("GetAllAccounts() = %v, %v, want none", accounts, err)
+	}
+}
+
+func TestItemAddDuplicate(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+
+	first := addTestItem(t, db, a, TEST_COLA, "Cola")
+	again := addTestItem(t, db, a, TEST_COLA, "Cola")
+	if again.Id != first.Id {
+		t.Errorf("adding the same item again set the id %d, want %d", again.Id, first.Id)
+	}
+	if n := countRows(t, db, "select count(*) from product"); n != 1 {
+		t.Errorf("%d product rows, want 1", n)
+	}
+
+	// another product of the same barcode is another item
+	other := addTestItem(t, db, a, TEST_COLA, "Diet Cola")
+	if other.Id == first.Id {
+		t.Errorf("another description of the barcode got the same id %d", other.Id)
+	}
+}
+
+func TestItemUpdate(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Colla")
+	if err := cola.Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+
+	*now = now.Add(time.Hour)
+	if err := cola.Update(db, "Cola  ", 2); err != nil {
+		t.Fatal(err)
+	}
+	if cola.Desc != "Cola" || cola.Index == nil || *cola.Index != 2 {
+		t.Errorf("Update() left the Item at %q, %v, want Cola, 2", cola.Desc, cola.Index)
+	}
+
+	items, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("GetItems() returned %d items, want 1", len(items))
+	}
+	got := items[0]
+	if got.Id != cola.Id || got.Desc != "Cola" || got.Index == nil || *got.Index != 2 {
+		t.Errorf("GetItems() after Update = %+v, want Cola, 2", got)
+	}
+	if got.Barcode != TEST_COLA || got.AccountId != a.Id || !got.IsFavorite {
+		t.Errorf("Update() changed the barcode, account, or favorite flag: %+v", got)
+	}
+	if !got.PostedTime.Equal(testTime) {
+		t.Errorf("Update() changed the posted time to %s, want %s", got.PostedTime, testTime)
+	}
+}
+
+func TestItemDelete(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+
+	if err := cola.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+	items, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Id != pens.Id {
+		t.Errorf("GetItems() after Delete = %v, want only the pens", items)
+	}
+	if n, err := CountItems(db, a); err != nil || n != 1 {
+		t.Errorf("CountItems() = %d, %v, want 1", n, err)
+	}
+}
+
+func TestItemFavorites(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	addTestItem(t, db, a, TEST_PENS, "Pens")
+
+	*now = now.Add(time.Hour)
+	if err := cola.Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+	favorites, err := GetFavoriteItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(favorites) != 1 || favorites[0].Id != cola.Id || !favorites[0].IsFavorite {
+		t.Fatalf("GetFavoriteItems() = %v, want only the cola", favorites)
+	}
+	if got := favorites[0]; !got.Updated.Equal(*now) || !got.PostedTime.Equal(testTime) {
+		t.Errorf("the favorite was posted at %s, updated at %s, want %s, and %s", got.PostedTime, got.Updated, testTime, *now)
+	}
+
+	if err := cola.Unfavorite(db); err != nil {
+		t.Fatal(err)
+	}
+	favorites, err = GetFavoriteItems(db, a)
+	if err != nil || len(favorites) != 0 {
+		t.Errorf("GetFavoriteItems() after Unfavorite = %v, %v, want none", favorites, err)
+	}
+}
+
+func TestAccountCRUD(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	if a.Name != "alice" {
+		t.Errorf("the default name is %q, want alice", a.Name)
+	}
+
+	if err := a.SetName(db, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := NewAPICode()
+	if err := a.Update(db, "alice@example.com", code); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetAccount(db, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id != a.Id || got.Name != "Alice" || got.APICode != code {
+		t.Errorf("GetAccount() after Update = %+v, want id %d, Alice, %s", got, a.Id, code)
+	}
+	if old, err := GetAccount(db, "alice@example.org"); err != nil || old.Email != "" {
+		t.Errorf("GetAccount(the old email) = %+v, %v, want none", old, err)
+	}
+
+	addTestItem(t, db, got, TEST_COLA, "Cola")
+	if err := got.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+	if gone, err := GetAccount(db, "alice@example.com"); err != nil || gone.Email != "" {
+		t.Errorf("GetAccount() after Delete = %+v, %v, want none", gone, err)
+	}
+	if n := countRows(t, db, "select count(*) from product where account = $a", sqlite3.NamedArgs{"$a": a.Id}); n != 0 {
+		t.Errorf("Delete left %d of the account's products", n)
+	}
+	if err := got.Delete(db); !errors.Is(err, ErrNoAccount) {
+		t.Errorf("deleting the account again = %v, want ErrNoAccount", err)
+	}
+}
+
+func TestAccountEmailCase(t *testing.T) {
+	db := newTestDB(t)
+	bob := newTestAccount(t, db, "Bob@X.com")
+	if bob.Email != "bob@x.com" {
+		t.Errorf("the email was stored as %q, want bob@x.com", bob.Email)
+	}
+	for _, email := range []string{"bob@x.com", "BOB@X.COM", " Bob@x.Com "} {
+		if got, err := GetAccount(db, email); err != nil || got.Id != bob.Id {
+			t.Errorf("GetAccount(%q) = %+v, %v, want the id %d", email, got, err, bob.Id)
+		}
+	}
+
+	// no second Account with the same email, in another case
+	code, _ := NewAPICode()
+	if err := (&Account{Email: "bob@X.COM", APICode: code}).Add(db); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Add() of the same email = %v, want ErrDuplicateEmail", err)
+	}
+	alice := newTestAccount(t, db, "alice@example.org")
+	if err := alice.Update(db, "BOB@x.com", code); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Update() to the same email = %v, want ErrDuplicateEmail", err)
+	}
+	// while an Account may change the case of its own
+	if err := bob.Update(db, "BOB@X.com", bob.APICode); err != nil {
+		t.Errorf("Update() of the account's own email = %v", err)
+	}
+	if n := countRows(t, db, "select count(*) from account where email = 'bob@x.com'"); n != 1 {
+		t.Errorf("%d accounts with bob@x.com, want 1", n)
+	}
+}
+
+func TestAnonymousBootstrap(t *testing.T) {
+	db := newTestDB(t)
+
+	// an empty db gets the anonymous account, once
+	anon, err := GetDesignatedAccount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !anon.IsAnonymous() || anon.Id == 0 || !ValidAPICode(anon.APICode) {
+		t.Fatalf("GetDesignatedAccount() = %+v, want the anonymous account", anon)
+	}
+	again, err := GetDesignatedAccount(db)
+	if err != nil || again.Id != anon.Id || again.APICode != anon.APICode {
+		t.Errorf("GetDesignatedAccount() again = %+v, %v, want %+v", again, err, anon)
+	}
+	if n := countRows(t, db, "select count(*) from account where email = $e", sqlite3.NamedArgs{"$e": ANONYMOUS_EMAIL}); n != 1 {
+		t.Errorf("%d anonymous accounts, want 1", n)
+	}
+
+	if err := anon.Delete(db); !errors.Is(err, ErrAnonymousDelete) {
+		t.Errorf("deleting the anonymous account = %v, want ErrAnonymousDelete", err)
+	}
+}
+
+func TestFetchOrCreateDefault(t *testing.T) {
+	db := newTestDB(t)
+	code, err := NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two kiosks, each with its own walk-in account
+	first, created, err := FetchOrCreateDefault(db, "kiosk-1@example.org", code)
+	if err != nil || !created || first.Id == 0 || first.APICode != code {
+		t.Fatalf("FetchOrCreateDefault(kiosk-1) = %+v, %v, %v", first, created, err)
+	}
+	second, created, err := FetchOrCreateDefault(db, "kiosk-2@example.org", "")
+	if err != nil || !created || second.Id == first.Id || !ValidAPICode(second.APICode) {
+		t.Fatalf("FetchOrCreateDefault(kiosk-2) = %+v, %v, %v", second, created, err)
+	}
+
+	// fetched again, rather than created, even with another api code
+	again, created, err := FetchOrCreateDefault(db, "Kiosk-1@Example.org", "")
+	if err != nil || created || again.Id != first.Id || again.APICode != code {
+		t.Errorf("FetchOrCreateDefault(kiosk-1) again = %+v, %v, %v, want the first", again, created, err)
+	}
+	// alongside the global anonymous account
+	anon, err := FetchOrCreateDefaultAccount(db)
+	if err != nil || anon.Id == first.Id || anon.Id == second.Id {
+		t.Errorf("FetchOrCreateDefaultAccount() = %+v, %v", anon, err)
+	}
+	if n := countRows(t, db, "select count(*) from account"); n != 3 {
+		t.Errorf("%d accounts, want 3", n)
+	}
+
+	if _, _, err := FetchOrCreateDefault(db, "kiosk-3@example.org", "not a code"); !errors.Is(err, ErrBadAPICode) {
+		t.Errorf("FetchOrCreateDefault() with a bad api code = %v, want ErrBadAPICode", err)
+	}
+}
+
+func TestDisableAnonymous(t *testing.T) {
+	db := newTestDB(t)
+	DisableAnonymous(true)
+	t.Cleanup(func() { DisableAnonymous(false) })
+
+	if _, err := FetchOrCreateDefaultAccount(db); !errors.Is(err, ErrAnonymousDisabled) {
+		t.Errorf("FetchOrCreateDefaultAccount() = %v, want ErrAnonymousDisabled", err)
+	}
+	if _, err := GetDesignatedAccount(db); !errors.Is(err, ErrAnonymousDisabled) {
+		t.Errorf("GetDesignatedAccount() = %v, want ErrAnonymousDisabled", err)
+	}
+	if n := countRows(t, db, "select count(*) from account"); n != 0 {
+		t.Fatalf("%d accounts were created, want none", n)
+	}
+
+	// a registered account is still designated
+	alice := newTestAccount(t, db, "alice@example.org")
+	if a, err := GetDesignatedAccount(db); err != nil || a.Id != alice.Id {
+		t.Errorf("GetDesignatedAccount() = %+v, %v, want alice", a, err)
+	}
+
+	// and the fallback is back, once enabled again
+	DisableAnonymous(false)
+	anon, err := FetchOrCreateDefaultAccount(db)
+	if err != nil || !anon.IsAnonymous() {
+		t.Errorf("FetchOrCreateDefaultAccount() = %+v, %v, want the anonymous account", anon, err)
+	}
+}
+
+func TestIsAnonymous(t *testing.T) {
+	for email, want := range map[string]bool{
+		ANONYMOUS_EMAIL:           true,
+		"Anonymous@Example.ORG":   true,
+		" anonymous@example.org ": true,
+		"anonymous@example.com":   false,
+		"anonymous":               false,
+		"":                        false,
+	} {
+		if got := (&Account{Email: email}).IsAnonymous(); got != want {
+			t.Errorf("IsAnonymous(%q) = %v, want %v", email, got, want)
+		}
+	}
+
+	// as stored by a release which did not normalize emails
+	db := newTestDB(t)
+	code, _ := NewAPICode()
+	args := sqlite3.NamedArgs{"$e": "ANONYMOUS@example.org", "$a": code, "$n": "anonymous"}
+	if err := db.Exec(ADD_ACCOUNT, args); err != nil {
+		t.Fatal(err)
+	}
+	anon, err := GetAccount(db, "Anonymous@Example.org")
+	if err != nil || anon.Id == 0 || !anon.IsAnonymous() {
+		t.Errorf("GetAccount() of the stored anonymous account = %+v, %v", anon, err)
+	}
+	if designated, err := GetDesignatedAccount(db); err != nil || designated.Id != anon.Id || !designated.IsAnonymous() {
+		t.Errorf("GetDesignatedAccount() = %+v, %v, want the stored anonymous account", designated, err)
+	}
+}
+
+func TestFetchOrCreateDefaultAccountConcurrent(t *testing.T) {
+	const GOROUTINES = 50
+	d := newTestFileDB(t)
+
+	var wg sync.WaitGroup
+	ids := make([]int64, GOROUTINES)
+	errs := make([]error, GOROUTINES)
+	for n := 0; n < GOROUTINES; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs[n] = d.WithWrite(func(db *sqlite3.Conn) error {
+				anon, err := FetchOrCreateDefaultAccount(db)
+				ids[n] = anon.Id
+				return err
+			})
+		}(n)
+	}
+	wg.Wait()
+
+	for n := 0; n < GOROUTINES; n++ {
+		if errs[n] != nil {
+			t.Errorf("goroutine %d: %v", n, errs[n])
+		} else if ids[n] == 0 || ids[n] != ids[0] {
+			t.Errorf("goroutine %d got the account %d, want %d", n, ids[n], ids[0])
+		}
+	}
+	count := countRows(t, d.Read(), "select count(*) from account where email = $e", sqlite3.NamedArgs{"$e": ANONYMOUS_EMAIL})
+	if count != 1 {
+		t.Errorf("%d anonymous accounts, want 1", count)
+	}
+}
+
+func TestDeleteItems(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+	gum := addTestItem(t, db, a, TEST_GUM, "Gum")
+	theirs := addTestItem(t, db, b, TEST_BOOK, "Book")
+
+	n, err := DeleteItems(db, a, []int64{cola.Id, pens.Id, theirs.Id})
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteItems() = %d, %v, want 2", n, err)
+	}
+	items, err := GetItems(db, a)
+	if err != nil || len(items) != 1 || items[0].Id != gum.Id {
+		t.Errorf("GetItems() after DeleteItems = %v, %v, want only the gum", items, err)
+	}
+	if items, err := GetItems(db, b); err != nil || len(items) != 1 {
+		t.Errorf("DeleteItems() deleted another account's item: %v, %v", items, err)
+	}
+
+	// the Items are in the trash, not gone
+	trash, err := GetDeletedItems(db, a)
+	if err != nil || len(trash) != 2 {
+		t.Fatalf("GetDeletedItems() = %v, %v, want the cola and the pens", trash, err)
+	}
+	if err := cola.Restore(db); err != nil {
+		t.Errorf("Restore() after DeleteItems = %v", err)
+	}
+	if n, err := DeleteItems(db, a, []int64{pens.Id}); err != nil || n != 0 {
+		t.Errorf("DeleteItems() of an item in the trash = %d, %v, want 0", n, err)
+	}
+}
+
+func TestEnforceItemLimit(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	var items []*Item
+	for _, barcode := range []string{TEST_COLA, TEST_PENS, TEST_GUM, TEST_BOOK, TEST_WATER} {
+		*now = now.Add(time.Minute)
+		items = append(items, addTestItem(t, db, a, barcode, "Item "+barcode))
+	}
+	// the oldest is a favorite, the next two are in the trash
+	if err := items[0].Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteItems(db, a, []int64{items[1].Id, items[2].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the 2 items left which are not favorites are within the limit
+	if n, err := EnforceItemLimit(db, a, 2); err != nil || n != 0 {
+		t.Errorf("EnforceItemLimit(2) = %d, %v, want 0", n, err)
+	}
+	if n, err := CountItems(db, a); err != nil || n != 3 {
+		t.Errorf("CountItems() = %d, %v, want 3", n, err)
+	}
+
+	// ...while a limit of 1 evicts the older one
+	if n, err := EnforceItemLimit(db, a, 1); err != nil || n != 1 {
+		t.Errorf("EnforceItemLimit(1) = %d, %v, want 1", n, err)
+	}
+	left, err := GetItems(db, a)
+	if err != nil || len(left) != 2 || left[0].Id != items[4].Id || left[1].Id != items[0].Id {
+		t.Errorf("GetItems() after EnforceItemLimit(1) = %v, %v, want the newest and the favorite", left, err)
+	}
+	if trash, err := GetDeletedItems(db, a); err != nil || len(trash) != 2 {
+		t.Errorf("EnforceItemLimit() changed the trash: %v, %v", trash, err)
+	}
+
+	if _, err := EnforceItemLimit(db, a, 0); !errors.Is(err, ErrBadLimit) {
+		t.Errorf("EnforceItemLimit(0) = %v, want ErrBadLimit", err)
+	}
+}
+
+func TestEnforceItemLimitKeepsNewest(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	var items []*Item
+	for _, barcode := range []string{TEST_COLA, TEST_PENS, TEST_GUM, TEST_BOOK, TEST_WATER} {
+		*now = now.Add(time.Minute)
+		items = append(items, addTestItem(t, db, a, barcode, "Item "+barcode))
+		addTestItem(t, db, b, barcode, "Item "+barcode)
+	}
+	// the two posted at the same time are ordered by id
+	twin := addTestItem(t, db, a, TEST_COLA, "Twin")
+	// a favorite in the middle, which does not count against the limit
+	if err := items[2].Favorite(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := EnforceItemLimit(db, a, 3); err != nil || n != 2 {
+		t.Fatalf("EnforceItemLimit(3) = %d, %v, want 2", n, err)
+	}
+	left, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{twin.Id, items[4].Id, items[3].Id, items[2].Id}
+	if len(left) != len(want) {
+		t.Fatalf("GetItems() after EnforceItemLimit(3) = %v, want %v", left, want)
+	}
+	for k, id := range want {
+		if left[k].Id != id {
+			t.Errorf("GetItems()[%d] = %d, want %d", k, left[k].Id, id)
+		}
+	}
+	// evicted for good, not into the trash
+	if n := countRows(t, db, "select count(*) from product where account = ?", a.Id); n != 4 {
+		t.Errorf("%d products are left for the account, want 4", n)
+	}
+
+	// enforcing the same limit again is a no-op, and other Accounts keep
+	// all their Items
+	if n, err := EnforceItemLimit(db, a, 3); err != nil || n != 0 {
+		t.Errorf("EnforceItemLimit(3) again = %d, %v, want 0", n, err)
+	}
+	if n, err := CountItems(db, b); err != nil || n != 5 {
+		t.Errorf("CountItems() for the other account = %d, %v, want 5", n, err)
+	}
+}
+
+func TestItemAddPerAccount(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	theirs := addTestItem(t, db, a, TEST_COLA, "Cola")
+	if err := theirs.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// another Account's item (in the trash, or not) is not a duplicate
+	mine := addTestItem(t, db, b, TEST_COLA, "Cola")
+	if mine.Id == theirs.Id {
+		t.Fatalf("Add() returned the other account's id %d", mine.Id)
+	}
+	if items, err := GetItems(db, a); err != nil || len(items) != 0 {
+		t.Errorf("Add() restored the other account's item: %v, %v", items, err)
+	}
+	items, err := GetItems(db, b)
+	if err != nil || len(items) != 1 || items[0].Id != mine.Id {
+		t.Errorf("GetItems() = %v, %v, want the new item", items, err)
+	}
+
+	// while the Account's own deleted item is restored
+	again := addTestItem(t, db, a, TEST_COLA, "Cola")
+	if again.Id != theirs.Id {
+		t.Errorf("Add() of a deleted item set the id %d, want %d", again.Id, theirs.Id)
+	}
+	if n, err := CountItems(db, a); err != nil || n != 1 {
+		t.Errorf("CountItems() after Add() of a deleted item = %d, %v, want 1", n, err)
+	}
+}
+
+func TestItemMoveToAccount(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+	addTestItem(t, db, b, TEST_COLA, "Cola")
+
+	if err := pens.MoveToAccount(db, b); err != nil || pens.AccountId != b.Id {
+		t.Errorf("MoveToAccount() = %v, with the account %d, want %d", err, pens.AccountId, b.Id)
+	}
+	if err := cola.MoveToAccount(db, b); !errors.Is(err, ErrDuplicateItem) {
+		t.Errorf("MoveToAccount() of an item the account has = %v, want ErrDuplicateItem", err)
+	}
+	if n, err := CountItems(db, b); err != nil || n != 2 {
+		t.Errorf("CountItems() = %d, %v, want 2", n, err)
+	}
+}
+
+func TestMigrateProductUnique(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	addTestItem(t, db, a, TEST_PENS, "Pens")
+	gum := addTestItem(t, db, a, TEST_GUM, "Gum")
+	if err := gum.Purge(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnableItemAudit(db, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the db as an earlier release left it
+	const SCHEMA = "select count(*) from sqlite_master where tbl_name = 'product' and type in ('index', 'trigger')"
+	schema := countRows(t, db, SCHEMA)
+	if err := rebuildProduct(db, PRODUCT_UNIQUE_ACCOUNT, PRODUCT_UNIQUE_GLOBAL); err != nil {
+		t.Fatal(err)
+	}
+	if err := setSchemaVersion(db, len(SCHEMA_MIGRATIONS)-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Item{Barcode: TEST_COLA, Desc: "Cola"}).Add(db, b); err == nil {
+		t.Fatal("the global constraint was not restored")
+	}
+
+	if err := MigrateTo(db, len(SCHEMA_MIGRATIONS)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, SCHEMA); n != schema {
+		t.Errorf("%d product indexes and triggers after the migration, want %d", n, schema)
+	}
+	items, err := GetItems(db, a)
+	if err != nil || len(items) != 2 || items[1].Id != cola.Id {
+		t.Fatalf("GetItems() after the migration = %v, %v, want the cola, and the pens", items, err)
+	}
+
+	theirs := addTestItem(t, db, b, TEST_COLA, "Cola")
+	if theirs.Id <= gum.Id {
+		t.Errorf("the new item reused the id %d (of the purged %d)", theirs.Id, gum.Id)
+	}
+	found, err := SearchItems(db, b, "cola")
+	if err != nil || len(found) != 1 || found[0].Id != theirs.Id {
+		t.Errorf("SearchItems() after the migration = %v, %v, want the new item", found, err)
+	}
+	history, err := GetItemHistory(db, theirs.Id)
+	if err != nil || len(history) != 1 {
+		t.Errorf("GetItemHistory() after the migration = %v, %v, want the add", history, err)
+	}
+}
+
+func TestGetItemByBarcode(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, "051000012616", "Soup")
+
+	// the same barcode, as a 13-digit code
+	item, err := GetItemByBarcode(db, a, "0051000012616")
+	if err != nil || item == nil || item.Barcode != "051000012616" {
+		t.Errorf("GetItemByBarcode(the EAN-13 form) = %+v, %v, want the soup", item, err)
+	}
+	if item, err := GetItemByBarcode(db, a, TEST_PENS); err != nil || item != nil {
+		t.Errorf("GetItemByBarcode(another barcode) = %+v, %v, want nil", item, err)
+	}
+	if _, err := GetItemByBarcode(db, a, "036000291453"); err == nil {
+		t.Error("GetItemByBarcode(a wrong check digit) succeeded")
+	}
+}
+
+func TestExistingBarcodes(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, "051000012616", "Soup")
+	addTestItem(t, db, a, TEST_COLA, "Cola")
+
+	barcodes := []string{"0051000012616", "051000012616", " 036000291452", TEST_PENS, "x y"}
+	found, err := ExistingBarcodes(db, a, barcodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"0051000012616": true, "051000012616": true, " 036000291452": true, TEST_PENS: false, "x y": false}
+	if len(found) != len(want) {
+		t.Errorf("ExistingBarcodes() = %v, want %v", found, want)
+	}
+	for b, exists := range want {
+		if got, given := found[b]; !given || got != exists {
+			t.Errorf("ExistingBarcodes()[%q] = %v, %v, want %v", b, got, given, exists)
+		}
+	}
+}
+
+func TestRecordScan(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+
+	for scan := 0; scan < 3; scan++ {
+		*now = now.Add(time.Minute)
+		if recorded, err := RecordScan(db, a, TEST_COLA, "Cola", 0); err != nil || !recorded {
+			t.Fatalf("RecordScan() #%d = %v, %v", scan+1, recorded, err)
+		}
+	}
+	// the same barcode, in its EAN-13 form
+	*now = now.Add(time.Minute)
+	if _, err := RecordScan(db, a, "0036000291452", "Cola", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := GetItems(db, a)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetItems() after RecordScan = %v, %v, want a single item", items, err)
+	}
+	if got := items[0]; got.ScanCount != 4 || !got.PostedTime.Equal(*now) {
+		t.Errorf("RecordScan() left the count at %d, posted at %s, want 4, at %s", got.ScanCount, got.PostedTime, *now)
+	}
+	if _, err := RecordScan(db, a, "036000291453", "Cola", 0); err == nil {
+		t.Error("RecordScan() of a wrong check digit succeeded")
+	}
+}
+
+func TestBarcodeIndexMigration(t *testing.T) {
+	db := newTestDB(t)
+	const INDEX = "select count(*) from sqlite_master where type = 'index' and name = 'product_account_barcode'"
+	if err := db.Exec("drop index product_account_barcode"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing db file gets it, even without the table definitions
+	if err := InitializeSchema(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, INDEX); n != 1 {
+		t.Errorf("%d product_account_barcode indexes after the migration, want 1", n)
+	}
+}
+
+// hasProductTable reports whether the db file at the coordinates has its
+// tables, on a new connection from InitializeDB
+func hasProductTable(t *testing.T, coords ConnCoordinates) bool {
+	t.Helper()
+	db, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	return len(getColumns(db, "product")) > 0
+}
+
+func TestInitializeDBRecreatedFile(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	if !hasProductTable(t, coords) {
+		t.Fatal("InitializeDB() created no tables")
+	}
+
+	// the file is deleted, and created again, by the same process
+	if err := os.Remove(path.Join(coords.DBPath, coords.DBFile)); err != nil {
+		t.Fatal(err)
+	}
+	if !hasProductTable(t, coords) {
+		t.Error("InitializeDB() of the recreated file created no tables")
+	}
+}
+
+// openFiles returns how many files the process has open (on Linux), or
+// skips the test, if that is not known
+func openFiles(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("the open files are unknown:", err)
+	}
+	return len(fds)
+}
+
+func TestInitializeDBTwice(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	before := openFiles(t)
+
+	first, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("InitializeDB() returned the same connection twice")
+	}
+	// each is the caller's own, usable after the other is closed, and
+	// neither is left with a statement which would keep it open (see
+	// sqlite3.Conn.Close)
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, second, "select count(*) from product"); n != 0 {
+		t.Errorf("%d products in the new db", n)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := openFiles(t); after != before {
+		t.Errorf("%d files open after closing both connections, want %d", after, before)
+	}
+}
+
+func TestInitializeDBFailure(t *testing.T) {
+	folder := t.TempDir()
+	before := openFiles(t)
+
+	// the db file opens, but the table definitions are missing, or invalid
+	coords := ConnCoordinates{DBPath: folder, DBFile: SQLITE_FILE, DBTablesPath: filepath.Join(folder, "missing")}
+	if db, err := InitializeDB(coords); err == nil || db != nil {
+		t.Errorf("InitializeDB() without the table definitions = %v, %v, want only an error", db, err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, TABLE_SQL_DEFINITIONS), []byte("CREATE TABLE oops ("), 0644); err != nil {
+		t.Fatal(err)
+	}
+	coords.DBTablesPath = folder
+	if db, err := InitializeDB(coords); err == nil || db != nil {
+		t.Errorf("InitializeDB() with invalid table definitions = %v, %v, want only an error", db, err)
+	}
+	// neither left the file open
+	if after := openFiles(t); after != before {
+		t.Errorf("%d files open after the failures, %d before", after, before)
+	}
+}
+
+func TestInitializeDBMemory(t *testing.T) {
+	coords := ConnCoordinates{DBFile: SQLITE_MEMORY}
+	for n := 1; n <= 2; n++ {
+		if !hasProductTable(t, coords) {
+			t.Errorf("in-memory db #%d has no tables", n)
+		}
+	}
+}
+
+func TestDBCloseForgetsFile(t *testing.T) {
+	d, err := OpenDB(ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := d.Write().Path("main")
+	initializedFilesMutex.Lock()
+	_, found := initializedFiles[name]
+	initializedFilesMutex.Unlock()
+	if !found {
+		t.Fatalf("OpenDB() did not record %s as initialized", name)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	initializedFilesMutex.Lock()
+	_, found = initializedFiles[name]
+	initializedFilesMutex.Unlock()
+	if found {
+		t.Errorf("DB.Close() left %s initialized", name)
+	}
+}
+
+func TestSafeLike(t *testing.T) {
+	for s, want := range map[string]string{
+		"milk":         "milk",
+		"100%":         `100\%`,
+		"a_b":          `a\_b`,
+		`c:\temp`:      `c:\\temp`,
+		"o'brien":      "o'brien",
+		`%_\`:          `\%\_\\`,
+		"":             "",
+		"50% off_sale": `50\% off\_sale`,
+	} {
+		if got := safeLike(s); got != want {
+			t.Errorf("safeLike(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestAccountsLikeMetacharacters(t *testing.T) {
+	db := newTestDB(t)
+	for _, email := range []string{"100%@example.org", "a_b@example.org", "axb@example.org", "o'brien@example.org", "bob@ex_ample.org", "bob@exxample.org"} {
+		newTestAccount(t, db, email)
+	}
+
+	emails := func(accounts []*Account, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make([]string, 0, len(accounts))
+		for _, a := range accounts {
+			found = append(found, a.Email)
+		}
+		return strings.Join(found, " ")
+	}
+	for query, want := range map[string]string{
+		"%":        "100%@example.org",
+		"_":        "a_b@example.org bob@ex_ample.org",
+		"a_b":      "a_b@example.org",
+		"o'brien":  "o'brien@example.org",
+		"' or '1'": "",
+	} {
+		if got := emails(SearchAccounts(db, query)); got != want {
+			t.Errorf("SearchAccounts(%q) = %q, want %q", query, got, want)
+		}
+	}
+	if got := emails(GetAccountsByDomain(db, "ex_ample.org")); got != "bob@ex_ample.org" {
+		t.Errorf("GetAccountsByDomain(ex_ample.org) = %q, want only bob@ex_ample.org", got)
+	}
+	if got := emails(GetAccountsByDomain(db, "%")); got != "" {
+		t.Errorf("GetAccountsByDomain(%%) = %q, want none", got)
+	}
+}
+
+var (
+	// a LIKE against a bound arg, which must then escape the
+	// metacharacters safeLike escapes
+	likeArg     = regexp.MustCompile(`(?i)\blike \$\w+`)
+	likeEscaped = regexp.MustCompile(`(?i)\blike \$\w+ escape '\\'`)
+)
+
+// TestSQLInjectionLint checks the package's own source: every LIKE against
+// a bound arg has an escape clause (so safeLike makes it literal), and no
+// sql is formatted (see fmt.Sprintf) with anything resembling an email,
+// which must only ever be bound as a NamedArg
+func TestSQLInjectionLint(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.BasicLit:
+				if n.Kind != token.STRING {
+					break
+				}
+				sql, err := strconv.Unquote(n.Value)
+				if err != nil {
+					break
+				}
+				if len(likeArg.FindAllString(sql, -1)) != len(likeEscaped.FindAllString(sql, -1)) {
+					t.Errorf("%s: like without an escape clause: %s", fset.Position(n.Pos()), sql)
+				}
+			case *ast.CallExpr:
+				fn, ok := n.Fun.(*ast.SelectorExpr)
+				if !ok || fn.Sel.Name != "Sprintf" {
+					break
+				}
+				for _, arg := range n.Args[1:] {
+					ast.Inspect(arg, func(a ast.Node) bool {
+						if id, ok := a.(*ast.Ident); ok && strings.Contains(strings.ToLower(id.Name), "mail") {
+							t.Errorf("%s: %s formatted into a string, rather than bound", fset.Position(id.Pos()), id.Name)
+						}
+						return true
+					})
+				}
+			}
+			return true
+		})
+	}
+}
+
+// lockTestFile holds an exclusive lock on the db file at the coordinates
+// (as an instance of the scanner which has not exited yet would), until
+// the returned function releases it
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"create table a (x); create table b (y);", []string{"create table a (x)", " create table b (y)"}},
+		{"  ;\n; select 1", []string{" select 1"}},
+		{"insert into a values ('x;y'); select \"a;b\" from [c;d]", []string{"insert into a values ('x;y')", " select \"a;b\" from [c;d]"}},
+		{"select 'it''s; ok'; select 2", []string{"select 'it''s; ok'", " select 2"}},
+		{"select 1 -- a comment; still\n; /* another; */ select 2", []string{"select 1 -- a comment; still\n", " /* another; */ select 2"}},
+		{
+			"CREATE TRIGGER t AFTER UPDATE ON a BEGIN UPDATE a SET x = 1; UPDATE a SET y = CASE WHEN x THEN 1 ELSE 2 END; END; select 3",
+			[]string{"CREATE TRIGGER t AFTER UPDATE ON a BEGIN UPDATE a SET x = 1; UPDATE a SET y = CASE WHEN x THEN 1 ELSE 2 END; END", " select 3"},
+		},
+		// BEGIN only opens a block inside a trigger
+		{"begin; select 1; commit", []string{"begin", " select 1", " commit"}},
+		// and CASE...END does not end one early
+		{"select case when 1 then 'a;' end; select 2", []string{"select case when 1 then 'a;' end", " select 2"}},
+	}
+	for _, test := range tests {
+		got := splitStatements(test.sql)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("splitStatements(%q) = %q, want %q", test.sql, got, test.want)
+		}
+	}
+}
+
+func TestInitializeDBTriggerFile(t *testing.T) {
+	// a definitions file whose trigger body, and string literals, have
+	// semicolons in them
+	folder := t.TempDir()
+	schema := `CREATE TABLE IF NOT EXISTS note (id integer primary key, body text, changes int DEFAULT 0);
+CREATE TRIGGER IF NOT EXISTS note_changed AFTER UPDATE OF body ON note
+BEGIN
+	UPDATE note SET changes = changes + 1 WHERE id = new.id;
+	UPDATE note SET body = body || ';' WHERE id = new.id AND body = 'end;';
+END;
+INSERT INTO note (body) VALUES ('first; line');`
+	if err := os.WriteFile(filepath.Join(folder, TABLE_SQL_DEFINITIONS), []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitializeDB(ConnCoordinates{DBPath: folder, DBFile: SQLITE_FILE, DBTablesPath: folder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if n := countRows(t, db, "select count(*) from note where body = 'first; line'"); n != 1 {
+		t.Fatalf("the insert after the trigger ran %d times, want 1", n)
+	}
+	if err := db.Exec("update note set body = 'end;'"); err != nil {
+		t.Fatal(err)
+	}
+	// both statements of the trigger body ran (the second changes the
+	// body again, but recursive triggers are off)
+	if n := countRows(t, db, "select count(*) from note where body = 'end;;' and changes = 1"); n != 1 {
+		t.Errorf("the trigger did not run both of its statements")
+	}
+}
+
+func TestInitializeSchema(t *testing.T) {
+	// a connection the caller opened, and keeps
+	db, err := sqlite3.Open(SQLITE_MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("create table other (x)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := InitializeSchema(db, embeddedTables); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, TEST_COLA, "Cola")
+	if v, err := SchemaVersion(db); err != nil || v != len(SCHEMA_MIGRATIONS) {
+		t.Errorf("SchemaVersion() = %d, %v, want %d", v, err, len(SCHEMA_MIGRATIONS))
+	}
+	// the caller's own tables are left alone
+	if n := countRows(t, db, "select count(*) from sqlite_master where name = 'other'"); n != 1 {
+		t.Error("InitializeSchema() dropped the caller's table")
+	}
+
+	// a second module's schema, on the same connection
+	if err := InitializeSchema(db, "CREATE TABLE IF NOT EXISTS module (y)"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "select count(*) from product"); n != 1 {
+		t.Errorf("%d products after the second schema, want 1", n)
+	}
+	if n := countRows(t, db, "select count(*) from sqlite_master where name = 'module'"); n != 1 {
+		t.Error("InitializeSchema() did not create the second schema")
+	}
+
+	// an empty schema only runs the migrations
+	if err := InitializeSchema(db, ""); err != nil {
+		t.Errorf("InitializeSchema(\"\") = %v", err)
+	}
+}
+
+// LEGACY_TABLES are the tables of a db written by the first release, i.e.,
+// before any of the COLUMN_MIGRATIONS
+const LEGACY_TABLES = `CREATE TABLE account (
+	id       integer primary key AUTOINCREMENT,
+	email    text NOT NULL,
+	api_code text NOT NULL,
+	UNIQUE(email)
+);
+CREATE TABLE product (
+	id           integer primary key AUTOINCREMENT,
+	barcode      text NOT NULL,
+	product_desc text,
+	product_ind  integer DEFAULT 0,
+	is_favorite  integer DEFAULT 0,
+	is_edit      integer DEFAULT 0,
+	posted       datetime DEFAULT (datetime('now')),
+	account      integer REFERENCES account(id),
+	UNIQUE(barcode, product_desc)
+);
+CREATE TABLE vendor (
+	id           integer primary key AUTOINCREMENT,
+	vendor_id    text NOT NULL,
+	display_name text NOT NULL,
+	UNIQUE(vendor_id)
+);
+CREATE TABLE product_availability (
+	id           integer primary key AUTOINCREMENT,
+	product_code text NOT NULL,
+	product      integer REFERENCES product(id),
+	vendor       integer REFERENCES vendor(id),
+	UNIQUE(product_code, product, vendor)
+)`
+
+func TestItemSelectLegacy(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	db, err := sqlite3.Open(path.Join(coords.DBPath, coords.DBFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := createTables(db, LEGACY_TABLES); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert into product (barcode, product_desc, is_favorite, posted, account) values (?, 'Cola', 1, ?, 7)", TEST_COLA, sqliteTime(&testTime)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the columns which are missing are selected as null...
+	sql := "select " + ITEM_COLUMNS + " from product where account = $a"
+	if got := itemSelect(db, sql); !strings.Contains(got, "null") || strings.Contains(got, "scan_count") {
+		t.Errorf("itemSelect() = %q, want the missing columns replaced", got)
+	}
+	// ...and read as their defaults
+	items, err := fetchItems(db, sql, sqlite3.NamedArgs{"$a": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("fetchItems() returned %d items, want 1", len(items))
+	}
+	got := items[0]
+	if got.Barcode != TEST_COLA || got.Desc != "Cola" || !got.IsFavorite || !got.PostedTime.Equal(testTime) {
+		t.Errorf("fetchItems()[0] = %+v, want the cola", got)
+	}
+	if got.Quantity != 1 || got.ScanCount != 0 || got.ExpiresAt != nil || got.Note != "" || !got.Updated.IsZero() {
+		t.Errorf("fetchItems()[0] = %+v, want the defaults for the missing columns", got)
+	}
+
+	// once the file is migrated, every column is selected
+	migrated, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	if got := itemSelect(migrated, sql); got != sql {
+		t.Errorf("itemSelect() after the migration = %q, want %q", got, sql)
+	}
+	if items, err := fetchItems(migrated, sql, sqlite3.NamedArgs{"$a": 7}); err != nil || len(items) != 1 || items[0].ScanCount != 1 {
+		t.Errorf("fetchItems() after the migration = %v, %v, want the cola, scanned once", items, err)
+	}
+}
+
+func lockTestFile(t *testing.T, coords ConnCoordinates) func() {
+	t.Helper()
+	locker, err := sqlite3.Open(path.Join(coords.DBPath, coords.DBFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.Exec("begin exclusive"); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			locker.Rollback()
+			locker.Close()
+		})
+	}
+	t.Cleanup(release)
+	return release
+}
+
+func TestInitializeDBRetriesBusy(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE, OpenAttempts: 6, OpenRetryDelay: 10 * time.Millisecond}
+	if !hasProductTable(t, coords) {
+		t.Fatal("InitializeDB() created no tables")
+	}
+
+	// the lock is released while InitializeDB is retrying
+	release := lockTestFile(t, coords)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	db, err := InitializeDB(coords)
+	if err != nil {
+		t.Fatalf("InitializeDB() of the transiently locked file = %v", err)
+	}
+	db.Close()
+}
+
+func TestInitializeDBGivesUpBusy(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE, OpenAttempts: 3, OpenRetryDelay: time.Millisecond}
+	if !hasProductTable(t, coords) {
+		t.Fatal("InitializeDB() created no tables")
+	}
+
+	lockTestFile(t, coords)
+	if db, err := InitializeDB(coords); !isBusy(err) {
+		if db != nil {
+			db.Close()
+		}
+		t.Errorf("InitializeDB() of the locked file = %v, want it busy", err)
+	}
+}
+
+func TestInitializeDBNotADatabase(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE, OpenAttempts: 5, OpenRetryDelay: time.Second}
+	garbage := []byte("this is not a sqlite database, but it is long enough to look like a header of one")
+	if err := os.WriteFile(path.Join(coords.DBPath, coords.DBFile), garbage, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// without waiting for any retry
+	started := time.Now()
+	db, err := InitializeDB(coords)
+	if err == nil || isBusy(err) {
+		t.Errorf("InitializeDB() of a file which is not a database = %v", err)
+	}
+	if db != nil {
+		db.Close()
+	}
+	if elapsed := time.Since(started); elapsed >= coords.OpenRetryDelay {
+		t.Errorf("InitializeDB() failed after %s, having retried", elapsed)
+	}
+}
+
+func TestAddItems(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	if err := AddItems(db, a, nil); err != nil {
+		t.Errorf("AddItems(nil) = %v", err)
+	}
+
+	items := []*Item{{Barcode: TEST_COLA, Desc: "Cola"}, {Barcode: TEST_PENS, Desc: "Pens"}, {Barcode: TEST_GUM, Desc: "Gum"}}
+	if err := AddItems(db, a, items); err != nil {
+		t.Fatal(err)
+	}
+	// in order
+	for k := 1; k < len(items); k++ {
+		if items[k].Id <= items[k-1].Id {
+			t.Errorf("AddItems() set the ids %d, then %d", items[k-1].Id, items[k].Id)
+		}
+	}
+	for _, i := range items {
+		if got, err := GetItemByBarcode(db, a, i.Barcode); err != nil || got == nil || got.Id != i.Id {
+			t.Errorf("GetItemByBarcode(%q) = %+v, %v, want the id %d", i.Barcode, got, err, i.Id)
+		}
+	}
+
+	// none of them, if one fails
+	more := []*Item{{Barcode: TEST_BOOK, Desc: "Book"}, {Barcode: "not a barcode", Desc: "Water"}}
+	if err := AddItems(db, a, more); err == nil {
+		t.Fatal("AddItems() ignored the malformed barcode")
+	}
+	if n, err := CountItems(db, a); err != nil || n != 3 {
+		t.Errorf("CountItems() after the failed AddItems() = %d, %v, want 3", n, err)
+	}
+}
+
+// benchmarkItems returns n Items, each with a distinct description
+func benchmarkItems(n int) []*Item {
+	items := make([]*Item, n)
+	for k := range items {
+		items[k] = &Item{Barcode: TEST_COLA, Desc: "Cola " + strconv.Itoa(k)}
+	}
+	return items
+}
+
+// benchmarkFileDB returns a connection to a new db file, on disk, since
+// the cost of each commit is syncing the file
+func benchmarkFileDB(b *testing.B) (*sqlite3.Conn, *Account) {
+	b.Helper()
+	db, err := InitializeDB(ConnCoordinates{DBPath: b.TempDir(), DBFile: SQLITE_FILE})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db, newTestAccount(b, db, "alice@example.org")
+}
+
+// the import of 100 Items, in a single transaction...
+func BenchmarkAddItems(b *testing.B) {
+	db, a := benchmarkFileDB(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		db.Exec("delete from product")
+		items := benchmarkItems(100)
+		b.StartTimer()
+		if err := AddItems(db, a, items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// ...compared to one transaction per Item
+func BenchmarkAddEach(b *testing.B) {
+	db, a := benchmarkFileDB(b)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		db.Exec("delete from product")
+		items := benchmarkItems(100)
+		b.StartTimer()
+		for _, i := range items {
+			if _, err := i.Add(db, a); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// FILL_HISTORY inserts $n products for the Account, a second apart, every
+// tenth a favorite, in a single statement (rather than through Add, which
+// would take minutes for a large history)
+const FILL_HISTORY = `insert into product (barcode, product_desc, is_favorite, account, posted, updated)
+with recursive k(n) as (select 1 union all select n + 1 from k where n < $n)
+select $b, 'Item ' || n, n % 10 = 0, $a, datetime($t, '+' || n || ' seconds'), $t from k`
+
+// fillHistory adds n Items to the Account's history (see FILL_HISTORY)
+func fillHistory(tb testing.TB, db *sqlite3.Conn, a *Account, n int) {
+	tb.Helper()
+	args := sqlite3.NamedArgs{"$n": n, "$b": TEST_COLA, "$a": a.Id, "$t": sqliteTime(&testTime)}
+	if err := db.Exec(FILL_HISTORY, args); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: SQLITE_FILE}
+	plain, err := sqlite3.Open(SQLITE_MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	defaultSize := countRows(t, plain, "pragma cache_size")
+
+	// zero leaves sqlite's default, otherwise it is set in KB (which
+	// sqlite reports as a negative size)
+	for kb, want := range map[int]int64{0: defaultSize, 8000: -8000} {
+		coords.CacheSizeKB = kb
+		db, err := InitializeDB(coords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := countRows(t, db, "pragma cache_size"); got != want {
+			t.Errorf("CacheSizeKB %d: cache_size = %d, want %d", kb, got, want)
+		}
+		db.Close()
+	}
+}
+
+// the latest page of a long history, read over and over (as by the WebApp),
+// with each cache size
+func BenchmarkCacheSize(b *testing.B) {
+	for _, kb := range []int{0, 500, 8000, 32000} {
+		b.Run(strconv.Itoa(kb)+"KB", func(b *testing.B) {
+			coords := ConnCoordinates{DBPath: b.TempDir(), DBFile: SQLITE_FILE, CacheSizeKB: kb}
+			db, err := InitializeDB(coords)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			a := newTestAccount(b, db, "alice@example.org")
+			fillHistory(b, db, a, 20000)
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := GetItemsPaged(db, a, 500, (n%10)*500); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// queryPlan returns the details of sqlite's plan for the query, one step
+// per line
+func queryPlan(tb testing.TB, db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) string {
+	tb.Helper()
+	steps := make([]string, 0)
+	err := queryRows(db, "explain query plan "+sql, func(s *sqlite3.Stmt) error {
+		var id, order, from int64
+		var detail string
+		if err := s.Scan(&id, &order, &from, &detail); err != nil {
+			return err
+		}
+		steps = append(steps, detail)
+		return nil
+	}, args)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return strings.Join(steps, "\n")
+}
+
+func TestHistoryIndexes(t *testing.T) {
+	db := newTestDB(t)
+	args := sqlite3.NamedArgs{"$a": 1, "$l": 20, "$o": 0}
+	for sql, index := range map[string]string{
+		GET_ITEMS:          "product_account_posted",
+		GET_RECENT_ITEMS:   "product_account_posted",
+		GET_ITEMS_PAGE:     "product_account_posted",
+		GET_FAVORITE_ITEMS: "product_favorite_posted",
+	} {
+		if plan := queryPlan(t, db, sql, args); !strings.Contains(plan, index) {
+			t.Errorf("the plan of %q does not use %s:\n%s", sql, index, plan)
+		}
+	}
+
+	// an existing db file gets them, even without the table definitions
+	for _, index := range []string{"product_account_posted", "product_favorite_posted"} {
+		if err := db.Exec("drop index " + index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := InitializeSchema(db, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "select count(*) from sqlite_master where type = 'index' and name in ('product_account_posted', 'product_favorite_posted')"); n != 2 {
+		t.Errorf("%d of the indexes after the migration, want 2", n)
+	}
+}
+
+// benchmarkHistories returns a db with a long history for each of several
+// Accounts (without the history indexes, unless indexed), and one of them.
+// Its statements are cached, so that only the queries themselves count.
+func benchmarkHistories(b *testing.B, indexed bool) (*sqlite3.Conn, *Account) {
+	b.Helper()
+	db := newTestDB(b)
+	var a *Account
+	for _, email := range []string{"alice@example.org", "bob@example.org", "carol@example.org", "dave@example.org", "erin@example.org"} {
+		a = newTestAccount(b, db, email)
+		fillHistory(b, db, a, 10000)
+	}
+	if !indexed {
+		for _, index := range []string{"product_account_posted", "product_favorite_posted"} {
+			if err := db.Exec("drop index " + index); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	CacheStatements(db)
+	b.Cleanup(func() { ReleaseStatements(db) })
+	return db, a
+}
+
+// the latest scans, and the favorites, of one Account among 50k products
+func benchmarkHistory(b *testing.B, indexed bool) {
+	db, a := benchmarkHistories(b, indexed)
+	b.Run("GetRecentItems", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GetRecentItems(db, a, 20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetFavoriteItems", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GetFavoriteItems(db, a); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkHistoryIndexed(b *testing.B) {
+	benchmarkHistory(b, true)
+}
+
+func BenchmarkHistoryUnindexed(b *testing.B) {
+	benchmarkHistory(b, false)
+}
@@ -0,0 +1,202 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"sync"
+)
+
+const (
+	// Write-ahead logging, which lets readers of the db file proceed
+	// while another connection writes to it (and persists in the file)
+	JOURNAL_WAL = "pragma journal_mode = WAL"
+)
+
+// DB pairs a connection for writing to the db file with a separate,
+// read-only connection to the same file, so that reads (e.g., by the
+// WebApp) do not wait on writes (e.g., by the scanner). This relies on the
+// WAL journal mode, which OpenDB enables: each read then sees a consistent
+// snapshot of the db, as of the start of its statement (or transaction),
+// without any of the writes which are still in progress.
+//
+// A connection is not safe for concurrent use, so neither are the package's
+// functions which take one: several goroutines (e.g., an http handler and
+// the scanner) must share the DB instead, and use each connection only
+// within WithRead or WithWrite (or through the DB's own methods), which
+// take turns on it.
+type DB struct {
+	read  *sqlite3.Conn
+	write *sqlite3.Conn
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+
+	// the (optional) cache of GetItem, see SetItemCacheSize
+	cache      *itemCache
+	cacheMutex sync.RWMutex
+}
+
+// OpenDB initializes the db file defined by the coordinates (see
+// InitializeDB), switches it to WAL mode, and opens its read connection,
+// with the statements of both cached (see CacheStatements), since they
+// last as long as the DB. The caller must Close() the DB when done.
+func OpenDB(coords ConnCoordinates) (_ *DB, err error) {
+	defer wrapError("OpenDB", &err)
+	write, err := InitializeDB(coords)
+	if err != nil {
+		return nil, err
+	}
+	if err = write.Exec(JOURNAL_WAL); err != nil {
+		write.Close()
+		return nil, err
+	}
+
+	read, err := OpenReadOnly(coords)
+	if err != nil {
+		write.Close()
+		return nil, err
+	}
+
+	CacheStatements(read)
+	CacheStatements(write)
+	return &DB{read: read, write: write}, nil
+}
+
+// Read returns the read-only connection, for queries, from a single
+// goroutine (otherwise, see WithRead)
+func (d *DB) Read() *sqlite3.Conn {
+	return d.read
+}
+
+// Write returns the connection for any statement which changes the db, from
+// a single goroutine (otherwise, see WithWrite)
+func (d *DB) Write() *sqlite3.Conn {
+	return d.write
+}
+
+// WithRead calls the function with the read-only connection, once no other
+// goroutine is using it, and returns the function's error
+func (d *DB) WithRead(fn func(db *sqlite3.Conn) error) error {
+	d.readMutex.Lock()
+	defer d.readMutex.Unlock()
+	return fn(d.read)
+}
+
+// WithWrite calls the function with the connection for writes, once no
+// other goroutine is using it, and returns the function's error
+func (d *DB) WithWrite(fn func(db *sqlite3.Conn) error) error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	return fn(d.write)
+}
+
+// AddItem is Item.Add, on the write connection (see WithWrite)
+func (d *DB) AddItem(a *Account, i *Item) (int64, error) {
+	var pk int64
+	err := d.WithWrite(func(db *sqlite3.Conn) error {
+		var err error
+		pk, err = i.Add(db, a)
+		return err
+	})
+	return pk, err
+}
+
+// AddItems is AddItems, on the write connection (see WithWrite), e.g., for
+// a whole pantry inventory, in a single transaction
+func (d *DB) AddItems(a *Account, items []*Item) error {
+	return d.WithWrite(func(db *sqlite3.Conn) error {
+		return AddItems(db, a, items)
+	})
+}
+
+// GetItems is GetItems, on the read connection (see WithRead)
+func (d *DB) GetItems(a *Account) ([]*Item, error) {
+	var items []*Item
+	err := d.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		items, err = GetItems(db, a)
+		return err
+	})
+	return items, err
+}
+
+// GetFavoriteItems is GetFavoriteItems, on the read connection (see WithRead)
+func (d *DB) GetFavoriteItems(a *Account) ([]*Item, error) {
+	var items []*Item
+	err := d.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		items, err = GetFavoriteItems(db, a)
+		return err
+	})
+	return items, err
+}
+
+// GetAccount is GetAccount, on the read connection (see WithRead)
+func (d *DB) GetAccount(email string) (*Account, error) {
+	var a *Account
+	err := d.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		a, err = GetAccount(db, email)
+		return err
+	})
+	return a, err
+}
+
+// GetDesignatedAccount is GetDesignatedAccount, on the write connection
+// (see WithWrite), since it may have to create the anonymous account
+func (d *DB) GetDesignatedAccount() (*Account, error) {
+	var a *Account
+	err := d.WithWrite(func(db *sqlite3.Conn) error {
+		var err error
+		a, err = GetDesignatedAccount(db)
+		return err
+	})
+	return a, err
+}
+
+// BackupTo is BackupTo, on the read connection (see WithRead), so that the
+// scanner can keep writing while the backup is taken
+func (d *DB) BackupTo(destPath string) error {
+	return d.WithRead(func(db *sqlite3.Conn) error {
+		return BackupTo(db, destPath)
+	})
+}
+
+// RestoreFromBackup is RestoreFromBackup, on the write connection (see
+// WithWrite), which also drops any cached Items, since they may not be in
+// the restored db
+func (d *DB) RestoreFromBackup(srcPath string) error {
+	err := d.WithWrite(func(db *sqlite3.Conn) error {
+		return RestoreFromBackup(db, srcPath)
+	})
+	d.cacheMutex.Lock()
+	if d.cache != nil {
+		d.cache = newItemCache(d.cache.size)
+	}
+	d.cacheMutex.Unlock()
+	return err
+}
+
+// Close finalizes the cached statements of both connections, and closes
+// them, returning the first error, if any. The next OpenDB (or InitializeDB)
+// of the same file checks its tables again (see isInitialized).
+func (d *DB) Close() (err error) {
+	defer wrapError("DB.Close", &err)
+	d.readMutex.Lock()
+	defer d.readMutex.Unlock()
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	forgetInitialized(d.write.Path("main"))
+	ReleaseStatements(d.read)
+	ReleaseStatements(d.write)
+	readErr := d.read.Close()
+	writeErr := d.write.Close()
+	if readErr != nil {
+		return readErr
+	}
+	return writeErr
+}
@@ -0,0 +1,165 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDBReadDuringWrite(t *testing.T) {
+	d := newTestFileDB(t)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	addTestItem(t, d.Write(), a, TEST_COLA, "Cola")
+
+	// a write in progress...
+	if err := d.Write().Begin(); err != nil {
+		t.Fatal(err)
+	}
+	addTestItem(t, d.Write(), a, TEST_PENS, "Pens")
+
+	// ...neither blocks a read, nor shows in it
+	start := time.Now()
+	items, err := d.GetItems(a)
+	if err != nil || len(items) != 1 {
+		t.Errorf("GetItems() during a write = %v, %v, want only the cola", items, err)
+	}
+	if elapsed := time.Since(start); elapsed >= DEFAULT_BUSY_TIMEOUT {
+		t.Errorf("GetItems() waited %s for the write", elapsed)
+	}
+
+	// a read transaction keeps its snapshot after the write commits
+	if err := d.Read().Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, d.Read(), "select count(*) from product"); n != 1 {
+		t.Errorf("%d products at the start of the read, want 1", n)
+	}
+	if err := d.Write().Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, d.Read(), "select count(*) from product"); n != 1 {
+		t.Errorf("%d products within the read, after the write, want 1", n)
+	}
+	if err := d.Read().Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := d.GetItems(a); err != nil || len(items) != 2 {
+		t.Errorf("GetItems() after the write = %v, %v, want both", items, err)
+	}
+}
+
+func TestDBReadOnly(t *testing.T) {
+	d := newTestFileDB(t)
+	if err := d.Read().Exec("insert into account (email, api_code) values ('alice@example.org', 'x')"); err == nil {
+		t.Error("the read connection wrote to the db")
+	}
+	var mode string
+	s, err := d.Read().Query("pragma journal_mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("the journal mode is %q, %v, want wal", mode, err)
+	}
+}
+
+func TestDBConcurrent(t *testing.T) {
+	d := newTestFileDB(t)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	barcodes := []string{TEST_COLA, TEST_PENS, TEST_GUM, TEST_BOOK, TEST_WATER}
+
+	const ROUNDS = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*ROUNDS*len(barcodes))
+	wg.Add(2)
+	go func() {
+		// the scanner
+		defer wg.Done()
+		for r := 0; r < ROUNDS; r++ {
+			for _, barcode := range barcodes {
+				i := &Item{Barcode: barcode, Desc: "Round " + string(rune('a'+r))}
+				if _, err := d.AddItem(a, i); err != nil {
+					errs <- err
+				}
+			}
+		}
+	}()
+	go func() {
+		// the WebApp, which never sees the Items go back
+		defer wg.Done()
+		last := 0
+		for r := 0; r < ROUNDS*len(barcodes); r++ {
+			items, err := d.GetItems(a)
+			if err != nil {
+				errs <- err
+				continue
+			}
+			if len(items) < last {
+				t.Errorf("GetItems() returned %d items, after %d", len(items), last)
+			}
+			last = len(items)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if items, err := d.GetItems(a); err != nil || len(items) != ROUNDS*len(barcodes) {
+		t.Errorf("GetItems() = %d items, %v, want %d", len(items), err, ROUNDS*len(barcodes))
+	}
+}
+
+func TestDBManyGoroutines(t *testing.T) {
+	d := newTestFileDB(t)
+	d.SetItemCacheSize(4)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	barcodes := []string{TEST_COLA, TEST_PENS, TEST_GUM, TEST_BOOK, TEST_WATER}
+
+	// each goroutine adds its own Items, and favorites them, while reading
+	// back everyone's, through every kind of DB method
+	const GOROUTINES = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, GOROUTINES*len(barcodes)*5)
+	for g := 0; g < GOROUTINES; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for _, barcode := range barcodes {
+				i := &Item{Barcode: barcode, Desc: "Goroutine " + string(rune('a'+g))}
+				if _, err := d.AddItem(a, i); err != nil {
+					errs <- err
+					continue
+				}
+				if err := d.FavoriteItem(i); err != nil {
+					errs <- err
+				}
+				if got, err := d.GetItem(a, i.Id); err != nil || got.Id != i.Id {
+					errs <- fmt.Errorf("GetItem(%d) = %+v, %v", i.Id, got, err)
+				}
+				if _, err := d.GetItems(a); err != nil {
+					errs <- err
+				}
+				if got, err := d.GetAccount(a.Email); err != nil || got.Id != a.Id {
+					errs <- fmt.Errorf("GetAccount() = %+v, %v", got, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	favorites, err := d.GetFavoriteItems(a)
+	if err != nil || len(favorites) != GOROUTINES*len(barcodes) {
+		t.Errorf("GetFavoriteItems() = %d items, %v, want %d", len(favorites), err, GOROUTINES*len(barcodes))
+	}
+}
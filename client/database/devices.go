@@ -0,0 +1,158 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strings"
+	"time"
+)
+
+const (
+	// The scanners sharing the db (for existing db files; see also tables.sql)
+	CREATE_DEVICES = `CREATE TABLE IF NOT EXISTS device (
+	id           integer primary key AUTOINCREMENT,
+	serial       text NOT NULL,
+	name         text NOT NULL,
+	last_seen    datetime DEFAULT (datetime('now')),
+	UNIQUE(serial)
+)`
+
+	// Prepared Statements
+	// Devices
+	ADD_DEVICE       = "insert or ignore into device (serial, name, last_seen) values ($s, $n, $t)"
+	GET_DEVICE       = "select id, serial, name, strftime('%s', last_seen) from device where serial = $s"
+	GET_DEVICES      = "select id, serial, name, strftime('%s', last_seen) from device order by name collate nocase, id"
+	RENAME_DEVICE    = "update device set name = $n where id = $i"
+	DEVICE_LAST_SEEN = "update device set last_seen = $t where id = $i"
+)
+
+var (
+	ErrEmptySerial = errors.New("device serial must not be empty")
+	ErrEmptyName   = errors.New("device name must not be empty")
+	ErrNoDevice    = errors.New("no such device")
+)
+
+// Device is one of the scanners (e.g., in the kitchen, and in the garage)
+// sharing the db, each of which records which Items it scanned (see
+// Item.DeviceId)
+type Device struct {
+	Id       int64
+	Serial   string // whatever identifies the scanner for good, e.g., its hostname
+	Name     string // for display, e.g., "Kitchen"
+	LastSeen time.Time
+}
+
+// scanDevices converts the rows (selected by GET_DEVICE, GET_DEVICES) into
+// Devices
+func scanDevices(db *sqlite3.Conn, sql string, args ...interface{}) ([]*Device, error) {
+	results := make([]*Device, 0)
+	row := make(sqlite3.RowMap)
+	err := queryRows(db, sql, func(s *sqlite3.Stmt) error {
+		var rowid int64
+		if err := s.Scan(&rowid, row); err != nil {
+			return err
+		}
+
+		result := &Device{Id: rowid}
+		result.Serial, _ = row["serial"].(string)
+		result.Name, _ = row["name"].(string)
+		if seen, found := row["strftime('%s', last_seen)"].(string); found {
+			result.LastSeen, _ = unixTime(seen)
+		}
+		results = append(results, result)
+		return nil
+	}, args...)
+	return results, err
+}
+
+// RegisterDevice returns the Device with this serial, adding it (with the
+// name, or the serial, if the name is empty) if it is new, so each scanner
+// can call it every time it starts. A Device registered already keeps its
+// name (see Rename), and is marked as seen.
+func RegisterDevice(db *sqlite3.Conn, serial, name string) (_ *Device, err error) {
+	defer wrapError("RegisterDevice", &err)
+	serial = strings.TrimSpace(serial)
+	if serial == "" {
+		return nil, ErrEmptySerial
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = serial
+	}
+
+	var device *Device
+	err = withTransaction(db, func() error {
+		args := sqlite3.NamedArgs{"$s": serial, "$n": name, "$t": currentTime()}
+		if err := db.Exec(ADD_DEVICE, args); err != nil {
+			return err
+		}
+		devices, err := scanDevices(db, GET_DEVICE, sqlite3.NamedArgs{"$s": serial})
+		if err != nil {
+			return err
+		}
+		if len(devices) == 0 {
+			return ErrNoDevice
+		}
+		device = devices[0]
+		return device.Seen(db)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// GetDevice returns the Device with this serial, or nil if it has not been
+// registered (see RegisterDevice)
+func GetDevice(db *sqlite3.Conn, serial string) (_ *Device, err error) {
+	defer wrapError("GetDevice", &err)
+	devices, err := scanDevices(db, GET_DEVICE, sqlite3.NamedArgs{"$s": strings.TrimSpace(serial)})
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+	return devices[0], nil
+}
+
+// GetDevices returns all the Devices sharing the db, by name, e.g., for the
+// WebApp to show which of them scanned each Item
+func GetDevices(db *sqlite3.Conn) (_ []*Device, err error) {
+	defer wrapError("GetDevices", &err)
+	return scanDevices(db, GET_DEVICES)
+}
+
+// Rename changes the display name of the Device (its serial never changes),
+// returning ErrNoDevice if there is no such Device
+func (d *Device) Rename(db *sqlite3.Conn, name string) (err error) {
+	defer wrapError("Device.Rename", &err)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrEmptyName
+	}
+	if err = db.Exec(RENAME_DEVICE, sqlite3.NamedArgs{"$i": d.Id, "$n": name}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoDevice
+	}
+	d.Name = name
+	return nil
+}
+
+// Seen records that the Device is in use (i.e., when it scans), as of now
+func (d *Device) Seen(db *sqlite3.Conn) (err error) {
+	defer wrapError("Device.Seen", &err)
+	now := Now()
+	if err = db.Exec(DEVICE_LAST_SEEN, sqlite3.NamedArgs{"$i": d.Id, "$t": sqliteTime(&now)}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoDevice
+	}
+	d.LastSeen = now
+	return nil
+}
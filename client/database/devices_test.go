@@ -0,0 +1,48 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	db := newTestDB(t)
+	kitchen, err := RegisterDevice(db, " pi-kitchen ", "Kitchen")
+	if err != nil || kitchen.Serial != "pi-kitchen" || kitchen.Name != "Kitchen" {
+		t.Fatalf("RegisterDevice() = %+v, %v", kitchen, err)
+	}
+	garage, err := RegisterDevice(db, "pi-garage", "")
+	if err != nil || garage.Name != "pi-garage" {
+		t.Fatalf("RegisterDevice() without a name = %+v, %v, want the serial", garage, err)
+	}
+	// registering again keeps the name
+	if again, err := RegisterDevice(db, "pi-kitchen", "Pantry"); err != nil || again.Id != kitchen.Id || again.Name != "Kitchen" {
+		t.Errorf("RegisterDevice() again = %+v, %v, want the Kitchen", again, err)
+	}
+	if _, err := RegisterDevice(db, " ", "Nowhere"); !errors.Is(err, ErrEmptySerial) {
+		t.Errorf("RegisterDevice() without a serial = %v, want ErrEmptySerial", err)
+	}
+
+	if err := garage.Rename(db, "Garage"); err != nil {
+		t.Fatal(err)
+	}
+	devices, err := GetDevices(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].Name != "Garage" || devices[1].Name != "Kitchen" || devices[1].LastSeen.IsZero() {
+		t.Errorf("GetDevices() = %+v, want the Garage, then the Kitchen", devices)
+	}
+	if d, err := GetDevice(db, "pi-garage"); err != nil || d == nil || d.Id != garage.Id {
+		t.Errorf("GetDevice() = %+v, %v", d, err)
+	}
+	if d, err := GetDevice(db, "pi-attic"); err != nil || d != nil {
+		t.Errorf("GetDevice() of an unknown serial = %+v, %v, want nil", d, err)
+	}
+	if err := (&Device{Id: BAD_PK}).Rename(db, "Attic"); !errors.Is(err, ErrNoDevice) {
+		t.Errorf("Rename() of an unknown Device = %v, want ErrNoDevice", err)
+	}
+}
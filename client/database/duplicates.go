@@ -0,0 +1,71 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// What a duplicate scan does, i.e., one of a barcode the Account has
+	// just saved, or scanned again, within the duplicate window (see
+	// RecentScan), e.g., from a trigger which bounced, or was pulled twice
+	DUPLICATE_IGNORE    = "ignore"    // nothing, except for logging it (see IgnoreScan)
+	DUPLICATE_INCREMENT = "increment" // what any repeated scan does (see RecordQuantityScan)
+	DUPLICATE_INSERT    = "insert"    // saves it again, as another Item
+
+	// The scan_log action of each duplicate scan which was ignored
+	SCAN_IGNORED = "duplicate"
+
+	// Prepared Statements
+	// Duplicate scans
+	GET_RECENT_SCAN = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and barcode = $b and (posted >= $s or updated >= $s) order by posted desc, id desc limit 1"
+	LOG_IGNORED     = "insert into scan_log (account, product, barcode, action, source, device) values ($a, $i, $b, '" + SCAN_IGNORED + "', $s, $v)"
+)
+
+var (
+	DUPLICATE_POLICIES = map[string]bool{
+		DUPLICATE_IGNORE:    true,
+		DUPLICATE_INCREMENT: true,
+		DUPLICATE_INSERT:    true,
+	}
+
+	ErrBadDuplicatePolicy = errors.New("unknown duplicate scan policy")
+)
+
+// RecentScan returns the Account's Item of the barcode if it was saved, or
+// changed (e.g., its quantity, by a repeated scan), within the window, i.e.,
+// if a scan of the barcode now is a duplicate, or else nil. The barcode is
+// normalized first, or rejected if malformed, as by Add.
+func RecentScan(db *sqlite3.Conn, a *Account, barcode string, window time.Duration) (_ *Item, err error) {
+	defer wrapError("RecentScan", &err)
+	if barcode, err = normalizedBarcode(barcode); err != nil {
+		return nil, err
+	}
+	since := Now().Add(-window)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$b": barcode, "$s": sqliteTime(&since)}
+	items, err := fetchItems(db, GET_RECENT_SCAN, args)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// IgnoreScan logs the scan, by the Device (if known, or else zero), as a
+// duplicate of the Account's Item (see RecentScan) which was not recorded,
+// so that the WebApp can still show that it happened (see
+// GetScanEventsAfter), while the Item itself is left as it was
+func IgnoreScan(db *sqlite3.Conn, a *Account, i *Item, deviceId int64) (err error) {
+	defer wrapError("IgnoreScan", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id,
+		"$i": i.Id,
+		"$b": i.Barcode,
+		"$s": sqliteText(i.Source),
+		"$v": sqliteId(deviceId)}
+	return db.Exec(LOG_IGNORED, args)
+}
@@ -0,0 +1,57 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// DBError is the error returned by each of the package's exported functions,
+// naming the operation (e.g., "GetItems", or "Item.Add") which failed. The
+// underlying error (e.g., a *sqlite3.Error, or ErrNoItem) is still reachable
+// with errors.Is and errors.As. A write which fails because the disk is full
+// also matches ErrDiskFull, with errors.Is.
+type DBError struct {
+	Op  string
+	Err error
+}
+
+func (e *DBError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DBError) Is(target error) bool {
+	return target == ErrDiskFull && isDiskFull(e.Err)
+}
+
+// isDiskFull reports whether the error is sqlite's SQLITE_FULL, i.e., there
+// was no room left (e.g., on the Pi's SD card) to write to the db file
+func isDiskFull(err error) bool {
+	var e *sqlite3.Error
+	if errors.As(err, &e) {
+		// mask any extended result code
+		return e.Code()&0xff == sqlite3.FULL
+	}
+	return false
+}
+
+// wrapError wraps the error (if any) in a DBError for the operation. It is
+// deferred by each exported function, on its (named) error result, so an
+// error which is already a DBError keeps the innermost operation, i.e., the
+// one which actually failed.
+func wrapError(op string, err *error) {
+	if *err == nil {
+		return
+	}
+	if _, wrapped := (*err).(*DBError); !wrapped {
+		*err = &DBError{Op: op, Err: *err}
+	}
+}
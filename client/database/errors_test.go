@@ -0,0 +1,64 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestErrDiskFull(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+
+	// no room for more than the pages the db already has
+	pages := countRows(t, db, "pragma page_count")
+	if err := db.Exec("pragma max_page_count = " + strconv.FormatInt(pages, 10)); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for n := 0; n < 100 && err == nil; n++ {
+		i := &Item{Barcode: TEST_COLA, Desc: strings.Repeat("Cola ", 200) + strconv.Itoa(n)}
+		_, err = i.Add(db, a)
+	}
+	if !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("Add() on a full db = %v, want ErrDiskFull", err)
+	}
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) || dbErr.Op != "Item.Add" {
+		t.Fatalf("Add() on a full db = %#v, want a DBError for Item.Add", err)
+	}
+	if !isDiskFull(dbErr.Err) {
+		t.Errorf("the underlying error %v is not SQLITE_FULL", dbErr.Err)
+	}
+
+	// reads still work, and any other error does not match
+	if _, err := GetItems(db, a); err != nil {
+		t.Errorf("GetItems() on a full db = %v", err)
+	}
+	if errors.Is(&DBError{Op: "GetItems", Err: ErrNoItem}, ErrDiskFull) {
+		t.Error("ErrNoItem matches ErrDiskFull")
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	var err error
+	wrapError("Outer", &err)
+	if err != nil {
+		t.Errorf("wrapError(nil) = %v", err)
+	}
+
+	err = ErrNoItem
+	wrapError("Inner", &err)
+	wrapError("Outer", &err)
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) || dbErr.Op != "Inner" || !errors.Is(err, ErrNoItem) {
+		t.Errorf("wrapError() twice = %#v, want the inner DBError, wrapping ErrNoItem", err)
+	}
+	if got, want := err.Error(), "Inner: "+ErrNoItem.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
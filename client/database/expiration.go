@@ -0,0 +1,163 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// the format of an Item's expiration date, as shown (see ExpiryDate)
+	EXPIRY_DATE = "Jan 2"
+
+	// Expiry warnings (for existing db files; see also tables.sql)
+	CREATE_EXPIRY_WARNINGS = `CREATE TABLE IF NOT EXISTS expiry_warning (
+	product integer primary key REFERENCES product(id),
+	account integer REFERENCES account(id),
+	expires datetime NOT NULL,
+	warned  datetime NOT NULL
+)`
+	EXPIRES_INDEX = "CREATE INDEX IF NOT EXISTS product_account_expires ON product(account, expires) WHERE expires IS NOT NULL"
+
+	// Prepared Statements
+	// Product expiration
+	SET_ITEM_EXPIRES       = "update product set expires = $x, updated = $t where id = $i"
+	DELETE_EXPIRED         = "delete from product where expires is not null and expires <= $n"
+	GET_EXPIRING_ITEMS     = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and expires is not null and expires <= $n order by expires"
+	GET_EXPIRY_WARNINGS    = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and expires is not null and expires <= $n and not exists (select 1 from expiry_warning where expiry_warning.product = product.id and expiry_warning.expires = product.expires) order by expires"
+	MARK_EXPIRY_WARNED     = "insert or replace into expiry_warning (product, account, expires, warned) select id, account, expires, $t from product where account = $a and expires is not null and id in ($ids)"
+	DELETE_EXPIRY_WARNINGS = "delete from expiry_warning where account = $a"
+)
+
+// ExpiryWarningFn warns the Account about its Items which are about to
+// expire (or have already), e.g., by email, returning an error if it could
+// not, so that they are included in the next warning instead (see
+// WarnExpiring)
+type ExpiryWarningFn func(a *Account, items []*Item) error
+
+// ExpiresOn returns the expiration time of something good until the given
+// day, i.e., the last second of it
+func ExpiresOn(day time.Time) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, 23, 59, 59, 0, day.Location())
+}
+
+// ExpiryDate is the day the Item expires, as EXPIRY_DATE writes it (in the
+// local time zone), or empty, if it never expires
+func (i *Item) ExpiryDate() string {
+	if i.ExpiresAt == nil {
+		return ""
+	}
+	return i.ExpiresAt.Local().Format(EXPIRY_DATE)
+}
+
+// Expired reports whether the Item has an expiration time, which has passed
+func (i *Item) Expired() bool {
+	return i.ExpiresAt != nil && !i.ExpiresAt.After(Now())
+}
+
+// SetExpires updates the Item with the given expiration time, or clears it,
+// if nil, so that the Item never expires
+func (i *Item) SetExpires(db *sqlite3.Conn, t *time.Time) (err error) {
+	defer wrapError("Item.SetExpires", &err)
+	args := sqlite3.NamedArgs{"$x": sqliteTime(t), "$i": i.Id, "$t": currentTime()}
+	err = db.Exec(SET_ITEM_EXPIRES, args)
+	if err == nil {
+		i.ExpiresAt = t
+	}
+	return err
+}
+
+// SetBarcodeExpires updates the Account's Item with the barcode (the most
+// recent one, see GetItemByBarcode) with the given expiration time, e.g.,
+// from the date barcode scanned after it, and returns it, or ErrNoItem, if
+// the Account has not scanned the barcode
+func SetBarcodeExpires(db *sqlite3.Conn, a *Account, barcode string, t time.Time) (_ *Item, err error) {
+	defer wrapError("SetBarcodeExpires", &err)
+	item, err := GetItemByBarcode(db, a, barcode)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrNoItem
+	}
+	return item, item.SetExpires(db, &t)
+}
+
+// DeleteExpired removes every Item (for all Accounts) which expired at or
+// before the given time, returning the number of Items removed. Items
+// without an expiration time are never affected.
+func DeleteExpired(db *sqlite3.Conn, now time.Time) (_ int64, err error) {
+	defer wrapError("DeleteExpired", &err)
+	args := sqlite3.NamedArgs{"$n": sqliteTime(&now)}
+	n, err := execProducts(db, DELETE_EXPIRED, args)
+	if err == nil {
+		countItems(ITEM_DELETED, n)
+	}
+	return n, err
+}
+
+// GetExpiringItems returns the Items for this Account which expire within
+// the given duration (including those which have already expired, but have
+// not yet been removed by DeleteExpired), soonest first
+func GetExpiringItems(db *sqlite3.Conn, a *Account, within time.Duration) (_ []*Item, err error) {
+	defer wrapError("GetExpiringItems", &err)
+	limit := Now().Add(within)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$n": sqliteTime(&limit)}
+	return fetchItems(db, GET_EXPIRING_ITEMS, args)
+}
+
+// GetExpiryWarnings returns the Items for this Account which expire within
+// the given duration (as GetExpiringItems does), except for those it has
+// been warned about already, at their current expiration time (see
+// MarkExpiryWarned), soonest first
+func GetExpiryWarnings(db *sqlite3.Conn, a *Account, within time.Duration) (_ []*Item, err error) {
+	defer wrapError("GetExpiryWarnings", &err)
+	limit := Now().Add(within)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$n": sqliteTime(&limit)}
+	return fetchItems(db, GET_EXPIRY_WARNINGS, args)
+}
+
+// MarkExpiryWarned records that the Account has been warned about each of
+// its Items which are about to expire, so that GetExpiryWarnings leaves
+// them out, until their expiration time is changed
+func MarkExpiryWarned(db *sqlite3.Conn, a *Account, items []*Item) (err error) {
+	defer wrapError("MarkExpiryWarned", &err)
+	for start := 0; start < len(items); start += MAX_IN_VALUES {
+		end := start + MAX_IN_VALUES
+		if end > len(items) {
+			end = len(items)
+		}
+		ids := make([]int64, 0, end-start)
+		for _, item := range items[start:end] {
+			ids = append(ids, item.Id)
+		}
+		placeholders, args := buildInClause("$id", ids)
+		args["$a"] = a.Id
+		args["$t"] = currentTime()
+		if err := db.Exec(inClause(MARK_EXPIRY_WARNED, placeholders), args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarnExpiring calls the function with the Account's Items which expire
+// within the given duration, and which it has not been warned about yet
+// (see GetExpiryWarnings), if there are any, then marks them as warned
+// (unless the function fails), returning how many there were
+func WarnExpiring(db *sqlite3.Conn, a *Account, within time.Duration, fn ExpiryWarningFn) (_ int, err error) {
+	defer wrapError("WarnExpiring", &err)
+	items, err := GetExpiryWarnings(db, a, within)
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+	if err := fn(a, items); err != nil {
+		return 0, err
+	}
+	return len(items), MarkExpiryWarned(db, a, items)
+}
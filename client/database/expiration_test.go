@@ -0,0 +1,91 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"testing"
+	"time"
+)
+
+// addExpiringItem adds the Item, expiring at the given time (or never, if it
+// is nil), to the Account
+func addExpiringItem(t *testing.T, db *sqlite3.Conn, a *Account, barcode string, expires *time.Time) *Item {
+	t.Helper()
+	i := &Item{Barcode: barcode, Desc: "Item " + barcode, ExpiresAt: expires}
+	if _, err := i.Add(db, a); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestDeleteExpired(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	yesterday := now.Add(-24 * time.Hour)
+	tomorrow := now.Add(24 * time.Hour)
+	expired := addExpiringItem(t, db, a, TEST_COLA, &yesterday)
+	due := addExpiringItem(t, db, a, TEST_PENS, now)
+	fresh := addExpiringItem(t, db, a, TEST_GUM, &tomorrow)
+	never := addExpiringItem(t, db, a, TEST_BOOK, nil)
+
+	n, err := DeleteExpired(db, *now)
+	if err != nil || n != 2 {
+		t.Fatalf("DeleteExpired() = %d, %v, want the 2 expired at, or before, now", n, err)
+	}
+	items, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make(map[int64]bool)
+	for _, i := range items {
+		left[i.Id] = true
+	}
+	if left[expired.Id] || left[due.Id] || !left[fresh.Id] || !left[never.Id] || len(left) != 2 {
+		t.Errorf("DeleteExpired() left %v", items)
+	}
+
+	// a year later, only the one without an expiration time is left
+	if n, err := DeleteExpired(db, now.AddDate(1, 0, 0)); err != nil || n != 1 {
+		t.Errorf("DeleteExpired() a year later = %d, %v, want 1", n, err)
+	}
+	items, err = GetItems(db, a)
+	if err != nil || len(items) != 1 || items[0].Id != never.Id || items[0].ExpiresAt != nil {
+		t.Errorf("GetItems() = %v, %v, want only the item which never expires", items, err)
+	}
+}
+
+func TestGetExpiringItems(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	inAnHour := now.Add(time.Hour)
+	inAWeek := now.Add(7 * 24 * time.Hour)
+	anHourAgo := now.Add(-time.Hour)
+	soon := addExpiringItem(t, db, a, TEST_COLA, &inAnHour)
+	addExpiringItem(t, db, a, TEST_PENS, &inAWeek)
+	gone := addExpiringItem(t, db, a, TEST_GUM, &anHourAgo)
+	addExpiringItem(t, db, a, TEST_BOOK, nil)
+
+	items, err := GetExpiringItems(db, a, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Id != gone.Id || items[1].Id != soon.Id {
+		t.Fatalf("GetExpiringItems(a day) = %v, want the expired one, then the one due in an hour", items)
+	}
+	if items[1].ExpiresAt == nil || !items[1].ExpiresAt.Equal(inAnHour) {
+		t.Errorf("the item due in an hour expires at %v", items[1].ExpiresAt)
+	}
+
+	// once cleared, it never expires
+	if err := soon.SetExpires(db, nil); err != nil || soon.ExpiresAt != nil {
+		t.Fatalf("SetExpires(nil) = %v, left %v", err, soon.ExpiresAt)
+	}
+	items, err = GetExpiringItems(db, a, 24*time.Hour)
+	if err != nil || len(items) != 1 || items[0].Id != gone.Id {
+		t.Errorf("GetExpiringItems() after SetExpires(nil) = %v, %v, want only the expired one", items, err)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The formats of ExportItems and ImportItems
+	FORMAT_JSON = "json"
+	FORMAT_CSV  = "csv"
+
+	// Prepared Statements
+	// Full database export/import
+	EXPORT_ITEMS = "select id, barcode, product_desc, product_ind, is_favorite, is_edit, strftime('%s', posted), strftime('%s', expires), scan_count, strftime('%s', updated), note, raw_payload, quantity from product where account = $a and deleted_at is null order by posted"
+	IMPORT_ITEM  = "insert into product (barcode, product_desc, product_ind, is_favorite, is_edit, posted, expires, account, scan_count, updated, note, raw_payload, quantity) values ($b, $d, $i, $f, $e, $p, $x, $a, $c, $u, $n, $r, $q)"
+)
+
+var (
+	// the columns written by ExportItemsCSV
+	CSV_HEADER = []string{"barcode", "description", "index", "favorite", "posted"}
+
+	ErrBadFormat  = errors.New("unknown format: must be json or csv")
+	ErrNoBarcodes = errors.New("the csv header has no barcode column")
+)
+
+// ExportedAccount is the archive representation of an Account and all of
+// its Items
+type ExportedAccount struct {
+	Email   string          `json:"email"`
+	APICode string          `json:"api_code"`
+	Name    string          `json:"name,omitempty"`
+	Items   []*ExportedItem `json:"items"`
+}
+
+// ExportedItem is the archive representation of a single Item, including
+// the columns which are not part of the Item struct
+type ExportedItem struct {
+	Barcode         string     `json:"barcode"`
+	Desc            string     `json:"desc"`
+	Index           *int64     `json:"index,omitempty"`
+	Favorite        bool       `json:"favorite"`
+	UserContributed bool       `json:"user_contributed"`
+	Posted          time.Time  `json:"posted"`
+	Updated         time.Time  `json:"updated"`
+	Expires         *time.Time `json:"expires,omitempty"`
+	ScanCount       int64      `json:"scan_count"`
+	Note            string     `json:"note,omitempty"`
+	RawPayload      string     `json:"raw_payload,omitempty"`
+	Quantity        *int64     `json:"quantity,omitempty"`
+}
+
+// ExportedDatabase is the archive representation of the whole database
+type ExportedDatabase struct {
+	Accounts []*ExportedAccount `json:"accounts"`
+}
+
+// writeJSON marshals the value and writes it, along with the given suffix
+func writeJSON(w io.Writer, v interface{}, suffix string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, string(b)+suffix)
+	return err
+}
+
+// forEachExportedItem calls the function with each of the Account's Items,
+// oldest first, one row at a time, until it returns an error
+func forEachExportedItem(db *sqlite3.Conn, a *Account, fn func(item *ExportedItem) error) error {
+	args := sqlite3.NamedArgs{"$a": a.Id}
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(EXPORT_ITEMS, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		item := new(ExportedItem)
+		item.Barcode, _ = row["barcode"].(string)
+		item.Desc, _ = row["product_desc"].(string)
+		if ind, found := row["product_ind"].(int64); found {
+			item.Index = &ind
+		}
+		fav, _ := row["is_favorite"].(int64)
+		item.Favorite = (fav == 1)
+		edit, _ := row["is_edit"].(int64)
+		item.UserContributed = (edit == 1)
+		item.ScanCount, _ = row["scan_count"].(int64)
+		item.Note, _ = row["note"].(string)
+		item.RawPayload, _ = row["raw_payload"].(string)
+		if quantity, found := row["quantity"].(int64); found {
+			item.Quantity = &quantity
+		}
+		if posted, found := row["strftime('%s', posted)"].(string); found {
+			item.Posted, _ = unixTime(posted)
+		}
+		if updated, found := row["strftime('%s', updated)"].(string); found {
+			item.Updated, _ = unixTime(updated)
+		}
+		if expires, found := row["strftime('%s', expires)"].(string); found {
+			if t, err := unixTime(expires); err == nil {
+				item.Expires = &t
+			}
+		}
+
+		if fnErr := fn(item); fnErr != nil {
+			s.Close()
+			return fnErr
+		}
+	}
+
+	return queryError(err)
+}
+
+// exportItems streams all the Items for the Account to the writer, as a
+// comma-separated list of json objects, one row at a time
+func exportItems(db *sqlite3.Conn, a *Account, w io.Writer) error {
+	separator := ""
+	return forEachExportedItem(db, a, func(item *ExportedItem) error {
+		if _, err := io.WriteString(w, separator); err != nil {
+			return err
+		}
+		separator = ","
+		return writeJSON(w, item, "")
+	})
+}
+
+// ExportItemsJSON writes all the Items for the Account to the writer (e.g.,
+// a file, or an http response), as a json list of ExportedItem objects,
+// which ImportItemsJSON can read back
+func ExportItemsJSON(db *sqlite3.Conn, a *Account, w io.Writer) (err error) {
+	defer wrapError("ExportItemsJSON", &err)
+	if _, err = io.WriteString(w, "["); err != nil {
+		return err
+	}
+	if err = exportItems(db, a, w); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]\n")
+	return err
+}
+
+// ExportItemsCSV writes all the Items for the Account to the writer, as csv
+// with a header row (see CSV_HEADER), quoting any field which needs it
+func ExportItemsCSV(db *sqlite3.Conn, a *Account, w io.Writer) (err error) {
+	defer wrapError("ExportItemsCSV", &err)
+	out := csv.NewWriter(w)
+	if err = out.Write(CSV_HEADER); err != nil {
+		return err
+	}
+
+	err = forEachExportedItem(db, a, func(item *ExportedItem) error {
+		index := ""
+		if item.Index != nil {
+			index = strconv.FormatInt(*item.Index, 10)
+		}
+		return out.Write([]string{item.Barcode,
+			item.Desc,
+			index,
+			strconv.FormatBool(item.Favorite),
+			item.Posted.Format(time.RFC3339)})
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// ExportItems writes all the Items for the Account to the writer in the
+// format, FORMAT_JSON (see ExportItemsJSON) or FORMAT_CSV (see
+// ExportItemsCSV), e.g., as chosen by the user for a download
+func ExportItems(db *sqlite3.Conn, a *Account, format string, w io.Writer) (err error) {
+	defer wrapError("ExportItems", &err)
+	switch format {
+	case FORMAT_JSON:
+		return ExportItemsJSON(db, a, w)
+	case FORMAT_CSV:
+		return ExportItemsCSV(db, a, w)
+	}
+	return ErrBadFormat
+}
+
+// ExportAll writes every Account, each with all of its Items, to the writer
+// as a single json document (see ExportedDatabase), streaming the Items so
+// that the whole database is never held in memory
+func ExportAll(db *sqlite3.Conn, w io.Writer) (err error) {
+	defer wrapError("ExportAll", &err)
+	accounts, err := GetAllAccounts(db)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w, `{"accounts":[`); err != nil {
+		return err
+	}
+	for j, a := range accounts {
+		if j > 0 {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+
+		// write the Account fields, leaving the Items list open
+		if _, err = io.WriteString(w, `{"email":`); err != nil {
+			return err
+		}
+		if err = writeJSON(w, a.Email, `,"api_code":`); err != nil {
+			return err
+		}
+		if err = writeJSON(w, a.APICode, `,"name":`); err != nil {
+			return err
+		}
+		if err = writeJSON(w, a.Name, `,"items":[`); err != nil {
+			return err
+		}
+		if err = exportItems(db, a, w); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, "]}"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// importItem inserts the archived Item for the Account, as-is
+func importItem(db *sqlite3.Conn, a *Account, item *ExportedItem) error {
+	if item.Posted.IsZero() {
+		// e.g., a csv row without a posted time
+		item.Posted = Now()
+	}
+	if item.Updated.IsZero() {
+		// archived before the updated column existed
+		item.Updated = item.Posted
+	}
+	if item.Quantity == nil {
+		// archived before the quantity column existed
+		quantity := int64(1)
+		item.Quantity = &quantity
+	}
+	args := sqlite3.NamedArgs{"$b": item.Barcode,
+		"$d": item.Desc,
+		"$i": sqliteInt(item.Index),
+		"$f": item.Favorite,
+		"$e": item.UserContributed,
+		"$p": sqliteTime(&item.Posted),
+		"$x": sqliteTime(item.Expires),
+		"$a": a.Id,
+		"$c": item.ScanCount,
+		"$u": sqliteTime(&item.Updated),
+		"$n": item.Note,
+		"$r": item.RawPayload,
+		"$q": *item.Quantity}
+	return db.Exec(IMPORT_ITEM, args)
+}
+
+// importItems adds the archived Items to the Account, in a single
+// transaction, returning how many were imported, and the barcodes of those
+// skipped as duplicates (see ImportItemsJSON). Each barcode is saved in its
+// canonical form, as by Item.Add, keeping the one archived in its
+// RawPayload (if it has none) when they differ.
+func importItems(db *sqlite3.Conn, a *Account, items []*ExportedItem) (int, []string, error) {
+	skipped := make([]string, 0)
+	for j, item := range items {
+		if !ValidBarcode(item.Barcode) {
+			return 0, skipped, fmt.Errorf("item %d (%q): %w", j+1, item.Barcode, ErrBadBarcode)
+		}
+		code, err := normalizedBarcode(item.Barcode)
+		if err != nil {
+			// e.g., barcode.ErrCheckDigit
+			return 0, skipped, fmt.Errorf("item %d (%q): %w", j+1, item.Barcode, err)
+		}
+		if code != item.Barcode && item.RawPayload == "" {
+			item.RawPayload = item.Barcode
+		}
+		item.Barcode = code
+	}
+
+	imported := 0
+	err := withTransaction(db, func() error {
+		for _, item := range items {
+			if getExistingItem(db, a, item.Barcode, item.Desc) != BAD_PK {
+				skipped = append(skipped, item.Barcode)
+				continue
+			}
+			if err := importItem(db, a, item); err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, skipped, err
+	}
+
+	countItems(ITEM_ADDED, int64(imported))
+	if imported > 0 {
+		notifyItemChange(a.Id, ITEM_ADDED)
+	}
+	return imported, skipped, nil
+}
+
+// ImportItemsJSON adds the Items in the json list (of ExportedItem objects,
+// e.g., the "items" of one ExportedAccount) to the Account, in a single
+// transaction, returning how many were imported. Any Item which already
+// exists for the Account (see Item.Add) is skipped, and its barcode is
+// returned in the list of skipped duplicates. A malformed barcode (see
+// ValidBarcode), or one with a wrong check digit, rejects the whole import,
+// and any other error rolls it back.
+func ImportItemsJSON(db *sqlite3.Conn, a *Account, r io.Reader) (_ int, _ []string, err error) {
+	defer wrapError("ImportItemsJSON", &err)
+	items := make([]*ExportedItem, 0)
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return 0, make([]string, 0), err
+	}
+	return importItems(db, a, items)
+}
+
+// ImportItemsCSV is ImportItemsJSON, for csv with a header row naming its
+// columns, in any order: those of CSV_HEADER (e.g., as written by
+// ExportItemsCSV, or by a spreadsheet), of which only the barcode is
+// required, and any others are ignored. The posted time is in RFC3339 (now,
+// if it is empty), and the favorite flag is "true" or "false".
+func ImportItemsCSV(db *sqlite3.Conn, a *Account, r io.Reader) (_ int, _ []string, err error) {
+	defer wrapError("ImportItemsCSV", &err)
+	skipped := make([]string, 0)
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+
+	header, err := in.Read()
+	if err != nil {
+		return 0, skipped, err
+	}
+	columns := make(map[string]int)
+	for j, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = j
+	}
+	if _, found := columns["barcode"]; !found {
+		return 0, skipped, ErrNoBarcodes
+	}
+
+	items := make([]*ExportedItem, 0)
+	for line := 2; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, skipped, err
+		}
+		item, err := csvItem(columns, record)
+		if err != nil {
+			return 0, skipped, fmt.Errorf("line %d: %w", line, err)
+		}
+		items = append(items, item)
+	}
+	return importItems(db, a, items)
+}
+
+// csvItem converts the csv record into the archived Item, using the columns
+// (the position of each of CSV_HEADER, if present) from the header row
+func csvItem(columns map[string]int, record []string) (*ExportedItem, error) {
+	field := func(name string) string {
+		if j, found := columns[name]; found && j < len(record) {
+			return strings.TrimSpace(record[j])
+		}
+		return ""
+	}
+
+	item := &ExportedItem{Barcode: field("barcode"), Desc: SanitizeDescription(field("description"))}
+	if index := field("index"); index != "" {
+		ind, err := strconv.ParseInt(index, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		item.Index = &ind
+	}
+	if favorite := field("favorite"); favorite != "" {
+		fav, err := strconv.ParseBool(favorite)
+		if err != nil {
+			return nil, err
+		}
+		item.Favorite = fav
+	}
+	if posted := field("posted"); posted != "" {
+		t, err := time.Parse(time.RFC3339, posted)
+		if err != nil {
+			return nil, err
+		}
+		item.Posted = t.UTC()
+	}
+	return item, nil
+}
+
+// ImportItems adds the Items read in the format, FORMAT_JSON (see
+// ImportItemsJSON) or FORMAT_CSV (see ImportItemsCSV), to the Account,
+// e.g., from another app's export, or a backup taken before reinstalling
+func ImportItems(db *sqlite3.Conn, a *Account, format string, r io.Reader) (_ int, _ []string, err error) {
+	defer wrapError("ImportItems", &err)
+	switch format {
+	case FORMAT_JSON:
+		return ImportItemsJSON(db, a, r)
+	case FORMAT_CSV:
+		return ImportItemsCSV(db, a, r)
+	}
+	return 0, make([]string, 0), ErrBadFormat
+}
+
+// ImportAll recreates the Accounts and Items written by ExportAll, in a
+// single transaction. It is meant for an empty database: any Account whose
+// email already exists is not merged, but skipped (with all its Items), and
+// its email is returned in the list of collisions, for the caller to report.
+func ImportAll(db *sqlite3.Conn, r io.Reader) (_ []string, err error) {
+	defer wrapError("ImportAll", &err)
+	collisions := make([]string, 0)
+
+	archive := new(ExportedDatabase)
+	if err := json.NewDecoder(r).Decode(archive); err != nil {
+		return collisions, err
+	}
+
+	err = withTransaction(db, func() error {
+		for _, exported := range archive.Accounts {
+			existing, err := GetAccount(db, exported.Email)
+			if err != nil {
+				return err
+			}
+			if existing.Email != "" {
+				collisions = append(collisions, exported.Email)
+				continue
+			}
+
+			a := &Account{Email: exported.Email, APICode: exported.APICode, Name: exported.Name}
+			if err = a.Add(db); err != nil {
+				return err
+			}
+			a.Id = db.LastInsertId()
+
+			for _, item := range exported.Items {
+				if err = importItem(db, a, item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	return collisions, err
+}
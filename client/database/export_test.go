@@ -0,0 +1,75 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/barcode"
+	"strings"
+	"testing"
+)
+
+func TestImportItemsJSONNormalizes(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, "051000012616", "Soup")
+
+	archive := `[{"barcode": "0036000291452", "desc": "Cola"}, {"barcode": "036000291452", "desc": "Cola"}, {"barcode": "0051000012616", "desc": "Soup"}]`
+	n, skipped, err := ImportItemsJSON(db, a, strings.NewReader(archive))
+	if err != nil || n != 1 {
+		t.Fatalf("ImportItemsJSON() = %d, %v, want 1", n, err)
+	}
+	if len(skipped) != 2 || skipped[0] != TEST_COLA || skipped[1] != "051000012616" {
+		t.Errorf("ImportItemsJSON() skipped %v, want the second cola, and the soup", skipped)
+	}
+
+	item, err := GetItemByBarcode(db, a, TEST_COLA)
+	if err != nil || item == nil {
+		t.Fatalf("GetItemByBarcode() after the import = %v, %v", item, err)
+	}
+	if item.Barcode != TEST_COLA || item.RawPayload != "0036000291452" {
+		t.Errorf("the cola was imported as %q (%q), want %q (the archived one)", item.Barcode, item.RawPayload, TEST_COLA)
+	}
+}
+
+func TestImportItemsJSONCheckDigit(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+
+	archive := `[{"barcode": "036000291452", "desc": "Cola"}, {"barcode": "036000291453", "desc": "Typo"}]`
+	n, _, err := ImportItemsJSON(db, a, strings.NewReader(archive))
+	if !errors.Is(err, barcode.ErrCheckDigit) || n != 0 {
+		t.Errorf("ImportItemsJSON() = %d, %v, want barcode.ErrCheckDigit", n, err)
+	}
+	if n, err := CountItems(db, a); err != nil || n != 0 {
+		t.Errorf("the rejected import saved %d items (%v)", n, err)
+	}
+
+	_, _, err = ImportItemsJSON(db, a, strings.NewReader(`[{"barcode": "x y"}]`))
+	if !errors.Is(err, ErrBadBarcode) {
+		t.Errorf("ImportItemsJSON(a malformed barcode) = %v, want ErrBadBarcode", err)
+	}
+}
+
+func TestImportItemsCSVPerAccount(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	b := newTestAccount(t, db, "bob@example.org")
+	addTestItem(t, db, b, TEST_COLA, "Cola")
+
+	// the other Account's Item is not a duplicate
+	const CSV = "barcode,desc\n036000291452,Cola\n"
+	n, skipped, err := ImportItemsCSV(db, a, strings.NewReader(CSV))
+	if err != nil || n != 1 || len(skipped) != 0 {
+		t.Fatalf("ImportItemsCSV() = %d, %v, %v, want 1, and none skipped", n, skipped, err)
+	}
+	// but the Account's own is
+	n, skipped, err = ImportItemsCSV(db, a, strings.NewReader(CSV))
+	if err != nil || n != 0 || len(skipped) != 1 {
+		t.Errorf("ImportItemsCSV() again = %d, %v, %v, want the cola skipped", n, skipped, err)
+	}
+	if n, err := CountItems(db, b); err != nil || n != 1 {
+		t.Errorf("CountItems() of the other account = %d, %v, want 1", n, err)
+	}
+}
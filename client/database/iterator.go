@@ -0,0 +1,93 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+)
+
+// ItemIterator steps through the Items of an Account one row at a time,
+// as a pull-style alternative to reading them all with GetItems, so the
+// caller can stop early: call Next until it returns false, then check Err
+type ItemIterator struct {
+	db      *sqlite3.Conn
+	stmt    *sqlite3.Stmt
+	item    *Item
+	err     error
+	started bool
+}
+
+// NewItemIterator returns an ItemIterator over the Items of the Account,
+// in the same order as GetItems. The caller must Close() it when done,
+// even if it stops before the last Item.
+func NewItemIterator(db *sqlite3.Conn, a *Account) (_ *ItemIterator, err error) {
+	defer wrapError("NewItemIterator", &err)
+	it := &ItemIterator{db: db}
+
+	args := sqlite3.NamedArgs{"$a": a.Id}
+	s, err := db.Query(itemSelect(db, GET_ITEMS), args)
+	if err == io.EOF {
+		// no Items: the iterator is already done
+		return it, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.stmt = s
+	return it, nil
+}
+
+// Next advances to the next Item, returning false once there are no more,
+// or if there is an error (see Err)
+func (it *ItemIterator) Next() bool {
+	it.item = nil
+	if it.stmt == nil {
+		return false
+	}
+	if it.started {
+		if err := it.stmt.Next(); err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			it.Close()
+			return false
+		}
+	}
+	it.started = true
+
+	item, err := scanItem(it.db, it.stmt)
+	if err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	it.item = item
+	return true
+}
+
+// Item returns the current Item, i.e., the one Next advanced to
+func (it *ItemIterator) Item() *Item {
+	return it.item
+}
+
+// Err returns the error which stopped the iteration, if any
+func (it *ItemIterator) Err() (err error) {
+	defer wrapError("ItemIterator.Err", &err)
+	return it.err
+}
+
+// Close finalizes the underlying statement; it is safe to call more than
+// once, and after the iteration has ended
+func (it *ItemIterator) Close() (err error) {
+	defer wrapError("ItemIterator.Close", &err)
+	if it.stmt == nil {
+		return nil
+	}
+	err = it.stmt.Close()
+	it.stmt = nil
+	return err
+}
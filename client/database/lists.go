@@ -0,0 +1,165 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strings"
+)
+
+const (
+	// The list which corresponds to product.is_favorite: its Items are
+	// those flagged as favorites, so Favorite/Unfavorite, FavoriteItems and
+	// GetFavoriteItems all work on it, and nothing needs to be migrated
+	DEFAULT_LIST = "Favorites"
+
+	// Named lists (for existing db files; see also tables.sql)
+	CREATE_LISTS = `CREATE TABLE IF NOT EXISTS list (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	name         text NOT NULL,
+	UNIQUE(account, name)
+)`
+	CREATE_ITEM_LISTS = `CREATE TABLE IF NOT EXISTS item_list (
+	list         integer REFERENCES list(id),
+	product      integer REFERENCES product(id),
+	PRIMARY KEY(list, product)
+)`
+
+	// Prepared Statements
+	ADD_LIST         = "insert or ignore into list (account, name) values ($a, $n)"
+	GET_LIST         = "select id from list where account = $a and name = $n"
+	GET_LISTS        = "select id, name from list where account = $a and name <> $d order by name"
+	ADD_TO_LIST      = "insert or ignore into item_list (list, product) values ($l, $i)"
+	REMOVE_FROM_LIST = "delete from item_list where list = $l and product = $i"
+	GET_LIST_ITEMS   = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and id in (select product from item_list where list = $l) order by posted desc"
+)
+
+var (
+	ErrEmptyTag = errors.New("tag must not be empty")
+)
+
+// getListId returns the pk of the Account's list with the given name, or
+// BAD_PK if there is no such list
+func getListId(db *sqlite3.Conn, a *Account, name string) int64 {
+	args := sqlite3.NamedArgs{"$a": a.Id, "$n": name}
+
+	var id int64 = BAD_PK
+	for s, err := db.Query(GET_LIST, args); err == nil; err = s.Next() {
+		s.Scan(&id)
+	}
+	return id
+}
+
+// GetLists returns the names of all the Account's lists, with DEFAULT_LIST
+// (which always exists) first, and the rest in alphabetical order
+func GetLists(db *sqlite3.Conn, a *Account) (_ []string, err error) {
+	defer wrapError("GetLists", &err)
+	results := []string{DEFAULT_LIST}
+
+	args := sqlite3.NamedArgs{"$a": a.Id, "$d": DEFAULT_LIST}
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_LISTS, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+		if name, found := row["name"].(string); found {
+			results = append(results, name)
+		}
+	}
+
+	return results, queryError(err)
+}
+
+// AddToList adds the Item to the Account's list with the given name,
+// creating the list if it does not exist yet. The Item must belong to the
+// Account (or else ErrNotOwned is returned), and can be in any number of
+// lists; adding it to a list it is already in does nothing.
+func AddToList(db *sqlite3.Conn, a *Account, name string, i *Item) (err error) {
+	defer wrapError("AddToList", &err)
+	if getItemAccount(db, i.Id) != a.Id {
+		return ErrNotOwned
+	}
+	if name == DEFAULT_LIST {
+		return i.Favorite(db)
+	}
+
+	return withTransaction(db, func() error {
+		err := db.Exec(ADD_LIST, sqlite3.NamedArgs{"$a": a.Id, "$n": name})
+		if err != nil {
+			return err
+		}
+		args := sqlite3.NamedArgs{"$l": getListId(db, a, name), "$i": i.Id}
+		return db.Exec(ADD_TO_LIST, args)
+	})
+}
+
+// RemoveFromList removes the Item from the Account's list with the given
+// name; removing it from a list it is not in (or which does not exist)
+// does nothing
+func RemoveFromList(db *sqlite3.Conn, a *Account, name string, i *Item) (err error) {
+	defer wrapError("RemoveFromList", &err)
+	if getItemAccount(db, i.Id) != a.Id {
+		return ErrNotOwned
+	}
+	if name == DEFAULT_LIST {
+		return i.Unfavorite(db)
+	}
+
+	args := sqlite3.NamedArgs{"$l": getListId(db, a, name), "$i": i.Id}
+	return db.Exec(REMOVE_FROM_LIST, args)
+}
+
+// GetItemsInList returns the Items in the Account's list with the given
+// name, most recent first (none, if there is no such list)
+func GetItemsInList(db *sqlite3.Conn, a *Account, name string) (_ []*Item, err error) {
+	defer wrapError("GetItemsInList", &err)
+	if name == DEFAULT_LIST {
+		return GetFavoriteItems(db, a)
+	}
+
+	args := sqlite3.NamedArgs{"$a": a.Id, "$l": getListId(db, a, name)}
+	return fetchItems(db, GET_LIST_ITEMS, args)
+}
+
+// The lists are also the Account's tags (e.g., "pantry", "cleaning", or
+// "restock soon"), for grouping Items more finely than the favorites: each
+// tag is the name of a list, and tagging an Item adds it to that list.
+
+// AddTag tags the Item, which must belong to the Account, with the given
+// (trimmed) tag, creating it if the Account has not used it yet (see
+// AddToList). Tagging it with DEFAULT_LIST favorites it.
+func (i *Item) AddTag(db *sqlite3.Conn, a *Account, tag string) (err error) {
+	defer wrapError("Item.AddTag", &err)
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return ErrEmptyTag
+	}
+	return AddToList(db, a, tag, i)
+}
+
+// RemoveTag removes the (trimmed) tag from the Item, which must belong to
+// the Account (see RemoveFromList); removing a tag it does not have does
+// nothing
+func (i *Item) RemoveTag(db *sqlite3.Conn, a *Account, tag string) (err error) {
+	defer wrapError("Item.RemoveTag", &err)
+	return RemoveFromList(db, a, strings.TrimSpace(tag), i)
+}
+
+// GetItemsByTag returns the Account's Items with the (trimmed) tag, most
+// recent first (see GetItemsInList)
+func GetItemsByTag(db *sqlite3.Conn, a *Account, tag string) (_ []*Item, err error) {
+	defer wrapError("GetItemsByTag", &err)
+	return GetItemsInList(db, a, strings.TrimSpace(tag))
+}
+
+// GetTagsForAccount returns all the tags the Account has used, with
+// DEFAULT_LIST first, and the rest in alphabetical order (see GetLists)
+func GetTagsForAccount(db *sqlite3.Conn, a *Account) (_ []string, err error) {
+	defer wrapError("GetTagsForAccount", &err)
+	return GetLists(db, a)
+}
@@ -0,0 +1,91 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+const (
+	// How MergeAccounts handles a barcode both Accounts have
+	MERGE_KEEP_BOTH   = "keep-both"   // both Accounts' Items are kept (but only one of the very same Items)
+	MERGE_KEEP_NEWEST = "keep-newest" // only the Items of the Account which posted it most recently are kept
+	MERGE_KEEP_TARGET = "keep-target" // only the target Account's Items are kept
+
+	// Prepared Statements
+	// Account merges
+	DELETE_SAME_ITEMS      = "delete from product where account = $x and exists (select 1 from product p where p.account = $y and p.barcode = product.barcode and p.product_desc = product.product_desc)"
+	DELETE_SHARED_BARCODES = "delete from product where account = $x and barcode in (select barcode from product where account = $y)"
+	DELETE_OLDER_BARCODES  = "delete from product where account = $x and barcode in (select barcode from product where account = $y) and (select max(posted) from product p where p.account = $x and p.barcode = product.barcode) <= (select max(posted) from product p where p.account = $y and p.barcode = product.barcode)"
+	MOVE_ACCOUNT_ITEMS     = "update product set account = $y, updated = $t where account = $x"
+)
+
+var (
+	ErrBadStrategy = errors.New("unknown merge strategy")
+	ErrSameAccount = errors.New("cannot merge an account into itself")
+)
+
+// deleteBarcodes runs one of the merge delete statements, for the Items of
+// the Account x which have a barcode the Account y also has
+func deleteBarcodes(db *sqlite3.Conn, sql string, x, y *Account) error {
+	args := sqlite3.NamedArgs{"$x": x.Id, "$y": y.Id}
+	n, err := execProducts(db, sql, args)
+	if err == nil {
+		countItems(ITEM_DELETED, n)
+	}
+	return err
+}
+
+// MergeAccounts moves all the Items of the from Account to the to Account,
+// handling the barcodes they both have according to the strategy (one of
+// the MERGE_* values), in a single transaction which is rolled back on any
+// error. With MERGE_KEEP_NEWEST, the most recent posted time of the barcode
+// on each side decides, and the target wins a tie. The from Account itself
+// (and any of its lists) is left as-is, for the caller to remove.
+func MergeAccounts(db *sqlite3.Conn, from, to *Account, strategy string) (err error) {
+	defer wrapError("MergeAccounts", &err)
+	if from.Id == to.Id {
+		return ErrSameAccount
+	}
+
+	err = withTransaction(db, func() error {
+		switch strategy {
+		case MERGE_KEEP_BOTH:
+			// the target keeps its own copy of an Item both have (i.e.,
+			// the same barcode, and description), since it has only one
+			if err := deleteBarcodes(db, DELETE_SAME_ITEMS, from, to); err != nil {
+				return err
+			}
+		case MERGE_KEEP_TARGET:
+			if err := deleteBarcodes(db, DELETE_SHARED_BARCODES, from, to); err != nil {
+				return err
+			}
+		case MERGE_KEEP_NEWEST:
+			// first drop the from Items which are not newer, so the
+			// barcodes the from Account still shares are those it wins
+			if err := deleteBarcodes(db, DELETE_OLDER_BARCODES, from, to); err != nil {
+				return err
+			}
+			if err := deleteBarcodes(db, DELETE_SHARED_BARCODES, to, from); err != nil {
+				return err
+			}
+		default:
+			return ErrBadStrategy
+		}
+
+		args := sqlite3.NamedArgs{"$x": from.Id, "$y": to.Id}
+		_, err := execProducts(db, MOVE_ACCOUNT_ITEMS, args)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	notifyItemChange(from.Id, ITEM_DELETED)
+	notifyItemChange(to.Id, ITEM_ADDED)
+	return nil
+}
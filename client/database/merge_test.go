@@ -0,0 +1,137 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"testing"
+	"time"
+)
+
+func TestMergeAccountsKeepBoth(t *testing.T) {
+	db := newTestDB(t)
+	from := newTestAccount(t, db, "alice@example.org")
+	to := newTestAccount(t, db, "bob@example.org")
+	addTestItem(t, db, from, TEST_COLA, "Cola")
+	addTestItem(t, db, from, TEST_COLA, "Diet Cola")
+	addTestItem(t, db, from, TEST_PENS, "Pens")
+	cola := addTestItem(t, db, to, TEST_COLA, "Cola")
+
+	if err := MergeAccounts(db, from, to, MERGE_KEEP_BOTH); err != nil {
+		t.Fatal(err)
+	}
+	items, err := GetItems(db, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("GetItems() after the merge = %v, want the 3 distinct items", items)
+	}
+	for _, i := range items {
+		if i.Desc == "Cola" && i.Id != cola.Id {
+			t.Errorf("the merge kept the other cola (%d), want %d", i.Id, cola.Id)
+		}
+	}
+	if n, err := CountItems(db, from); err != nil || n != 0 {
+		t.Errorf("CountItems(from) after the merge = %d, %v, want 0", n, err)
+	}
+}
+
+// mergeBarcodes returns the barcodes of the Account's Items, and the id of
+// the Item (the last one, if more than one) with each
+func mergeBarcodes(t *testing.T, db *sqlite3.Conn, a *Account) map[string]int64 {
+	t.Helper()
+	items, err := GetItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	barcodes := make(map[string]int64)
+	for _, i := range items {
+		barcodes[i.Barcode] = i.Id
+	}
+	return barcodes
+}
+
+func TestMergeAccountsKeepTarget(t *testing.T) {
+	db := newTestDB(t)
+	from := newTestAccount(t, db, "alice@example.org")
+	to := newTestAccount(t, db, "bob@example.org")
+	addTestItem(t, db, from, TEST_COLA, "Diet Cola")
+	pens := addTestItem(t, db, from, TEST_PENS, "Pens")
+	cola := addTestItem(t, db, to, TEST_COLA, "Cola")
+
+	if err := MergeAccounts(db, from, to, MERGE_KEEP_TARGET); err != nil {
+		t.Fatal(err)
+	}
+	got := mergeBarcodes(t, db, to)
+	if len(got) != 2 || got[TEST_COLA] != cola.Id || got[TEST_PENS] != pens.Id {
+		t.Errorf("the target has %v after the merge, want its own cola, and the pens", got)
+	}
+	if n := countRows(t, db, "select count(*) from product"); n != 2 {
+		t.Errorf("%d products after the merge, want 2", n)
+	}
+}
+
+func TestMergeAccountsKeepNewest(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	from := newTestAccount(t, db, "alice@example.org")
+	to := newTestAccount(t, db, "bob@example.org")
+
+	// the target posted the cola first, the pens last, and the gum at
+	// the same time as the other Account
+	addTestItem(t, db, to, TEST_COLA, "Cola")
+	addTestItem(t, db, from, TEST_GUM, "Gum")
+	toGum := addTestItem(t, db, to, TEST_GUM, "Gum, too")
+	*now = now.Add(time.Hour)
+	fromCola := addTestItem(t, db, from, TEST_COLA, "Diet Cola")
+	addTestItem(t, db, from, TEST_PENS, "Pens")
+	*now = now.Add(time.Hour)
+	toPens := addTestItem(t, db, to, TEST_PENS, "Blue Pens")
+
+	if err := MergeAccounts(db, from, to, MERGE_KEEP_NEWEST); err != nil {
+		t.Fatal(err)
+	}
+	got := mergeBarcodes(t, db, to)
+	want := map[string]int64{TEST_COLA: fromCola.Id, TEST_PENS: toPens.Id, TEST_GUM: toGum.Id}
+	if len(got) != len(want) {
+		t.Fatalf("the target has %v after the merge, want %v", got, want)
+	}
+	for barcode, id := range want {
+		if got[barcode] != id {
+			t.Errorf("the target kept the item %d for %s, want %d", got[barcode], barcode, id)
+		}
+	}
+}
+
+func TestMergeAccountsRollback(t *testing.T) {
+	db := newTestDB(t)
+	from := newTestAccount(t, db, "alice@example.org")
+	to := newTestAccount(t, db, "bob@example.org")
+	addTestItem(t, db, from, TEST_COLA, "Cola")
+	addTestItem(t, db, from, TEST_PENS, "Pens")
+	addTestItem(t, db, to, TEST_COLA, "Cola")
+
+	if err := MergeAccounts(db, from, from, MERGE_KEEP_BOTH); !errors.Is(err, ErrSameAccount) {
+		t.Errorf("MergeAccounts(from, from) = %v, want ErrSameAccount", err)
+	}
+	if err := MergeAccounts(db, from, to, "keep-all"); !errors.Is(err, ErrBadStrategy) {
+		t.Errorf("MergeAccounts(\"keep-all\") = %v, want ErrBadStrategy", err)
+	}
+
+	// the move fails after the duplicates are deleted, which are restored
+	if err := db.Exec("CREATE TRIGGER no_moves BEFORE UPDATE OF account ON product BEGIN SELECT RAISE(ABORT, 'no moves'); END"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeAccounts(db, from, to, MERGE_KEEP_TARGET); err == nil {
+		t.Fatal("MergeAccounts() ignored the failed move")
+	}
+	if n, err := CountItems(db, from); err != nil || n != 2 {
+		t.Errorf("CountItems(from) after the failed merge = %d, %v, want 2", n, err)
+	}
+	if n, err := CountItems(db, to); err != nil || n != 1 {
+		t.Errorf("CountItems(to) after the failed merge = %d, %v, want 1", n, err)
+	}
+}
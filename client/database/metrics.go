@@ -0,0 +1,94 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ItemMetrics is a snapshot of the counters kept by this process since it
+// started, for the caller to publish (e.g., in the Prometheus text format)
+type ItemMetrics struct {
+	ItemsAdded       int64
+	ItemsDeleted     int64
+	ItemsFavorited   int64
+	ItemsUnfavorited int64
+	QueryErrors      int64
+
+	// the queries which read Items, or Accounts (e.g., GetItems, or
+	// GetAccount), how long they took altogether (from the statement's
+	// preparation to its last row), and how many of them took at most each
+	// of the QUERY_LATENCY_BUCKETS, i.e., a cumulative histogram
+	Queries      int64
+	QueryTime    time.Duration
+	QueryBuckets []int64
+}
+
+var (
+	// the upper bounds of the query latency histogram (see ItemMetrics)
+	QUERY_LATENCY_BUCKETS = []time.Duration{time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, time.Second, 5 * time.Second}
+
+	// the live counters behind ItemMetrics, only ever updated atomically
+	itemsAdded       int64
+	itemsDeleted     int64
+	itemsFavorited   int64
+	itemsUnfavorited int64
+	queryErrors      int64
+	queries          int64
+	queryNanos       int64
+	queryBuckets     = make([]int64, len(QUERY_LATENCY_BUCKETS))
+)
+
+// Metrics returns the current value of every counter
+func Metrics() ItemMetrics {
+	buckets := make([]int64, len(queryBuckets))
+	for j := range queryBuckets {
+		buckets[j] = atomic.LoadInt64(&queryBuckets[j])
+	}
+	return ItemMetrics{
+		ItemsAdded:       atomic.LoadInt64(&itemsAdded),
+		ItemsDeleted:     atomic.LoadInt64(&itemsDeleted),
+		ItemsFavorited:   atomic.LoadInt64(&itemsFavorited),
+		ItemsUnfavorited: atomic.LoadInt64(&itemsUnfavorited),
+		QueryErrors:      atomic.LoadInt64(&queryErrors),
+		Queries:          atomic.LoadInt64(&queries),
+		QueryTime:        time.Duration(atomic.LoadInt64(&queryNanos)),
+		QueryBuckets:     buckets,
+	}
+}
+
+// countItems adds the number of Items changed to the counter for the kind
+// of change
+func countItems(kind string, n int64) {
+	switch kind {
+	case ITEM_ADDED:
+		atomic.AddInt64(&itemsAdded, n)
+	case ITEM_DELETED:
+		atomic.AddInt64(&itemsDeleted, n)
+	case ITEM_FAVORITED:
+		atomic.AddInt64(&itemsFavorited, n)
+	case ITEM_UNFAVORITED:
+		atomic.AddInt64(&itemsUnfavorited, n)
+	}
+}
+
+// countQueryError records a failed statement
+func countQueryError() {
+	atomic.AddInt64(&queryErrors, 1)
+}
+
+// countQuery records a query which started at the time, and just ended
+func countQuery(started time.Time) {
+	d := time.Since(started)
+	atomic.AddInt64(&queries, 1)
+	atomic.AddInt64(&queryNanos, int64(d))
+	for j, bound := range QUERY_LATENCY_BUCKETS {
+		if d <= bound {
+			atomic.AddInt64(&queryBuckets[j], 1)
+		}
+	}
+}
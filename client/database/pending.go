@@ -0,0 +1,154 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// The Items still to be sent to the API server (for existing db files;
+	// see also tables.sql)
+	CREATE_PENDING_SYNC = `CREATE TABLE IF NOT EXISTS pending_sync (
+	id           integer primary key AUTOINCREMENT,
+	product      integer REFERENCES product(id),
+	attempts     integer DEFAULT 0,
+	last_error   text,
+	queued       datetime DEFAULT (datetime('now')),
+	next_attempt datetime DEFAULT (datetime('now')),
+	synced       datetime,
+	UNIQUE(product)
+)`
+
+	// The sync status of a queued Item (see GetSyncStatus)
+	SYNC_PENDING  = "pending"  // not tried yet
+	SYNC_RETRYING = "retrying" // tried, and failed, at least once
+	SYNC_DONE     = "synced"
+
+	// Prepared Statements
+	// Pending syncs
+	QUEUE_SYNC     = "insert or ignore into pending_sync (product, queued, next_attempt) values ($i, $t, $t)"
+	REQUEUE_SYNC   = "update pending_sync set attempts = 0, last_error = null, queued = $t, next_attempt = $t, synced = null where product = $i and synced is not null"
+	GET_DUE_SYNCS  = "select ps.id, ps.product, p.barcode, p.account, ps.attempts, ps.last_error from pending_sync ps, product p where p.id = ps.product and p.deleted_at is null and ps.synced is null and ps.next_attempt <= $t order by ps.next_attempt, ps.id limit $l"
+	MARK_SYNCED    = "update pending_sync set synced = $t, last_error = null where id = $i"
+	MARK_SYNC_FAIL = "update pending_sync set attempts = attempts + 1, last_error = $e, next_attempt = $n where id = $i"
+	GET_SYNC_STATE = "select ps.product, ps.attempts, ps.synced from pending_sync ps, product p where p.id = ps.product and p.account = $a"
+	COUNT_UNSYNCED = "select count(*) from pending_sync where synced is null"
+)
+
+// PendingSync is an Item queued to be sent to the API server (e.g., for a
+// barcode scanned while the Pi had no network), until it is
+type PendingSync struct {
+	Id        int64
+	ItemId    int64
+	Barcode   string
+	AccountId int64
+	Attempts  int64  // how many times sending it has failed
+	LastError string // why it failed the last time
+}
+
+// QueueItemSync adds the Item to the queue of Items to be sent to the API
+// server (see GetDueSyncs), to be tried as soon as possible. Queueing an
+// Item which is queued already does nothing, and one which was synced
+// already is queued again.
+func QueueItemSync(db *sqlite3.Conn, i *Item) (err error) {
+	defer wrapError("QueueItemSync", &err)
+	return withTransaction(db, func() error {
+		args := sqlite3.NamedArgs{"$i": i.Id, "$t": currentTime()}
+		if err := db.Exec(QUEUE_SYNC, args); err != nil {
+			return err
+		}
+		return db.Exec(REQUEUE_SYNC, args)
+	})
+}
+
+// GetDueSyncs returns (at most limit of) the queued Items which are due to
+// be sent, i.e., not synced yet, and not waiting to be retried, the
+// longest waiting first. Items deleted since they were queued are skipped.
+func GetDueSyncs(db *sqlite3.Conn, limit int) (_ []*PendingSync, err error) {
+	defer wrapError("GetDueSyncs", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	results := make([]*PendingSync, 0)
+
+	args := sqlite3.NamedArgs{"$t": currentTime(), "$l": limit}
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_DUE_SYNCS, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &PendingSync{Id: rowid}
+		result.ItemId, _ = row["product"].(int64)
+		result.Barcode, _ = row["barcode"].(string)
+		result.AccountId, _ = row["account"].(int64)
+		result.Attempts, _ = row["attempts"].(int64)
+		result.LastError, _ = row["last_error"].(string)
+		results = append(results, result)
+	}
+
+	return results, queryError(err)
+}
+
+// Synced records that the queued Item was sent, so it is not sent again
+// (unless it is queued again)
+func (p *PendingSync) Synced(db *sqlite3.Conn) (err error) {
+	defer wrapError("PendingSync.Synced", &err)
+	return db.Exec(MARK_SYNCED, sqlite3.NamedArgs{"$i": p.Id, "$t": currentTime()})
+}
+
+// Failed records that sending the queued Item failed, with the error, and
+// when it is due to be retried
+func (p *PendingSync) Failed(db *sqlite3.Conn, syncErr error, retryAt time.Time) (err error) {
+	defer wrapError("PendingSync.Failed", &err)
+	args := sqlite3.NamedArgs{"$i": p.Id, "$e": syncErr.Error(), "$n": sqliteTime(&retryAt)}
+	if err = db.Exec(MARK_SYNC_FAIL, args); err != nil {
+		return err
+	}
+	p.Attempts += 1
+	p.LastError = syncErr.Error()
+	return nil
+}
+
+// GetSyncStatus returns the sync status (SYNC_PENDING, SYNC_RETRYING, or
+// SYNC_DONE) of each of the Account's Items which have been queued, by Item
+// id, e.g., for the WebApp to show which Items are still waiting for the API
+// server. Items which were never queued are not included.
+func GetSyncStatus(db *sqlite3.Conn, a *Account) (_ map[int64]string, err error) {
+	defer wrapError("GetSyncStatus", &err)
+	results := make(map[int64]string)
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_SYNC_STATE, sqlite3.NamedArgs{"$a": a.Id})
+	for ; err == nil; err = s.Next() {
+		var product int64
+		s.Scan(&product, row)
+
+		status := SYNC_PENDING
+		if _, synced := row["synced"].(string); synced {
+			status = SYNC_DONE
+		} else if attempts, _ := row["attempts"].(int64); attempts > 0 {
+			status = SYNC_RETRYING
+		}
+		results[product] = status
+	}
+
+	return results, queryError(err)
+}
+
+// CountUnsynced returns how many queued Items (for all Accounts) have not
+// been sent yet
+func CountUnsynced(db *sqlite3.Conn) (_ int64, err error) {
+	defer wrapError("CountUnsynced", &err)
+	var count int64
+	s, err := db.Query(COUNT_UNSYNCED)
+	for ; err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count, queryError(err)
+}
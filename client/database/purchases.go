@@ -0,0 +1,362 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The currency of a Purchase which does not give one
+	DEFAULT_CURRENCY = "USD"
+
+	// Purchases (for existing db files; see also tables.sql)
+	CREATE_PURCHASES = `CREATE TABLE IF NOT EXISTS purchase (
+	id            integer primary key AUTOINCREMENT,
+	account       integer REFERENCES account(id),
+	barcode       text,
+	product_desc  text,
+	price         integer NOT NULL,
+	currency      text NOT NULL,
+	store         text,
+	quantity      integer DEFAULT 1,
+	purchased     datetime DEFAULT (datetime('now')),
+	shopping_item integer
+)`
+	PURCHASE_BARCODE_INDEX = "CREATE INDEX IF NOT EXISTS purchase_barcode ON purchase(barcode, purchased)"
+
+	// Prepared Statements
+	// Prices paid
+	PURCHASE_COLUMNS      = "id, account, barcode, product_desc, price, currency, store, quantity, strftime('%s', purchased), shopping_item"
+	ADD_PURCHASE          = "insert into purchase (account, barcode, product_desc, price, currency, store, quantity, purchased, shopping_item) values ($a, $b, $d, $p, $c, $s, $q, $t, $i)"
+	GET_PRICE_HISTORY     = "select " + PURCHASE_COLUMNS + " from purchase where barcode = $b order by purchased desc, id desc"
+	GET_ACCOUNT_PRICES    = "select " + PURCHASE_COLUMNS + " from purchase where barcode = $b and account = $a order by purchased desc, id desc"
+	GET_STORES            = "select store, max(purchased) from purchase where account = $a and store is not null group by store order by max(purchased) desc"
+	GET_LAST_CURRENCY     = "select currency from purchase where account = $a order by purchased desc, id desc limit 1"
+	DELETE_PURCHASE       = "delete from purchase where id = $i and account = $a"
+	DELETE_ITEM_PURCHASES = "delete from purchase where shopping_item = $i"
+	DELETE_PURCHASES      = "delete from purchase where account = $a"
+)
+
+var (
+	ErrBadPrice    = errors.New("price must be an amount, e.g., 3.49, of no less than zero")
+	ErrBadCurrency = errors.New("currency must be a three letter code, e.g., USD")
+	ErrBadPurchase = errors.New("the purchase needs a barcode, or a description")
+	ErrNoPurchase  = errors.New("no such purchase")
+
+	// a currency code (ISO 4217)
+	CURRENCY_FORMAT = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	// a price as it is typed, with at most two decimal places
+	PRICE_FORMAT = regexp.MustCompile(`^([0-9]+)(?:[.,]([0-9]{1,2}))?$`)
+)
+
+// Purchase is one price paid for (each of) an Item, or anything bought
+type Purchase struct {
+	Id             int64
+	AccountId      int64
+	Barcode        string // empty for something bought which was never scanned
+	Desc           string
+	Price          int64 // for each one, in hundredths of the Currency (e.g., cents)
+	Currency       string
+	Store          string // where it was bought, if known
+	Quantity       int64
+	Purchased      time.Time
+	ShoppingItemId int64 // the ShoppingItem it was bought as (see ShoppingItem.Buy), zero if none
+}
+
+// ParsePrice converts a price as typed (e.g., "3.49", "3,49", or "3") into
+// hundredths, e.g., 349, for a Purchase
+func ParsePrice(s string) (int64, error) {
+	m := PRICE_FORMAT.FindStringSubmatch(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "$")))
+	if m == nil {
+		return 0, ErrBadPrice
+	}
+	units, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, ErrBadPrice
+	}
+	fraction := m[2]
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+	hundredths, _ := strconv.ParseInt(fraction, 10, 64)
+	return units*100 + hundredths, nil
+}
+
+// FormatPrice is the reverse of ParsePrice, e.g., 349 becomes "3.49"
+func FormatPrice(price int64) string {
+	sign := ""
+	if price < 0 {
+		sign, price = "-", -price
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, price/100, price%100)
+}
+
+// FormattedPrice is the Purchase's Price, as FormatPrice writes it
+func (p *Purchase) FormattedPrice() string {
+	return FormatPrice(p.Price)
+}
+
+// RecordPurchase saves the price the Account paid for the Purchase, which
+// must have a barcode or a description, defaulting its Currency (to
+// DEFAULT_CURRENCY), Quantity (to one), and Purchased time (to Now), and
+// returns its id
+func RecordPurchase(db *sqlite3.Conn, a *Account, p *Purchase) (_ int64, err error) {
+	defer wrapError("RecordPurchase", &err)
+	p.Barcode = strings.TrimSpace(p.Barcode)
+	p.Desc = SanitizeDescription(p.Desc)
+	p.Store = SanitizeDescription(p.Store)
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if p.Barcode == "" && p.Desc == "" {
+		return BAD_PK, ErrBadPurchase
+	}
+	if p.Barcode != "" && !ValidBarcode(p.Barcode) {
+		return BAD_PK, ErrBadBarcode
+	}
+	if p.Price < 0 {
+		return BAD_PK, ErrBadPrice
+	}
+	if p.Currency == "" {
+		p.Currency = DEFAULT_CURRENCY
+	}
+	if !CURRENCY_FORMAT.MatchString(p.Currency) {
+		return BAD_PK, ErrBadCurrency
+	}
+	if p.Quantity < 1 {
+		p.Quantity = 1
+	}
+	if p.Purchased.IsZero() {
+		p.Purchased = Now()
+	}
+	p.Purchased = p.Purchased.UTC().Truncate(time.Second)
+
+	args := sqlite3.NamedArgs{"$a": a.Id,
+		"$b": nullString(p.Barcode),
+		"$d": nullString(p.Desc),
+		"$p": p.Price,
+		"$c": p.Currency,
+		"$s": nullString(p.Store),
+		"$q": p.Quantity,
+		"$t": sqliteTime(&p.Purchased),
+		"$i": nil}
+	if p.ShoppingItemId != 0 {
+		args["$i"] = p.ShoppingItemId
+	}
+	if err := db.Exec(ADD_PURCHASE, args); err != nil {
+		return BAD_PK, err
+	}
+	p.Id = db.LastInsertId()
+	p.AccountId = a.Id
+	return p.Id, nil
+}
+
+// nullString is the arg to bind to a text column which can be null, for an
+// empty string
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// DeletePurchase removes the Account's Purchase with the given id, e.g., a
+// price entered by mistake, or returns ErrNoPurchase
+func DeletePurchase(db *sqlite3.Conn, a *Account, id int64) (err error) {
+	defer wrapError("DeletePurchase", &err)
+	if err := db.Exec(DELETE_PURCHASE, sqlite3.NamedArgs{"$i": id, "$a": a.Id}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoPurchase
+	}
+	return nil
+}
+
+// GetPriceHistory returns every price paid for the barcode, by any of the
+// Accounts (the prices in a store are the same for everyone in the house),
+// most recent first
+func GetPriceHistory(db *sqlite3.Conn, barcode string) (_ []*Purchase, err error) {
+	defer wrapError("GetPriceHistory", &err)
+	return fetchPurchases(db, GET_PRICE_HISTORY, sqlite3.NamedArgs{"$b": strings.TrimSpace(barcode)})
+}
+
+// GetAccountPriceHistory is GetPriceHistory, but only the prices the
+// Account itself paid
+func GetAccountPriceHistory(db *sqlite3.Conn, a *Account, barcode string) (_ []*Purchase, err error) {
+	defer wrapError("GetAccountPriceHistory", &err)
+	return fetchPurchases(db, GET_ACCOUNT_PRICES, sqlite3.NamedArgs{"$b": strings.TrimSpace(barcode), "$a": a.Id})
+}
+
+func fetchPurchases(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) ([]*Purchase, error) {
+	results := make([]*Purchase, 0)
+	row := make(sqlite3.RowMap)
+	err := queryRows(db, sql, func(s *sqlite3.Stmt) error {
+		var rowid int64
+		if err := s.Scan(&rowid, row); err != nil {
+			return err
+		}
+
+		result := &Purchase{Id: rowid}
+		result.AccountId, _ = row["account"].(int64)
+		result.Barcode, _ = row["barcode"].(string)
+		result.Desc, _ = row["product_desc"].(string)
+		result.Price, _ = row["price"].(int64)
+		result.Currency, _ = row["currency"].(string)
+		result.Store, _ = row["store"].(string)
+		result.Quantity, _ = row["quantity"].(int64)
+		if purchased := optionalTime(row, "strftime('%s', purchased)"); purchased != nil {
+			result.Purchased = *purchased
+		}
+		result.ShoppingItemId, _ = row["shopping_item"].(int64)
+		results = append(results, result)
+		return nil
+	}, args)
+	return results, err
+}
+
+// GetStores returns the names of the stores where the Account has bought
+// anything, the most recent first
+func GetStores(db *sqlite3.Conn, a *Account) (_ []string, err error) {
+	defer wrapError("GetStores", &err)
+	results := make([]string, 0)
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_STORES, sqlite3.NamedArgs{"$a": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+		if store, found := row["store"].(string); found {
+			results = append(results, store)
+		}
+	}
+
+	return results, queryError(err)
+}
+
+// GetLastCurrency returns the currency the Account last paid in, or
+// DEFAULT_CURRENCY, if it has no Purchases
+func GetLastCurrency(db *sqlite3.Conn, a *Account) (_ string, err error) {
+	defer wrapError("GetLastCurrency", &err)
+	currency := DEFAULT_CURRENCY
+	s, err := db.Query(GET_LAST_CURRENCY, sqlite3.NamedArgs{"$a": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&currency)
+	}
+	return currency, queryError(err)
+}
+
+// PriceSummary sums up the prices paid for a barcode in one currency
+type PriceSummary struct {
+	Currency      string
+	Purchases     int
+	Last          *Purchase
+	Average       int64 // of the price of each one, over all the Purchases
+	Lowest        *Purchase
+	CheapestStore string // the store with the lowest average price, empty if none are known
+	StoreAverage  int64  // that lowest average price
+}
+
+// FormattedAverage is the Average price, as FormatPrice writes it
+func (s *PriceSummary) FormattedAverage() string {
+	return FormatPrice(s.Average)
+}
+
+// FormattedStoreAverage is the StoreAverage price, as FormatPrice writes it
+func (s *PriceSummary) FormattedStoreAverage() string {
+	return FormatPrice(s.StoreAverage)
+}
+
+// SummarizePrices sums up the Purchases (most recent first, as
+// GetPriceHistory returns them), in each currency, the currency last paid
+// in first
+func SummarizePrices(purchases []*Purchase) []*PriceSummary {
+	summaries := make([]*PriceSummary, 0)
+	byCurrency := make(map[string]*PriceSummary)
+	totals := make(map[string]int64)
+	storeTotals := make(map[string]map[string][]int64) // currency, then store: the total price, and the count
+
+	for _, p := range purchases {
+		summary, found := byCurrency[p.Currency]
+		if !found {
+			summary = &PriceSummary{Currency: p.Currency, Last: p}
+			byCurrency[p.Currency] = summary
+			summaries = append(summaries, summary)
+			storeTotals[p.Currency] = make(map[string][]int64)
+		}
+		summary.Purchases += 1
+		totals[p.Currency] += p.Price
+		if summary.Lowest == nil || p.Price < summary.Lowest.Price {
+			summary.Lowest = p
+		}
+		if p.Store != "" {
+			t, found := storeTotals[p.Currency][p.Store]
+			if !found {
+				t = []int64{0, 0}
+				storeTotals[p.Currency][p.Store] = t
+			}
+			t[0] += p.Price
+			t[1] += 1
+		}
+	}
+
+	for _, summary := range summaries {
+		summary.Average = (totals[summary.Currency] + int64(summary.Purchases)/2) / int64(summary.Purchases)
+
+		stores := make([]string, 0, len(storeTotals[summary.Currency]))
+		for store := range storeTotals[summary.Currency] {
+			stores = append(stores, store)
+		}
+		sort.Strings(stores) // so a tie goes to the same store every time
+		for _, store := range stores {
+			t := storeTotals[summary.Currency][store]
+			average := (t[0] + t[1]/2) / t[1]
+			if summary.CheapestStore == "" || average < summary.StoreAverage {
+				summary.CheapestStore, summary.StoreAverage = store, average
+			}
+		}
+	}
+	return summaries
+}
+
+// GetPriceSummary sums up the prices paid for the barcode (see
+// GetPriceHistory, and SummarizePrices)
+func GetPriceSummary(db *sqlite3.Conn, barcode string) (_ []*PriceSummary, err error) {
+	defer wrapError("GetPriceSummary", &err)
+	history, err := GetPriceHistory(db, barcode)
+	if err != nil {
+		return nil, err
+	}
+	return SummarizePrices(history), nil
+}
+
+// Buy moves the item, which must be on the Account's open shopping list,
+// to SHOPPING_PURCHASED (see MoveTo), recording the price paid for it, if
+// there is one (see RecordPurchase), all or nothing. Moving it back out of
+// the purchased state later deletes the price again.
+func (s *ShoppingItem) Buy(db *sqlite3.Conn, a *Account, price *Purchase) (err error) {
+	defer wrapError("ShoppingItem.Buy", &err)
+	return withTransaction(db, func() error {
+		if err := s.MoveTo(db, a, SHOPPING_PURCHASED); err != nil {
+			return err
+		}
+		if price == nil {
+			return nil
+		}
+		price.Barcode, price.Desc, price.Quantity, price.ShoppingItemId = s.Barcode, s.Desc, s.Quantity, s.Id
+		if s.PurchasedAt != nil {
+			price.Purchased = *s.PurchasedAt
+		}
+		_, err := RecordPurchase(db, a, price)
+		return err
+	})
+}
@@ -0,0 +1,120 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+const (
+	// What a repeated scan of a barcode means, for each Account (see
+	// RecordQuantityScan): one more of it in the pantry, or one of them
+	// used up
+	SCAN_RESTOCK = "restock" // the default
+	SCAN_CONSUME = "consume"
+
+	// Prepared Statements
+	// Per-account scan modes
+	GET_SCAN_MODE = "select scan_mode from account where id = $i"
+	SET_SCAN_MODE = "update account set scan_mode = $m where id = $i"
+)
+
+var (
+	// the change in quantity of a repeated scan, in each scan mode
+	SCAN_MODE_DELTAS = map[string]int64{
+		SCAN_RESTOCK: 1,
+		SCAN_CONSUME: -1,
+	}
+
+	ErrBadScanMode = errors.New("unknown scan mode")
+)
+
+// DecrementQuantity subtracts the delta from the Item's stored quantity
+// (e.g., when some are used up), like IncrementQuantity, so it returns
+// ErrNegativeQuantity (and changes nothing) if there are not that many left
+func (i *Item) DecrementQuantity(db *sqlite3.Conn, delta int64) (err error) {
+	defer wrapError("Item.DecrementQuantity", &err)
+	return i.IncrementQuantity(db, -delta)
+}
+
+// ScanMode returns what a repeated scan means for this Account, i.e., one of
+// SCAN_MODE_DELTAS (SCAN_RESTOCK, unless SetScanMode has changed it), or
+// ErrNoAccount if there is no such Account
+func (a *Account) ScanMode(db *sqlite3.Conn) (_ string, err error) {
+	defer wrapError("Account.ScanMode", &err)
+	found := false
+	mode := SCAN_RESTOCK
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_SCAN_MODE, sqlite3.NamedArgs{"$i": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+		found = true
+		if m, ok := row["scan_mode"].(string); ok && m != "" {
+			mode = m
+		}
+	}
+	if err = queryError(err); err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrNoAccount
+	}
+	return mode, nil
+}
+
+// SetScanMode changes what a repeated scan means for this Account (see
+// RecordQuantityScan), to one of SCAN_MODE_DELTAS, e.g., SCAN_CONSUME for a
+// scanner by the kitchen bin, rather than the pantry shelf
+func (a *Account) SetScanMode(db *sqlite3.Conn, mode string) (err error) {
+	defer wrapError("Account.SetScanMode", &err)
+	if _, found := SCAN_MODE_DELTAS[mode]; !found {
+		return ErrBadScanMode
+	}
+	args := sqlite3.NamedArgs{"$i": a.Id, "$m": mode}
+	if err = db.Exec(SET_SCAN_MODE, args); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoAccount
+	}
+	return nil
+}
+
+// RecordQuantityScan is the alternative to saving another Item for a
+// barcode the Account has already scanned: it changes the quantity of the
+// saved Item (the most recent one, if Add saved several products for it)
+// according to the Account's ScanMode, one added or one used up, and
+// returns it. It returns nil (and changes nothing) if the barcode is new to
+// the Account, for the caller to look it up and Add it, and
+// ErrNegativeQuantity if it is consumed with none of it left. The barcode
+// is normalized first, or rejected if malformed, as by Add.
+func RecordQuantityScan(db *sqlite3.Conn, a *Account, barcode string) (_ *Item, err error) {
+	defer wrapError("RecordQuantityScan", &err)
+	if barcode, err = normalizedBarcode(barcode); err != nil {
+		return nil, err
+	}
+	var item *Item
+	err = withTransaction(db, func() error {
+		mode, err := a.ScanMode(db)
+		if err != nil {
+			return err
+		}
+		delta, found := SCAN_MODE_DELTAS[mode]
+		if !found {
+			return ErrBadScanMode
+		}
+
+		if item, err = GetItemByBarcode(db, a, barcode); err != nil || item == nil {
+			return err
+		}
+		return item.IncrementQuantity(db, delta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
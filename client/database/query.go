@@ -0,0 +1,191 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strings"
+	"time"
+)
+
+const (
+	// ItemQuery orders
+	ORDER_NEWEST = "newest" // the default
+	ORDER_OLDEST = "oldest"
+	ORDER_DESC   = "description"
+	ORDER_CODE   = "barcode"
+
+	// Prepared Statements
+	// The filters each ItemQuery field adds (when set) to QUERY_ITEMS
+	QUERY_ITEMS        = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null"
+	COUNT_QUERY_ITEMS  = "select count(*) from product where account = $a and deleted_at is null"
+	FILTER_FAVORITE    = "is_favorite = $f"
+	FILTER_SINCE       = "posted >= $s"
+	FILTER_UNTIL       = "posted <= $u"
+	FILTER_LIST        = "id in (select product from item_list where list = $l)"
+	FILTER_INDICATOR   = "product_ind = $i"
+	FILTER_DEVICE      = "device = $v"
+	FILTER_SEARCH      = "(product_desc like $q escape '\\' or barcode like $q escape '\\')"
+	FILTER_LIMIT       = " limit $n offset $o"
+	FILTER_NO_LIMIT    = " limit -1 offset $o"
+	FILTER_CONJUNCTION = " and "
+	FILTER_ORDER       = " order by "
+	FILTER_FAVS_FIRST  = "is_favorite desc, "
+)
+
+var (
+	// the order by columns for each of the ItemQuery orders
+	ITEM_QUERY_ORDERS = map[string]string{
+		ORDER_NEWEST: "posted desc, id desc",
+		ORDER_OLDEST: "posted, id",
+		ORDER_DESC:   "product_desc collate nocase, id",
+		ORDER_CODE:   "barcode, id",
+	}
+
+	ErrBadOrder  = errors.New("unknown item query order")
+	ErrBadOffset = errors.New("offset must not be negative")
+)
+
+// ItemQuery combines any of the filters on an Account's Items: each field
+// which is set (i.e., not nil or empty) narrows the Items returned
+// by QueryItemsFiltered, and the others are ignored
+type ItemQuery struct {
+	Favorite  *bool
+	Since     *time.Time // posted at or after
+	Until     *time.Time // posted at or before
+	Tag       string     // the name of a list (see GetLists)
+	Indicator *int64
+	Device    int64  // the id of the Device which scanned it (see GetDevices)
+	Search    string // in the description or the barcode
+	Limit     int    // zero means no limit
+	Offset    int
+	Order     string // one of ITEM_QUERY_ORDERS, ORDER_NEWEST by default
+
+	FavoritesFirst bool // all the favorites, in order, before the rest
+}
+
+// itemQueryFilters returns the conditions (after QUERY_ITEMS, or
+// COUNT_QUERY_ITEMS) and their args for the filters set in the query, or
+// false if no Item could possibly match them
+func itemQueryFilters(db *sqlite3.Conn, a *Account, q ItemQuery) ([]string, sqlite3.NamedArgs, bool) {
+	filters := make([]string, 0)
+	args := sqlite3.NamedArgs{"$a": a.Id}
+
+	// the default list is the favorites (see lists.go)
+	if q.Tag == DEFAULT_LIST {
+		if q.Favorite != nil && !*q.Favorite {
+			return filters, args, false
+		}
+		favorite := true
+		q.Favorite = &favorite
+	} else if q.Tag != "" {
+		filters = append(filters, FILTER_LIST)
+		args["$l"] = getListId(db, a, q.Tag)
+	}
+
+	if q.Favorite != nil {
+		filters = append(filters, FILTER_FAVORITE)
+		args["$f"] = *q.Favorite
+	}
+	if q.Since != nil {
+		filters = append(filters, FILTER_SINCE)
+		args["$s"] = sqliteTime(q.Since)
+	}
+	if q.Until != nil {
+		filters = append(filters, FILTER_UNTIL)
+		args["$u"] = sqliteTime(q.Until)
+	}
+	if q.Indicator != nil {
+		filters = append(filters, FILTER_INDICATOR)
+		args["$i"] = *q.Indicator
+	}
+	if q.Device != 0 {
+		filters = append(filters, FILTER_DEVICE)
+		args["$v"] = q.Device
+	}
+	if q.Search != "" {
+		filters = append(filters, FILTER_SEARCH)
+		args["$q"] = "%" + safeLike(q.Search) + "%"
+	}
+	return filters, args, true
+}
+
+// QueryItemsFiltered returns the Account's Items which match all the filters
+// set in the query. Only the filters and the order (from ITEM_QUERY_ORDERS)
+// are written into the sql statement: every value is bound as an arg.
+func QueryItemsFiltered(db *sqlite3.Conn, a *Account, q ItemQuery) (_ []*Item, err error) {
+	defer wrapError("QueryItemsFiltered", &err)
+	if q.Limit < 0 {
+		return nil, ErrBadLimit
+	}
+	if q.Offset < 0 {
+		return nil, ErrBadOffset
+	}
+	if q.Order == "" {
+		q.Order = ORDER_NEWEST
+	}
+	order, found := ITEM_QUERY_ORDERS[q.Order]
+	if !found {
+		return nil, ErrBadOrder
+	}
+	if q.FavoritesFirst {
+		order = FILTER_FAVS_FIRST + order
+	}
+
+	filters, args, possible := itemQueryFilters(db, a, q)
+	if !possible {
+		return make([]*Item, 0), nil
+	}
+	args["$n"] = q.Limit
+	args["$o"] = q.Offset
+
+	sql := strings.Join(append([]string{QUERY_ITEMS}, filters...), FILTER_CONJUNCTION) + FILTER_ORDER + order
+	if q.Limit > 0 {
+		sql += FILTER_LIMIT
+	} else {
+		sql += FILTER_NO_LIMIT
+	}
+	return fetchItems(db, sql, args)
+}
+
+// CountItemsFiltered returns how many of the Account's Items match all the
+// filters set in the query, regardless of its Limit and Offset (e.g., for
+// the number of pages of QueryItemsFiltered)
+func CountItemsFiltered(db *sqlite3.Conn, a *Account, q ItemQuery) (_ int64, err error) {
+	defer wrapError("CountItemsFiltered", &err)
+	filters, args, possible := itemQueryFilters(db, a, q)
+	if !possible {
+		return 0, nil
+	}
+
+	sql := strings.Join(append([]string{COUNT_QUERY_ITEMS}, filters...), FILTER_CONJUNCTION)
+	var count int64
+	s, err := db.Query(sql, args)
+	for ; err == nil; err = s.Next() {
+		s.Scan(&count)
+	}
+	return count, queryError(err)
+}
+
+// QueryItemsPage returns one page of the Account's Items (see
+// QueryItemsFiltered) along with the total number of Items which match the
+// filters, on every page (see CountItemsFiltered), both read in the same
+// transaction, so that they agree even while Items are being scanned
+func QueryItemsPage(db *sqlite3.Conn, a *Account, q ItemQuery) (_ []*Item, _ int64, err error) {
+	defer wrapError("QueryItemsPage", &err)
+	var items []*Item
+	var total int64
+	err = withTransaction(db, func() error {
+		var err error
+		if items, err = QueryItemsFiltered(db, a, q); err != nil {
+			return err
+		}
+		total, err = CountItemsFiltered(db, a, q)
+		return err
+	})
+	return items, total, err
+}
@@ -0,0 +1,87 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// BarcodeResolver looks up the description and index for a barcode, e.g.,
+// from a remote product service, keeping the lookup separate from storage
+type BarcodeResolver func(barcode string) (desc string, ind int64, err error)
+
+// ResolveError is returned by AddResolved when the resolver failed but the
+// Item was saved anyway, with whatever it had: it is a warning, not a failure
+type ResolveError struct {
+	Barcode string
+	Err     error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("could not resolve barcode %s: %v", e.Barcode, e.Err)
+}
+
+// AddResolved uses the resolver to fill in the description and index of the
+// Item, if they are empty, before inserting it for the given Account (with
+// the same duplicate check as Add), and sets its Id. If the resolver fails,
+// the Item is inserted as-is, and the error returned wraps a *ResolveError
+// (see errors.As).
+func (i *Item) AddResolved(db *sqlite3.Conn, a *Account, r BarcodeResolver) (err error) {
+	defer wrapError("Item.AddResolved", &err)
+	var warning error
+	if i.Desc == "" || i.Index == nil {
+		desc, ind, err := r(i.Barcode)
+		if err != nil {
+			warning = &ResolveError{Barcode: i.Barcode, Err: err}
+		} else {
+			if i.Desc == "" {
+				i.Desc = desc
+			}
+			if i.Index == nil {
+				i.Index = &ind
+			}
+		}
+	}
+
+	if _, err := i.Add(db, a); err != nil {
+		return err
+	}
+	return warning
+}
+
+// AddResolveFavorite is the kiosk workflow: it adds the barcode for the
+// Account, resolving its description (see AddResolved), and marks it as a
+// favorite, all in a single transaction, returning the Item as stored. If
+// the resolver fails, the Item is still added, but not as a favorite, and
+// the error wrapping the *ResolveError is returned along with it.
+func AddResolveFavorite(db *sqlite3.Conn, a *Account, barcode string, r BarcodeResolver) (_ *Item, err error) {
+	defer wrapError("AddResolveFavorite", &err)
+	item := &Item{Barcode: barcode}
+
+	var warning error
+	err = withTransaction(db, func() error {
+		warning = item.AddResolved(db, a, r)
+		var unresolved *ResolveError
+		if errors.As(warning, &unresolved) {
+			return nil
+		}
+		if warning != nil {
+			return warning
+		}
+		return item.Favorite(db)
+	})
+	if err != nil {
+		return item, err
+	}
+
+	stored, err := GetSingleItem(db, a, item.Id)
+	if err != nil {
+		return item, err
+	}
+	return stored, warning
+}
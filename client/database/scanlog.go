@@ -0,0 +1,142 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// Scan history (for existing db files; see also tables.sql)
+	CREATE_SCAN_LOG = `CREATE TABLE IF NOT EXISTS scan_log (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	product      integer NOT NULL,
+	barcode      text NOT NULL,
+	action       text NOT NULL,
+	source       text,
+	device       integer REFERENCES device(id),
+	logged       datetime DEFAULT (datetime('now'))
+)`
+	SCAN_LOG_INDEX = "CREATE INDEX IF NOT EXISTS scan_log_account_logged ON scan_log(account, logged)"
+
+	// The triggers which write to scan_log, for every statement which adds
+	// (or scans again, or restores), deletes, or favorites a product, in the
+	// same transaction as the change itself
+	CREATE_LOG_INSERT = `CREATE TRIGGER IF NOT EXISTS scan_log_insert AFTER INSERT ON product
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END`
+	CREATE_LOG_RESCAN = `CREATE TRIGGER IF NOT EXISTS scan_log_rescan AFTER UPDATE OF scan_count ON product
+FOR EACH ROW WHEN new.scan_count > old.scan_count
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END`
+	CREATE_LOG_DELETE = `CREATE TRIGGER IF NOT EXISTS scan_log_delete AFTER DELETE ON product
+FOR EACH ROW WHEN old.deleted_at IS NULL
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (old.account, old.id, old.barcode, 'delete', old.source, old.device);
+END`
+	CREATE_LOG_TRASH = `CREATE TRIGGER IF NOT EXISTS scan_log_trash AFTER UPDATE OF deleted_at ON product
+FOR EACH ROW WHEN new.deleted_at IS NOT NULL AND old.deleted_at IS NULL
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'delete', new.source, new.device);
+END`
+	CREATE_LOG_RESTORE = `CREATE TRIGGER IF NOT EXISTS scan_log_restore AFTER UPDATE OF deleted_at ON product
+FOR EACH ROW WHEN new.deleted_at IS NULL AND old.deleted_at IS NOT NULL AND new.scan_count = old.scan_count
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END`
+	CREATE_LOG_FAVORITE = `CREATE TRIGGER IF NOT EXISTS scan_log_favorite AFTER UPDATE OF is_favorite ON product
+FOR EACH ROW WHEN new.is_favorite = 1 AND old.is_favorite = 0
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'favorite', new.source, new.device);
+END`
+	CREATE_LOG_UNFAVORITE = `CREATE TRIGGER IF NOT EXISTS scan_log_unfavorite AFTER UPDATE OF is_favorite ON product
+FOR EACH ROW WHEN new.is_favorite = 0 AND old.is_favorite = 1
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'unfavorite', new.source, new.device);
+END`
+
+	// Prepared Statements
+	GET_SCAN_HISTORY = "select id, account, product, barcode, action, source, device, strftime('%s', logged) from scan_log where account = $a and logged >= $s order by logged desc, id desc"
+	GET_SCAN_EVENTS  = "select id, account, product, barcode, action, source, device, strftime('%s', logged) from scan_log where id > $i order by id limit $l"
+	LAST_SCAN_EVENT  = "select coalesce(max(id), 0) from scan_log"
+)
+
+// ScanEvent is one entry in the scan history of an Account
+type ScanEvent struct {
+	Id        int64
+	AccountId int64
+	ItemId    int64 // the Item may since have been deleted
+	Barcode   string
+	Action    string // ITEM_ADDED, ITEM_DELETED, ITEM_FAVORITED, ITEM_UNFAVORITED, or SCAN_IGNORED
+	Source    string // where the Item was scanned (see Item.Source), if known
+	DeviceId  int64  // the Device which scanned it (see Item.DeviceId), if known
+	Logged    time.Time
+}
+
+// GetScanHistory returns the scan history of the Account (every Item added,
+// scanned again, deleted, or favorited, whichever way it was done) at or
+// after the given time, most recent first, e.g., for an activity feed which
+// outlives the Items themselves. Unlike the optional item_audit history (see
+// EnableItemAudit), it is always kept. Events are logged according to
+// sqlite's clock, not Now.
+func GetScanHistory(db *sqlite3.Conn, a *Account, since time.Time) (_ []*ScanEvent, err error) {
+	defer wrapError("GetScanHistory", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$s": sqliteTime(&since)}
+	return fetchScanEvents(db, GET_SCAN_HISTORY, args)
+}
+
+// GetScanEventsAfter returns (up to the limit) the events logged after the
+// one with the given id, for every Account, oldest first, e.g., to follow
+// the scans made by another process (see LastScanEventId)
+func GetScanEventsAfter(db *sqlite3.Conn, afterId int64, limit int) (_ []*ScanEvent, err error) {
+	defer wrapError("GetScanEventsAfter", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	args := sqlite3.NamedArgs{"$i": afterId, "$l": limit}
+	return fetchScanEvents(db, GET_SCAN_EVENTS, args)
+}
+
+// LastScanEventId returns the id of the most recent event logged, or zero
+// if there are none
+func LastScanEventId(db *sqlite3.Conn) (_ int64, err error) {
+	defer wrapError("LastScanEventId", &err)
+	var last int64
+	s, err := db.Query(LAST_SCAN_EVENT)
+	for ; err == nil; err = s.Next() {
+		s.Scan(&last)
+	}
+	return last, queryError(err)
+}
+
+func fetchScanEvents(db *sqlite3.Conn, query string, args sqlite3.NamedArgs) ([]*ScanEvent, error) {
+	results := make([]*ScanEvent, 0)
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(query, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &ScanEvent{Id: rowid}
+		result.AccountId, _ = row["account"].(int64)
+		result.ItemId, _ = row["product"].(int64)
+		result.Barcode, _ = row["barcode"].(string)
+		result.Action, _ = row["action"].(string)
+		result.Source, _ = row["source"].(string)
+		result.DeviceId, _ = row["device"].(int64)
+		if logged, found := row["strftime('%s', logged)"].(string); found {
+			result.Logged, _ = unixTime(logged)
+		}
+		results = append(results, result)
+	}
+
+	return results, queryError(err)
+}
@@ -0,0 +1,81 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strings"
+	"unicode"
+)
+
+const (
+	// The full-text index of the product descriptions (for existing db
+	// files; see also tables.sql), and the triggers which keep it in sync
+	// with every insert, delete, and change of description
+	CREATE_PRODUCT_SEARCH = `CREATE VIRTUAL TABLE IF NOT EXISTS product_search USING fts4(content="product", product_desc)`
+	CREATE_SEARCH_INSERT  = `CREATE TRIGGER IF NOT EXISTS product_search_insert AFTER INSERT ON product
+BEGIN
+	INSERT INTO product_search (docid, product_desc) VALUES (new.id, new.product_desc);
+END`
+	CREATE_SEARCH_DELETE = `CREATE TRIGGER IF NOT EXISTS product_search_delete BEFORE DELETE ON product
+BEGIN
+	DELETE FROM product_search WHERE docid = old.id;
+END`
+	CREATE_SEARCH_UNINDEX = `CREATE TRIGGER IF NOT EXISTS product_search_unindex BEFORE UPDATE OF product_desc ON product
+BEGIN
+	DELETE FROM product_search WHERE docid = old.id;
+END`
+	CREATE_SEARCH_REINDEX = `CREATE TRIGGER IF NOT EXISTS product_search_reindex AFTER UPDATE OF product_desc ON product
+BEGIN
+	INSERT INTO product_search (docid, product_desc) VALUES (new.id, new.product_desc);
+END`
+
+	// Prepared Statements
+	// Item search
+	REBUILD_PRODUCT_SEARCH = "insert into product_search (product_search) values ('rebuild')"
+	SEARCH_ITEMS           = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and (id in (select docid from product_search where product_search match $m) or barcode like $b escape '\\') order by posted desc, id desc"
+	SEARCH_BARCODES        = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and barcode like $b escape '\\' order by posted desc, id desc"
+
+	// the fts prefix query operator
+	SEARCH_PREFIX = "*"
+)
+
+// searchTerms turns the query into an fts match expression: each of its
+// words (i.e., runs of letters and digits) as a prefix, all of which must
+// match. Anything else in the query, including the fts operators (which are
+// upper case only), is dropped, so the query can never be a syntax error.
+func searchTerms(query string) string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for j, word := range words {
+		words[j] = word + SEARCH_PREFIX
+	}
+	return strings.Join(words, " ")
+}
+
+// SearchItems returns the Items for this Account whose description has
+// words starting with each of the words in the query, in any order (e.g.,
+// "whole mil" finds "Milk, Whole"), ignoring case, or whose barcode starts
+// with the query, most recent first. The query is never a pattern: any '%'
+// or '_' in it match only themselves, in a barcode, and any punctuation is
+// ignored, in a description. An empty (or blank) query is ErrEmptyQuery.
+func SearchItems(db *sqlite3.Conn, a *Account, query string) (_ []*Item, err error) {
+	defer wrapError("SearchItems", &err)
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, ErrEmptyQuery
+	}
+
+	args := sqlite3.NamedArgs{"$a": a.Id, "$b": safeLike(query) + "%"}
+	terms := searchTerms(query)
+	if terms == "" {
+		// nothing to match in the descriptions
+		return fetchItems(db, SEARCH_BARCODES, args)
+	}
+	args["$m"] = terms
+	return fetchItems(db, SEARCH_ITEMS, args)
+}
@@ -0,0 +1,368 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CREATE_SESSIONS = `CREATE TABLE IF NOT EXISTS session (
+	id           integer primary key AUTOINCREMENT,
+	token        text NOT NULL,
+	account      integer REFERENCES account(id),
+	created      datetime DEFAULT (datetime('now')),
+	expires      datetime NOT NULL,
+	UNIQUE(token)
+)`
+
+	// how long a session lasts since it was last used
+	SESSION_TTL = 30 * 24 * time.Hour
+
+	// the random bytes in each session token
+	SESSION_TOKEN_BYTES = 32
+
+	// the key stretching of each PIN (PBKDF2, with HMAC-SHA256)
+	PIN_ITERATIONS = 20000
+	PIN_SALT_BYTES = 16
+	PIN_HASH_ID    = "pbkdf2-sha256"
+
+	// Prepared Statements
+	// Sessions
+	ADD_SESSION          = "insert into session (token, account, created, expires) values ($t, $a, $c, $x)"
+	GET_SESSION          = "select account, strftime('%s', expires) from session where token = $t"
+	RENEW_SESSION        = "update session set expires = $x where token = $t"
+	DELETE_SESSION       = "delete from session where token = $t"
+	DELETE_SESSIONS      = "delete from session where account = $a"
+	PURGE_SESSIONS       = "delete from session where expires < $x"
+	COUNT_REGISTERED     = "select count(*) from account where lower(trim(email)) <> $e"
+	GET_PIN_HASH         = "select pin_hash from account where id = $i"
+	SET_PIN_HASH         = "update account set pin_hash = $p where id = $i"
+	SET_ACCOUNT_ADMIN    = "update account set is_admin = $v where id = $i and lower(trim(email)) <> $e"
+	IS_ACCOUNT_ADMIN     = "select case when exists (select 1 from account where is_admin = 1) then (select is_admin from account where id = $i) else $i = (select min(id) from account where lower(trim(email)) <> $e) end"
+	GET_ADMIN_ACCOUNT_ID = "select coalesce((select min(id) from account where is_admin = 1), (select min(id) from account where lower(trim(email)) <> $e), 0)"
+)
+
+var (
+	ErrBadCredentials = errors.New("the email address, PIN, or api code is incorrect")
+	ErrNoSession      = errors.New("no such session, or it has expired")
+	ErrBadPIN         = errors.New("the PIN must be 4 to 8 digits")
+	ErrBadEmail       = errors.New("that is not an email address")
+
+	ErrAnonymousLogin = errors.New("the anonymous account cannot log in")
+
+	// what SetPIN accepts
+	PIN_FORMAT = regexp.MustCompile(`^[0-9]{4,8}$`)
+)
+
+// LoginRequired reports whether the WebApp needs each visitor to log in
+// (see Authenticate): only once an Account has registered an email address,
+// since until then, there is only the anonymous account
+func LoginRequired(db *sqlite3.Conn) (_ bool, err error) {
+	defer wrapError("LoginRequired", &err)
+	var n int64
+	s, err := db.Query(COUNT_REGISTERED, sqlite3.NamedArgs{"$e": ANONYMOUS_EMAIL})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&n)
+	}
+	return n > 0, queryError(err)
+}
+
+// pbkdf2 returns the single (32 byte) block of PBKDF2-HMAC-SHA256, which is
+// all that a PIN hash needs
+func pbkdf2(secret, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	t := append([]byte(nil), u...)
+	for j := 1; j < iterations; j++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for k := range t {
+			t[k] ^= u[k]
+		}
+	}
+	return t
+}
+
+// hashPIN returns the PIN in the form in which it is stored: the hash id,
+// iterations, salt, and hash, separated by $
+func hashPIN(pin string) (string, error) {
+	salt := make([]byte, PIN_SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return "", ErrNoEntropy
+	}
+	hash := pbkdf2([]byte(pin), salt, PIN_ITERATIONS)
+	return strings.Join([]string{PIN_HASH_ID, strconv.Itoa(PIN_ITERATIONS), hex.EncodeToString(salt), hex.EncodeToString(hash)}, "$"), nil
+}
+
+// pinMatches reports whether the PIN is the one which was stored as hashed
+func pinMatches(pin, hashed string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 4 || parts[0] != PIN_HASH_ID {
+		return false
+	}
+	iterations, iterErr := strconv.Atoi(parts[1])
+	salt, saltErr := hex.DecodeString(parts[2])
+	hash, hashErr := hex.DecodeString(parts[3])
+	if iterErr != nil || saltErr != nil || hashErr != nil || iterations < 1 {
+		return false
+	}
+	return hmac.Equal(pbkdf2([]byte(pin), salt, iterations), hash)
+}
+
+// SetPIN sets the PIN with which the Account logs in (see Authenticate),
+// replacing any it had, which must be 4 to 8 digits (see PIN_FORMAT). Only
+// its salted hash is stored.
+func (a *Account) SetPIN(db *sqlite3.Conn, pin string) (err error) {
+	defer wrapError("Account.SetPIN", &err)
+	if a.IsAnonymous() {
+		return ErrAnonymousLogin
+	}
+	if !PIN_FORMAT.MatchString(pin) {
+		return ErrBadPIN
+	}
+	hashed, err := hashPIN(pin)
+	if err != nil {
+		return err
+	}
+	if err = db.Exec(SET_PIN_HASH, sqlite3.NamedArgs{"$i": a.Id, "$p": hashed}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoAccount
+	}
+	return nil
+}
+
+// HasPIN reports whether the Account has set a PIN (see SetPIN)
+func (a *Account) HasPIN(db *sqlite3.Conn) (_ bool, err error) {
+	defer wrapError("Account.HasPIN", &err)
+	found := false
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_PIN_HASH, sqlite3.NamedArgs{"$i": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+		_, found = row["pin_hash"].(string)
+	}
+	return found, queryError(err)
+}
+
+// Authenticate returns the Account with the email, provided the secret is
+// either its PIN (see SetPIN), or its api code, or ErrBadCredentials
+// (without saying which of them was wrong)
+func Authenticate(db *sqlite3.Conn, email, secret string) (_ *Account, err error) {
+	defer wrapError("Authenticate", &err)
+	a, err := GetAccount(db, email)
+	if err != nil {
+		return nil, err
+	}
+	if a.Email == "" || a.IsAnonymous() || secret == "" {
+		return nil, ErrBadCredentials
+	}
+
+	if subtle.ConstantTimeCompare([]byte(normalizeAPICode(secret)), []byte(normalizeAPICode(a.APICode))) == 1 {
+		return a, nil
+	}
+	matched := false
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_PIN_HASH, sqlite3.NamedArgs{"$i": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+		if hashed, found := row["pin_hash"].(string); found {
+			matched = pinMatches(secret, hashed)
+		}
+	}
+	if err = queryError(err); err != nil {
+		return nil, err
+	}
+	if matched {
+		return a, nil
+	}
+	return nil, ErrBadCredentials
+}
+
+// NewSession starts a session for the Account, returning its token (e.g.,
+// for a cookie), which GetSessionAccount accepts for SESSION_TTL after it
+// was last used. Only the token's sha256 is stored.
+func NewSession(db *sqlite3.Conn, a *Account) (_ string, err error) {
+	defer wrapError("NewSession", &err)
+	if a.IsAnonymous() {
+		return "", ErrAnonymousLogin
+	}
+	b := make([]byte, SESSION_TOKEN_BYTES)
+	if _, err = rand.Read(b); err != nil {
+		return "", ErrNoEntropy
+	}
+	token := hex.EncodeToString(b)
+	now := Now()
+	expires := now.Add(SESSION_TTL)
+	args := sqlite3.NamedArgs{"$t": hashToken(token), "$a": a.Id, "$c": sqliteTime(&now), "$x": sqliteTime(&expires)}
+	if err = db.Exec(ADD_SESSION, args); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetSessionAccount returns the Account whose session has the token, or
+// ErrNoSession, if there is none (or it has expired). Sessions past half
+// their SESSION_TTL are renewed.
+func GetSessionAccount(db *sqlite3.Conn, token string) (_ *Account, err error) {
+	defer wrapError("GetSessionAccount", &err)
+	hashed := hashToken(token)
+	var id int64
+	var expires time.Time
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_SESSION, sqlite3.NamedArgs{"$t": hashed})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&id, row)
+		if t, found := row["strftime('%s', expires)"].(string); found {
+			expires, _ = unixTime(t)
+		}
+	}
+	if err = queryError(err); err != nil {
+		return nil, err
+	}
+	now := Now()
+	if id == 0 || now.After(expires) {
+		return nil, ErrNoSession
+	}
+
+	if expires.Sub(now) < SESSION_TTL/2 {
+		renewed := now.Add(SESSION_TTL)
+		if err = db.Exec(RENEW_SESSION, sqlite3.NamedArgs{"$t": hashed, "$x": sqliteTime(&renewed)}); err != nil {
+			return nil, err
+		}
+	}
+	a, err := getAccountById(db, id)
+	if errors.Is(err, ErrNoAccount) {
+		return nil, ErrNoSession
+	}
+	return a, err
+}
+
+// EndSession ends the session with the token (e.g., on logging out)
+func EndSession(db *sqlite3.Conn, token string) (err error) {
+	defer wrapError("EndSession", &err)
+	return db.Exec(DELETE_SESSION, sqlite3.NamedArgs{"$t": hashToken(token)})
+}
+
+// EndSessions ends all of the Account's sessions (e.g., when its PIN
+// changes), returning how many there were
+func (a *Account) EndSessions(db *sqlite3.Conn) (_ int64, err error) {
+	defer wrapError("Account.EndSessions", &err)
+	if err = db.Exec(DELETE_SESSIONS, sqlite3.NamedArgs{"$a": a.Id}); err != nil {
+		return 0, err
+	}
+	return int64(db.RowsAffected()), nil
+}
+
+// PurgeSessions deletes the sessions which have expired, returning how
+// many there were
+func PurgeSessions(db *sqlite3.Conn) (_ int64, err error) {
+	defer wrapError("PurgeSessions", &err)
+	now := Now()
+	if err = db.Exec(PURGE_SESSIONS, sqlite3.NamedArgs{"$x": sqliteTime(&now)}); err != nil {
+		return 0, err
+	}
+	return int64(db.RowsAffected()), nil
+}
+
+// IsAdmin reports whether the Account can manage the others (see
+// SetAdmin). Until any Account is made an admin, the first one registered
+// is, so that there is always one.
+func (a *Account) IsAdmin(db *sqlite3.Conn) (_ bool, err error) {
+	defer wrapError("Account.IsAdmin", &err)
+	var admin int64
+	s, err := db.Query(IS_ACCOUNT_ADMIN, sqlite3.NamedArgs{"$i": a.Id, "$e": ANONYMOUS_EMAIL})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&admin)
+	}
+	return admin == 1, queryError(err)
+}
+
+// SetAdmin makes the Account an admin (or not). The anonymous account
+// cannot be one, since it never logs in.
+func (a *Account) SetAdmin(db *sqlite3.Conn, admin bool) (err error) {
+	defer wrapError("Account.SetAdmin", &err)
+	if a.IsAnonymous() {
+		return ErrAnonymousLogin
+	}
+	v := 0
+	if admin {
+		v = 1
+	}
+	// the first admin made replaces the default one (see IsAdmin), so
+	// make that one explicit, to keep it
+	if admin {
+		var first int64
+		s, err := db.Query(GET_ADMIN_ACCOUNT_ID, sqlite3.NamedArgs{"$e": ANONYMOUS_EMAIL})
+		for ; err == nil; err = s.Next() {
+			s.Scan(&first)
+		}
+		if err := queryError(err); err != nil {
+			return err
+		}
+		if first != 0 && first != a.Id {
+			if err := db.Exec(SET_ACCOUNT_ADMIN, sqlite3.NamedArgs{"$i": first, "$v": 1, "$e": ANONYMOUS_EMAIL}); err != nil {
+				return err
+			}
+		}
+	}
+	if err = db.Exec(SET_ACCOUNT_ADMIN, sqlite3.NamedArgs{"$i": a.Id, "$v": v, "$e": ANONYMOUS_EMAIL}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoAccount
+	}
+	return nil
+}
+
+// NewAccount registers another Account, with a new random api code, and
+// the PIN (if any) with which it logs in
+func NewAccount(db *sqlite3.Conn, email, name, pin string) (_ *Account, err error) {
+	defer wrapError("NewAccount", &err)
+	if normalizeEmail(email) == ANONYMOUS_EMAIL || !strings.Contains(email, "@") {
+		return nil, ErrBadEmail
+	}
+	if pin != "" && !PIN_FORMAT.MatchString(pin) {
+		return nil, ErrBadPIN
+	}
+	code, err := NewAPICode()
+	if err != nil {
+		return nil, err
+	}
+	a := &Account{Email: email, Name: name, APICode: code}
+	err = withTransaction(db, func() error {
+		if err := a.Add(db); err != nil {
+			return err
+		}
+		a.Id = db.LastInsertId()
+		if pin != "" {
+			return a.SetPIN(db, pin)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if a.Name == "" {
+		a.Name = defaultAccountName(a.Email)
+	}
+	return a, nil
+}
@@ -0,0 +1,429 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// The states of each item on a shopping list, in the order a shopping
+	// trip moves it through them (see SHOPPING_TRANSITIONS)
+	SHOPPING_NEEDED    = "needed"
+	SHOPPING_IN_CART   = "in_cart"
+	SHOPPING_PURCHASED = "purchased"
+
+	// Shopping lists (for existing db files; see also tables.sql)
+	CREATE_SHOPPING_LISTS = `CREATE TABLE IF NOT EXISTS shopping_list (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	created      datetime DEFAULT (datetime('now')),
+	completed    datetime
+)`
+	SHOPPING_LIST_OPEN_INDEX = "CREATE UNIQUE INDEX IF NOT EXISTS shopping_list_open ON shopping_list(account) WHERE completed IS NULL"
+	CREATE_SHOPPING_ITEMS    = `CREATE TABLE IF NOT EXISTS shopping_item (
+	id           integer primary key AUTOINCREMENT,
+	list         integer REFERENCES shopping_list(id),
+	product      integer,
+	barcode      text,
+	product_desc text NOT NULL,
+	quantity     integer DEFAULT 1,
+	state        text DEFAULT 'needed',
+	needed_at    datetime DEFAULT (datetime('now')),
+	in_cart_at   datetime,
+	purchased_at datetime,
+	UNIQUE(list, product)
+)`
+
+	// Prepared Statements
+	// Shopping lists, and the items on them
+	SHOPPING_LIST_COLUMNS     = "id, account, strftime('%s', created), strftime('%s', completed)"
+	SHOPPING_ITEM_COLUMNS     = "id, list, product, barcode, product_desc, quantity, state, strftime('%s', needed_at), strftime('%s', in_cart_at), strftime('%s', purchased_at)"
+	OPEN_SHOPPING_LISTS       = "select id from shopping_list where account = $a and completed is null"
+	ADD_SHOPPING_LIST         = "insert or ignore into shopping_list (account, created) values ($a, $t)"
+	GET_SHOPPING_LIST         = "select " + SHOPPING_LIST_COLUMNS + " from shopping_list where account = $a and completed is null"
+	GET_SHOPPING_HISTORY      = "select " + SHOPPING_LIST_COLUMNS + " from shopping_list where account = $a and completed is not null order by completed desc, id desc limit $l"
+	COMPLETE_SHOPPING_LIST    = "update shopping_list set completed = $t where id = $l and completed is null"
+	GET_SHOPPING_ITEMS        = "select " + SHOPPING_ITEM_COLUMNS + " from shopping_item where list = $l order by needed_at, id"
+	GET_SHOPPING_ITEM         = "select " + SHOPPING_ITEM_COLUMNS + " from shopping_item where id = $i and list in (" + OPEN_SHOPPING_LISTS + ")"
+	ADD_SHOPPING_ITEM         = "insert or ignore into shopping_item (list, product, barcode, product_desc, quantity, needed_at) values ($l, $p, $b, $d, $q, $t)"
+	SET_SHOPPING_STATE        = "update shopping_item set state = $s, needed_at = $n, in_cart_at = $c, purchased_at = $p where id = $i and state = $f"
+	SET_SHOPPING_QUANTITY     = "update shopping_item set quantity = $q where id = $i and list in (" + OPEN_SHOPPING_LISTS + ")"
+	REMOVE_SHOPPING_ITEM      = "delete from shopping_item where id = $i and list in (" + OPEN_SHOPPING_LISTS + ")"
+	CARRY_OVER_SHOPPING_ITEMS = "insert into shopping_item (list, product, barcode, product_desc, quantity, needed_at) select $n, product, barcode, product_desc, quantity, needed_at from shopping_item where list = $l and state <> 'purchased'"
+	RESTOCK_PURCHASED         = "update product set quantity = quantity + (select sum(s.quantity) from shopping_item s where s.list = $l and s.state = 'purchased' and s.product = product.id), updated = $t where account = $a and deleted_at is null and id in (select product from shopping_item where list = $l and state = 'purchased')"
+	ADD_FAVORITES_TO_LIST     = "insert or ignore into shopping_item (list, product, barcode, product_desc, quantity, needed_at) select $l, id, barcode, product_desc, 1, $t from product where account = $a and deleted_at is null and product_desc <> '' and is_favorite = 1 order by posted"
+	ADD_LOW_QUANTITY_TO_LIST  = "insert or ignore into shopping_item (list, product, barcode, product_desc, quantity, needed_at) select $l, id, barcode, product_desc, 1, $t from product where account = $a and deleted_at is null and product_desc <> '' and quantity <= $q order by posted"
+	DELETE_SHOPPING_ITEMS     = "delete from shopping_item where list in (select id from shopping_list where account = $a)"
+	DELETE_SHOPPING_LISTS     = "delete from shopping_list where account = $a"
+)
+
+var (
+	ErrNoShoppingItem = errors.New("no such item on the open shopping list")
+	ErrBadTransition  = errors.New("the shopping list item cannot move to that state")
+	ErrBadShopping    = errors.New("the shopping list item needs a description, and a quantity of at least one")
+
+	// the states each shopping list item can move to, from each state: a
+	// purchase can be undone (back into the cart), but needs no cart first
+	SHOPPING_TRANSITIONS = map[string][]string{
+		SHOPPING_NEEDED:    {SHOPPING_IN_CART, SHOPPING_PURCHASED},
+		SHOPPING_IN_CART:   {SHOPPING_NEEDED, SHOPPING_PURCHASED},
+		SHOPPING_PURCHASED: {SHOPPING_IN_CART},
+	}
+)
+
+// ShoppingList is one shopping trip of an Account: the open one (see
+// GetShoppingList), or one in its history (see CompleteShoppingList)
+type ShoppingList struct {
+	Id        int64
+	AccountId int64
+	Created   time.Time
+	Completed *time.Time // nil while the list is open
+	Items     []*ShoppingItem
+}
+
+// ShoppingItem is one line of a ShoppingList, with when it last entered
+// each state (so it is nil for each state it is not, or has not been, in)
+type ShoppingItem struct {
+	Id          int64
+	ListId      int64
+	ItemId      int64 // the Item it was added from (which may since have been deleted), zero if none
+	Barcode     string
+	Desc        string // copied from the Item, so the history outlives it
+	Quantity    int64
+	State       string // SHOPPING_NEEDED, SHOPPING_IN_CART, or SHOPPING_PURCHASED
+	NeededAt    time.Time
+	InCartAt    *time.Time
+	PurchasedAt *time.Time
+}
+
+// CanMoveTo reports whether the item can go from its State to the given one
+// (see SHOPPING_TRANSITIONS)
+func (s *ShoppingItem) CanMoveTo(state string) bool {
+	for _, next := range SHOPPING_TRANSITIONS[s.State] {
+		if next == state {
+			return true
+		}
+	}
+	return false
+}
+
+// optionalTime converts the (possibly null) result of "strftime('%s',
+// [column])" into a time, or nil
+func optionalTime(row sqlite3.RowMap, column string) *time.Time {
+	if seconds, found := row[column].(string); found {
+		if t, err := unixTime(seconds); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func fetchShoppingLists(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) ([]*ShoppingList, error) {
+	results := make([]*ShoppingList, 0)
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(sql, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &ShoppingList{Id: rowid}
+		result.AccountId, _ = row["account"].(int64)
+		if created := optionalTime(row, "strftime('%s', created)"); created != nil {
+			result.Created = *created
+		}
+		result.Completed = optionalTime(row, "strftime('%s', completed)")
+		results = append(results, result)
+	}
+	if err = queryError(err); err != nil {
+		return nil, err
+	}
+
+	for _, l := range results {
+		if l.Items, err = fetchShoppingItems(db, GET_SHOPPING_ITEMS, sqlite3.NamedArgs{"$l": l.Id}); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func fetchShoppingItems(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) ([]*ShoppingItem, error) {
+	results := make([]*ShoppingItem, 0)
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(sql, args)
+	for ; err == nil; err = s.Next() {
+		var rowid int64
+		s.Scan(&rowid, row)
+
+		result := &ShoppingItem{Id: rowid}
+		result.ListId, _ = row["list"].(int64)
+		result.ItemId, _ = row["product"].(int64)
+		result.Barcode, _ = row["barcode"].(string)
+		result.Desc, _ = row["product_desc"].(string)
+		result.Quantity, _ = row["quantity"].(int64)
+		result.State, _ = row["state"].(string)
+		if needed := optionalTime(row, "strftime('%s', needed_at)"); needed != nil {
+			result.NeededAt = *needed
+		}
+		result.InCartAt = optionalTime(row, "strftime('%s', in_cart_at)")
+		result.PurchasedAt = optionalTime(row, "strftime('%s', purchased_at)")
+		results = append(results, result)
+	}
+
+	return results, queryError(err)
+}
+
+// GetShoppingList returns the Account's open shopping list, with all its
+// items, in the order they were needed, creating the list if it has none
+// (there is never more than one open at a time)
+func GetShoppingList(db *sqlite3.Conn, a *Account) (_ *ShoppingList, err error) {
+	defer wrapError("GetShoppingList", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$t": currentTime()}
+	if err := db.Exec(ADD_SHOPPING_LIST, args); err != nil {
+		return nil, err
+	}
+	lists, err := fetchShoppingLists(db, GET_SHOPPING_LIST, sqlite3.NamedArgs{"$a": a.Id})
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, ErrNoAccount
+	}
+	return lists[0], nil
+}
+
+// GetShoppingHistory returns (up to the limit) the Account's completed
+// shopping lists, with all their items, most recently completed first
+func GetShoppingHistory(db *sqlite3.Conn, a *Account, limit int) (_ []*ShoppingList, err error) {
+	defer wrapError("GetShoppingHistory", &err)
+	if limit <= 0 {
+		return nil, ErrBadLimit
+	}
+	return fetchShoppingLists(db, GET_SHOPPING_HISTORY, sqlite3.NamedArgs{"$a": a.Id, "$l": limit})
+}
+
+// addShoppingItem adds the item to the list as needed, returning whether
+// it was added (i.e., the Item it is for, if any, was not on it already)
+func addShoppingItem(db *sqlite3.Conn, l *ShoppingList, itemId interface{}, barcode, desc string, quantity int64) (bool, error) {
+	desc = SanitizeDescription(desc)
+	if desc == "" || quantity < 1 {
+		return false, ErrBadShopping
+	}
+	args := sqlite3.NamedArgs{"$l": l.Id, "$p": itemId, "$b": barcode, "$d": desc, "$q": quantity, "$t": currentTime()}
+	if err := db.Exec(ADD_SHOPPING_ITEM, args); err != nil {
+		return false, err
+	}
+	return db.RowsAffected() > 0, nil
+}
+
+// AddItem puts (the quantity of) the Item, which must belong to the
+// Account, and be described, on its open shopping list. Adding an Item
+// which is on the list already does nothing.
+func (l *ShoppingList) AddItem(db *sqlite3.Conn, i *Item, quantity int64) (err error) {
+	defer wrapError("ShoppingList.AddItem", &err)
+	if getItemAccount(db, i.Id) != l.AccountId {
+		return ErrNotOwned
+	}
+	_, err = addShoppingItem(db, l, i.Id, i.Barcode, i.Desc, quantity)
+	return err
+}
+
+// AddText puts (the quantity of) something which was never scanned (e.g.,
+// "bread") on the open shopping list, by its description alone
+func (l *ShoppingList) AddText(db *sqlite3.Conn, desc string, quantity int64) (err error) {
+	defer wrapError("ShoppingList.AddText", &err)
+	_, err = addShoppingItem(db, l, nil, "", desc, quantity)
+	return err
+}
+
+// ShoppingSources are the Items GenerateShoppingList puts on the list
+type ShoppingSources struct {
+	Favorites   bool  // every favorite
+	LowQuantity bool  // every Item with at most AtMost of it left
+	AtMost      int64 // zero means only the Items used up (see SCAN_CONSUME)
+}
+
+// GenerateShoppingList puts the Account's described Items from the
+// sources on its open shopping list (one of each, see AddItem), returning
+// how many were added: those already on the list are left as they are
+func GenerateShoppingList(db *sqlite3.Conn, a *Account, from ShoppingSources) (_ int64, err error) {
+	defer wrapError("GenerateShoppingList", &err)
+	l, err := GetShoppingList(db, a)
+	if err != nil {
+		return 0, err
+	}
+
+	var added int64
+	args := sqlite3.NamedArgs{"$l": l.Id, "$a": a.Id, "$q": from.AtMost, "$t": currentTime()}
+	err = withTransaction(db, func() error {
+		if from.Favorites {
+			if err := db.Exec(ADD_FAVORITES_TO_LIST, args); err != nil {
+				return err
+			}
+			added += int64(db.RowsAffected())
+		}
+		if from.LowQuantity {
+			if err := db.Exec(ADD_LOW_QUANTITY_TO_LIST, args); err != nil {
+				return err
+			}
+			added += int64(db.RowsAffected())
+		}
+		return nil
+	})
+	return added, err
+}
+
+// GetShoppingItem returns the item with the given id on the Account's open
+// shopping list, or ErrNoShoppingItem (the completed lists cannot change)
+func GetShoppingItem(db *sqlite3.Conn, a *Account, id int64) (_ *ShoppingItem, err error) {
+	defer wrapError("GetShoppingItem", &err)
+	items, err := fetchShoppingItems(db, GET_SHOPPING_ITEM, sqlite3.NamedArgs{"$i": id, "$a": a.Id})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrNoShoppingItem
+	}
+	return items[0], nil
+}
+
+// MoveTo changes the State of the item, which must be on the Account's
+// open shopping list, to the given one, provided it is one of the
+// SHOPPING_TRANSITIONS from its current State (or else ErrBadTransition
+// is returned), recording when it entered the new State. Going back a
+// state (e.g., out of the cart) clears the time of the one it left, and
+// going back out of SHOPPING_PURCHASED deletes the price paid (see Buy).
+func (s *ShoppingItem) MoveTo(db *sqlite3.Conn, a *Account, state string) (err error) {
+	defer wrapError("ShoppingItem.MoveTo", &err)
+	current, err := GetShoppingItem(db, a, s.Id)
+	if err != nil {
+		return err
+	}
+	if !current.CanMoveTo(state) {
+		return ErrBadTransition
+	}
+
+	now := Now().UTC().Truncate(time.Second)
+	next := *current
+	next.State = state
+	switch state {
+	case SHOPPING_NEEDED:
+		next.NeededAt, next.InCartAt, next.PurchasedAt = now, nil, nil
+	case SHOPPING_IN_CART:
+		next.InCartAt, next.PurchasedAt = &now, nil
+	case SHOPPING_PURCHASED:
+		next.PurchasedAt = &now
+	}
+
+	args := sqlite3.NamedArgs{"$i": s.Id,
+		"$f": current.State,
+		"$s": next.State,
+		"$n": sqliteTime(&next.NeededAt),
+		"$c": sqliteTime(next.InCartAt),
+		"$p": sqliteTime(next.PurchasedAt)}
+	err = withTransaction(db, func() error {
+		if err := db.Exec(SET_SHOPPING_STATE, args); err != nil {
+			return err
+		}
+		if db.RowsAffected() == 0 {
+			return ErrBadTransition // it moved meanwhile
+		}
+		if current.State == SHOPPING_PURCHASED {
+			// it was not bought after all (see Buy)
+			return db.Exec(DELETE_ITEM_PURCHASES, sqlite3.NamedArgs{"$i": s.Id})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*s = next
+	return nil
+}
+
+// SetQuantity changes how many of the item, which must be on the Account's
+// open shopping list, are needed
+func (s *ShoppingItem) SetQuantity(db *sqlite3.Conn, a *Account, quantity int64) (err error) {
+	defer wrapError("ShoppingItem.SetQuantity", &err)
+	if quantity < 1 {
+		return ErrBadShopping
+	}
+	args := sqlite3.NamedArgs{"$i": s.Id, "$a": a.Id, "$q": quantity}
+	if err := db.Exec(SET_SHOPPING_QUANTITY, args); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoShoppingItem
+	}
+	s.Quantity = quantity
+	return nil
+}
+
+// Remove takes the item off the Account's open shopping list
+func (s *ShoppingItem) Remove(db *sqlite3.Conn, a *Account) (err error) {
+	defer wrapError("ShoppingItem.Remove", &err)
+	if err := db.Exec(REMOVE_SHOPPING_ITEM, sqlite3.NamedArgs{"$i": s.Id, "$a": a.Id}); err != nil {
+		return err
+	}
+	if db.RowsAffected() == 0 {
+		return ErrNoShoppingItem
+	}
+	return nil
+}
+
+// CompleteShoppingList ends the Account's shopping trip: its open list
+// goes into its history (see GetShoppingHistory) as it is, and the items
+// not purchased are carried over, as needed, to a new open list. If
+// restock is set, the quantity of each Item purchased goes up by the
+// number bought (which should not be set if they are scanned in when put
+// away, with the restock scan mode, see SetScanMode). It returns the list
+// completed.
+func CompleteShoppingList(db *sqlite3.Conn, a *Account, restock bool) (_ *ShoppingList, err error) {
+	defer wrapError("CompleteShoppingList", &err)
+	l, err := GetShoppingList(db, a)
+	if err != nil {
+		return nil, err
+	}
+
+	var restocked int64
+	err = withTransaction(db, func() error {
+		args := sqlite3.NamedArgs{"$l": l.Id, "$a": a.Id, "$t": currentTime()}
+		if err := db.Exec(COMPLETE_SHOPPING_LIST, args); err != nil {
+			return err
+		}
+		if db.RowsAffected() == 0 {
+			return ErrNoShoppingItem // completed meanwhile
+		}
+		if restock {
+			var restockErr error
+			if restocked, restockErr = execProducts(db, RESTOCK_PURCHASED, args); restockErr != nil {
+				return restockErr
+			}
+		}
+
+		next, err := GetShoppingList(db, a)
+		if err != nil {
+			return err
+		}
+		args["$n"] = next.Id
+		return db.Exec(CARRY_OVER_SHOPPING_ITEMS, args)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	countItems(ITEM_UPDATED, restocked)
+	if restocked > 0 {
+		notifyItemChange(a.Id, ITEM_UPDATED)
+	}
+	now := Now().UTC().Truncate(time.Second)
+	l.Completed = &now
+	return l, nil
+}
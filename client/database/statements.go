@@ -0,0 +1,132 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"sync"
+	"time"
+)
+
+const (
+	// the most statements cached per connection: the sql of an in clause
+	// (see buildInClause) differs with the number of ids, so the rest are
+	// prepared each time, as usual
+	MAX_CACHED_STATEMENTS = 64
+)
+
+// cachedStmt is a statement prepared once, and reused for each query with
+// the same sql, unless it is busy (e.g., in a nested query)
+type cachedStmt struct {
+	stmt *sqlite3.Stmt
+	busy bool
+}
+
+var (
+	// the cached statements of each connection (see CacheStatements),
+	// keyed by their sql
+	stmtCaches     = make(map[*sqlite3.Conn]map[string]*cachedStmt)
+	stmtCacheMutex sync.Mutex
+)
+
+// CacheStatements makes the queries which read Items and Accounts (e.g.,
+// GetItems, or GetAccount) on the connection prepare their statements only
+// once, instead of on each call, which is worth it for a long-lived
+// connection (OpenDB does it for both of the DB's). The caller must call
+// ReleaseStatements before closing the connection.
+func CacheStatements(db *sqlite3.Conn) {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	if _, found := stmtCaches[db]; !found {
+		stmtCaches[db] = make(map[string]*cachedStmt)
+	}
+}
+
+// ReleaseStatements finalizes the connection's cached statements (see
+// CacheStatements), if any, which sqlite needs to actually close it, and
+// returns the first error, if any
+func ReleaseStatements(db *sqlite3.Conn) (err error) {
+	defer wrapError("ReleaseStatements", &err)
+	stmtCacheMutex.Lock()
+	cache := stmtCaches[db]
+	delete(stmtCaches, db)
+	stmtCacheMutex.Unlock()
+
+	for _, c := range cache {
+		if closeErr := c.stmt.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// prepareCached returns the connection's cached statement for the sql,
+// preparing (and caching) it if it is the first time, and reporting whether
+// it is cached, i.e., whether releaseCached must reset it, rather than
+// close it; a statement which is busy is prepared afresh instead
+func prepareCached(db *sqlite3.Conn, sql string) (*sqlite3.Stmt, bool, error) {
+	stmtCacheMutex.Lock()
+	cache, caching := stmtCaches[db]
+	if c, found := cache[sql]; found && !c.busy {
+		c.busy = true
+		stmtCacheMutex.Unlock()
+		return c.stmt, true, nil
+	}
+	stmtCacheMutex.Unlock()
+
+	s, err := db.Prepare(sql)
+	if err != nil || !caching {
+		return s, false, err
+	}
+
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	cache, caching = stmtCaches[db]
+	if _, found := cache[sql]; caching && !found && len(cache) < MAX_CACHED_STATEMENTS {
+		cache[sql] = &cachedStmt{stmt: s, busy: true}
+		return s, true, nil
+	}
+	return s, false, nil
+}
+
+// releaseCached returns the statement (from prepareCached) to the cache,
+// after resetting it, so that it no longer holds the read snapshot (or the
+// locks) of its last query, or else closes it
+func releaseCached(db *sqlite3.Conn, sql string, s *sqlite3.Stmt, cached bool) {
+	if !cached {
+		s.Close()
+		return
+	}
+	s.Reset()
+
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	// otherwise, ReleaseStatements has finalized it already
+	if c, found := stmtCaches[db][sql]; found && c.stmt == s {
+		c.busy = false
+	}
+}
+
+// queryRows runs the query with the connection's cached statement for the
+// sql (see CacheStatements), if it has one, and calls the function with the
+// statement on each row in turn, to Scan(), until there are no more, or the
+// function returns an error, which it returns (except for io.EOF, i.e., no
+// rows at all), counting how long it took (see Metrics)
+func queryRows(db *sqlite3.Conn, sql string, fn func(s *sqlite3.Stmt) error, args ...interface{}) error {
+	defer countQuery(time.Now())
+	s, cached, err := prepareCached(db, sql)
+	if err != nil {
+		return queryError(err)
+	}
+	defer releaseCached(db, sql, s, cached)
+
+	for err = s.Query(args...); err == nil; err = s.Next() {
+		if err = fn(s); err != nil {
+			return queryError(err)
+		}
+	}
+	return queryError(err)
+}
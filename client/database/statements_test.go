@@ -0,0 +1,157 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strconv"
+	"testing"
+)
+
+// cachedCount returns how many statements the connection has cached
+func cachedCount(db *sqlite3.Conn) int {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	return len(stmtCaches[db])
+}
+
+func TestCacheStatements(t *testing.T) {
+	db, err := NewTestDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAccount(t, db, "alice@example.org")
+	addTestItem(t, db, a, TEST_COLA, "Cola")
+
+	// nothing is cached, unless asked
+	if _, err := GetItems(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if n := cachedCount(db); n != 0 {
+		t.Errorf("%d statements cached before CacheStatements()", n)
+	}
+
+	CacheStatements(db)
+	for k := 0; k < 3; k++ {
+		items, err := GetItems(db, a)
+		if err != nil || len(items) != 1 || items[0].Desc != "Cola" {
+			t.Fatalf("GetItems() with the cache = %v, %v", items, err)
+		}
+		if got, err := GetAccount(db, a.Email); err != nil || got.Id != a.Id {
+			t.Fatalf("GetAccount() with the cache = %+v, %v", got, err)
+		}
+	}
+	cached := cachedCount(db)
+	if cached == 0 {
+		t.Fatal("no statements cached")
+	}
+	// each is reused, rather than cached again
+	if _, err := GetItems(db, a); err != nil {
+		t.Fatal(err)
+	}
+	if n := cachedCount(db); n != cached {
+		t.Errorf("%d statements cached after another GetItems(), want %d", n, cached)
+	}
+	// a write is seen by the cached statements
+	addTestItem(t, db, a, TEST_PENS, "Pens")
+	if items, err := GetItems(db, a); err != nil || len(items) != 2 {
+		t.Errorf("GetItems() after Add() = %v, %v, want both", items, err)
+	}
+
+	// the connection only closes once they are released
+	if err := ReleaseStatements(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := cachedCount(db); n != 0 {
+		t.Errorf("%d statements cached after ReleaseStatements()", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Close() after ReleaseStatements() = %v", err)
+	}
+}
+
+func TestPrepareCachedBusy(t *testing.T) {
+	db := newTestDB(t)
+	CacheStatements(db)
+	defer ReleaseStatements(db)
+
+	// a nested query with the same sql gets a statement of its own
+	const SQL = "select 1"
+	outer, outerCached, err := prepareCached(db, SQL)
+	if err != nil || !outerCached {
+		t.Fatalf("prepareCached() = %v, %v", outerCached, err)
+	}
+	inner, innerCached, err := prepareCached(db, SQL)
+	if err != nil || innerCached || inner == outer {
+		t.Fatalf("prepareCached() while busy = %v, %v, want a new statement", innerCached, err)
+	}
+	releaseCached(db, SQL, inner, innerCached)
+	releaseCached(db, SQL, outer, outerCached)
+
+	// and, once released, the cached one is reused
+	again, cached, err := prepareCached(db, SQL)
+	if err != nil || !cached || again != outer {
+		t.Errorf("prepareCached() after the release = %v, %v, want the cached statement", cached, err)
+	}
+	releaseCached(db, SQL, again, cached)
+}
+
+func TestCacheStatementsLimit(t *testing.T) {
+	db := newTestDB(t)
+	CacheStatements(db)
+	defer ReleaseStatements(db)
+
+	// e.g., the in clauses of each number of ids
+	for k := 0; k < MAX_CACHED_STATEMENTS+10; k++ {
+		err := queryRows(db, "select "+strconv.Itoa(k), func(s *sqlite3.Stmt) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cachedCount(db); n != MAX_CACHED_STATEMENTS {
+		t.Errorf("%d statements cached, want %d", n, MAX_CACHED_STATEMENTS)
+	}
+}
+
+// benchmarkStatements reads a history of 10k Items, and its Account, over
+// and over, with the statements cached, or not
+func benchmarkStatements(b *testing.B, cache bool) {
+	db := newTestDB(b)
+	a := newTestAccount(b, db, "alice@example.org")
+	fillHistory(b, db, a, 10000)
+	if cache {
+		CacheStatements(db)
+		b.Cleanup(func() { ReleaseStatements(db) })
+	}
+
+	b.Run("GetAccount", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GetAccount(db, a.Email); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetRecentItems", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GetRecentItems(db, a, 20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetItems", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if _, err := GetItems(db, a); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStatementsCached(b *testing.B) {
+	benchmarkStatements(b, true)
+}
+
+func BenchmarkStatementsUncached(b *testing.B) {
+	benchmarkStatements(b, false)
+}
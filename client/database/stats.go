@@ -0,0 +1,51 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+const (
+	// Prepared Statements
+	// Account statistics
+	COUNT_ACCOUNT_ITEMS  = "select count(*), coalesce(sum(is_favorite), 0) from product where account = $a and deleted_at is null"
+	COUNT_ITEMS_BY_INDEX = "select coalesce(product_ind, -1), count(*) from product where account = $a and deleted_at is null group by product_ind"
+	STATS_NULL_INDICATOR = BAD_PK // the ByIndicator key for Items without a product indicator
+)
+
+// AccountStats summarizes the Items of an Account
+type AccountStats struct {
+	Items       int64
+	Favorites   int64
+	ByIndicator map[int64]int64 // the number of Items with each product indicator
+}
+
+// GetAccountStats returns the totals for the Account's Items, along with
+// their counts by product indicator, where the Items which do not have one
+// are under STATS_NULL_INDICATOR (an empty Account has an empty map)
+func GetAccountStats(db *sqlite3.Conn, a *Account) (_ *AccountStats, err error) {
+	defer wrapError("GetAccountStats", &err)
+	result := &AccountStats{ByIndicator: make(map[int64]int64)}
+
+	args := sqlite3.NamedArgs{"$a": a.Id}
+	s, err := db.Query(COUNT_ACCOUNT_ITEMS, args)
+	for ; err == nil; err = s.Next() {
+		s.Scan(&result.Items, &result.Favorites)
+	}
+	if err = queryError(err); err != nil {
+		return result, err
+	}
+
+	s, err = db.Query(COUNT_ITEMS_BY_INDEX, args)
+	for ; err == nil; err = s.Next() {
+		var ind, count int64
+		s.Scan(&ind, &count)
+		result.ByIndicator[ind] = count
+	}
+
+	return result, queryError(err)
+}
@@ -0,0 +1,309 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Prepared Statements
+	// Storage usage and schema introspection
+	GET_TABLE_NAMES = "select name from sqlite_master where type = 'table' and name not like 'sqlite_%' order by name"
+	COUNT_ROWS      = "select count(*) from %s"
+	TABLE_INFO      = "pragma table_info(%s)"
+
+	// the name sqlite gives the db file a conn opens (as opposed to an
+	// attached one), for backups
+	MAIN_DATABASE = "main"
+
+	// Backup verification
+	INTEGRITY_CHECK = "pragma integrity_check"
+
+	// Space reclamation
+	DELETE_ACCOUNT_ITEMS = "delete from product where account = $a"
+	INCREMENTAL_VACUUM   = "pragma incremental_vacuum"
+)
+
+var (
+	// the files sqlite keeps alongside the db file, in WAL mode
+	SIDECAR_SUFFIXES = []string{"-wal", "-shm"}
+
+	// a table definition, and the name of the table it creates
+	CREATE_TABLE_FORMAT = regexp.MustCompile(`(?is)^\s*(?:--[^\n]*\n\s*)*CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?["\x60\[]?(\w+)`)
+)
+
+// DatabaseSize returns the total size, in bytes, of the db file defined by
+// the coordinates, including its WAL and shared memory files, if present
+func DatabaseSize(coords ConnCoordinates) (_ int64, err error) {
+	defer wrapError("DatabaseSize", &err)
+	file := path.Join(coords.DBPath, coords.DBFile)
+	info, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("no database file at %s", file)
+		}
+		return 0, err
+	}
+
+	size := info.Size()
+	for _, suffix := range SIDECAR_SUFFIXES {
+		if sidecar, err := os.Stat(file + suffix); err == nil {
+			size += sidecar.Size()
+		}
+	}
+	return size, nil
+}
+
+// ListTables returns the names of all the (non-internal) tables actually
+// present in the db, in alphabetical order
+func ListTables(db *sqlite3.Conn) (_ []string, err error) {
+	defer wrapError("ListTables", &err)
+	results := make([]string, 0)
+
+	s, err := db.Query(GET_TABLE_NAMES)
+	for ; err == nil; err = s.Next() {
+		var name string
+		s.Scan(&name)
+		results = append(results, name)
+	}
+	return results, queryError(err)
+}
+
+// ListColumns returns the names of the columns actually present in the
+// table, in their defined order, to help diagnose migration drift. The
+// table must be one of those listed by ListTables, since its name cannot
+// be bound as a parameter of the pragma.
+func ListColumns(db *sqlite3.Conn, table string) (_ []string, err error) {
+	defer wrapError("ListColumns", &err)
+	results := make([]string, 0)
+
+	tables, err := ListTables(db)
+	if err != nil {
+		return results, err
+	}
+	known := false
+	for _, t := range tables {
+		if t == table {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return results, fmt.Errorf("no such table: %s", table)
+	}
+
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(fmt.Sprintf(TABLE_INFO, table))
+	for ; err == nil; err = s.Next() {
+		var cid int64
+		s.Scan(&cid, row)
+		if name, found := row["name"].(string); found {
+			results = append(results, name)
+		}
+	}
+	return results, queryError(err)
+}
+
+// TableStats returns the number of rows in each table of the db, keyed by
+// table name, e.g., to show which history is worth pruning
+func TableStats(db *sqlite3.Conn) (_ map[string]int64, err error) {
+	defer wrapError("TableStats", &err)
+	results := make(map[string]int64)
+
+	tables, err := ListTables(db)
+	if err != nil {
+		return results, err
+	}
+	for _, table := range tables {
+		var count int64
+		s, err := db.Query(fmt.Sprintf(COUNT_ROWS, table))
+		if err != nil {
+			return results, err
+		}
+		s.Scan(&count)
+		s.Close()
+		results[table] = count
+	}
+	return results, nil
+}
+
+// DeleteItemsAndCompact removes all the Items of the Account, and then
+// immediately shrinks the db file by the pages this freed, returning the
+// number of Items removed. The shrinking requires auto_vacuum=INCREMENTAL,
+// which tables.sql sets, but which sqlite only applies to a brand new db
+// file: for an older one, the Items are still removed, but the file keeps
+// its size until a full VACUUM.
+func DeleteItemsAndCompact(db *sqlite3.Conn, a *Account) (_ int64, err error) {
+	defer wrapError("DeleteItemsAndCompact", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id}
+	n, err := execProducts(db, DELETE_ACCOUNT_ITEMS, args)
+	if err != nil {
+		return 0, err
+	}
+	countItems(ITEM_DELETED, n)
+	if n > 0 {
+		notifyItemChange(a.Id, ITEM_DELETED)
+	}
+
+	return n, db.Exec(INCREMENTAL_VACUUM)
+}
+
+// BackupTo copies the db, as of a single moment, to a new file at the path,
+// using the sqlite online backup api, so it is safe to call while other
+// conns are still reading and writing it (e.g., the scanner). The file must
+// not exist yet: it is never overwritten, and is removed again if the backup
+// fails partway. The copy can be opened with InitializeDB, like the original.
+func BackupTo(db *sqlite3.Conn, destPath string) (err error) {
+	defer wrapError("BackupTo", &err)
+	f, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("a file already exists at %s", destPath)
+		}
+		return err
+	}
+	f.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(destPath)
+		}
+	}()
+
+	dest, err := sqlite3.Open(destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	backup, err := db.Backup(MAIN_DATABASE, dest, MAIN_DATABASE)
+	if err != nil {
+		return err
+	}
+	// copy every page in one step: another conn writing meanwhile would
+	// make an incremental backup start over
+	if err = backup.Step(-1); err != io.EOF {
+		backup.Close()
+		if err == nil {
+			err = fmt.Errorf("the backup to %s did not complete", destPath)
+		}
+		return err
+	}
+	return backup.Close()
+}
+
+// RestoreFromBackup replaces the contents of the db with those of the
+// backup file (e.g., one written by BackupTo), using the sqlite online
+// backup api, so that the other conns see the restored db as soon as it is
+// complete, without reopening it. The backup must pass sqlite's integrity
+// check, and have the account and product tables, or the db is left as it
+// was. A backup from an earlier release is migrated once restored (see
+// InitializeSchema). Since the restore replaces everything, any process
+// holding Items in memory (e.g., the scanner's cache, see
+// DB.SetItemCacheSize) should be restarted, or use DB.RestoreFromBackup.
+func RestoreFromBackup(db *sqlite3.Conn, srcPath string) (err error) {
+	defer wrapError("RestoreFromBackup", &err)
+	if _, err = os.Stat(srcPath); err != nil {
+		return err
+	}
+	src, err := sqlite3.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err = checkBackup(src); err != nil {
+		return fmt.Errorf("%s cannot be restored: %s", srcPath, err)
+	}
+
+	backup, err := src.Backup(MAIN_DATABASE, db, MAIN_DATABASE)
+	if err != nil {
+		return err
+	}
+	if err = backup.Step(-1); err != io.EOF {
+		backup.Close()
+		if err == nil {
+			err = fmt.Errorf("the restore from %s did not complete", srcPath)
+		}
+		return err
+	}
+	if err = backup.Close(); err != nil {
+		return err
+	}
+
+	// the restored tables may be missing columns (and so, the cached list)
+	productColumnsFoundMutex.Lock()
+	delete(productColumnsFound, db.Path(MAIN_DATABASE))
+	productColumnsFoundMutex.Unlock()
+	return InitializeSchema(db, embeddedTables)
+}
+
+// checkBackup returns why the backup's conn is not a PiScan db which can be
+// restored, if it is not
+func checkBackup(src *sqlite3.Conn) error {
+	var result string
+	s, err := src.Query(INTEGRITY_CHECK)
+	if err != nil {
+		return err
+	}
+	s.Scan(&result)
+	s.Close()
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	tables, err := ListTables(src)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool)
+	for _, t := range tables {
+		found[t] = true
+	}
+	for _, t := range []string{"account", "product"} {
+		if !found[t] {
+			return fmt.Errorf("no %s table", t)
+		}
+	}
+	return nil
+}
+
+// RepairSchema runs only the table definitions in the schema whose tables
+// do not exist in the db (e.g., after an initialization which failed
+// partway), returning the names of the tables it created. Every other
+// statement in the schema (indexes, triggers, etc.) is skipped.
+func RepairSchema(db *sqlite3.Conn, schema string) (_ []string, err error) {
+	defer wrapError("RepairSchema", &err)
+	created := make([]string, 0)
+
+	tables, err := ListTables(db)
+	if err != nil {
+		return created, err
+	}
+	existing := make(map[string]bool)
+	for _, t := range tables {
+		existing[strings.ToLower(t)] = true
+	}
+
+	for _, statement := range splitStatements(schema) {
+		match := CREATE_TABLE_FORMAT.FindStringSubmatch(statement)
+		if match == nil || existing[strings.ToLower(match[1])] {
+			continue
+		}
+		if err := db.Exec(statement); err != nil {
+			return created, err
+		}
+		existing[strings.ToLower(match[1])] = true
+		created = append(created, match[1])
+	}
+	return created, nil
+}
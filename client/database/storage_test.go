@@ -0,0 +1,137 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// dumpItems returns the barcode and description of each of the Items of
+// every Account, keyed by email, to compare two dbs
+func dumpItems(t *testing.T, db *sqlite3.Conn) map[string][]string {
+	t.Helper()
+	accounts, err := GetAllAccounts(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string][]string)
+	for _, a := range accounts {
+		items, err := GetItems(db, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[a.Email] = make([]string, 0, len(items))
+		for _, i := range items {
+			results[a.Email] = append(results[a.Email], i.Barcode+" "+i.Desc)
+		}
+	}
+	return results
+}
+
+func sameItems(got, want map[string][]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for email, items := range want {
+		if len(got[email]) != len(items) {
+			return false
+		}
+		for k := range items {
+			if got[email][k] != items[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBackupTo(t *testing.T) {
+	d := newTestFileDB(t)
+	alice := newTestAccount(t, d.Write(), "alice@example.org")
+	bob := newTestAccount(t, d.Write(), "bob@example.org")
+	addTestItem(t, d.Write(), alice, TEST_COLA, "Cola")
+	addTestItem(t, d.Write(), alice, TEST_PENS, "Pens")
+	addTestItem(t, d.Write(), bob, TEST_GUM, "Gum")
+	want := dumpItems(t, d.Write())
+
+	// taken while a write is in progress, which it does not include
+	if err := d.Write().Begin(); err != nil {
+		t.Fatal(err)
+	}
+	addTestItem(t, d.Write(), bob, TEST_BOOK, "Book")
+	folder := t.TempDir()
+	dest := filepath.Join(folder, SQLITE_FILE)
+	if err := d.BackupTo(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write().Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := InitializeDB(ConnCoordinates{DBPath: folder, DBFile: SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if got := dumpItems(t, backup); !sameItems(got, want) {
+		t.Errorf("the backup has %v, want %v", got, want)
+	}
+
+	// an existing file is never overwritten
+	before, _ := ioutil.ReadFile(dest)
+	if err := d.BackupTo(dest); err == nil {
+		t.Error("BackupTo() an existing file succeeded")
+	}
+	if after, _ := ioutil.ReadFile(dest); string(after) != string(before) {
+		t.Error("BackupTo() changed the existing file")
+	}
+	// nor is a file left behind by a backup which fails
+	missing := filepath.Join(folder, "missing", SQLITE_FILE)
+	if err := d.BackupTo(missing); err == nil {
+		t.Error("BackupTo() a missing folder succeeded")
+	}
+}
+
+func TestRestoreFromBackup(t *testing.T) {
+	d := newTestFileDB(t)
+	a := newTestAccount(t, d.Write(), "alice@example.org")
+	addTestItem(t, d.Write(), a, TEST_COLA, "Cola")
+	want := dumpItems(t, d.Write())
+	dest := filepath.Join(t.TempDir(), SQLITE_FILE)
+	if err := d.BackupTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	addTestItem(t, d.Write(), a, TEST_PENS, "Pens")
+	if err := d.RestoreFromBackup(dest); err != nil {
+		t.Fatal(err)
+	}
+	// both connections see the restored db
+	if got := dumpItems(t, d.Write()); !sameItems(got, want) {
+		t.Errorf("the restored db has %v, want %v", got, want)
+	}
+	if items, err := d.GetItems(a); err != nil || len(items) != 1 {
+		t.Errorf("GetItems() on the read connection = %v, %v, want only the cola", items, err)
+	}
+
+	// a db which is not PiScan's is not restored
+	other := filepath.Join(t.TempDir(), "other.sqlite")
+	db, err := sqlite3.Open(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("create table note (body text)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if err := d.RestoreFromBackup(other); err == nil {
+		t.Error("RestoreFromBackup() of another db succeeded")
+	}
+	if got := dumpItems(t, d.Write()); !sameItems(got, want) {
+		t.Errorf("the failed restore left %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"strings"
+	"time"
+)
+
+const (
+	// Deleted products (for existing db files; see also tables.sql)
+	CREATE_TOMBSTONES = `CREATE TABLE IF NOT EXISTS product_tombstone (
+	id           integer primary key AUTOINCREMENT,
+	product      integer NOT NULL,
+	barcode      text NOT NULL,
+	account      integer REFERENCES account(id),
+	deleted      datetime DEFAULT (datetime('now'))
+)`
+
+	// Keeps product.updated current (for existing db files; see also
+	// tables.sql) for any update which does not set it explicitly
+	CREATE_UPDATED_TRIGGER = `CREATE TRIGGER IF NOT EXISTS product_updated AFTER UPDATE ON product
+FOR EACH ROW WHEN new.updated IS old.updated
+BEGIN
+	UPDATE product SET updated = datetime('now') WHERE id = new.id;
+END`
+
+	// Prepared Statements
+	// Every product delete statement starts with this prefix, so that
+	// the matching tombstones can be created (and the rows which refer to
+	// the products deleted) with the same where clause
+	DELETE_PRODUCTS    = "delete from product where"
+	TOMBSTONE_PRODUCTS = "insert into product_tombstone (product, barcode, account, deleted) select id, barcode, account, $t from product where"
+	DELETE_REFERENCES  = "delete from %s where product in (select id from product where%s)"
+
+	// Sync cursors
+	GET_ITEMS_CHANGED = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is null and updated >= $s order by updated"
+	GET_DELETED_ITEMS = "select product, deleted from product_tombstone where account = $a and deleted >= $s union all select id, deleted_at from product where account = $a and deleted_at >= $s order by 2"
+)
+
+var (
+	// the tables whose rows refer to a product (by its id, in the product
+	// column), and which are deleted along with it
+	PRODUCT_REFERENCES = []string{"item_list", "product_availability", "pending_sync"}
+)
+
+// execProducts runs the statement against the product table, returning the
+// number of rows affected. Deletes also create a tombstone for each row, and
+// delete the rows which refer to it (see PRODUCT_REFERENCES), in the same
+// transaction, so that no list (or vendor) is left with a dangling product.
+// Any error, including a foreign key violation (if foreign keys are enforced)
+// rolls the whole delete back. The current time is bound to $t, unless the
+// caller has already done so.
+func execProducts(db *sqlite3.Conn, sql string, args sqlite3.NamedArgs) (int64, error) {
+	if _, found := args["$t"]; !found {
+		args["$t"] = currentTime()
+	}
+
+	var n int64
+	err := withTransaction(db, func() error {
+		if strings.HasPrefix(sql, DELETE_PRODUCTS) {
+			tombstones := strings.Replace(sql, DELETE_PRODUCTS, TOMBSTONE_PRODUCTS, 1)
+			if err := db.Exec(tombstones, args); err != nil {
+				return err
+			}
+			clause := strings.TrimPrefix(sql, DELETE_PRODUCTS)
+			for _, table := range PRODUCT_REFERENCES {
+				if err := db.Exec(fmt.Sprintf(DELETE_REFERENCES, table, clause), args); err != nil {
+					return err
+				}
+			}
+		}
+		if err := db.Exec(sql, args); err != nil {
+			return err
+		}
+		n = int64(db.RowsAffected())
+		return nil
+	})
+	if err != nil {
+		countQueryError()
+	}
+	return n, err
+}
+
+// GetItemsChangedSince returns the Items for this Account which were added
+// or updated at or after the given time, oldest change first. A sync client
+// keeps the most recent Item.Updated it has seen, and passes it back next
+// time, to fetch only what changed in between (see also GetDeletedSince).
+func GetItemsChangedSince(db *sqlite3.Conn, a *Account, since time.Time) (_ []*Item, err error) {
+	defer wrapError("GetItemsChangedSince", &err)
+	args := sqlite3.NamedArgs{"$a": a.Id, "$s": sqliteTime(&since)}
+	return fetchItems(db, GET_ITEMS_CHANGED, args)
+}
+
+// GetDeletedSince returns the ids of the Items for this Account which were
+// deleted (or moved to the trash, see Item.Delete) at or after the given
+// time, i.e., the counterpart of GetItemsChangedSince for removals. An Item
+// which is purged later is reported again, then.
+func GetDeletedSince(db *sqlite3.Conn, a *Account, since time.Time) (_ []int64, err error) {
+	defer wrapError("GetDeletedSince", &err)
+	results := make([]int64, 0)
+
+	args := sqlite3.NamedArgs{"$a": a.Id, "$s": sqliteTime(&since)}
+	s, err := db.Query(GET_DELETED_ITEMS, args)
+	for ; err == nil; err = s.Next() {
+		var product int64
+		var deleted string
+		s.Scan(&product, &deleted)
+		results = append(results, product)
+	}
+
+	return results, queryError(err)
+}
+
+// Equals reports whether the two Items have the same barcode, description,
+// index, favorite flag, and quantity, i.e., everything a sync client can
+// change, ignoring the ids and timestamps, which differ between the local
+// and the remote copies of the same Item
+func (i *Item) Equals(other *Item) bool {
+	if other == nil {
+		return false
+	}
+	sameIndex := (i.Index == nil && other.Index == nil) ||
+		(i.Index != nil && other.Index != nil && *i.Index == *other.Index)
+	return sameIndex &&
+		i.Barcode == other.Barcode &&
+		i.Desc == other.Desc &&
+		i.IsFavorite == other.IsFavorite &&
+		i.Quantity == other.Quantity
+}
+
+// itemsByBarcode maps each barcode to the first of the Items which has it
+func itemsByBarcode(items []*Item) map[string]*Item {
+	results := make(map[string]*Item, len(items))
+	for _, i := range items {
+		if _, found := results[i.Barcode]; !found {
+			results[i.Barcode] = i
+		}
+	}
+	return results
+}
+
+// DiffItems compares the local Items with the remote ones, by barcode (only
+// the first Item with a given barcode is compared, on either side), and
+// returns what needs to change locally to match: the remote Items whose
+// barcode is not local (toAdd), the remote Items which differ from the local
+// ones (toUpdate, see Equals), as copies with the local Id, and the local
+// Items whose barcode is not remote (toDelete)
+func DiffItems(local, remote []*Item) (toAdd, toUpdate, toDelete []*Item) {
+	toAdd = make([]*Item, 0)
+	toUpdate = make([]*Item, 0)
+	toDelete = make([]*Item, 0)
+
+	localItems := itemsByBarcode(local)
+	remoteItems := itemsByBarcode(remote)
+	for _, r := range remote {
+		if remoteItems[r.Barcode] != r {
+			continue // not the first with this barcode
+		}
+		l, found := localItems[r.Barcode]
+		if !found {
+			toAdd = append(toAdd, r)
+		} else if !l.Equals(r) {
+			update := *r
+			update.Id = l.Id
+			toUpdate = append(toUpdate, &update)
+		}
+	}
+	for _, l := range local {
+		if localItems[l.Barcode] != l {
+			continue
+		}
+		if _, found := remoteItems[l.Barcode]; !found {
+			toDelete = append(toDelete, l)
+		}
+	}
+
+	return toAdd, toUpdate, toDelete
+}
@@ -0,0 +1,183 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"testing"
+)
+
+// countReferences returns how many rows of the PRODUCT_REFERENCES tables
+// refer to the Item
+func countReferences(t *testing.T, db *sqlite3.Conn, i *Item) int64 {
+	t.Helper()
+	var n int64
+	for _, table := range PRODUCT_REFERENCES {
+		n += countRows(t, db, "select count(*) from "+table+" where product = ?", i.Id)
+	}
+	return n
+}
+
+// addReferences puts the Item on a list, and a vendor
+func addReferences(t *testing.T, db *sqlite3.Conn, a *Account, i *Item) {
+	t.Helper()
+	if err := AddToList(db, a, "shopping", i); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.AddTag(db, a, "drinks"); err != nil {
+		t.Fatal(err)
+	}
+	vendor, err := AddVendor(db, "shop-"+i.Barcode, "The Shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddVendorProduct(db, "SKU-"+i.Barcode, vendor, i.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n := countReferences(t, db, i); n != 3 {
+		t.Fatalf("%d rows refer to the item, want 3", n)
+	}
+}
+
+func TestPurgeDeletesReferences(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Exec("pragma foreign_keys = on"); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+	addReferences(t, db, a, cola)
+	addReferences(t, db, a, pens)
+
+	if err := cola.Purge(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := countReferences(t, db, cola); n != 0 {
+		t.Errorf("%d rows still refer to the purged item", n)
+	}
+	if items, err := GetItemsInList(db, a, "shopping"); err != nil || len(items) != 1 || items[0].Id != pens.Id {
+		t.Errorf("GetItemsInList() = %v, %v, want only the pens", items, err)
+	}
+	// the other Item's rows are left alone
+	if n := countReferences(t, db, pens); n != 3 {
+		t.Errorf("%d rows refer to the other item, want 3", n)
+	}
+
+	// the trash, once emptied, too
+	if err := pens.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := countReferences(t, db, pens); n != 3 {
+		t.Errorf("%d rows refer to the item in the trash, want 3", n)
+	}
+	if n, err := PurgeDeleted(db, 0); err != nil || n != 1 {
+		t.Fatalf("PurgeDeleted(0) = %d, %v, want 1", n, err)
+	}
+	if n := countReferences(t, db, pens); n != 0 {
+		t.Errorf("%d rows still refer to the purged item", n)
+	}
+}
+
+func TestPurgeForeignKeyRollback(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Exec("pragma foreign_keys = on"); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	addReferences(t, db, a, cola)
+
+	// a table which refers to products, but which the deletes do not know
+	if err := db.Exec("create table review (product integer REFERENCES product(id))"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert into review (product) values (?)", cola.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := cola.Purge(db); err == nil {
+		t.Fatal("Purge() ignored the foreign key violation")
+	}
+
+	// nothing was deleted: neither the Item, nor its rows, nor a tombstone
+	if n := countRows(t, db, "select count(*) from product where id = ?", cola.Id); n != 1 {
+		t.Error("the item was deleted")
+	}
+	if n := countReferences(t, db, cola); n != 3 {
+		t.Errorf("%d rows refer to the item, after the rollback, want 3", n)
+	}
+	if n := countRows(t, db, "select count(*) from product_tombstone"); n != 0 {
+		t.Errorf("%d tombstones, after the rollback, want none", n)
+	}
+}
+
+func TestItemEquals(t *testing.T) {
+	one, two := int64(1), int64(2)
+	base := Item{Id: 1, Barcode: TEST_COLA, Desc: "Cola", Index: &one, Quantity: 2, PostedTime: testTime}
+	same := base
+	same.Id, same.PostedTime, same.Updated, same.AccountId = 9, testTime.AddDate(1, 0, 0), testTime, 3
+	otherIndex := base
+	otherIndex.Index = &two
+	sameIndex := base
+	sameIndex.Index = new(int64)
+	*sameIndex.Index = 1
+
+	tests := []struct {
+		name  string
+		other *Item
+		want  bool
+	}{
+		{"ids and times differ", &same, true},
+		{"index at another address", &sameIndex, true},
+		{"nil", nil, false},
+		{"barcode", &Item{Barcode: TEST_PENS, Desc: "Cola", Index: &one, Quantity: 2}, false},
+		{"desc", &Item{Barcode: TEST_COLA, Desc: "Diet Cola", Index: &one, Quantity: 2}, false},
+		{"index", &otherIndex, false},
+		{"no index", &Item{Barcode: TEST_COLA, Desc: "Cola", Quantity: 2}, false},
+		{"favorite", &Item{Barcode: TEST_COLA, Desc: "Cola", Index: &one, Quantity: 2, IsFavorite: true}, false},
+		{"quantity", &Item{Barcode: TEST_COLA, Desc: "Cola", Index: &one, Quantity: 3}, false},
+	}
+	for _, test := range tests {
+		if got := base.Equals(test.other); got != test.want {
+			t.Errorf("Equals(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDiffItems(t *testing.T) {
+	local := []*Item{
+		{Id: 1, Barcode: TEST_COLA, Desc: "Cola", Quantity: 1},
+		{Id: 2, Barcode: TEST_PENS, Desc: "Pens", Quantity: 1},
+		{Id: 3, Barcode: TEST_GUM, Desc: "Gum", Quantity: 1},
+		{Id: 4, Barcode: TEST_GUM, Desc: "Another gum", Quantity: 1},
+	}
+	remote := []*Item{
+		{Id: 10, Barcode: TEST_COLA, Desc: "Cola", Quantity: 1},      // unchanged
+		{Id: 11, Barcode: TEST_PENS, Desc: "Pens", Quantity: 5},      // updated
+		{Id: 12, Barcode: TEST_BOOK, Desc: "Book", Quantity: 1},      // added
+		{Id: 13, Barcode: TEST_BOOK, Desc: "Same book", Quantity: 1}, // not the first
+	}
+
+	toAdd, toUpdate, toDelete := DiffItems(local, remote)
+	if len(toAdd) != 1 || toAdd[0] != remote[2] {
+		t.Errorf("toAdd = %v, want the book", toAdd)
+	}
+	if len(toUpdate) != 1 || toUpdate[0].Id != 2 || toUpdate[0].Quantity != 5 {
+		t.Errorf("toUpdate = %v, want the remote pens, with the local id", toUpdate)
+	}
+	if remote[1].Id != 11 {
+		t.Errorf("DiffItems() changed the remote id to %d", remote[1].Id)
+	}
+	if len(toDelete) != 1 || toDelete[0] != local[2] {
+		t.Errorf("toDelete = %v, want the first gum", toDelete)
+	}
+
+	// nothing to do between identical lists, or empty ones
+	for _, items := range [][]*Item{local, nil} {
+		toAdd, toUpdate, toDelete := DiffItems(items, items)
+		if len(toAdd)+len(toUpdate)+len(toDelete) != 0 {
+			t.Errorf("DiffItems() of the same %d items = %v, %v, %v", len(items), toAdd, toUpdate, toDelete)
+		}
+	}
+}
@@ -4,16 +4,55 @@
 -- datatypes (https://www.sqlite.org/datatype3.html), so the analogous
 -- server database columns have been adjusted accordingly.
 
+-- Let DeleteItemsAndCompact return the pages it frees to the filesystem.
+-- This only takes effect when the db file is first created (i.e., before
+-- any table exists), so it changes nothing for existing db files.
+
+PRAGMA auto_vacuum = INCREMENTAL;
+
 -- `account` defines basic end-user information, corresponding to the
 -- account table in the server database
 
 CREATE TABLE IF NOT EXISTS account (
-	id       integer primary key AUTOINCREMENT,
-	email    text NOT NULL,
-	api_code text NOT NULL,
+	id           integer primary key AUTOINCREMENT,
+	email        text NOT NULL,
+	api_code     text NOT NULL,
+	name         text, -- display name: defaults to the local part of the email
+	scan_mode    text DEFAULT 'restock', -- what a repeated scan means: restock or consume
+	verified_at  datetime, -- when the email was verified (null until it is, or once it changes)
+	verify_token text, -- the sha256 of the token in the verification link last sent
+	verify_sent  datetime,
+	pin_hash     text, -- the salted hash of the PIN which logs in to the WebApp (see Account.SetPIN)
+	is_admin     integer DEFAULT 0, -- 0 = false, 1 = true: can manage the other accounts
 	UNIQUE(email)
 );
 
+CREATE INDEX IF NOT EXISTS account_api_code ON account(api_code);
+
+-- `session` defines who is logged in to the WebApp (see NewSession), by
+-- the sha256 of each session cookie
+
+CREATE TABLE IF NOT EXISTS session (
+	id           integer primary key AUTOINCREMENT,
+	token        text NOT NULL,
+	account      integer REFERENCES account(id),
+	created      datetime DEFAULT (datetime('now')),
+	expires      datetime NOT NULL,
+	UNIQUE(token)
+);
+
+-- `device` defines the scanners sharing the database (e.g., one in the
+-- kitchen, and one in the garage), each registered by its serial, which
+-- never changes, with a display name (see RegisterDevice)
+
+CREATE TABLE IF NOT EXISTS device (
+	id           integer primary key AUTOINCREMENT,
+	serial       text NOT NULL,
+	name         text NOT NULL,
+	last_seen    datetime DEFAULT (datetime('now')), -- when it last scanned (see Device.Seen)
+	UNIQUE(serial)
+);
+
 -- `product` defines the items scanned, edited (when the barcode lookup
 -- resulted in no matches), and favorited by a given end-user
 
@@ -21,14 +60,161 @@ CREATE TABLE IF NOT EXISTS product (
 	id           integer primary key AUTOINCREMENT,
 	barcode      text NOT NULL,
 	product_desc text, -- can be null: means the scanned item is unknown
-	product_ind  integer DEFAULT 0, -- to distinguish multiple products with the same barcode
+	product_ind  integer, -- to distinguish multiple products with the same barcode: null if there is none
 	is_favorite  integer DEFAULT 0, -- 0 = false, 1 = true
 	is_edit      integer DEFAULT 0, -- 0 = false, 1 = true
 	posted       datetime DEFAULT (datetime('now')),
+	updated      datetime DEFAULT (datetime('now')), -- changed by every product update
+	expires      datetime, -- can be null: means the item never expires
 	account      integer REFERENCES account(id),
-	UNIQUE(barcode, product_desc)
+	scan_count   integer DEFAULT 1, -- incremented by repeated scans (see RecordScan)
+	note         text, -- can be null: the user's own remarks about the item
+	raw_payload  text DEFAULT '', -- the whole scan, when the barcode was extracted from it
+	quantity     integer DEFAULT 1, -- how many of the product the end-user has
+	deleted_at   datetime, -- can be null: set while the product is in the trash (see Item.Delete)
+	source       text, -- can be null: where the product was scanned (see Item.Source)
+	device       integer REFERENCES device(id), -- can be null: the scanner which scanned it (see Item.DeviceId)
+	UNIQUE(account, barcode, product_desc) -- each end-user has their own products
 ); 
 
+CREATE INDEX IF NOT EXISTS product_account_expires ON product(account, expires) WHERE expires IS NOT NULL;
+
+-- the products of each end-user are looked up by barcode (e.g., by
+-- RecordScan), which is not unique: each description of a barcode saved by
+-- Item.Add is a product of its own
+
+CREATE INDEX IF NOT EXISTS product_account_barcode ON product(account, barcode);
+
+-- the history of each end-user is listed (and counted, and filtered by
+-- date) in posted order, and so is each end-user's list of favorites
+
+CREATE INDEX IF NOT EXISTS product_account_posted ON product(account, posted);
+CREATE INDEX IF NOT EXISTS product_favorite_posted ON product(account, posted) WHERE is_favorite = 1;
+
+-- the favorites (or the rest) of each end-user are also listed in barcode
+-- order (see ItemQuery)
+
+CREATE INDEX IF NOT EXISTS product_account_favorite_barcode ON product(account, is_favorite, barcode);
+
+-- `item_audit` is the history of changes to each product, written by
+-- triggers on the product table, while it is enabled (see EnableItemAudit)
+
+CREATE TABLE IF NOT EXISTS item_audit (
+	id           integer primary key AUTOINCREMENT,
+	product      integer NOT NULL, -- the id of the product row
+	account      integer REFERENCES account(id),
+	event        text NOT NULL, -- add, delete, favorite, unfavorite, or update
+	logged       datetime DEFAULT (datetime('now'))
+);
+
+-- `product_updated` sets the updated time of any product row changed by a
+-- statement which does not set it explicitly (e.g., an ad-hoc update from
+-- the sqlite3 shell). The package's own updates all set it, according to
+-- its clock (see Now), which then takes precedence.
+
+CREATE TRIGGER IF NOT EXISTS product_updated AFTER UPDATE ON product
+FOR EACH ROW WHEN new.updated IS old.updated
+BEGIN
+	UPDATE product SET updated = datetime('now') WHERE id = new.id;
+END;
+
+-- `product_search` is the full-text index of the product descriptions
+-- (see SearchItems), which stores no copy of them: the triggers after it
+-- keep it in sync with every insert, delete, and change of description
+
+CREATE VIRTUAL TABLE IF NOT EXISTS product_search USING fts4(content="product", product_desc);
+
+CREATE TRIGGER IF NOT EXISTS product_search_insert AFTER INSERT ON product
+BEGIN
+	INSERT INTO product_search (docid, product_desc) VALUES (new.id, new.product_desc);
+END;
+
+CREATE TRIGGER IF NOT EXISTS product_search_delete BEFORE DELETE ON product
+BEGIN
+	DELETE FROM product_search WHERE docid = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS product_search_unindex BEFORE UPDATE OF product_desc ON product
+BEGIN
+	DELETE FROM product_search WHERE docid = old.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS product_search_reindex AFTER UPDATE OF product_desc ON product
+BEGIN
+	INSERT INTO product_search (docid, product_desc) VALUES (new.id, new.product_desc);
+END;
+
+-- `scan_log` is the history of each end-user's scans, written by the
+-- triggers after it for every product added (or scanned again, or
+-- restored), deleted, favorited, or unfavorited (see GetScanHistory), and
+-- for every duplicate scan which was ignored (see IgnoreScan)
+
+CREATE TABLE IF NOT EXISTS scan_log (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	product      integer NOT NULL, -- the id of the product row (which may since have been deleted)
+	barcode      text NOT NULL,
+	action       text NOT NULL, -- add, delete, favorite, unfavorite, or duplicate
+	source       text, -- can be null: where the product was scanned
+	device       integer REFERENCES device(id), -- can be null: the scanner which scanned it
+	logged       datetime DEFAULT (datetime('now'))
+);
+
+CREATE INDEX IF NOT EXISTS scan_log_account_logged ON scan_log(account, logged);
+
+CREATE TRIGGER IF NOT EXISTS scan_log_insert AFTER INSERT ON product
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_rescan AFTER UPDATE OF scan_count ON product
+FOR EACH ROW WHEN new.scan_count > old.scan_count
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_delete AFTER DELETE ON product
+FOR EACH ROW WHEN old.deleted_at IS NULL
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (old.account, old.id, old.barcode, 'delete', old.source, old.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_trash AFTER UPDATE OF deleted_at ON product
+FOR EACH ROW WHEN new.deleted_at IS NOT NULL AND old.deleted_at IS NULL
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'delete', new.source, new.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_restore AFTER UPDATE OF deleted_at ON product
+FOR EACH ROW WHEN new.deleted_at IS NULL AND old.deleted_at IS NOT NULL AND new.scan_count = old.scan_count
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'add', new.source, new.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_favorite AFTER UPDATE OF is_favorite ON product
+FOR EACH ROW WHEN new.is_favorite = 1 AND old.is_favorite = 0
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'favorite', new.source, new.device);
+END;
+
+CREATE TRIGGER IF NOT EXISTS scan_log_unfavorite AFTER UPDATE OF is_favorite ON product
+FOR EACH ROW WHEN new.is_favorite = 0 AND old.is_favorite = 1
+BEGIN
+	INSERT INTO scan_log (account, product, barcode, action, source, device) VALUES (new.account, new.id, new.barcode, 'unfavorite', new.source, new.device);
+END;
+
+-- `product_tombstone` records the products which have been deleted, so
+-- that anything syncing with the client (see GetDeletedSince) can tell
+-- them apart from products it has simply not seen yet
+
+CREATE TABLE IF NOT EXISTS product_tombstone (
+	id           integer primary key AUTOINCREMENT,
+	product      integer NOT NULL, -- the id of the deleted product row
+	barcode      text NOT NULL,
+	account      integer REFERENCES account(id),
+	deleted      datetime DEFAULT (datetime('now'))
+);
+
 -- `vendor` defines the list of commercial vendors for products.
 -- vendor_id is the description/result of the vendor's API, and
 -- display_name is the string to use in the UI.
@@ -53,3 +239,110 @@ CREATE TABLE IF NOT EXISTS product_availability (
 	UNIQUE(product_code, product, vendor)
 );
 
+-- each product listed looks up where it can be purchased
+
+CREATE INDEX IF NOT EXISTS product_availability_product ON product_availability(product);
+
+-- `list` defines the named lists of products (e.g., "shopping") created by
+-- a given end-user, in addition to the favorites (which are the products
+-- flagged with is_favorite), and `item_list` defines which products are in
+-- each list. The lists double as the end-user's tags (see Item.AddTag).
+
+CREATE TABLE IF NOT EXISTS list (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	name         text NOT NULL,
+	UNIQUE(account, name)
+);
+
+CREATE TABLE IF NOT EXISTS item_list (
+	list         integer REFERENCES list(id),
+	product      integer REFERENCES product(id),
+	PRIMARY KEY(list, product)
+);
+
+-- `shopping_list` defines the shopping trips of a given end-user: the open
+-- one (there is never more than one), and the completed ones, kept as the
+-- history of what was bought (see CompleteShoppingList), and
+-- `shopping_item` defines what is on each, and where it is in the trip
+
+CREATE TABLE IF NOT EXISTS shopping_list (
+	id           integer primary key AUTOINCREMENT,
+	account      integer REFERENCES account(id),
+	created      datetime DEFAULT (datetime('now')),
+	completed    datetime -- can be null: means the list is still open
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS shopping_list_open ON shopping_list(account) WHERE completed IS NULL;
+
+CREATE TABLE IF NOT EXISTS shopping_item (
+	id           integer primary key AUTOINCREMENT,
+	list         integer REFERENCES shopping_list(id),
+	product      integer, -- can be null: the id of the product row it was added from (which may since have been deleted)
+	barcode      text,
+	product_desc text NOT NULL, -- copied from the product, so the history outlives it
+	quantity     integer DEFAULT 1, -- how many to buy
+	state        text DEFAULT 'needed', -- needed, in_cart, or purchased (see ShoppingItem.MoveTo)
+	needed_at    datetime DEFAULT (datetime('now')), -- when it last entered each state
+	in_cart_at   datetime,
+	purchased_at datetime,
+	UNIQUE(list, product)
+);
+
+-- `purchase` defines the prices paid by a given end-user, for each barcode
+-- (or anything else bought), where, and when (see RecordPurchase), so the
+-- price history of each product can be compared across stores
+
+CREATE TABLE IF NOT EXISTS purchase (
+	id            integer primary key AUTOINCREMENT,
+	account       integer REFERENCES account(id),
+	barcode       text, -- can be null: for something bought which was never scanned
+	product_desc  text,
+	price         integer NOT NULL, -- for each one, in hundredths of the currency (e.g., cents)
+	currency      text NOT NULL, -- the ISO 4217 code, e.g., USD
+	store         text, -- can be null: if the store is not known
+	quantity      integer DEFAULT 1,
+	purchased     datetime DEFAULT (datetime('now')),
+	shopping_item integer -- can be null: the id of the shopping_item row it was bought as
+);
+
+CREATE INDEX IF NOT EXISTS purchase_barcode ON purchase(barcode, purchased);
+
+-- `expiry_warning` records each product a given end-user has been warned
+-- is about to expire (see WarnExpiring), at the expiration time it had
+-- then, so that it is warned about once, unless its expiration changes
+
+CREATE TABLE IF NOT EXISTS expiry_warning (
+	product integer primary key REFERENCES product(id),
+	account integer REFERENCES account(id),
+	expires datetime NOT NULL, -- the product's expiration time, when it was warned about
+	warned  datetime NOT NULL
+);
+
+-- `pending_sync` is the queue of products still to be sent to the API
+-- server (e.g., scanned while the Pi had no network), each retried with
+-- a backoff until it is synced (see QueueItemSync)
+
+CREATE TABLE IF NOT EXISTS pending_sync (
+	id           integer primary key AUTOINCREMENT,
+	product      integer REFERENCES product(id),
+	attempts     integer DEFAULT 0, -- how many times sending it has failed
+	last_error   text, -- can be null: why it failed the last time
+	queued       datetime DEFAULT (datetime('now')),
+	next_attempt datetime DEFAULT (datetime('now')), -- when it is due to be (re)tried
+	synced       datetime, -- can be null: means it has not been sent yet
+	UNIQUE(product)
+);
+
+-- `product_catalog` caches what the product providers (e.g., Open Food
+-- Facts) know about each barcode, including the barcodes they do not have
+-- (with a null product_desc), so that each one is looked up only once
+-- (see LookupCatalog)
+
+CREATE TABLE IF NOT EXISTS product_catalog (
+	barcode      text primary key,
+	product_desc text, -- can be null: means the provider did not find it
+	brand        text, -- can be null: if the provider did not have one
+	provider     text NOT NULL, -- the name of the provider
+	fetched      datetime DEFAULT (datetime('now'))
+);
@@ -0,0 +1,73 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// Prepared Statements
+	// Deleted products, not yet purged (see Item.Delete)
+	SOFT_DELETE_ITEM  = "update product set deleted_at = $t, updated = $t where id = $i and deleted_at is null"
+	SOFT_DELETE_OWNED = "update product set deleted_at = $t, updated = $t where id = $i and account = $a and deleted_at is null"
+	RESTORE_ITEM      = "update product set deleted_at = null, updated = $t where id = $i and deleted_at is not null"
+	RESTORE_OWNED     = "update product set deleted_at = null, updated = $t where id = $i and account = $a and deleted_at is not null"
+	GET_DELETED       = "select " + ITEM_COLUMNS + " from product where account = $a and deleted_at is not null order by deleted_at desc, id desc"
+	PURGE_DELETED     = "delete from product where deleted_at is not null and deleted_at <= $d"
+)
+
+// restoreItem takes the Account's Item out of the trash, reporting whether
+// it was there, i.e., whether it is visible again
+func restoreItem(db *sqlite3.Conn, a *Account, id int64) (bool, error) {
+	args := sqlite3.NamedArgs{"$i": id, "$a": a.Id, "$t": currentTime()}
+	if err := db.Exec(RESTORE_OWNED, args); err != nil {
+		return false, err
+	}
+	return db.RowsAffected() > 0, nil
+}
+
+// Restore undoes Delete: the Item is back in every query, as it was (in the
+// same lists, with the same posted time), returning ErrNoItem if there is no
+// such Item in the trash (e.g., it was purged already)
+func (i *Item) Restore(db *sqlite3.Conn) (err error) {
+	defer wrapError("Item.Restore", &err)
+	n, err := execItemChange(db, RESTORE_ITEM, i.Id, nil, ITEM_ADDED)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoItem
+	}
+	return nil
+}
+
+// Purge deletes the Item for good, whether it is in the trash or not (and
+// removes it from any lists, see execProducts)
+func (i *Item) Purge(db *sqlite3.Conn) (err error) {
+	defer wrapError("Item.Purge", &err)
+	_, err = execItemChange(db, DELETE_ITEM, i.Id, nil, ITEM_DELETED)
+	return err
+}
+
+// GetDeletedItems returns the Items of this Account which are in the trash,
+// most recently deleted first, e.g., for the user to pick one to Restore
+func GetDeletedItems(db *sqlite3.Conn, a *Account) (_ []*Item, err error) {
+	defer wrapError("GetDeletedItems", &err)
+	return fetchItems(db, GET_DELETED, sqlite3.NamedArgs{"$a": a.Id})
+}
+
+// PurgeDeleted deletes for good every Item (for all Accounts) which has been
+// in the trash for longer than the given duration, returning the number of
+// Items removed, e.g., as a nightly maintenance task. Zero empties the trash.
+func PurgeDeleted(db *sqlite3.Conn, olderThan time.Duration) (_ int64, err error) {
+	defer wrapError("PurgeDeleted", &err)
+	cutoff := Now().Add(-olderThan)
+	args := sqlite3.NamedArgs{"$d": sqliteTime(&cutoff)}
+	// not counted again: they were, when they were deleted
+	return execProducts(db, PURGE_DELETED, args)
+}
@@ -0,0 +1,108 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPurgeDeleted(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	pens := addTestItem(t, db, a, TEST_PENS, "Pens")
+	addTestItem(t, db, a, TEST_GUM, "Gum")
+
+	// the cola is trashed first, the pens a day later, by the test clock
+	if err := cola.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, "select count(*) from product where id = ? and deleted_at = ?", cola.Id, sqliteTime(now)); n != 1 {
+		t.Fatalf("the cola was not trashed at %s", *now)
+	}
+	*now = now.Add(24 * time.Hour)
+	if err := pens.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// an hour later, nothing has been in the trash for two days
+	*now = now.Add(time.Hour)
+	if n, err := PurgeDeleted(db, 48*time.Hour); err != nil || n != 0 {
+		t.Errorf("PurgeDeleted(48h) = %d, %v, want 0", n, err)
+	}
+	// but the cola has been there for a day
+	if n, err := PurgeDeleted(db, 24*time.Hour); err != nil || n != 1 {
+		t.Errorf("PurgeDeleted(24h) = %d, %v, want 1", n, err)
+	}
+	deleted, err := GetDeletedItems(db, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Id != pens.Id {
+		t.Errorf("GetDeletedItems() = %v, want only the pens", deleted)
+	}
+
+	// zero empties the trash, leaving the Items which were not in it
+	if n, err := PurgeDeleted(db, 0); err != nil || n != 1 {
+		t.Errorf("PurgeDeleted(0) = %d, %v, want 1", n, err)
+	}
+	if n := countRows(t, db, "select count(*) from product"); n != 1 {
+		t.Errorf("%d products are left, want only the gum", n)
+	}
+}
+
+func TestTrashedItemUnreachable(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	cola := addTestItem(t, db, a, TEST_COLA, "Cola")
+	if err := cola.Delete(db); err != nil {
+		t.Fatal(err)
+	}
+	const ROW = "select count(*) from product where id = ? and is_favorite = 0 and quantity = 1 and product_desc = 'Cola'"
+
+	if i, err := GetSingleItem(db, a, cola.Id); err != nil || i.Id != BAD_PK {
+		t.Errorf("GetSingleItem() of a trashed item = %+v, %v, want none", i, err)
+	}
+	if err := cola.Favorite(db); err != nil {
+		t.Errorf("Favorite() of a trashed item = %v", err)
+	}
+	if err := cola.FavoriteWithNote(db, "note"); !errors.Is(err, ErrNoItem) {
+		t.Errorf("FavoriteWithNote() of a trashed item = %v, want ErrNoItem", err)
+	}
+	if n, err := FavoriteItems(db, a, []int64{cola.Id}, true); err != nil || n != 0 {
+		t.Errorf("FavoriteItems() of a trashed item = %d, %v, want 0", n, err)
+	}
+	if err := cola.IncrementQuantity(db, 2); !errors.Is(err, ErrNoItem) {
+		t.Errorf("IncrementQuantity() of a trashed item = %v, want ErrNoItem", err)
+	}
+	if err := cola.Update(db, "Diet Cola", 0); !errors.Is(err, ErrNoItem) {
+		t.Errorf("Update() of a trashed item = %v, want ErrNoItem", err)
+	}
+	if err := SetDescription(db, cola.Id, "Diet Cola"); !errors.Is(err, ErrNoItem) {
+		t.Errorf("SetDescription() of a trashed item = %v, want ErrNoItem", err)
+	}
+	if n, err := UpdateDescriptions(db, map[int64]string{cola.Id: "Diet Cola"}); err != nil || n != 0 {
+		t.Errorf("UpdateDescriptions() of a trashed item = %d, %v, want 0", n, err)
+	}
+	if n, err := UpdateItems(db, map[int64]Item{cola.Id: {Desc: "Diet Cola"}}); err != nil || n != 0 {
+		t.Errorf("UpdateItems() of a trashed item = %d, %v, want 0", n, err)
+	}
+	if n := countRows(t, db, ROW, cola.Id); n != 1 {
+		t.Error("the trashed item was changed")
+	}
+
+	// until it is restored
+	if err := cola.Restore(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := cola.IncrementQuantity(db, 2); err != nil || cola.Quantity != 3 {
+		t.Errorf("IncrementQuantity() after Restore() = %v, quantity %d, want 3", err, cola.Quantity)
+	}
+	if i, err := GetSingleItem(db, a, cola.Id); err != nil || i.Id != cola.Id || i.Quantity != 3 {
+		t.Errorf("GetSingleItem() after Restore() = %+v, %v", i, err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"time"
+)
+
+const (
+	// how long the link sent to verify an Account's email works
+	VERIFY_TOKEN_TTL = 48 * time.Hour
+
+	// the random bytes in each verification token
+	VERIFY_TOKEN_BYTES = 32
+
+	// Prepared Statements
+	// Account email verification
+	SET_VERIFY_TOKEN  = "update account set verify_token = $t, verify_sent = $s where id = $i"
+	GET_VERIFY_TOKEN  = "select id, email, strftime('%s', verify_sent) from account where verify_token = $t"
+	VERIFY_ACCOUNT    = "update account set verified_at = $v, verify_token = null where id = $i and verify_token = $t"
+	GET_VERIFIED      = "select strftime('%s', verified_at) from account where id = $i"
+	SET_API_CODE      = "update account set api_code = $a where id = $i"
+	GET_ACCOUNT_BY_ID = "select id, email, api_code, name from account where id = $i"
+)
+
+var (
+	ErrBadToken     = errors.New("this verification link is invalid, or has already been used")
+	ErrTokenExpired = errors.New("this verification link has expired: ask for a new one")
+	ErrNoEntropy    = errors.New("no random source for a new api code")
+
+	ErrAnonymousVerify = errors.New("the anonymous account has no email to verify")
+)
+
+// NewAPICode returns a new random api code, an undashed (version 4) uuid,
+// from the operating system's cryptographically secure random source
+func NewAPICode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", ErrNoEntropy
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the form in which the token is stored, so that the db
+// file alone is not enough to verify an Account
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartVerification returns a new token for the link which verifies the
+// Account's email (see VerifyAccount), replacing any sent before, valid for
+// VERIFY_TOKEN_TTL. The anonymous account has no email to verify.
+func (a *Account) StartVerification(db *sqlite3.Conn) (_ string, err error) {
+	defer wrapError("Account.StartVerification", &err)
+	if a.IsAnonymous() {
+		return "", ErrAnonymousVerify
+	}
+	b := make([]byte, VERIFY_TOKEN_BYTES)
+	if _, err = rand.Read(b); err != nil {
+		return "", ErrNoEntropy
+	}
+	token := hex.EncodeToString(b)
+	now := Now()
+	args := sqlite3.NamedArgs{"$i": a.Id, "$t": hashToken(token), "$s": sqliteTime(&now)}
+	if err = db.Exec(SET_VERIFY_TOKEN, args); err != nil {
+		return "", err
+	}
+	if db.RowsAffected() == 0 {
+		return "", ErrNoAccount
+	}
+	return token, nil
+}
+
+// VerifyAccount marks the Account whose verification link had the token as
+// verified, and returns it, or ErrBadToken if no Account has the token (e.g.,
+// it was used already, or its email changed since), or ErrTokenExpired
+func VerifyAccount(db *sqlite3.Conn, token string) (_ *Account, err error) {
+	defer wrapError("VerifyAccount", &err)
+	hashed := hashToken(token)
+	var id int64
+	var sent time.Time
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_VERIFY_TOKEN, sqlite3.NamedArgs{"$t": hashed})
+	for ; err == nil; err = s.Next() {
+		s.Scan(&id, row)
+		if t, found := row["strftime('%s', verify_sent)"].(string); found {
+			sent, _ = unixTime(t)
+		}
+	}
+	if err = queryError(err); err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, ErrBadToken
+	}
+	if Now().Sub(sent) > VERIFY_TOKEN_TTL {
+		return nil, ErrTokenExpired
+	}
+
+	now := Now()
+	args := sqlite3.NamedArgs{"$i": id, "$t": hashed, "$v": sqliteTime(&now)}
+	if err = db.Exec(VERIFY_ACCOUNT, args); err != nil {
+		return nil, err
+	}
+	if db.RowsAffected() == 0 {
+		return nil, ErrBadToken
+	}
+	return getAccountById(db, id)
+}
+
+// IsVerified reports whether the Account's current email has been verified
+// (see VerifyAccount): changing it (see Update) makes it unverified again
+func (a *Account) IsVerified(db *sqlite3.Conn) (_ bool, err error) {
+	defer wrapError("Account.IsVerified", &err)
+	verified := false
+	row := make(sqlite3.RowMap)
+	s, err := db.Query(GET_VERIFIED, sqlite3.NamedArgs{"$i": a.Id})
+	for ; err == nil; err = s.Next() {
+		s.Scan(row)
+		_, verified = row["strftime('%s', verified_at)"].(string)
+	}
+	return verified, queryError(err)
+}
+
+// RegenerateAPICode replaces the Account's api code with a new random one
+// (e.g., if the old one has leaked), so that the old one no longer works,
+// and returns it
+func (a *Account) RegenerateAPICode(db *sqlite3.Conn) (_ string, err error) {
+	defer wrapError("Account.RegenerateAPICode", &err)
+	code, err := NewAPICode()
+	if err != nil {
+		return "", err
+	}
+	if err = db.Exec(SET_API_CODE, sqlite3.NamedArgs{"$i": a.Id, "$a": code}); err != nil {
+		return "", err
+	}
+	if db.RowsAffected() == 0 {
+		return "", ErrNoAccount
+	}
+	a.APICode = code
+	return code, nil
+}
+
+func getAccountById(db *sqlite3.Conn, id int64) (*Account, error) {
+	accounts, err := fetchAccounts(db, GET_ACCOUNT_BY_ID, sqlite3.NamedArgs{"$i": id})
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, ErrNoAccount
+	}
+	return accounts[0], nil
+}
@@ -0,0 +1,106 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewAPICode(t *testing.T) {
+	seen := make(map[string]bool)
+	for k := 0; k < 100; k++ {
+		code, err := NewAPICode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ValidAPICode(code) || len(code) != 32 || code[12] != '4' {
+			t.Errorf("NewAPICode() = %q, want a version 4 uuid", code)
+		}
+		if seen[code] {
+			t.Errorf("NewAPICode() returned %q twice", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestVerifyAccount(t *testing.T) {
+	now := fixClock(t)
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	if verified, err := a.IsVerified(db); err != nil || verified {
+		t.Errorf("IsVerified() of a new Account = %v, %v", verified, err)
+	}
+
+	// only the latest token works
+	old, err := a.StartVerification(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.StartVerification(db)
+	if err != nil || token == old {
+		t.Fatalf("StartVerification() again = %q, %v, want a new token", token, err)
+	}
+	// which is not what is stored
+	if n := countRows(t, db, "select count(*) from account where verify_token = ?", token); n != 0 {
+		t.Error("the token is stored as is")
+	}
+	if _, err := VerifyAccount(db, old); !errors.Is(err, ErrBadToken) {
+		t.Errorf("VerifyAccount() with the replaced token = %v, want ErrBadToken", err)
+	}
+
+	*now = now.Add(VERIFY_TOKEN_TTL - time.Minute)
+	verified, err := VerifyAccount(db, token)
+	if err != nil || verified.Id != a.Id || verified.Email != a.Email {
+		t.Fatalf("VerifyAccount() = %+v, %v", verified, err)
+	}
+	if ok, err := a.IsVerified(db); err != nil || !ok {
+		t.Errorf("IsVerified() after VerifyAccount() = %v, %v", ok, err)
+	}
+	// once
+	if _, err := VerifyAccount(db, token); !errors.Is(err, ErrBadToken) {
+		t.Errorf("VerifyAccount() again = %v, want ErrBadToken", err)
+	}
+
+	// a new email is not verified, until its own link is used, in time
+	if err := a.Update(db, "alice@example.com", a.APICode); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.IsVerified(db); err != nil || ok {
+		t.Errorf("IsVerified() after a new email = %v, %v", ok, err)
+	}
+	token, err = a.StartVerification(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(VERIFY_TOKEN_TTL + time.Minute)
+	if _, err := VerifyAccount(db, token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("VerifyAccount() of an expired token = %v, want ErrTokenExpired", err)
+	}
+
+	anonymous := &Account{Email: ANONYMOUS_EMAIL}
+	if _, err := anonymous.StartVerification(db); !errors.Is(err, ErrAnonymousVerify) {
+		t.Errorf("StartVerification() of the anonymous Account = %v, want ErrAnonymousVerify", err)
+	}
+	if _, err := (&Account{Id: BAD_PK, Email: "nobody@example.org"}).StartVerification(db); !errors.Is(err, ErrNoAccount) {
+		t.Errorf("StartVerification() of a missing Account = %v, want ErrNoAccount", err)
+	}
+}
+
+func TestRegenerateAPICode(t *testing.T) {
+	db := newTestDB(t)
+	a := newTestAccount(t, db, "alice@example.org")
+	old := a.APICode
+	code, err := a.RegenerateAPICode(db)
+	if err != nil || code == old || a.APICode != code || !ValidAPICode(code) {
+		t.Fatalf("RegenerateAPICode() = %q, %v, replacing %q", code, err, old)
+	}
+	if got, err := GetAccountByAPICode(db, code); err != nil || got.Id != a.Id {
+		t.Errorf("GetAccountByAPICode() of the new code = %+v, %v", got, err)
+	}
+	if _, err := GetAccountByAPICode(db, old); !errors.Is(err, ErrNoAccount) {
+		t.Errorf("GetAccountByAPICode() of the old code = %v, want ErrNoAccount", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package enrich fills in the descriptions of the scanned Items which have
+// none, from the product catalogs which implement database.Provider: a
+// dump of the Open Product Database (POD), the Open Food Facts api
+// (https://world.openfoodfacts.org/data), or several of them, in turn
+
+package enrich
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/barcode"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	OFF_NAME     = "openfoodfacts"
+	OFF_API_HOST = "https://world.openfoodfacts.org"
+	OFF_PRODUCT  = "%s/api/v0/product/%s.json"
+	OFF_FOUND    = 1 // the api's status for a barcode it has
+	OFF_TIMEOUT  = 10 * time.Second
+
+	// Open Food Facts asks every api client to identify itself
+	USER_AGENT = "PiScan - Raspberry Pi - https://github.com/Banrai/PiScan"
+
+	POD_NAME = "pod"
+
+	// the POD gtin table columns (see server/database/products.sql)
+	POD_CODE_COLUMN = "gtin_cd"
+	POD_NAME_COLUMN = "gtin_nm"
+)
+
+// OpenFoodFacts looks up each barcode with the Open Food Facts api
+type OpenFoodFacts struct {
+	Host   string       // defaults to OFF_API_HOST
+	Client *http.Client // defaults to one with OFF_TIMEOUT
+}
+
+// offProduct is the part of the api's product reply which is used
+type offProduct struct {
+	Status  int `json:"status"`
+	Product struct {
+		Name   string `json:"product_name"`
+		Brands string `json:"brands"`
+	} `json:"product"`
+}
+
+func (o *OpenFoodFacts) Name() string {
+	return OFF_NAME
+}
+
+// Lookup returns the product's name and brand (the first one, if there are
+// several), or nil if Open Food Facts does not have the barcode (or has it,
+// without a name)
+func (o *OpenFoodFacts) Lookup(code string) (*database.CatalogEntry, error) {
+	host := o.Host
+	if host == "" {
+		host = OFF_API_HOST
+	}
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: OFF_TIMEOUT}
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(OFF_PRODUCT, host, url.PathEscape(code)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", USER_AGENT)
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open food facts lookup: %s", res.Status)
+	}
+
+	var reply offProduct
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(reply.Product.Name)
+	if reply.Status != OFF_FOUND || name == "" {
+		return nil, nil
+	}
+	brand := strings.TrimSpace(strings.Split(reply.Product.Brands, ",")[0])
+	return &database.CatalogEntry{Desc: name, Brand: brand, Provider: OFF_NAME}, nil
+}
+
+// PODDump looks up each barcode in a csv export of the POD gtin table, read
+// into memory (see NewPODDump), so it needs no network at all
+type PODDump struct {
+	names map[string]string // by barcode, normalized
+}
+
+// NewPODDump reads the csv file, whose header must name the gtin_cd and
+// gtin_nm columns (in any order, among any others), skipping the rows whose
+// code is not a valid barcode
+func NewPODDump(path string) (*PODDump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	codeAt, nameAt := -1, -1
+	for j, column := range header {
+		switch strings.ToLower(strings.TrimSpace(column)) {
+		case POD_CODE_COLUMN:
+			codeAt = j
+		case POD_NAME_COLUMN:
+			nameAt = j
+		}
+	}
+	if codeAt < 0 || nameAt < 0 {
+		return nil, fmt.Errorf("%s: the header must have the %s and %s columns", path, POD_CODE_COLUMN, POD_NAME_COLUMN)
+	}
+
+	pod := &PODDump{names: make(map[string]string)}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if codeAt >= len(record) || nameAt >= len(record) {
+			continue
+		}
+		code, codeErr := barcode.Normalize(record[codeAt])
+		if name := strings.TrimSpace(record[nameAt]); codeErr == nil && name != "" {
+			pod.names[code] = name
+		}
+	}
+	return pod, nil
+}
+
+func (p *PODDump) Name() string {
+	return POD_NAME
+}
+
+// Lookup returns the product's name, or nil if the dump does not have it
+func (p *PODDump) Lookup(code string) (*database.CatalogEntry, error) {
+	name, found := p.names[code]
+	if !found {
+		return nil, nil
+	}
+	return &database.CatalogEntry{Desc: name, Provider: POD_NAME}, nil
+}
+
+// Chain tries each of the Providers in turn, e.g., the POD dump first, then
+// the Open Food Facts api, for a barcode the dump does not have
+type Chain []database.Provider
+
+// Name is the names of all the Providers, in order
+func (c Chain) Name() string {
+	names := make([]string, 0, len(c))
+	for _, p := range c {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Lookup returns the first of the Providers' entries for the barcode, or
+// nil if none of them has it. A Provider which fails is skipped, but, if
+// none has it, the first failure is returned, so that it is tried again.
+func (c Chain) Lookup(code string) (*database.CatalogEntry, error) {
+	var failed error
+	for _, p := range c {
+		entry, err := p.Lookup(code)
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		if entry != nil {
+			if entry.Provider == "" {
+				entry.Provider = p.Name()
+			}
+			return entry, nil
+		}
+	}
+	return nil, failed
+}
+
+// Backfill describes each of the Account's Items which has no description,
+// from the Provider (through the product_catalog cache, see
+// database.LookupCatalog), returning how many were described. Each Item is
+// looked up, and saved, on its own, on the DB's write connection, so the
+// scanner can keep saving its scans in between.
+func Backfill(store *database.DB, a *database.Account, p database.Provider) (int, error) {
+	var items []*database.Item
+	err := store.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		items, err = database.GetUndescribedItems(db, a)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	described := 0
+	for _, item := range items {
+		err = store.WithWrite(func(db *sqlite3.Conn) error {
+			entry, err := database.LookupCatalog(db, p, item.Barcode)
+			if err != nil || entry == nil {
+				return err
+			}
+			if err := database.SetDescription(db, item.Id, entry.Desc); err != nil {
+				// e.g., the same product is saved already, under this
+				// description (or the Item is gone): leave it as is
+				return nil
+			}
+			described += 1
+			return nil
+		})
+		if err != nil {
+			return described, err
+		}
+	}
+	return described, nil
+}
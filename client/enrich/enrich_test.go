@@ -0,0 +1,221 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package enrich
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	COLA = "036000291452"
+	PENS = "4006381333931"
+)
+
+// fakeProvider has the descriptions of some barcodes, and counts how many
+// times each barcode is looked up
+type fakeProvider struct {
+	name    string
+	descs   map[string]string
+	err     error
+	lookups map[string]int
+}
+
+func (f *fakeProvider) Name() string {
+	return f.name
+}
+
+func (f *fakeProvider) Lookup(code string) (*database.CatalogEntry, error) {
+	if f.lookups == nil {
+		f.lookups = make(map[string]int)
+	}
+	f.lookups[code] += 1
+	if f.err != nil {
+		return nil, f.err
+	}
+	desc, found := f.descs[code]
+	if !found {
+		return nil, nil
+	}
+	return &database.CatalogEntry{Desc: desc}, nil
+}
+
+func TestOpenFoodFacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != USER_AGENT {
+			t.Errorf("the lookup was sent as %q", r.Header.Get("User-Agent"))
+		}
+		switch r.URL.Path {
+		case "/api/v0/product/" + COLA + ".json":
+			fmt.Fprint(w, `{"status": 1, "product": {"product_name": " Cola ", "brands": "Fizz, Fizz Co"}}`)
+		case "/api/v0/product/" + PENS + ".json":
+			fmt.Fprint(w, `{"status": 1, "product": {"product_name": "", "brands": "Pens Co"}}`)
+		case "/api/v0/product/000000000000.json":
+			fmt.Fprint(w, `{"status": 0, "status_verbose": "product not found"}`)
+		case "/api/v0/product/111111111117.json":
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	o := &OpenFoodFacts{Host: server.URL}
+
+	entry, err := o.Lookup(COLA)
+	if err != nil || entry == nil || entry.Desc != "Cola" || entry.Brand != "Fizz" || entry.Provider != OFF_NAME {
+		t.Errorf("Lookup(%q) = %+v, %v", COLA, entry, err)
+	}
+	// neither a product without a name, nor one which it does not have, is found
+	for _, code := range []string{PENS, "000000000000", "222222222224"} {
+		if entry, err := o.Lookup(code); err != nil || entry != nil {
+			t.Errorf("Lookup(%q) = %+v, %v, want nil", code, entry, err)
+		}
+	}
+	if _, err := o.Lookup("111111111117"); err == nil {
+		t.Error("Lookup() from a server which is down succeeded")
+	}
+}
+
+func TestNewPODDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gtin.csv")
+	dump := "GTIN_NM,brand,GTIN_CD\n" +
+		"Cola,Fizz," + COLA + "\n" +
+		"Pens,," + PENS + "\n" +
+		"Not a barcode,,036000291453\n" +
+		",,000000000000\n" +
+		"Short\n"
+	if err := ioutil.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pod, err := NewPODDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pod.names) != 2 {
+		t.Errorf("NewPODDump() read %v, want only the cola and the pens", pod.names)
+	}
+	if entry, err := pod.Lookup(COLA); err != nil || entry == nil || entry.Desc != "Cola" || entry.Provider != POD_NAME {
+		t.Errorf("Lookup(%q) = %+v, %v", COLA, entry, err)
+	}
+	if entry, err := pod.Lookup("000000000000"); err != nil || entry != nil {
+		t.Errorf("Lookup() of a barcode without a name = %+v, %v, want nil", entry, err)
+	}
+
+	// the header must have both columns
+	if err := ioutil.WriteFile(path, []byte("gtin_cd,brand\n"+COLA+",Fizz\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPODDump(path); err == nil {
+		t.Error("NewPODDump() without a gtin_nm column succeeded")
+	}
+}
+
+func TestChain(t *testing.T) {
+	down := &fakeProvider{name: "down", err: errors.New("no network")}
+	pod := &fakeProvider{name: "pod", descs: map[string]string{COLA: "Cola"}}
+	off := &fakeProvider{name: "off", descs: map[string]string{COLA: "Cola Classic", PENS: "Pens"}}
+	c := Chain{down, pod, off}
+	if name := c.Name(); name != "down,pod,off" {
+		t.Errorf("Name() = %q", name)
+	}
+
+	// the first which has it, and names it
+	if entry, err := c.Lookup(COLA); err != nil || entry == nil || entry.Desc != "Cola" || entry.Provider != "pod" {
+		t.Errorf("Lookup(%q) = %+v, %v, want the pod's", COLA, entry, err)
+	}
+	if off.lookups[COLA] != 0 {
+		t.Error("Lookup() went on past the Provider which had it")
+	}
+	if entry, err := c.Lookup(PENS); err != nil || entry == nil || entry.Provider != "off" {
+		t.Errorf("Lookup(%q) = %+v, %v, want the off's", PENS, entry, err)
+	}
+	// which none has, but one failed to look up
+	if entry, err := c.Lookup("000000000000"); err != down.err || entry != nil {
+		t.Errorf("Lookup() of an unknown barcode = %+v, %v, want the failure", entry, err)
+	}
+	if entry, err := (Chain{pod, off}).Lookup("000000000000"); err != nil || entry != nil {
+		t.Errorf("Lookup() of an unknown barcode = %+v, %v, want nil", entry, err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	now := time.Date(2015, time.March, 14, 9, 26, 53, 0, time.UTC)
+	database.Now = func() time.Time { return now }
+	defer func() { database.Now = time.Now }()
+
+	d, err := database.OpenDB(database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	code, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&database.Account{Email: "alice@example.org", APICode: code}).Add(d.Write()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := d.GetAccount("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, barcode := range []string{COLA, PENS} {
+		if _, err := d.AddItem(a, &database.Item{Barcode: barcode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	descs := func() map[string]string {
+		items, err := d.GetItems(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := make(map[string]string)
+		for _, i := range items {
+			results[i.Barcode] = i.Desc
+		}
+		return results
+	}
+
+	// a failed lookup is not cached
+	p := &fakeProvider{name: "fake", err: errors.New("no network")}
+	if n, err := Backfill(d, a, p); err == nil || n != 0 {
+		t.Errorf("Backfill() with the Provider down = %d, %v, want the failure", n, err)
+	}
+	p.err = nil
+	p.descs = map[string]string{COLA: "Cola"}
+	if n, err := Backfill(d, a, p); err != nil || n != 1 {
+		t.Fatalf("Backfill() = %d, %v, want 1", n, err)
+	}
+	if got := descs(); got[COLA] != "Cola" || got[PENS] != "" {
+		t.Errorf("Backfill() described %v, want only the cola", got)
+	}
+	if p.lookups[COLA] != 2 || p.lookups[PENS] != 1 {
+		t.Errorf("Backfill() looked up %v", p.lookups)
+	}
+
+	// but a barcode it does not have is, until CATALOG_RETRY
+	p.descs[PENS] = "Pens"
+	if n, err := Backfill(d, a, p); err != nil || n != 0 || p.lookups[PENS] != 1 {
+		t.Errorf("Backfill() again = %d, %v, after %d lookups of the pens, want none", n, err, p.lookups[PENS])
+	}
+	now = now.Add(database.CATALOG_RETRY + time.Hour)
+	if n, err := Backfill(d, a, p); err != nil || n != 1 || p.lookups[PENS] != 2 {
+		t.Errorf("Backfill() after CATALOG_RETRY = %d, %v, after %d lookups of the pens, want 1, 2", n, err, p.lookups[PENS])
+	}
+
+	// and one it has is never looked up again
+	if _, err := d.AddItem(a, &database.Item{Barcode: COLA}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Backfill(d, a, p); err != nil || p.lookups[COLA] != 2 {
+		t.Errorf("Backfill() of a cached barcode = %d, %v, after %d lookups, want 2", n, err, p.lookups[COLA])
+	}
+}
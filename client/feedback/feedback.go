@@ -0,0 +1,213 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package feedback signals the outcome of each scan on the Pi's GPIO pins,
+// with LEDs and a piezo buzzer, for a scanner running headless, without a
+// screen to confirm that each scan was recorded. The pins are driven
+// through the sysfs gpio interface (https://www.kernel.org/doc/Documentation/gpio/sysfs.txt),
+// so they need no other library.
+
+package feedback
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// Scan outcomes
+	SUCCESS   = "success"   // saved, with its description
+	DUPLICATE = "duplicate" // scanned before, so only its quantity changed
+	UNKNOWN   = "unknown"   // saved, but no one had its description
+	ERROR     = "error"     // not saved (e.g., not a barcode, or the db failed)
+	IGNORED   = "ignored"   // scanned again right away, so not recorded (a duplicate scan)
+
+	GPIO_PATH = "/sys/class/gpio"
+
+	// how long a newly exported pin takes to be writable (udev sets its
+	// permissions)
+	EXPORT_WAIT = 100 * time.Millisecond
+
+	SHORT = 80 * time.Millisecond
+	LONG  = 400 * time.Millisecond
+	GAP   = 80 * time.Millisecond
+)
+
+// Step turns a pin on (or off) for a while
+type Step struct {
+	On  bool
+	For time.Duration
+}
+
+// Pattern is the Steps a pin goes through, ending off
+type Pattern []Step
+
+func beeps(n int, d time.Duration) Pattern {
+	p := make(Pattern, 0, 2*n)
+	for j := 0; j < n; j++ {
+		p = append(p, Step{On: true, For: d}, Step{On: false, For: GAP})
+	}
+	return p
+}
+
+// The buzzer pattern, and LED lit, for each outcome
+var (
+	BUZZER_PATTERNS = map[string]Pattern{
+		SUCCESS:   beeps(1, SHORT),
+		DUPLICATE: beeps(2, SHORT),
+		UNKNOWN:   beeps(1, LONG),
+		ERROR:     beeps(3, LONG),
+		IGNORED:   {}, // silent, so a trigger which bounced does not sound like another scan
+	}
+	LED_PATTERNS = map[string]Pattern{
+		SUCCESS:   {{On: true, For: time.Second}},
+		DUPLICATE: beeps(2, 250*time.Millisecond),
+		UNKNOWN:   {{On: true, For: time.Second}},
+		ERROR:     {{On: true, For: 2 * time.Second}},
+		IGNORED:   beeps(1, SHORT),
+	}
+)
+
+// Pin is a GPIO output, e.g., an LED, or a buzzer
+type Pin interface {
+	Set(on bool) error
+}
+
+// GPIOPin is an output pin, by its sysfs number (which, on recent kernels,
+// may be offset from the Broadcom number printed on the Pi's pinout: see
+// the base of /sys/class/gpio/gpiochip*)
+type GPIOPin struct {
+	Number int
+	value  *os.File
+}
+
+// OpenGPIOPin exports the pin (if it is not already), and sets it as an
+// output, initially off
+func OpenGPIOPin(number int) (*GPIOPin, error) {
+	dir := filepath.Join(GPIO_PATH, fmt.Sprintf("gpio%d", number))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := writeFile(filepath.Join(GPIO_PATH, "export"), strconv.Itoa(number)); err != nil {
+			return nil, err
+		}
+		time.Sleep(EXPORT_WAIT)
+	}
+	// "low" sets it as an output which starts off
+	if err := writeFile(filepath.Join(dir, "direction"), "low"); err != nil {
+		return nil, err
+	}
+	value, err := os.OpenFile(filepath.Join(dir, "value"), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &GPIOPin{Number: number, value: value}, nil
+}
+
+func (p *GPIOPin) Set(on bool) error {
+	v := "0"
+	if on {
+		v = "1"
+	}
+	_, err := p.value.WriteAt([]byte(v), 0)
+	return err
+}
+
+// Close turns the pin off, and releases it (without unexporting it, since
+// another process may have exported it)
+func (p *GPIOPin) Close() error {
+	p.Set(false)
+	return p.value.Close()
+}
+
+func writeFile(path, value string) error {
+	return os.WriteFile(path, []byte(value), 0)
+}
+
+// Feedback plays the pattern of each outcome on its pins: the Green LED for
+// a success, the Yellow one for a duplicate (or an ignored one), or an
+// unknown barcode, the Red one for an error, and the Buzzer for all of them
+// except an ignored duplicate (each is optional). It must be created with
+// New.
+type Feedback struct {
+	Green, Yellow, Red, Buzzer Pin
+
+	signals chan string
+}
+
+// New returns the Feedback on the pins (any of which may be nil), which
+// plays each outcome (see Signal) from its own goroutine
+func New(green, yellow, red, buzzer Pin) *Feedback {
+	f := &Feedback{Green: green, Yellow: yellow, Red: red, Buzzer: buzzer, signals: make(chan string, 1)}
+	go f.play()
+	return f
+}
+
+// NewGPIO returns the Feedback on the GPIO pins, by number, where a
+// negative number means there is no such pin
+func NewGPIO(green, yellow, red, buzzer int) (*Feedback, error) {
+	pins := make([]Pin, 4)
+	for j, number := range []int{green, yellow, red, buzzer} {
+		if number < 0 {
+			continue
+		}
+		pin, err := OpenGPIOPin(number)
+		if err != nil {
+			return nil, err
+		}
+		pins[j] = pin
+	}
+	return New(pins[0], pins[1], pins[2], pins[3]), nil
+}
+
+// Signal plays the outcome, without ever blocking the scan which caused
+// it: an outcome signalled while another is still playing is dropped. A nil
+// Feedback does nothing, so there need not be any pins.
+func (f *Feedback) Signal(outcome string) {
+	if f == nil {
+		return
+	}
+	select {
+	case f.signals <- outcome:
+	default:
+	}
+}
+
+func (f *Feedback) led(outcome string) Pin {
+	switch outcome {
+	case SUCCESS:
+		return f.Green
+	case DUPLICATE, IGNORED, UNKNOWN:
+		return f.Yellow
+	}
+	return f.Red
+}
+
+func (f *Feedback) play() {
+	for outcome := range f.signals {
+		done := make(chan struct{})
+		go func() {
+			playPattern(f.Buzzer, BUZZER_PATTERNS[outcome])
+			close(done)
+		}()
+		playPattern(f.led(outcome), LED_PATTERNS[outcome])
+		<-done
+	}
+}
+
+// playPattern runs the pin through the pattern, leaving it off
+func playPattern(pin Pin, p Pattern) {
+	if pin == nil {
+		return
+	}
+	defer pin.Set(false)
+	for _, step := range p {
+		if err := pin.Set(step.On); err != nil {
+			log.Println(err)
+			return
+		}
+		time.Sleep(step.For)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package feedback
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePin records each value it is set to
+type fakePin struct {
+	mutex  sync.Mutex
+	values []bool
+	err    error
+}
+
+func (p *fakePin) Set(on bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.values = append(p.values, on)
+	return p.err
+}
+
+func (p *fakePin) set() []bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]bool{}, p.values...)
+}
+
+var OUTCOMES = []string{SUCCESS, DUPLICATE, UNKNOWN, ERROR, IGNORED}
+
+func TestPatterns(t *testing.T) {
+	// every outcome has a pattern of each, which ends off
+	for _, outcome := range OUTCOMES {
+		for kind, patterns := range map[string]map[string]Pattern{"buzzer": BUZZER_PATTERNS, "led": LED_PATTERNS} {
+			p, found := patterns[outcome]
+			if !found {
+				t.Errorf("no %s pattern for %s", kind, outcome)
+				continue
+			}
+			if len(p) > 1 && p[len(p)-1].On {
+				t.Errorf("the %s pattern for %s ends on", kind, outcome)
+			}
+		}
+	}
+	// the buzzer beeps once for a success, twice for a duplicate, long
+	// for an unknown barcode, three times long for an error, and never for
+	// an ignored duplicate
+	for outcome, want := range map[string][]time.Duration{
+		SUCCESS:   {SHORT},
+		DUPLICATE: {SHORT, SHORT},
+		UNKNOWN:   {LONG},
+		ERROR:     {LONG, LONG, LONG},
+		IGNORED:   {},
+	} {
+		got := make([]time.Duration, 0)
+		for _, step := range BUZZER_PATTERNS[outcome] {
+			if step.On {
+				got = append(got, step.For)
+			} else if step.For != GAP {
+				t.Errorf("the buzzer pattern for %s has a gap of %s", outcome, step.For)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("the buzzer pattern for %s beeps %v, want %v", outcome, got, want)
+			continue
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("the buzzer pattern for %s beeps %v, want %v", outcome, got, want)
+			}
+		}
+	}
+}
+
+func TestLED(t *testing.T) {
+	green, yellow, red := &fakePin{}, &fakePin{}, &fakePin{}
+	f := &Feedback{Green: green, Yellow: yellow, Red: red}
+	for outcome, want := range map[string]Pin{
+		SUCCESS:   green,
+		DUPLICATE: yellow,
+		IGNORED:   yellow,
+		UNKNOWN:   yellow,
+		ERROR:     red,
+		"other":   red,
+	} {
+		if led := f.led(outcome); led != want {
+			t.Errorf("led(%s) is the wrong one", outcome)
+		}
+	}
+}
+
+func TestPlayPattern(t *testing.T) {
+	pin := &fakePin{}
+	playPattern(pin, Pattern{{On: true, For: time.Millisecond}, {On: false, For: time.Millisecond}, {On: true, For: time.Millisecond}})
+	if got, want := pin.set(), []bool{true, false, true, false}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Errorf("the pin was set to %v, want %v, ending off", got, want)
+	}
+
+	// a pin which fails stops the pattern, but is still turned off
+	broken := &fakePin{err: errors.New("unexported")}
+	playPattern(broken, beeps(3, time.Millisecond))
+	if got := broken.set(); len(got) != 2 || !got[0] || got[1] {
+		t.Errorf("the broken pin was set to %v, want on, then off", got)
+	}
+	// and a missing one is skipped
+	playPattern(nil, beeps(1, time.Millisecond))
+}
+
+func TestSignal(t *testing.T) {
+	// a nil Feedback does nothing
+	var none *Feedback
+	none.Signal(SUCCESS)
+
+	yellow, buzzer := &fakePin{}, &fakePin{}
+	f := New(nil, yellow, nil, buzzer)
+	f.Signal(IGNORED)
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(yellow.set()) < 3 || len(buzzer.set()) < 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the led blinks once, and the buzzer stays silent (only turned off)
+	if got := yellow.set(); len(got) != 3 || !got[0] || got[1] || got[2] {
+		t.Errorf("the yellow led was set to %v, want on, then off", got)
+	}
+	if got := buzzer.set(); len(got) != 1 || got[0] {
+		t.Errorf("the buzzer was set to %v, want only off", got)
+	}
+}
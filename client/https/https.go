@@ -0,0 +1,201 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package https serves the WebApp over TLS, with a certificate of its own,
+// or one generated (and signed by itself) on first boot, and lets it run
+// behind a reverse proxy (e.g., nginx, or Caddy) which terminates TLS for
+// it, trusting the X-Forwarded-* headers of that proxy alone (see Proxied).
+
+package https
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// the certificate and key generated by SelfSigned, in the folder given
+	CERT_FILE = "piscan-cert.pem"
+	KEY_FILE  = "piscan-key.pem"
+
+	// how long a generated certificate is valid
+	SELF_SIGNED_VALIDITY = 10 * 365 * 24 * time.Hour
+
+	ORGANIZATION = "PiScan"
+
+	// the server timeouts, which the default http server does not have
+	READ_HEADER_TIMEOUT = 10 * time.Second
+	IDLE_TIMEOUT        = 2 * time.Minute
+)
+
+var (
+	ErrNoKeyPair = errors.New("both the certificate and the key file are needed for https")
+)
+
+// Config is how the WebApp listens: over plain http, unless it has the
+// certificate and key files, which SelfSigned can create (if they are not
+// there already)
+type Config struct {
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool // generate a certificate for the host on first boot, if it has none
+}
+
+// Enabled reports whether the WebApp should serve https
+func (c *Config) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.SelfSigned
+}
+
+// files returns the certificate and key files, which default to CERT_FILE
+// and KEY_FILE in the folder, for a self signed certificate
+func (c *Config) files(folder string) (string, string, error) {
+	cert, key := c.CertFile, c.KeyFile
+	if c.SelfSigned {
+		if cert == "" {
+			cert = filepath.Join(folder, CERT_FILE)
+		}
+		if key == "" {
+			key = filepath.Join(folder, KEY_FILE)
+		}
+	}
+	if cert == "" || key == "" {
+		return "", "", ErrNoKeyPair
+	}
+	return cert, key, nil
+}
+
+// ListenAndServe serves the handler on the address, over https if the
+// Config is Enabled (generating the self signed certificate first, in the
+// folder, if need be), or plain http otherwise
+func (c *Config) ListenAndServe(addr, folder string, h http.Handler) error {
+	server := &http.Server{Addr: addr,
+		Handler:           h,
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		IdleTimeout:       IDLE_TIMEOUT}
+	if !c.Enabled() {
+		return server.ListenAndServe()
+	}
+
+	cert, key, err := c.files(folder)
+	if err != nil {
+		return err
+	}
+	if c.SelfSigned {
+		created, err := SelfSigned(cert, key, Hostnames())
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Println(fmt.Sprintf("Generated the self signed certificate %s", cert))
+		}
+	}
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	return server.ListenAndServeTLS(cert, key)
+}
+
+// Hostnames returns the names (and addresses) by which the Pi can be
+// reached on the LAN, for a self signed certificate
+func Hostnames() []string {
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		names = append(names, host)
+		if !strings.Contains(host, ".") {
+			names = append(names, host+".local") // as mDNS announces it
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				names = append(names, ipNet.IP.String())
+			}
+		}
+	}
+	return names
+}
+
+// SelfSigned writes a new certificate, signed by its own (ECDSA P-256) key,
+// for the host names and addresses, unless both files exist already,
+// reporting whether it did
+func SelfSigned(certFile, keyFile string, hosts []string) (bool, error) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return false, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{SerialNumber: serial,
+		Subject:               pkix.Name{Organization: []string{ORGANIZATION}, CommonName: ORGANIZATION},
+		NotBefore:             now.Add(-time.Hour), // allow for the Pi's clock being a little behind
+		NotAfter:              now.Add(SELF_SIGNED_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[len(template.DNSNames)-1]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return false, err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func writePEM(file, kind string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,129 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// the proxies trusted by default: only one on the Pi itself
+	DEFAULT_TRUSTED_PROXIES = "127.0.0.1/32,::1/128"
+
+	FORWARDED_FOR   = "X-Forwarded-For"
+	FORWARDED_PROTO = "X-Forwarded-Proto"
+	FORWARDED_HOST  = "X-Forwarded-Host"
+)
+
+// ParseProxies returns the networks of the comma-separated list of CIDRs
+// (or single addresses) of the trusted reverse proxies
+func ParseProxies(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trusted(ip net.IP, proxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the other end of the request's connection
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// Proxied serves each request with the handler, after applying its
+// X-Forwarded-* headers, provided it came from one of the trusted proxies
+// (the headers of any other request are removed, since anyone could have
+// set them): the client's address becomes the RemoteAddr, the host it
+// asked for the Host, and the scheme it used (http or https) the URL's
+// Scheme (see IsSecure).
+func Proxied(h http.Handler, proxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trusted(remoteIP(r), proxies) {
+			r.Header.Del(FORWARDED_FOR)
+			r.Header.Del(FORWARDED_PROTO)
+			r.Header.Del(FORWARDED_HOST)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		// the client is the last address added by a proxy not trusted
+		// (each proxy appends the address it received the request from)
+		if forwarded := r.Header.Values(FORWARDED_FOR); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			for j := len(hops) - 1; j >= 0; j-- {
+				ip := net.ParseIP(strings.TrimSpace(hops[j]))
+				if ip == nil {
+					break
+				}
+				r2.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				if !trusted(ip, proxies) {
+					break
+				}
+			}
+		}
+		if proto := firstValue(r.Header.Get(FORWARDED_PROTO)); proto == "http" || proto == "https" {
+			r2.URL.Scheme = proto
+		}
+		if host := firstValue(r.Header.Get(FORWARDED_HOST)); host != "" {
+			r2.Host = host
+		}
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// firstValue returns the first of the (comma-separated) header values, the
+// one added by the proxy nearest the client
+func firstValue(header string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(header, ",")[0]))
+}
+
+// IsSecure reports whether the client made the request over https, either
+// directly, or to a trusted proxy (see Proxied)
+func IsSecure(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
+
+// BaseURL returns the scheme and host by which the client reached the
+// WebApp (e.g., for a link to it, in an email)
+func BaseURL(r *http.Request) string {
+	scheme := "http"
+	if IsSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
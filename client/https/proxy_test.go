@@ -0,0 +1,119 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package https
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseProxies(t *testing.T) {
+	proxies, err := ParseProxies(" 10.0.0.0/8, 192.0.2.1,,::1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	if len(proxies) != len(want) {
+		t.Fatalf("ParseProxies() = %v, want %v", proxies, want)
+	}
+	for j, n := range proxies {
+		if n.String() != want[j] {
+			t.Errorf("ParseProxies()[%d] = %s, want %s", j, n, want[j])
+		}
+	}
+	for _, list := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err := ParseProxies(list); err == nil {
+			t.Errorf("ParseProxies(%q) succeeded", list)
+		}
+	}
+}
+
+// seen is what the handler behind Proxied is given
+type seen struct {
+	remoteAddr, host, scheme, forwardedFor string
+	secure                                 bool
+}
+
+// proxied makes the request from the peer, with the X-Forwarded-* headers
+// (unless empty), returning what the handler saw
+func proxied(t *testing.T, trustedList, peer, forwardedFor, proto, host string) seen {
+	t.Helper()
+	proxies, err := ParseProxies(trustedList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s seen
+	h := Proxied(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s = seen{r.RemoteAddr, r.Host, r.URL.Scheme, r.Header.Get(FORWARDED_FOR), IsSecure(r)}
+	}), proxies)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = peer
+	r.Host = "pi.local"
+	for header, value := range map[string]string{FORWARDED_FOR: forwardedFor, FORWARDED_PROTO: proto, FORWARDED_HOST: host} {
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return s
+}
+
+func TestProxiedUntrusted(t *testing.T) {
+	// the headers of a client which connects directly are ignored, and
+	// removed, even with the default list
+	for _, peer := range []string{"192.0.2.10:4321", "[2001:db8::10]:4321", "garbage"} {
+		s := proxied(t, DEFAULT_TRUSTED_PROXIES, peer, "127.0.0.1", "https", "example.org")
+		if s.remoteAddr != peer || s.host != "pi.local" || s.scheme != "" || s.secure || s.forwardedFor != "" {
+			t.Errorf("a request from %s was seen as %+v", peer, s)
+		}
+	}
+	// as are those of every client, if no proxy is trusted
+	s := proxied(t, "", "127.0.0.1:4321", "203.0.113.5", "https", "example.org")
+	if s.remoteAddr != "127.0.0.1:4321" || s.host != "pi.local" || s.secure {
+		t.Errorf("a request with no trusted proxies was seen as %+v", s)
+	}
+}
+
+func TestProxiedTrusted(t *testing.T) {
+	s := proxied(t, DEFAULT_TRUSTED_PROXIES, "127.0.0.1:4321", "203.0.113.5", "https", "Pi.Example.org")
+	want := seen{"203.0.113.5:0", "pi.example.org", "https", "203.0.113.5", true}
+	if s != want {
+		t.Errorf("a request from the proxy was seen as %+v, want %+v", s, want)
+	}
+	if scheme := proxied(t, DEFAULT_TRUSTED_PROXIES, "[::1]:4321", "", "ftp", "").scheme; scheme != "" {
+		t.Errorf("a forwarded ftp scheme was seen as %q", scheme)
+	}
+
+	for _, test := range []struct {
+		forwardedFor, client string
+	}{
+		// through a chain of trusted proxies
+		{"203.0.113.5, 10.0.0.2", "203.0.113.5:0"},
+		// an address the client made up itself is skipped
+		{"198.51.100.1, 203.0.113.5", "203.0.113.5:0"},
+		{"198.51.100.1", "198.51.100.1:0"},
+		// up to one which is not an address
+		{"203.0.113.5, unknown", "127.0.0.1:4321"},
+		{"2001:db8::5", "[2001:db8::5]:0"},
+	} {
+		s := proxied(t, "127.0.0.1, 10.0.0.0/8", "127.0.0.1:4321", test.forwardedFor, "", "")
+		if s.remoteAddr != test.client || s.host != "pi.local" || s.secure {
+			t.Errorf("a request forwarded for %q was seen as %+v, want the client %s", test.forwardedFor, s, test.client)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "pi.local:8080"
+	if url := BaseURL(r); url != "http://pi.local:8080" {
+		t.Errorf("BaseURL() = %q", url)
+	}
+	r = httptest.NewRequest("GET", "https://pi.local/", nil)
+	if url := BaseURL(r); url != "https://pi.local" {
+		t.Errorf("BaseURL() over tls = %q", url)
+	}
+}
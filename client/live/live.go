@@ -0,0 +1,212 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package live pushes each Item change (every scan, delete, or favorite) to
+// the WebApp pages which are open, as server-sent events
+// (https://html.spec.whatwg.org/multipage/server-sent-events.html), so that
+// new scans show up without refreshing the page.
+//
+// Since the scanner runs in a process of its own, the changes are read from
+// the scan_log (see database.GetScanEventsAfter), which the db triggers
+// write whichever process made them.
+
+package live
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/ui"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	POLL_INTERVAL = time.Second      // how often the scan_log is checked
+	HEARTBEAT     = 15 * time.Second // how often an idle stream is kept alive
+	BATCH_SIZE    = 64               // the most events read per check
+	BUFFER_SIZE   = 16               // the events queued for each subscriber
+
+	MIME_EVENT_STREAM = "text/event-stream"
+)
+
+// Event is the data of each server-sent event, whose name is its Action
+type Event struct {
+	Id       int64     `json:"id"`
+	ItemId   int64     `json:"item_id"`
+	Barcode  string    `json:"barcode"`
+	Action   string    `json:"action"`
+	Source   string    `json:"source,omitempty"`
+	DeviceId int64     `json:"device_id,omitempty"`
+	Logged   time.Time `json:"logged"`
+}
+
+func liveEvent(e *database.ScanEvent) *Event {
+	return &Event{Id: e.Id,
+		ItemId:   e.ItemId,
+		Barcode:  e.Barcode,
+		Action:   e.Action,
+		Source:   e.Source,
+		DeviceId: e.DeviceId,
+		Logged:   e.Logged}
+}
+
+// Hub broadcasts each event to the subscribers of its Account. It must be
+// created with NewHub.
+type Hub struct {
+	mutex       sync.Mutex
+	subscribers map[chan *Event]int64 // the account id of each
+	wake        chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan *Event]int64), wake: make(chan struct{}, 1)}
+}
+
+// Subscribe returns the channel of the Account's events, and the function
+// which closes it, once the subscriber is done
+func (h *Hub) Subscribe(accountId int64) (<-chan *Event, func()) {
+	ch := make(chan *Event, BUFFER_SIZE)
+	h.mutex.Lock()
+	h.subscribers[ch] = accountId
+	h.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mutex.Lock()
+			delete(h.subscribers, ch)
+			h.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends the event to each of its Account's subscribers, without ever
+// blocking: a subscriber whose buffer is full misses it
+func (h *Hub) Publish(e *database.ScanEvent) {
+	event := liveEvent(e)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for ch, accountId := range h.subscribers {
+		if accountId != e.AccountId {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Wake makes Tail check the scan_log now, rather than at the next poll,
+// e.g., from the database.OnItemChange observer, for the changes made in
+// this process. It never blocks.
+func (h *Hub) Wake() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Tail publishes each event logged from now on, checking the scan_log at
+// every poll (or Wake), until the context is done
+func (h *Hub) Tail(ctx context.Context, coords database.ConnCoordinates) error {
+	db, err := database.InitializeDB(coords)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	last, err := database.LastScanEventId(db)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-h.wake:
+		}
+
+		for {
+			events, err := database.GetScanEventsAfter(db, last, BATCH_SIZE)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			for _, e := range events {
+				h.Publish(e)
+				last = e.Id
+			}
+			if len(events) < BATCH_SIZE {
+				break
+			}
+		}
+	}
+}
+
+// Handler returns the handler which streams the events of the designated
+// Account (as the WebApp pages show its Items) until the client goes away
+func Handler(h *Hub, coords database.ConnCoordinates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, canFlush := w.(http.Flusher)
+		if !canFlush {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// look up the Account logged in, without holding the db open for the
+		// whole stream
+		db, err := database.InitializeDB(coords)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		acc, accErr := ui.CurrentAccount(r, db)
+		db.Close()
+		if accErr != nil {
+			http.Error(w, accErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		events, unsubscribe := h.Subscribe(acc.Id)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", MIME_EVENT_STREAM)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(HEARTBEAT)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case e := <-events:
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Action, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
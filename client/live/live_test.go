@@ -0,0 +1,83 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package live
+
+import (
+	"github.com/Banrai/PiScan/client/database"
+	"testing"
+)
+
+func TestHubPublish(t *testing.T) {
+	h := NewHub()
+	alice, unsubscribeAlice := h.Subscribe(1)
+	defer unsubscribeAlice()
+	alsoAlice, unsubscribeAlsoAlice := h.Subscribe(1)
+	defer unsubscribeAlsoAlice()
+	bob, unsubscribeBob := h.Subscribe(2)
+	defer unsubscribeBob()
+
+	// each event goes to every subscriber of its Account, and no other
+	h.Publish(&database.ScanEvent{Id: 7, AccountId: 1, ItemId: 3, Barcode: "036000291452", Action: database.ITEM_ADDED})
+	for _, ch := range []<-chan *Event{alice, alsoAlice} {
+		select {
+		case e := <-ch:
+			if e.Id != 7 || e.ItemId != 3 || e.Barcode != "036000291452" || e.Action != database.ITEM_ADDED {
+				t.Errorf("the subscriber got %+v", e)
+			}
+		default:
+			t.Error("a subscriber of the Account got nothing")
+		}
+	}
+	select {
+	case e := <-bob:
+		t.Errorf("another Account's subscriber got %+v", e)
+	default:
+	}
+}
+
+func TestHubFullBuffer(t *testing.T) {
+	h := NewHub()
+	ch, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+
+	// a subscriber which falls behind misses the events past its buffer,
+	// rather than blocking the others
+	for id := int64(1); id <= BUFFER_SIZE+5; id++ {
+		h.Publish(&database.ScanEvent{Id: id, AccountId: 1})
+	}
+	if n := len(ch); n != BUFFER_SIZE {
+		t.Fatalf("%d events queued, want %d", n, BUFFER_SIZE)
+	}
+	for id := int64(1); id <= BUFFER_SIZE; id++ {
+		if e := <-ch; e.Id != id {
+			t.Errorf("event %d is %d", id, e.Id)
+		}
+	}
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	h := NewHub()
+	ch, unsubscribe := h.Subscribe(1)
+	unsubscribe()
+	if _, open := <-ch; open {
+		t.Error("the channel is still open after unsubscribing")
+	}
+	if n := len(h.subscribers); n != 0 {
+		t.Errorf("%d subscribers left", n)
+	}
+	// which is done once, however many times it is called, and publishing
+	// after it sends nothing on the closed channel
+	unsubscribe()
+	h.Publish(&database.ScanEvent{Id: 1, AccountId: 1})
+}
+
+func TestHubWake(t *testing.T) {
+	h := NewHub()
+	// never blocks, with a single wake pending
+	h.Wake()
+	h.Wake()
+	if n := len(h.wake); n != 1 {
+		t.Errorf("%d wakes pending, want 1", n)
+	}
+}
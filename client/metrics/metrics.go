@@ -0,0 +1,335 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package metrics serves the scanner's counters in the Prometheus text
+// exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/),
+// and a health check of its db, scanners, and lookups, as json, so that a
+// fleet of Pi clients can be scraped (e.g., into Grafana), and alerted on
+// when a scanner goes offline.
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	METRICS_PATH = "/metrics"
+	HEALTH_PATH  = "/healthz"
+
+	MIME_PROMETHEUS = "text/plain; version=0.0.4"
+	MIME_JSON       = "application/json"
+
+	// how long a request waits for the db, before reporting it unreachable
+	HEALTH_TIMEOUT = 2 * time.Second
+
+	// Health statuses
+	STATUS_OK       = "ok"       // everything works
+	STATUS_DEGRADED = "degraded" // scans are saved, but the last lookup (or sync) failed
+	STATUS_DOWN     = "down"     // the db is unreachable, or a scanner is disconnected
+)
+
+// scannerState is what the Monitor knows of each scanner (see
+// ScannerStatus)
+type scannerState struct {
+	connected   bool
+	since       time.Time
+	disconnects int64
+}
+
+// Monitor counts the scans, and tracks the state of the scanners and of
+// the lookups sent to the API server, for the metrics and the health check
+// (see Handler), which also read the DB. It must be created with
+// NewMonitor.
+type Monitor struct {
+	DB *database.DB
+
+	mutex         sync.Mutex
+	scans         map[string]int64 // by outcome (see feedback)
+	scanners      map[string]*scannerState
+	syncs         int64
+	syncErrors    int64
+	lastSync      time.Time
+	lastSyncError time.Time
+	syncErr       string
+}
+
+// NewMonitor returns a Monitor of the DB, which has seen nothing yet
+func NewMonitor(db *database.DB) *Monitor {
+	return &Monitor{DB: db,
+		scans:    make(map[string]int64),
+		scanners: make(map[string]*scannerState)}
+}
+
+// CountScan records the outcome of a scan (one of the feedback outcomes,
+// e.g., feedback.SUCCESS)
+func (m *Monitor) CountScan(outcome string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.scans[outcome] += 1
+}
+
+// ScannerStatus records that the named scanner connected to its device, or
+// lost it; it is a scanner.StatusFn
+func (m *Monitor) ScannerStatus(name string, connected bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, found := m.scanners[name]
+	if !found {
+		s = &scannerState{since: time.Now()}
+		m.scanners[name] = s
+	} else if s.connected != connected {
+		s.since = time.Now()
+		if !connected {
+			s.disconnects += 1
+		}
+	}
+	s.connected = connected
+}
+
+// SyncResult records the outcome of a lookup sent to the API server,
+// whether as a barcode is scanned, or from the outbox: nil if it got
+// through, or else its error
+func (m *Monitor) SyncResult(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.syncs += 1
+	if err == nil {
+		m.lastSync = time.Now()
+		return
+	}
+	m.syncErrors += 1
+	m.lastSyncError = time.Now()
+	m.syncErr = err.Error()
+}
+
+// Handler returns the handler which serves both ServeMetrics, at
+// METRICS_PATH, and ServeHealth, at HEALTH_PATH
+func (m *Monitor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, m.ServeMetrics)
+	mux.HandleFunc(HEALTH_PATH, m.ServeHealth)
+	return mux
+}
+
+// withDB calls the function with the DB's read-only connection, but gives
+// up with the context error after HEALTH_TIMEOUT, e.g., if the connection
+// is busy for that long
+func (m *Monitor) withDB(fn func(ctx context.Context, db *sqlite3.Conn) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_TIMEOUT)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- m.DB.WithRead(func(db *sqlite3.Conn) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fn(ctx, db)
+		})
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeMetrics writes every counter, and the sync queue depth, read from
+// the DB, in the Prometheus text format
+func (m *Monitor) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var pending int64
+	dbErr := m.withDB(func(ctx context.Context, db *sqlite3.Conn) (err error) {
+		pending, err = database.CountUnsynced(db)
+		return err
+	})
+	counts := database.Metrics()
+
+	w.Header().Set("Content-Type", MIME_PROMETHEUS)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	metric(w, "piscan_scans_total", "counter", "The scans, by their outcome.")
+	for _, outcome := range sortedKeys(m.scans) {
+		fmt.Fprintf(w, "piscan_scans_total{outcome=%q} %d\n", outcome, m.scans[outcome])
+	}
+
+	metric(w, "piscan_scanner_connected", "gauge", "Whether each scanner has its device open (1), or not (0).")
+	names := make([]string, 0, len(m.scanners))
+	for name := range m.scanners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "piscan_scanner_connected{scanner=%q} %d\n", name, boolValue(m.scanners[name].connected))
+	}
+	metric(w, "piscan_scanner_disconnects_total", "counter", "The times each scanner lost its device, e.g., by being unplugged.")
+	for _, name := range names {
+		fmt.Fprintf(w, "piscan_scanner_disconnects_total{scanner=%q} %d\n", name, m.scanners[name].disconnects)
+	}
+
+	metric(w, "piscan_sync_queue_depth", "gauge", "The lookups queued for the API server, and not sent yet.")
+	if dbErr == nil {
+		fmt.Fprintf(w, "piscan_sync_queue_depth %d\n", pending)
+	}
+	metric(w, "piscan_syncs_total", "counter", "The lookups sent to the API server.")
+	fmt.Fprintf(w, "piscan_syncs_total %d\n", m.syncs)
+	metric(w, "piscan_sync_errors_total", "counter", "The lookups sent to the API server which failed.")
+	fmt.Fprintf(w, "piscan_sync_errors_total %d\n", m.syncErrors)
+	metric(w, "piscan_sync_last_success_timestamp_seconds", "gauge", "When a lookup last got through to the API server.")
+	if !m.lastSync.IsZero() {
+		fmt.Fprintf(w, "piscan_sync_last_success_timestamp_seconds %d\n", m.lastSync.Unix())
+	}
+
+	metric(w, "piscan_db_up", "gauge", "Whether the db could be read (1), or not (0).")
+	fmt.Fprintf(w, "piscan_db_up %d\n", boolValue(dbErr == nil))
+	metric(w, "piscan_db_query_errors_total", "counter", "The db queries which failed.")
+	fmt.Fprintf(w, "piscan_db_query_errors_total %d\n", counts.QueryErrors)
+	metric(w, "piscan_db_query_duration_seconds", "histogram", "How long the db queries which read items, or accounts, took.")
+	for j, bound := range database.QUERY_LATENCY_BUCKETS {
+		fmt.Fprintf(w, "piscan_db_query_duration_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), counts.QueryBuckets[j])
+	}
+	fmt.Fprintf(w, "piscan_db_query_duration_seconds_bucket{le=\"+Inf\"} %d\n", counts.Queries)
+	fmt.Fprintf(w, "piscan_db_query_duration_seconds_sum %g\n", counts.QueryTime.Seconds())
+	fmt.Fprintf(w, "piscan_db_query_duration_seconds_count %d\n", counts.Queries)
+
+	metric(w, "piscan_items_added_total", "counter", "The items added.")
+	fmt.Fprintf(w, "piscan_items_added_total %d\n", counts.ItemsAdded)
+	metric(w, "piscan_items_deleted_total", "counter", "The items deleted.")
+	fmt.Fprintf(w, "piscan_items_deleted_total %d\n", counts.ItemsDeleted)
+	metric(w, "piscan_items_favorited_total", "counter", "The items made favorites.")
+	fmt.Fprintf(w, "piscan_items_favorited_total %d\n", counts.ItemsFavorited)
+	metric(w, "piscan_items_unfavorited_total", "counter", "The items no longer favorites.")
+	fmt.Fprintf(w, "piscan_items_unfavorited_total %d\n", counts.ItemsUnfavorited)
+}
+
+// metric writes the HELP and TYPE lines which precede the metric's samples
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Health is the json reply of ServeHealth
+type Health struct {
+	Status   string                    `json:"status"`
+	DB       DBHealth                  `json:"db"`
+	Scanners map[string]*ScannerHealth `json:"scanners"`
+	Sync     SyncHealth                `json:"sync"`
+}
+
+// DBHealth is whether the db answered a ping within HEALTH_TIMEOUT
+type DBHealth struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ScannerHealth is whether the scanner has its device open, since when
+type ScannerHealth struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+}
+
+// SyncHealth is how the lookups sent to the API server are doing: OK
+// unless the last one failed
+type SyncHealth struct {
+	OK          bool       `json:"ok"`
+	Pending     int64      `json:"pending"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Health checks the db (by pinging it), the scanners, and the lookups, and
+// returns their state, with its overall Status: STATUS_DOWN if the db is
+// unreachable, or any scanner (or all, since none has started yet) is
+// disconnected, or else STATUS_DEGRADED if the last lookup failed, or else
+// STATUS_OK
+func (m *Monitor) Health() *Health {
+	h := &Health{Status: STATUS_OK, Scanners: make(map[string]*ScannerHealth)}
+	var pending int64
+	dbErr := m.withDB(func(ctx context.Context, db *sqlite3.Conn) (err error) {
+		if err = database.PingContext(ctx, db); err != nil {
+			return err
+		}
+		pending, err = database.CountUnsynced(db)
+		return err
+	})
+	// pending is only safe to read if the query finished in time
+	h.DB.OK = dbErr == nil
+	if dbErr == nil {
+		h.Sync.Pending = pending
+	} else {
+		h.DB.Error = dbErr.Error()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	connected := len(m.scanners) > 0
+	for name, s := range m.scanners {
+		h.Scanners[name] = &ScannerHealth{Connected: s.connected, Since: s.since}
+		connected = connected && s.connected
+	}
+
+	// a failed lookup is queued, and retried, so it does not fail the check
+	h.Sync.OK = m.lastSyncError.IsZero() || m.lastSync.After(m.lastSyncError)
+	if !m.lastSync.IsZero() {
+		lastSync := m.lastSync
+		h.Sync.LastSuccess = &lastSync
+	}
+	if !m.lastSyncError.IsZero() {
+		lastSyncError := m.lastSyncError
+		h.Sync.LastFailure = &lastSyncError
+		h.Sync.LastError = m.syncErr
+	}
+
+	if !h.DB.OK || !connected {
+		h.Status = STATUS_DOWN
+	} else if !h.Sync.OK {
+		h.Status = STATUS_DEGRADED
+	}
+	return h
+}
+
+// ServeHealth replies with the Health, as json, with a 503 status if it is
+// STATUS_DOWN, so that a plain http check can alert on it
+func (m *Monitor) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	h := m.Health()
+	status := http.StatusOK
+	if h.Status == STATUS_DOWN {
+		status = http.StatusServiceUnavailable
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=utf-8", MIME_JSON))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
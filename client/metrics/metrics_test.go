@@ -0,0 +1,109 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestMonitor(t *testing.T) *Monitor {
+	t.Helper()
+	d, err := database.OpenDB(database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return NewMonitor(d)
+}
+
+// getHealth returns the status code, and the Health, which /healthz replies
+func getHealth(t *testing.T, m *Monitor) (int, *Health) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", HEALTH_PATH, nil))
+	if mime := w.Header().Get("Content-Type"); !strings.HasPrefix(mime, MIME_JSON) {
+		t.Errorf("%s replied with %q", HEALTH_PATH, mime)
+	}
+	h := new(Health)
+	if err := json.Unmarshal(w.Body.Bytes(), h); err != nil {
+		t.Fatalf("%s replied with %q: %v", HEALTH_PATH, w.Body.String(), err)
+	}
+	return w.Code, h
+}
+
+func TestServeHealth(t *testing.T) {
+	m := newTestMonitor(t)
+	tests := []struct {
+		name   string
+		change func()
+		code   int
+		status string
+	}{
+		{"no scanner started", func() {}, http.StatusServiceUnavailable, STATUS_DOWN},
+		{"a scanner connected", func() { m.ScannerStatus("hid", true) }, http.StatusOK, STATUS_OK},
+		{"a lookup failed", func() { m.SyncResult(errors.New("no network")) }, http.StatusOK, STATUS_DEGRADED},
+		{"a lookup got through", func() { m.SyncResult(nil) }, http.StatusOK, STATUS_OK},
+		{"another scanner disconnected", func() { m.ScannerStatus("camera", false) }, http.StatusServiceUnavailable, STATUS_DOWN},
+		{"it reconnected", func() { m.ScannerStatus("camera", true) }, http.StatusOK, STATUS_OK},
+		{"the db closed", func() { m.DB.Close() }, http.StatusServiceUnavailable, STATUS_DOWN},
+	}
+	for _, test := range tests {
+		test.change()
+		code, h := getHealth(t, m)
+		if code != test.code || h.Status != test.status {
+			t.Errorf("once %s, %s = %d, %q, want %d, %q", test.name, HEALTH_PATH, code, h.Status, test.code, test.status)
+		}
+	}
+
+	code, h := getHealth(t, m)
+	if code != http.StatusServiceUnavailable || h.DB.OK || h.DB.Error == "" {
+		t.Errorf("%s with the db closed = %d, %+v", HEALTH_PATH, code, h.DB)
+	}
+	if len(h.Scanners) != 2 || !h.Scanners["camera"].Connected || h.Sync.LastSuccess == nil || h.Sync.LastError != "no network" || !h.Sync.OK {
+		t.Errorf("%s = %+v, %+v", HEALTH_PATH, h.Scanners, h.Sync)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	m := newTestMonitor(t)
+	m.CountScan("success")
+	m.CountScan("success")
+	m.CountScan("unknown")
+	m.ScannerStatus("hid", true)
+	m.ScannerStatus("hid", false)
+	m.SyncResult(errors.New("no network"))
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", METRICS_PATH, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != MIME_PROMETHEUS {
+		t.Fatalf("%s = %d, %q", METRICS_PATH, w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, sample := range []string{
+		"# TYPE piscan_scans_total counter\n",
+		"piscan_scans_total{outcome=\"success\"} 2\n",
+		"piscan_scans_total{outcome=\"unknown\"} 1\n",
+		"piscan_scanner_connected{scanner=\"hid\"} 0\n",
+		"piscan_scanner_disconnects_total{scanner=\"hid\"} 1\n",
+		"piscan_sync_queue_depth 0\n",
+		"piscan_syncs_total 1\n",
+		"piscan_sync_errors_total 1\n",
+		"piscan_db_up 1\n",
+		"piscan_db_query_duration_seconds_bucket{le=\"+Inf\"} ",
+	} {
+		if !strings.Contains(body, sample) {
+			t.Errorf("%s is missing %q", METRICS_PATH, sample)
+		}
+	}
+	// no lookup got through, so there is no timestamp of one
+	if strings.Contains(body, "\npiscan_sync_last_success_timestamp_seconds ") {
+		t.Errorf("%s has a last success", METRICS_PATH)
+	}
+}
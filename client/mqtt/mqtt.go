@@ -0,0 +1,189 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package mqtt publishes each Item added (see Publisher) to an MQTT broker,
+// e.g., for Home Assistant or Node-RED to act on each scan. It speaks just
+// enough of MQTT 3.1.1 (http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html)
+// to publish, at QoS 0, so it needs no other library on the Pi.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_PORT = "1883"
+	TIMEOUT      = 10 * time.Second
+
+	// control packet types (the high nibble of the fixed header)
+	CONNECT    = 0x10
+	CONNACK    = 0x20
+	PUBLISH    = 0x30
+	DISCONNECT = 0xe0
+
+	PROTOCOL_NAME  = "MQTT"
+	PROTOCOL_LEVEL = 4 // 3.1.1
+
+	// CONNECT flags
+	CLEAN_SESSION = 0x02
+	PASSWORD_FLAG = 0x40
+	USERNAME_FLAG = 0x80
+
+	PUBLISH_RETAIN = 0x01
+
+	// the largest remaining length a packet can have
+	MAX_LENGTH = 268435455
+)
+
+var (
+	ErrTooLong    = errors.New("mqtt packet too long")
+	ErrBadConnack = errors.New("mqtt broker did not acknowledge the connection")
+	ErrEmptyTopic = errors.New("mqtt topic must not be empty")
+
+	// the broker's reasons for refusing the connection, by its CONNACK
+	// return code
+	connackErrors = map[byte]string{
+		1: "unacceptable protocol version",
+		2: "client identifier rejected",
+		3: "server unavailable",
+		4: "bad user name or password",
+		5: "not authorized"}
+)
+
+// Broker is where the messages are published, connecting for each batch of
+// them (see Publish), since scans are few and far between
+type Broker struct {
+	Addr     string // host:port, or just the host, for DEFAULT_PORT
+	ClientId string // defaults to piscan-<hostname>
+	Username string // optional
+	Password string // optional, only sent with a Username
+	Retain   bool   // whether the broker keeps the last message, for new subscribers
+	Timeout  time.Duration
+}
+
+// Publish connects to the broker, publishes each of the payloads to the
+// topic, and disconnects
+func (b *Broker) Publish(topic string, payloads ...[]byte) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = TIMEOUT
+	}
+	addr := b.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DEFAULT_PORT)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := b.connect(conn); err != nil {
+		return err
+	}
+	for _, payload := range payloads {
+		flags := byte(0)
+		if b.Retain {
+			flags |= PUBLISH_RETAIN
+		}
+		var body bytes.Buffer
+		writeString(&body, topic)
+		body.Write(payload)
+		if err := writePacket(conn, PUBLISH|flags, body.Bytes()); err != nil {
+			return err
+		}
+	}
+	return writePacket(conn, DISCONNECT, nil)
+}
+
+// connect sends the CONNECT packet, and waits for the broker's CONNACK
+func (b *Broker) connect(conn net.Conn) error {
+	clientId := b.ClientId
+	if clientId == "" {
+		hostname, _ := os.Hostname()
+		clientId = "piscan-" + hostname
+	}
+
+	flags := byte(CLEAN_SESSION)
+	if b.Username != "" {
+		flags |= USERNAME_FLAG
+		if b.Password != "" {
+			flags |= PASSWORD_FLAG
+		}
+	}
+
+	var body bytes.Buffer
+	writeString(&body, PROTOCOL_NAME)
+	body.WriteByte(PROTOCOL_LEVEL)
+	body.WriteByte(flags)
+	body.Write([]byte{0, 0}) // no keep alive, since it disconnects right away
+	writeString(&body, clientId)
+	if flags&USERNAME_FLAG != 0 {
+		writeString(&body, b.Username)
+	}
+	if flags&PASSWORD_FLAG != 0 {
+		writeString(&body, b.Password)
+	}
+	if err := writePacket(conn, CONNECT, body.Bytes()); err != nil {
+		return err
+	}
+
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return err
+	}
+	if ack[0] != CONNACK || ack[1] != 2 {
+		return ErrBadConnack
+	}
+	if ack[3] != 0 {
+		reason, known := connackErrors[ack[3]]
+		if !known {
+			reason = fmt.Sprintf("return code %d", ack[3])
+		}
+		return fmt.Errorf("mqtt broker refused the connection: %s", reason)
+	}
+	return nil
+}
+
+// writePacket writes the fixed header (the type and flags, then the
+// remaining length, 7 bits per byte), followed by the rest of the packet
+func writePacket(w io.Writer, header byte, body []byte) error {
+	n := len(body)
+	if n > MAX_LENGTH {
+		return ErrTooLong
+	}
+	packet := []byte{header}
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// writeString writes the string, prefixed by its length, as MQTT encodes
+// each string
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte(byte(len(s) >> 8))
+	buf.WriteByte(byte(len(s)))
+	buf.WriteString(s)
+}
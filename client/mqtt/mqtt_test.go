@@ -0,0 +1,165 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestWritePacket(t *testing.T) {
+	// the remaining length takes one more byte every 7 bits
+	for _, test := range []struct {
+		n      int
+		length []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	} {
+		var buf bytes.Buffer
+		body := bytes.Repeat([]byte{'x'}, test.n)
+		if err := writePacket(&buf, PUBLISH|PUBLISH_RETAIN, body); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte{PUBLISH | PUBLISH_RETAIN}, test.length...), body...)
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("writePacket() of %d bytes starts with % x, want % x", test.n, buf.Bytes()[:1+len(test.length)], want[:1+len(test.length)])
+		}
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	var buf bytes.Buffer
+	writeString(&buf, "MQTT")
+	writeString(&buf, "")
+	writeString(&buf, strings.Repeat("a", 300))
+	want := append([]byte{0, 4, 'M', 'Q', 'T', 'T', 0, 0, 1, 44}, strings.Repeat("a", 300)...)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("writeString() = % x, want % x", buf.Bytes()[:10], want[:10])
+	}
+}
+
+// packet is one read by the fake broker
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{header, body}, nil
+}
+
+// fakeBroker accepts one connection, acknowledging it with the return
+// code, and sends each packet it reads on the channel, until it is closed
+func fakeBroker(t *testing.T, returnCode byte) (string, <-chan *packet) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	packets := make(chan *packet, 16)
+	go func() {
+		defer close(packets)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			p, err := readPacket(r)
+			if err != nil {
+				return
+			}
+			packets <- p
+			if p.header == CONNECT {
+				conn.Write([]byte{CONNACK, 2, 0, returnCode})
+			}
+		}
+	}()
+	return l.Addr().String(), packets
+}
+
+func TestBrokerPublish(t *testing.T) {
+	addr, packets := fakeBroker(t, 0)
+	b := &Broker{Addr: addr, ClientId: "piscan-test", Username: "alice", Password: "secret", Retain: true}
+	if err := b.Publish("piscan/scans", []byte(`{"a":1}`), []byte(`{"b":2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := <-packets
+	var want bytes.Buffer
+	writeString(&want, PROTOCOL_NAME)
+	want.Write([]byte{PROTOCOL_LEVEL, CLEAN_SESSION | USERNAME_FLAG | PASSWORD_FLAG, 0, 0})
+	writeString(&want, "piscan-test")
+	writeString(&want, "alice")
+	writeString(&want, "secret")
+	if connect.header != CONNECT || !bytes.Equal(connect.body, want.Bytes()) {
+		t.Errorf("CONNECT = %x % x, want % x", connect.header, connect.body, want.Bytes())
+	}
+
+	for _, payload := range []string{`{"a":1}`, `{"b":2}`} {
+		p := <-packets
+		want.Reset()
+		writeString(&want, "piscan/scans")
+		want.WriteString(payload)
+		if p == nil || p.header != PUBLISH|PUBLISH_RETAIN || !bytes.Equal(p.body, want.Bytes()) {
+			t.Errorf("PUBLISH = %+v, want the payload %s", p, payload)
+		}
+	}
+	if p := <-packets; p == nil || p.header != DISCONNECT || len(p.body) != 0 {
+		t.Errorf("the last packet = %+v, want a DISCONNECT", p)
+	}
+}
+
+func TestBrokerRefused(t *testing.T) {
+	addr, packets := fakeBroker(t, 4)
+	b := &Broker{Addr: addr, Password: "ignored, without a Username"}
+	err := b.Publish("piscan/scans", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), connackErrors[4]) {
+		t.Errorf("Publish() to a broker which refuses it = %v", err)
+	}
+	connect := <-packets
+	if flags := connect.body[7]; flags != CLEAN_SESSION {
+		t.Errorf("the CONNECT flags = %x, want only a clean session", flags)
+	}
+	// and nothing was published
+	for p := range packets {
+		t.Errorf("a %x packet was sent after the refusal", p.header)
+	}
+
+	if err := b.Publish("", []byte("{}")); !errors.Is(err, ErrEmptyTopic) {
+		t.Errorf("Publish() to no topic = %v, want ErrEmptyTopic", err)
+	}
+}
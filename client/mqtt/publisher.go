@@ -0,0 +1,154 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"log"
+	"time"
+)
+
+const (
+	DEFAULT_TOPIC = "piscan/scans"
+	POLL_INTERVAL = 2 * time.Second // how often the scan_log is checked
+	BATCH_SIZE    = 64              // the most events read per check
+)
+
+// Message is the json payload published for each Item added (or scanned
+// again)
+type Message struct {
+	ItemId    int64     `json:"item_id"`
+	Barcode   string    `json:"barcode"`
+	Desc      string    `json:"desc"`
+	AccountId int64     `json:"account_id"`
+	Account   string    `json:"account"` // the Account's email
+	DeviceId  int64     `json:"device_id,omitempty"`
+	Device    string    `json:"device,omitempty"` // the Device's name
+	Source    string    `json:"source,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Publisher publishes a Message for each Item added, by any process sharing
+// the db (the scanner, the WebApp, or its api), as logged in the scan_log
+// (see database.GetScanEventsAfter)
+type Publisher struct {
+	DB     *database.DB
+	Broker *Broker
+	Topic  string // defaults to DEFAULT_TOPIC
+}
+
+// Run publishes the Items added from now on, checking the scan_log at every
+// poll, until the context is done. If the broker cannot be reached, the
+// same Items are tried again at the next poll, so none are missed.
+func (p *Publisher) Run(ctx context.Context) error {
+	var last int64
+	err := p.DB.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		last, err = database.LastScanEventId(db)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		for {
+			messages, next, err := p.messagesAfter(last)
+			if err != nil {
+				log.Println(err)
+				break
+			}
+			if len(messages) > 0 {
+				if err := p.publish(messages); err != nil {
+					log.Println(err)
+					break
+				}
+			}
+			if next == last {
+				break
+			}
+			last = next
+		}
+	}
+}
+
+// messagesAfter returns the Messages for the Items added after the event
+// with the given id, along with the id of the last event read
+func (p *Publisher) messagesAfter(afterId int64) ([]*Message, int64, error) {
+	messages := make([]*Message, 0)
+	last := afterId
+	err := p.DB.WithRead(func(db *sqlite3.Conn) error {
+		events, err := database.GetScanEventsAfter(db, afterId, BATCH_SIZE)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		accountIds := make([]int64, 0, len(events))
+		for _, e := range events {
+			accountIds = append(accountIds, e.AccountId)
+		}
+		accounts, err := database.GetAccountsMap(db, accountIds)
+		if err != nil {
+			return err
+		}
+		devices, err := database.GetDevices(db)
+		if err != nil {
+			return err
+		}
+		deviceNames := make(map[int64]string)
+		for _, d := range devices {
+			deviceNames[d.Id] = d.Name
+		}
+
+		for _, e := range events {
+			last = e.Id
+			if e.Action != database.ITEM_ADDED {
+				continue
+			}
+			m := &Message{ItemId: e.ItemId,
+				Barcode:   e.Barcode,
+				AccountId: e.AccountId,
+				DeviceId:  e.DeviceId,
+				Device:    deviceNames[e.DeviceId],
+				Source:    e.Source,
+				Timestamp: e.Logged}
+			if acc, found := accounts[e.AccountId]; found {
+				m.Account = acc.Email
+				if item, itemErr := database.GetSingleItem(db, acc, e.ItemId); itemErr == nil {
+					m.Desc = item.Desc
+				}
+			}
+			messages = append(messages, m)
+		}
+		return nil
+	})
+	return messages, last, err
+}
+
+func (p *Publisher) publish(messages []*Message) error {
+	topic := p.Topic
+	if topic == "" {
+		topic = DEFAULT_TOPIC
+	}
+	payloads := make([][]byte, 0, len(messages))
+	for _, m := range messages {
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
+	}
+	return p.Broker.Publish(topic, payloads...)
+}
@@ -0,0 +1,73 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package mqtt
+
+import (
+	"encoding/json"
+	"github.com/Banrai/PiScan/client/database"
+	"testing"
+)
+
+func TestMessagesAfter(t *testing.T) {
+	d, err := database.OpenDB(database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	code, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&database.Account{Email: "alice@example.org", APICode: code}).Add(d.Write()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := d.GetAccount("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cola := &database.Item{Barcode: "036000291452", Desc: "Cola"}
+	if _, err := d.AddItem(a, cola); err != nil {
+		t.Fatal(err)
+	}
+	// which is not a Message, since nothing was added
+	if err := d.FavoriteItem(cola); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Publisher{DB: d}
+	messages, last, err := p.messagesAfter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("messagesAfter(0) = %d messages, want 1", len(messages))
+	}
+	m := messages[0]
+	if m.ItemId != cola.Id || m.Barcode != cola.Barcode || m.Desc != "Cola" || m.AccountId != a.Id || m.Account != a.Email || m.Timestamp.IsZero() {
+		t.Errorf("messagesAfter(0) = %+v", m)
+	}
+
+	// each is published as json
+	payload, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"item_id", "barcode", "desc", "account_id", "account", "timestamp"} {
+		if _, found := fields[field]; !found {
+			t.Errorf("the payload %s has no %s", payload, field)
+		}
+	}
+	if _, found := fields["device"]; found {
+		t.Errorf("the payload %s has a device, without one", payload)
+	}
+
+	// and the favorite was read past, so nothing is left
+	if messages, next, err := p.messagesAfter(last); err != nil || len(messages) != 0 || next != last {
+		t.Errorf("messagesAfter(%d) = %v, %d, %v, want nothing", last, messages, next, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package outbox sends the Items which the Pi client could not send to the
+// API server when they were scanned (e.g., because it had no network) once
+// it can, retrying each one with an exponential backoff
+
+package outbox
+
+import (
+	"context"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"log"
+	"time"
+)
+
+const (
+	POLL_INTERVAL = 30 * time.Second // how often the queue is checked
+	MIN_BACKOFF   = 30 * time.Second // the wait before the first retry
+	MAX_BACKOFF   = 6 * time.Hour    // the longest wait between retries
+	BATCH_SIZE    = 16               // the most Items sent per check
+)
+
+// SendFn sends the queued Item to the API server, returning an error if it
+// should be retried later. It is called without holding either of the
+// DB's connections, so it must use WithWrite (or WithRead) to save whatever
+// it gets back.
+type SendFn func(p *database.PendingSync) error
+
+// Engine sends the queued Items (see database.QueueItemSync) from its own
+// goroutine (see Run), sharing the DB with the scanner and the WebApp. It
+// must be created with NewEngine.
+type Engine struct {
+	DB   *database.DB
+	Send SendFn
+
+	PollInterval time.Duration // defaults to POLL_INTERVAL
+	MinBackoff   time.Duration // defaults to MIN_BACKOFF
+	MaxBackoff   time.Duration // defaults to MAX_BACKOFF
+
+	wake chan struct{}
+}
+
+// NewEngine returns an Engine which sends the Items queued in the DB with
+// the function, with the default interval and backoffs
+func NewEngine(db *database.DB, send SendFn) *Engine {
+	return &Engine{DB: db,
+		Send:         send,
+		PollInterval: POLL_INTERVAL,
+		MinBackoff:   MIN_BACKOFF,
+		MaxBackoff:   MAX_BACKOFF,
+		wake:         make(chan struct{}, 1)}
+}
+
+// Backoff returns how long to wait before retrying an Item which has failed
+// this many times: MinBackoff, doubled for each failure after the first,
+// up to MaxBackoff
+func (e *Engine) Backoff(attempts int64) time.Duration {
+	wait, longest := orDefault(e.MinBackoff, MIN_BACKOFF), orDefault(e.MaxBackoff, MAX_BACKOFF)
+	for n := int64(1); n < attempts && wait < longest; n++ {
+		wait *= 2
+	}
+	if wait > longest {
+		wait = longest
+	}
+	return wait
+}
+
+// orDefault returns the duration, or the default if it is not set
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// Wake makes Run check the queue now, rather than at the next poll, e.g.,
+// once the network is back. It never blocks.
+func (e *Engine) Wake() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends all the queued Items which are due, then again at every poll
+// (or Wake), until the context is done
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(orDefault(e.PollInterval, POLL_INTERVAL))
+	defer ticker.Stop()
+	for {
+		e.SendDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.wake:
+		}
+	}
+}
+
+// SendDue sends each of the queued Items which are due, marking each one as
+// synced, or as failed, to be retried after its backoff, and returns how
+// many were synced
+func (e *Engine) SendDue() int {
+	synced := 0
+	for {
+		var due []*database.PendingSync
+		err := e.DB.WithWrite(func(db *sqlite3.Conn) error {
+			var err error
+			due, err = database.GetDueSyncs(db, BATCH_SIZE)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			return synced
+		}
+
+		sent := 0
+		for _, p := range due {
+			sendErr := e.Send(p)
+			err = e.DB.WithWrite(func(db *sqlite3.Conn) error {
+				if sendErr != nil {
+					return p.Failed(db, sendErr, database.Now().Add(e.Backoff(p.Attempts+1)))
+				}
+				return p.Synced(db)
+			})
+			if err != nil {
+				log.Println(err)
+				return synced
+			}
+			if sendErr == nil {
+				sent += 1
+			}
+		}
+		synced += sent
+
+		// a full batch, all sent, means there may be more due now;
+		// otherwise, the rest wait for their backoff (or the next poll)
+		if len(due) < BATCH_SIZE || sent < len(due) {
+			return synced
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package outbox
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	e := &Engine{MinBackoff: time.Minute, MaxBackoff: time.Hour}
+	tests := []struct {
+		attempts int64
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, test := range tests {
+		if got := e.Backoff(test.attempts); got != test.want {
+			t.Errorf("Backoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+
+	// unset, the defaults are used
+	var unset Engine
+	if got := unset.Backoff(1); got != MIN_BACKOFF {
+		t.Errorf("Backoff(1) with no MinBackoff = %s, want %s", got, MIN_BACKOFF)
+	}
+	if got := unset.Backoff(1000); got != MAX_BACKOFF {
+		t.Errorf("Backoff(1000) with no MaxBackoff = %s, want %s", got, MAX_BACKOFF)
+	}
+}
+
+func TestWake(t *testing.T) {
+	e := NewEngine(nil, nil)
+	// a second Wake, before Run checks, does not block
+	e.Wake()
+	e.Wake()
+	if len(e.wake) != 1 {
+		t.Errorf("%d wakes pending, want 1", len(e.wake))
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	now := time.Date(2015, time.March, 14, 9, 26, 53, 0, time.UTC)
+	database.Now = func() time.Time { return now }
+	defer func() { database.Now = time.Now }()
+
+	d, err := database.OpenDB(database.ConnCoordinates{DBPath: t.TempDir(), DBFile: database.SQLITE_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	code, err := database.NewAPICode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&database.Account{Email: "alice@example.org", APICode: code}).Add(d.Write()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := d.GetAccount("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cola := &database.Item{Barcode: "036000291452", Desc: "Cola"}
+	if _, err := d.AddItem(a, cola); err != nil {
+		t.Fatal(err)
+	}
+	err = d.WithWrite(func(db *sqlite3.Conn) error { return database.QueueItemSync(db, cola) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the API server is down
+	var sent []*database.PendingSync
+	down := true
+	e := NewEngine(d, func(p *database.PendingSync) error {
+		sent = append(sent, p)
+		if down {
+			return errors.New("no network")
+		}
+		return nil
+	})
+	e.MinBackoff, e.MaxBackoff = time.Minute, time.Hour
+
+	if n := e.SendDue(); n != 0 || len(sent) != 1 {
+		t.Fatalf("SendDue() with the server down = %d, %d sent, want 0, 1", n, len(sent))
+	}
+	if p := sent[0]; p.ItemId != cola.Id || p.Barcode != cola.Barcode || p.AccountId != a.Id || p.Attempts != 1 || p.LastError != "no network" {
+		t.Errorf("the failed PendingSync = %+v", p)
+	}
+
+	// it waits its backoff, which doubles with each failure
+	if n := e.SendDue(); n != 0 || len(sent) != 1 {
+		t.Errorf("SendDue() before the backoff = %d, %d sent, want nothing sent", n, len(sent))
+	}
+	now = now.Add(time.Minute)
+	if n := e.SendDue(); n != 0 || len(sent) != 2 {
+		t.Fatalf("SendDue() after the backoff = %d, %d sent, want a retry", n, len(sent))
+	}
+	now = now.Add(time.Minute)
+	if e.SendDue(); len(sent) != 2 {
+		t.Errorf("SendDue() a minute after the second failure sent %d, want it to wait 2m", len(sent))
+	}
+
+	// until the server is back
+	down = false
+	now = now.Add(time.Minute)
+	if n := e.SendDue(); n != 1 || len(sent) != 3 {
+		t.Errorf("SendDue() with the server back = %d, %d sent, want 1, 3", n, len(sent))
+	}
+	now = now.Add(MAX_BACKOFF)
+	if n := e.SendDue(); n != 0 || len(sent) != 3 {
+		t.Errorf("SendDue() once synced = %d, %d sent, want nothing sent", n, len(sent))
+	}
+	var statuses map[int64]string
+	err = d.WithRead(func(db *sqlite3.Conn) error {
+		var err error
+		statuses, err = database.GetSyncStatus(db, a)
+		return err
+	})
+	if err != nil || statuses[cola.Id] != database.SYNC_DONE {
+		t.Errorf("GetSyncStatus() = %v, %v, want the cola synced", statuses, err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package report
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"log"
+	"time"
+)
+
+const (
+	EXPIRY_SUBJECT = "Food About to Expire"
+
+	// how many days before an Item expires it is warned about, by default
+	DEFAULT_EXPIRY_DAYS = 3
+
+	// the template files (in the folder given to LoadExpiryTemplates)
+	// which replace the defaults, if they exist
+	EXPIRY_TEXT_TEMPLATE_FILE = "expiring_items.txt"
+	EXPIRY_HTML_TEMPLATE_FILE = "expiring_items.html"
+
+	EXPIRY_TEXT_TEMPLATE = `These are about to expire, as of {{.Date}}:
+{{range $i, $item := .Items}}
+{{(plus1 $i)}}. {{$item.Desc}}: {{if $item.Expired}}expired{{else}}expires{{end}} {{$item.Expires}}{{end}}
+`
+	EXPIRY_HTML_TEMPLATE = `<p>These are about to expire, as of {{.Date}}:</p>
+<ol>
+{{range $item := .Items}}  <li>{{$item.Desc}}: {{if $item.Expired}}<strong>expired</strong>{{else}}expires{{end}} {{$item.Expires}}</li>
+{{end}}</ol>`
+)
+
+var (
+	ErrNoExpiryTemplates = errors.New("the mailer has no expiry warning templates")
+)
+
+// ExpiringItem is one line of the expiry warning
+type ExpiringItem struct {
+	Desc    string // or else the barcode, if the Item has no description
+	Barcode string
+	Expires string
+	Expired bool
+}
+
+// ExpiringList is what the expiry warning templates are executed with
+type ExpiringList struct {
+	Account *database.Account
+	Date    string
+	Items   []*ExpiringItem
+}
+
+// GetExpiringList returns the expiry warning of the Account's Items, e.g.,
+// those returned by database.GetExpiringItems, in the same order
+func GetExpiringList(a *database.Account, items []*database.Item) *ExpiringList {
+	list := &ExpiringList{Account: a, Date: database.Now().Format("Monday, January 2"), Items: make([]*ExpiringItem, 0, len(items))}
+	for _, i := range items {
+		if i.ExpiresAt == nil {
+			continue
+		}
+		line := &ExpiringItem{Desc: i.Desc, Barcode: i.Barcode,
+			Expires: i.ExpiresAt.Local().Format("Monday, January 2"),
+			Expired: i.Expired()}
+		if line.Desc == "" {
+			line.Desc = i.Barcode
+		}
+		list.Items = append(list.Items, line)
+	}
+	return list
+}
+
+// LoadExpiryTemplates returns the default expiry warning Templates, each
+// replaced by its file (EXPIRY_TEXT_TEMPLATE_FILE, or
+// EXPIRY_HTML_TEMPLATE_FILE) if it is in the folder
+func LoadExpiryTemplates(folder string) (*Templates, error) {
+	return loadTemplates(folder, EXPIRY_TEXT_TEMPLATE_FILE, EXPIRY_TEXT_TEMPLATE, EXPIRY_HTML_TEMPLATE_FILE, EXPIRY_HTML_TEMPLATE)
+}
+
+// Warn emails the Account the warning of its Items which are about to
+// expire (as a database.ExpiryWarningFn), unless it is anonymous
+// (ErrUnregistered), or there are none (ErrEmptyList)
+func (m *Mailer) Warn(a *database.Account, items []*database.Item) error {
+	if m.Expiry == nil {
+		return ErrNoExpiryTemplates
+	}
+	if a.IsAnonymous() || a.Email == "" {
+		return ErrUnregistered
+	}
+	list := GetExpiringList(a, items)
+	if len(list.Items) == 0 {
+		return ErrEmptyList
+	}
+	return m.send(a, EXPIRY_SUBJECT, m.Expiry, list)
+}
+
+// WarnAll warns each registered Account of its Items which expire within
+// the given duration, and which it has not been warned about already (see
+// database.WarnExpiring), and returns how many were warned, along with the
+// first error, if any (after trying all the others)
+func (m *Mailer) WarnAll(db *sqlite3.Conn, within time.Duration) (int, error) {
+	accounts, err := database.GetAllAccounts(db)
+	if err != nil {
+		return 0, err
+	}
+	warned := 0
+	var failed error
+	for _, a := range accounts {
+		if a.IsAnonymous() || a.Email == "" {
+			continue
+		}
+		n, err := database.WarnExpiring(db, a, within, m.Warn)
+		switch {
+		case err == nil:
+			if n > 0 {
+				warned += 1
+			}
+		case failed == nil:
+			failed = err
+		}
+	}
+	return warned, failed
+}
+
+// RunExpiryWarnings sends all the expiry warnings (see WarnAll) each time
+// the Schedule comes up, connecting to the client db for each run, until
+// the context is done
+func (m *Mailer) RunExpiryWarnings(ctx context.Context, s *Schedule, coords database.ConnCoordinates, within time.Duration) {
+	runScheduled(ctx, s, coords, "expiry warning", func(db *sqlite3.Conn) {
+		warned, warnErr := m.WarnAll(db, within)
+		if warnErr != nil {
+			log.Println(warnErr)
+		}
+		log.Println(fmt.Sprintf("Emailed %d expiry warnings", warned))
+	})
+}
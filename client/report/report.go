@@ -0,0 +1,259 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package report emails each registered Account its shopping list: what is
+// left to buy on its open one (see database.GetShoppingList), or else its
+// favorites, and the Items it has used up (at a quantity of zero, see
+// database.SCAN_CONSUME), as both plain text and html, from templates which
+// can be replaced (see LoadTemplates). The lists are sent on demand, from the
+// WebApp, or on a cron-like Schedule (see Mailer.Run). Each Account can also
+// be warned of its Items which are about to expire (see Mailer.Warn).
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/server/emailer"
+	"github.com/mxk/go-sqlite/sqlite3"
+	html "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	text "text/template"
+	"time"
+)
+
+const (
+	SUBJECT     = "My Shopping List"
+	SENDER_NAME = "PiScan"
+
+	// the template files (in the folder given to LoadTemplates) which
+	// replace the defaults, if they exist
+	TEXT_TEMPLATE_FILE = "shopping_list.txt"
+	HTML_TEMPLATE_FILE = "shopping_list.html"
+
+	TEXT_TEMPLATE = `Here is your shopping list, as of {{.Date}}:
+{{range $i, $item := .Items}}
+{{(plus1 $i)}}. {{$item.Desc}}{{if gt $item.Quantity 1}} (x{{$item.Quantity}}){{end}}{{if $item.UsedUp}} (used up){{end}}{{end}}
+`
+	HTML_TEMPLATE = `<p>Here is your shopping list, as of {{.Date}}:</p>
+<ol>
+{{range $item := .Items}}  <li>{{$item.Desc}}{{if gt $item.Quantity 1}} (x{{$item.Quantity}}){{end}}{{if $item.UsedUp}} <em>(used up)</em>{{end}}</li>
+{{end}}</ol>`
+)
+
+var (
+	ErrUnregistered = errors.New("the account has no email address to send to")
+	ErrEmptyList    = errors.New("the shopping list is empty")
+
+	TEMPLATE_FUNCTIONS = map[string]interface{}{
+		"plus1": func(x int) int { // use this to increment a range value (which starts at zero) within a template
+			return x + 1
+		},
+	}
+)
+
+// ListItem is one line of the shopping list
+type ListItem struct {
+	Desc     string
+	Barcode  string
+	Quantity int64 // how many to buy, if it is on the open shopping list
+	Favorite bool
+	UsedUp   bool
+}
+
+// ShoppingList is what the templates are executed with
+type ShoppingList struct {
+	Account *database.Account
+	Date    string
+	Items   []*ListItem
+}
+
+// GetShoppingList returns the Account's shopping list: what is still to be
+// bought on its open one (see database.GetShoppingList), if anything, or
+// else each of its described Items which is a favorite, or used up, in the
+// order they were scanned
+func GetShoppingList(db *sqlite3.Conn, a *database.Account) (*ShoppingList, error) {
+	list := &ShoppingList{Account: a, Date: database.Now().Format("Monday, January 2"), Items: make([]*ListItem, 0)}
+	open, err := database.GetShoppingList(db, a)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range open.Items {
+		if s.State != database.SHOPPING_PURCHASED {
+			list.Items = append(list.Items, &ListItem{Desc: s.Desc, Barcode: s.Barcode, Quantity: s.Quantity})
+		}
+	}
+	if len(list.Items) > 0 {
+		return list, nil
+	}
+
+	items, err := database.GetItems(db, a)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range items {
+		if i.Desc == "" || !(i.IsFavorite || i.Quantity == 0) {
+			continue
+		}
+		list.Items = append(list.Items, &ListItem{Desc: i.Desc, Barcode: i.Barcode, Favorite: i.IsFavorite, UsedUp: i.Quantity == 0})
+	}
+	return list, nil
+}
+
+// Templates are the plain text and html forms of the shopping list email
+type Templates struct {
+	Text *text.Template
+	HTML *html.Template
+}
+
+// LoadTemplates returns the default Templates, each replaced by its file
+// (TEXT_TEMPLATE_FILE, or HTML_TEMPLATE_FILE) if it is in the folder
+func LoadTemplates(folder string) (*Templates, error) {
+	return loadTemplates(folder, TEXT_TEMPLATE_FILE, TEXT_TEMPLATE, HTML_TEMPLATE_FILE, HTML_TEMPLATE)
+}
+
+// loadTemplates returns the plain text and html templates, each one read
+// from its file in the folder instead, if it is there
+func loadTemplates(folder, textFile, textDefault, htmlFile, htmlDefault string) (*Templates, error) {
+	textSource, textErr := readTemplate(folder, textFile, textDefault)
+	if textErr != nil {
+		return nil, textErr
+	}
+	htmlSource, htmlErr := readTemplate(folder, htmlFile, htmlDefault)
+	if htmlErr != nil {
+		return nil, htmlErr
+	}
+
+	t := new(Templates)
+	var err error
+	if t.Text, err = text.New(textFile).Funcs(TEMPLATE_FUNCTIONS).Parse(textSource); err != nil {
+		return nil, err
+	}
+	if t.HTML, err = html.New(htmlFile).Funcs(TEMPLATE_FUNCTIONS).Parse(htmlSource); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func readTemplate(folder, file, def string) (string, error) {
+	if folder == "" {
+		return def, nil
+	}
+	source, err := os.ReadFile(filepath.Join(folder, file))
+	if os.IsNotExist(err) {
+		return def, nil
+	}
+	return string(source), err
+}
+
+// Mailer sends the shopping lists (and the expiry warnings, see Warn)
+// through the mail server
+type Mailer struct {
+	Server    *emailer.MailServer
+	Sender    string // the From address
+	Templates *Templates
+	Expiry    *Templates // of the expiry warnings (see LoadExpiryTemplates)
+}
+
+// Send emails the Account its shopping list, unless it is anonymous
+// (ErrUnregistered), or has nothing on its list (ErrEmptyList)
+func (m *Mailer) Send(db *sqlite3.Conn, a *database.Account) error {
+	if a.IsAnonymous() || a.Email == "" {
+		return ErrUnregistered
+	}
+	list, err := GetShoppingList(db, a)
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return ErrEmptyList
+	}
+	return m.send(a, SUBJECT, m.Templates, list)
+}
+
+// send emails the Account the templates, executed with the data, as both
+// plain text and html
+func (m *Mailer) send(a *database.Account, subject string, t *Templates, data interface{}) error {
+	var plain, rich bytes.Buffer
+	if err := t.Text.Execute(&plain, data); err != nil {
+		return err
+	}
+	if err := t.HTML.Execute(&rich, data); err != nil {
+		return err
+	}
+	bodies := []*emailer.EmailBody{
+		{ContentType: emailer.TEXT_MIME, MessageBody: plain.String()},
+		{ContentType: emailer.HTML_MIME, MessageBody: rich.String()}}
+	sender := &emailer.EmailAddress{DisplayName: SENDER_NAME, Address: m.Sender}
+	recipient := &emailer.EmailAddress{DisplayName: a.Name, Address: a.Email}
+	return emailer.SendAlternatives(subject, bodies, m.Server, sender, recipient)
+}
+
+// SendAll emails each registered Account its shopping list, skipping those
+// with an empty list, and returns how many were sent, along with the first
+// error, if any (after trying all the others)
+func (m *Mailer) SendAll(db *sqlite3.Conn) (int, error) {
+	accounts, err := database.GetAllAccounts(db)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	var failed error
+	for _, a := range accounts {
+		err := m.Send(db, a)
+		switch {
+		case err == nil:
+			sent += 1
+		case errors.Is(err, ErrUnregistered), errors.Is(err, ErrEmptyList):
+		case failed == nil:
+			failed = err
+		}
+	}
+	return sent, failed
+}
+
+// Run sends all the shopping lists (see SendAll) each time the Schedule
+// comes up, connecting to the client db for each run, until the context is
+// done
+func (m *Mailer) Run(ctx context.Context, s *Schedule, coords database.ConnCoordinates) {
+	runScheduled(ctx, s, coords, "shopping list", func(db *sqlite3.Conn) {
+		sent, sendErr := m.SendAll(db)
+		if sendErr != nil {
+			log.Println(sendErr)
+		}
+		log.Println(fmt.Sprintf("Emailed %d shopping lists", sent))
+	})
+}
+
+// runScheduled calls the function each time the Schedule (of the named
+// emails) comes up, with a new connection to the client db, until the
+// context is done
+func runScheduled(ctx context.Context, s *Schedule, coords database.ConnCoordinates, name string, fn func(db *sqlite3.Conn)) {
+	for {
+		next := s.Next(database.Now())
+		if next.IsZero() {
+			log.Println(fmt.Sprintf("The %s schedule %q never comes up", name, s.Spec))
+			return
+		}
+		timer := time.NewTimer(next.Sub(database.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		db, err := database.InitializeDB(coords)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fn(db)
+		db.Close()
+	}
+}
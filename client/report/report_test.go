@@ -0,0 +1,115 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package report
+
+import (
+	"bytes"
+	"github.com/Banrai/PiScan/client/database"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testList = &ShoppingList{Date: "Saturday, March 14",
+	Items: []*ListItem{
+		{Desc: "Cola", Quantity: 6},
+		{Desc: "Fish & Chips", Quantity: 1, Favorite: true},
+		{Desc: "Pens", UsedUp: true}}}
+
+func render(t *testing.T, templates *Templates, data interface{}) (string, string) {
+	t.Helper()
+	var plain, rich bytes.Buffer
+	if err := templates.Text.Execute(&plain, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := templates.HTML.Execute(&rich, data); err != nil {
+		t.Fatal(err)
+	}
+	return plain.String(), rich.String()
+}
+
+func TestDefaultTemplates(t *testing.T) {
+	templates, err := LoadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, rich := render(t, templates, testList)
+	wantPlain := `Here is your shopping list, as of Saturday, March 14:
+
+1. Cola (x6)
+2. Fish & Chips
+3. Pens (used up)
+`
+	if plain != wantPlain {
+		t.Errorf("the text is %q, want %q", plain, wantPlain)
+	}
+	for _, want := range []string{"<li>Cola (x6)</li>", "<li>Fish &amp; Chips</li>", "<li>Pens <em>(used up)</em></li>"} {
+		if !strings.Contains(rich, want) {
+			t.Errorf("the html %q has no %q", rich, want)
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	// each file in the folder replaces its default, using the same functions
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, TEXT_TEMPLATE_FILE), []byte(`{{range $i, $item := .Items}}{{plus1 $i}}:{{$item.Desc}};{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, rich := render(t, templates, testList)
+	if plain != "1:Cola;2:Fish & Chips;3:Pens;" {
+		t.Errorf("the text from the file is %q", plain)
+	}
+	if !strings.HasPrefix(rich, "<p>Here is your shopping list") {
+		t.Errorf("the html is %q, want the default", rich)
+	}
+
+	// but one which does not parse fails
+	if err := os.WriteFile(filepath.Join(folder, HTML_TEMPLATE_FILE), []byte(`{{range .Items}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTemplates(folder); err == nil {
+		t.Error("LoadTemplates() of a broken html template succeeded")
+	}
+}
+
+func TestExpiryTemplates(t *testing.T) {
+	now := time.Date(2015, 3, 14, 9, 26, 53, 0, time.Local)
+	saved := database.Now
+	database.Now = func() time.Time { return now }
+	defer func() { database.Now = saved }()
+
+	tomorrow, yesterday := now.AddDate(0, 0, 1), now.AddDate(0, 0, -1)
+	list := GetExpiringList(&database.Account{Email: "alice@example.org"}, []*database.Item{
+		{Barcode: "036000291452", Desc: "Milk", ExpiresAt: &tomorrow},
+		{Barcode: "4006381333931", ExpiresAt: &yesterday},
+		{Barcode: "96385074", Desc: "Gum"}, // which never expires
+	})
+	if len(list.Items) != 2 || list.Date != "Saturday, March 14" {
+		t.Fatalf("GetExpiringList() = %+v, want the two which expire", list)
+	}
+	if list.Items[0].Desc != "Milk" || list.Items[0].Expires != "Sunday, March 15" || list.Items[0].Expired {
+		t.Errorf("the first is %+v", list.Items[0])
+	}
+	if list.Items[1].Desc != "4006381333931" || !list.Items[1].Expired {
+		t.Errorf("the second is %+v, want it named for its barcode, and expired", list.Items[1])
+	}
+
+	templates, err := LoadExpiryTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, rich := render(t, templates, list)
+	for _, body := range []string{plain, rich} {
+		if !strings.Contains(body, "Milk") || !strings.Contains(body, "4006381333931") || !strings.Contains(body, "Sunday, March 15") {
+			t.Errorf("the warning %q is missing an Item", body)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package report
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadSchedule = errors.New("schedule must be five cron fields: minute hour day-of-month month day-of-week")
+
+	// the range of each cron field
+	CRON_FIELDS = []struct {
+		Name     string
+		Min, Max int
+	}{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 6}, // sunday is 0 (or 7)
+	}
+
+	DAY_NAMES   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	MONTH_NAMES = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+)
+
+// Schedule is when the reports are sent, in the five fields of a crontab
+// line, e.g., "0 9 * * sat" for every Saturday, at 9am (see ParseSchedule)
+type Schedule struct {
+	Spec                                string
+	minutes, hours, days, months, wdays []bool
+	anyDay, anyWeekday                  bool
+}
+
+// ParseSchedule parses the five fields (minute, hour, day of month, month,
+// and day of week), each of which is a *, a number, a range (a-b), any of
+// them with a step (*/15, or 1-5/2), or a comma-separated list of any of
+// these. The months and days of the week can also be named, by their first
+// three letters. As in cron, when both the day of month and the day of
+// week are restricted, either one matching is enough.
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(CRON_FIELDS) {
+		return nil, ErrBadSchedule
+	}
+	sets := make([][]bool, len(fields))
+	for j, field := range fields {
+		var names []string
+		switch j {
+		case 3:
+			names = MONTH_NAMES
+		case 4:
+			names = DAY_NAMES
+		}
+		set, err := parseField(strings.ToLower(field), CRON_FIELDS[j].Min, CRON_FIELDS[j].Max, names)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", CRON_FIELDS[j].Name, err)
+		}
+		sets[j] = set
+	}
+	// sunday can also be 7
+	if len(sets[4]) > 7 && sets[4][7] {
+		sets[4][0] = true
+	}
+
+	return &Schedule{Spec: spec,
+		minutes:    sets[0],
+		hours:      sets[1],
+		days:       sets[2],
+		months:     sets[3],
+		wdays:      sets[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*")}, nil
+}
+
+// parseField returns which of the values min to max the field matches
+func parseField(field string, min, max int, names []string) ([]bool, error) {
+	top := max
+	if names != nil && min == 0 {
+		top = max + 1 // the day of week 7
+	}
+	set := make([]bool, top+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			part = part[:slash]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = fieldValue(bounds[0], min, names); err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = fieldValue(bounds[1], min, names); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				to = max // e.g., 5/15 means 5-59/15
+			}
+		}
+		if from < min || to > top || from > to {
+			return nil, fmt.Errorf("%q is out of range (%d-%d)", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// fieldValue returns the number, or named value (e.g., "sat")
+func fieldValue(s string, min int, names []string) (int, error) {
+	for j, name := range names {
+		if s == name {
+			return j + min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return v, nil
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	day, wday := s.days[t.Day()], s.wdays[int(t.Weekday())]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return wday
+	case s.anyWeekday:
+		return day
+	}
+	return day || wday
+}
+
+// Next returns the first time (to the minute) after the given one which
+// the Schedule matches, or the zero time if it never does (e.g., on
+// February 30th)
+func (s *Schedule) Next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// every possible day of the schedule comes up within five years
+	// (including a February 29th)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !s.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,81 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"0 9 * *",
+		"0 9 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+	} {
+		if s, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) = %+v, want an error", spec, s)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// a Saturday
+	after := time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC)
+	for _, test := range []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, 3, 14, 9, 27, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 3, 14, 9, 30, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2015, 3, 14, 9, 35, 0, 0, time.UTC)},
+		{"0,26 9,10 * * *", time.Date(2015, 3, 14, 10, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2015, 3, 15, 3, 0, 0, 0, time.UTC)},
+		// every Saturday, at 9am, is a week away
+		{"0 9 * * sat", time.Date(2015, 3, 21, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * SAT", time.Date(2015, 3, 21, 9, 0, 0, 0, time.UTC)},
+		// sunday is 0, or 7
+		{"0 0 * * 0", time.Date(2015, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * mon-fri", time.Date(2015, 3, 16, 8, 0, 0, 0, time.UTC)},
+		{"30 8 1 * *", time.Date(2015, 4, 1, 8, 30, 0, 0, time.UTC)},
+		{"59 23 31 dec *", time.Date(2015, 12, 31, 23, 59, 0, 0, time.UTC)},
+		{"0 12 * jan-may/2 sun", time.Date(2015, 3, 15, 12, 0, 0, 0, time.UTC)},
+		// with both days restricted, either one matching is enough
+		{"0 9 13 * fri", time.Date(2015, 3, 20, 9, 0, 0, 0, time.UTC)},
+		{"0 9 16 * fri", time.Date(2015, 3, 16, 9, 0, 0, 0, time.UTC)},
+		// the next leap day
+		{"0 0 29 feb *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// and one which never comes up
+		{"0 0 30 feb *", time.Time{}},
+	} {
+		s, err := ParseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q) = %v", test.spec, err)
+			continue
+		}
+		if next := s.Next(after); !next.Equal(test.next) {
+			t.Errorf("%q comes up next at %s, want %s", test.spec, next, test.next)
+		}
+	}
+
+	// always after the given time, even the minute it matches
+	s, err := ParseSchedule("26 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, want := s.Next(after.Truncate(time.Minute)), time.Date(2015, 3, 15, 9, 26, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("Next() of a time it matches = %s, want %s", next, want)
+	}
+}
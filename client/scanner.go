@@ -6,40 +6,99 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/Banrai/PiScan/barcode"
 	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/enrich"
+	"github.com/Banrai/PiScan/client/feedback"
+	"github.com/Banrai/PiScan/client/metrics"
+	"github.com/Banrai/PiScan/client/mqtt"
+	"github.com/Banrai/PiScan/client/outbox"
 	"github.com/Banrai/PiScan/scanner"
 	"github.com/Banrai/PiScan/server/commerce"
+	"github.com/mxk/go-sqlite/sqlite3"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 )
 
 const (
 	apiServerHost = "https://api.saruzai.com"
 	apiServerPort = 443
+
+	// the kinds of scanners (see the scanner package backends)
+	SCANNER_HID       = "hid"
+	SCANNER_SERIAL    = "serial"
+	SCANNER_BLUETOOTH = "bluetooth"
+	SCANNER_CAMERA    = "camera"
+
+	// how long after a product is scanned a date barcode can be scanned
+	// as its expiration date
+	EXPIRY_SCAN_WINDOW = 2 * time.Minute
+
+	// how long after a product is scanned another scan of it is a
+	// duplicate (e.g., a trigger which bounced), by default
+	DUPLICATE_SCAN_WINDOW = 2 * time.Second
 )
 
 func main() {
 	var (
 		device, apiServer, sqlitePath, sqliteFile, sqliteTablesDefinitionPath string
-		apiPort                                                               int
+		deviceSerial, deviceName, podDumpPath, duplicatePolicy                string
+		mqttBroker, mqttTopic, mqttUsername, mqttPassword                     string
+		scannerKinds, serialPort, bluetoothPort, videoDevice, metricsAddr     string
+		apiPort, serialBaud                                                   int
+		greenPin, yellowPin, redPin, buzzerPin                                int
+		useOpenFoodFacts                                                      bool
+		duplicateWindow                                                       time.Duration
 	)
 
+	// each scanner sharing the db is registered by its hostname, by default
+	hostname, _ := os.Hostname()
+
 	flag.StringVar(&device, "device", scanner.SCANNER_DEVICE, fmt.Sprintf("The '/dev/input/event' device associated with your scanner (defaults to '%s')", scanner.SCANNER_DEVICE))
+	flag.StringVar(&scannerKinds, "scanners", SCANNER_HID, fmt.Sprintf("The comma-separated kinds of scanners to read from: %s, %s, %s, and/or %s (defaults to '%s')", SCANNER_HID, SCANNER_SERIAL, SCANNER_BLUETOOTH, SCANNER_CAMERA, SCANNER_HID))
+	flag.StringVar(&serialPort, "serialPort", scanner.SERIAL_PORT, fmt.Sprintf("The serial port of the %s scanner (defaults to '%s')", SCANNER_SERIAL, scanner.SERIAL_PORT))
+	flag.IntVar(&serialBaud, "serialBaud", scanner.SERIAL_BAUD, fmt.Sprintf("The baud rate of the %s scanner (defaults to %d)", SCANNER_SERIAL, scanner.SERIAL_BAUD))
+	flag.StringVar(&bluetoothPort, "bluetoothPort", scanner.BLUETOOTH_PORT, fmt.Sprintf("The rfcomm device bound to the %s scanner (defaults to '%s')", SCANNER_BLUETOOTH, scanner.BLUETOOTH_PORT))
+	flag.StringVar(&videoDevice, "videoDevice", scanner.VIDEO_DEVICE, fmt.Sprintf("The video device of the %s scanner, read with zbarcam (defaults to '%s')", SCANNER_CAMERA, scanner.VIDEO_DEVICE))
+	flag.StringVar(&deviceSerial, "deviceSerial", hostname, fmt.Sprintf("The serial (or any other unique id) which this scanner is registered with in the client db (defaults to '%s')", hostname))
+	flag.StringVar(&deviceName, "deviceName", "", "The name to show for this scanner in the WebApp (e.g., 'Kitchen'), when it is first registered (defaults to its serial)")
 	flag.StringVar(&apiServer, "apiHost", apiServerHost, fmt.Sprintf("The hostname or IP address of the API server (defaults to '%s')", apiServerHost))
 	flag.IntVar(&apiPort, "apiPort", apiServerPort, fmt.Sprintf("The API server port (defaults to '%d')", apiServerPort))
+	flag.StringVar(&podDumpPath, "podDump", "", "Path to a csv export of the Open Product Data gtin table, to describe the items the API server does not find (optional)")
+	flag.BoolVar(&useOpenFoodFacts, "openFoodFacts", false, "Describe the items the API server does not find with the Open Food Facts api (after the podDump, if both are used)")
+	flag.DurationVar(&duplicateWindow, "duplicateWindow", DUPLICATE_SCAN_WINDOW, fmt.Sprintf("How soon after a product is scanned another scan of it is a duplicate, e.g., from a trigger which bounced (defaults to '%s', zero turns it off)", DUPLICATE_SCAN_WINDOW))
+	flag.StringVar(&duplicatePolicy, "duplicates", database.DUPLICATE_IGNORE, fmt.Sprintf("What a duplicate scan does: '%s' it, '%s' the quantity, or '%s' it as any other scan (defaults to '%s')", database.DUPLICATE_IGNORE, database.DUPLICATE_INCREMENT, database.DUPLICATE_INSERT, database.DUPLICATE_IGNORE))
+	flag.StringVar(&mqttBroker, "mqttBroker", "", fmt.Sprintf("The host:port of an MQTT broker to publish each item added to, e.g., for Home Assistant (optional, the port defaults to %s)", mqtt.DEFAULT_PORT))
+	flag.StringVar(&mqttTopic, "mqttTopic", mqtt.DEFAULT_TOPIC, fmt.Sprintf("The MQTT topic to publish each item added to (defaults to '%s')", mqtt.DEFAULT_TOPIC))
+	flag.StringVar(&mqttUsername, "mqttUsername", "", "The user name for the MQTT broker (optional)")
+	flag.StringVar(&mqttPassword, "mqttPassword", "", "The password for the MQTT broker (optional)")
+	flag.StringVar(&metricsAddr, "metricsAddr", "", fmt.Sprintf("The host:port (e.g., ':9100') to serve the Prometheus metrics at %s, and the health check at %s, on (optional)", metrics.METRICS_PATH, metrics.HEALTH_PATH))
+	flag.IntVar(&greenPin, "greenLED", -1, "The GPIO pin of the LED lit when a scan is saved (optional)")
+	flag.IntVar(&yellowPin, "yellowLED", -1, "The GPIO pin of the LED lit when a scan is a duplicate, or unknown (optional)")
+	flag.IntVar(&redPin, "redLED", -1, "The GPIO pin of the LED lit when a scan fails (optional)")
+	flag.IntVar(&buzzerPin, "buzzer", -1, "The GPIO pin of the piezo buzzer which beeps the outcome of each scan (optional)")
 	flag.StringVar(&sqlitePath, "sqlitePath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
 	flag.StringVar(&sqliteFile, "sqliteFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
-	flag.StringVar(&sqliteTablesDefinitionPath, "sqliteTables", "", fmt.Sprintf("Path to the sqlite database definitions file, %s, (use only if creating the client db for the first time)", database.TABLE_SQL_DEFINITIONS))
+	flag.StringVar(&sqliteTablesDefinitionPath, "sqliteTables", "", fmt.Sprintf("Path to a sqlite database definitions file, %s, which replaces the one compiled in (use only if creating the client db for the first time)", database.TABLE_SQL_DEFINITIONS))
 	flag.Parse()
 
+	if !database.DUPLICATE_POLICIES[duplicatePolicy] {
+		log.Fatal(fmt.Sprintf("%s: %q", database.ErrBadDuplicatePolicy, duplicatePolicy))
+	}
+
 	if len(sqliteTablesDefinitionPath) > 0 {
 		// this is a request to create the client db for the first time
-		initDb, initErr := database.InitializeDB(database.ConnCoordinates{sqlitePath, sqliteFile, sqliteTablesDefinitionPath})
+		initDb, initErr := database.InitializeDB(database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile, DBTablesPath: sqliteTablesDefinitionPath})
 		if initErr != nil {
 			log.Fatal(initErr)
 		}
@@ -52,90 +111,395 @@ func main() {
 		// coordinates for connecting to the sqlite database (from the command line options)
 		dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
 
-		// attempt to connect to the sqlite db
-		db, dbErr := database.InitializeDB(dbCoordinates)
+		// attempt to connect to the sqlite db, in WAL mode, so that the
+		// WebApp can keep reading it while each scan is written
+		store, dbErr := database.OpenDB(dbCoordinates)
 		if dbErr != nil {
 			log.Fatal(dbErr)
 		}
-		defer db.Close()
+		defer store.Close()
 
-		processScanFn := func(barcode string) {
-			// Lookup the barcode in the API server
-			apiResponse, apiErr := http.PostForm(fmt.Sprintf("%s:%d/lookup", apiServer, apiPort), url.Values{"barcode": {barcode}})
+		// the scans are processed one at a time, but the lookups which
+		// could not be sent are retried from their own goroutine, so both
+		// use the write connection only within WithWrite
+		var scannerDevice *database.Device
+		deviceErr := store.WithWrite(func(db *sqlite3.Conn) error {
+			// register this scanner, so that the items it scans are
+			// attributed to it, among the others sharing the db
+			var err error
+			scannerDevice, err = database.RegisterDevice(db, deviceSerial, deviceName)
+			return err
+		})
+		if deviceErr != nil {
+			log.Fatal(deviceErr)
+		}
+
+		// count the scans, and track the scanners and the lookups, for
+		// the metrics and the health check, if they are served
+		monitor := metrics.NewMonitor(store)
+		if len(metricsAddr) > 0 {
+			go func() {
+				log.Println(http.ListenAndServe(metricsAddr, monitor.Handler()))
+			}()
+		}
+
+		// the product catalogs (if any) which describe the items the
+		// API server does not find, in turn
+		providers := make(enrich.Chain, 0)
+		if len(podDumpPath) > 0 {
+			pod, podErr := enrich.NewPODDump(podDumpPath)
+			if podErr != nil {
+				log.Fatal(podErr)
+			}
+			providers = append(providers, pod)
+		}
+		if useOpenFoodFacts {
+			providers = append(providers, &enrich.OpenFoodFacts{})
+		}
+		var catalog database.Provider
+		if len(providers) > 0 {
+			catalog = providers
+
+			// and describe the unknown items scanned before, meanwhile
+			go func() {
+				acc, accErr := store.GetDesignatedAccount()
+				if accErr != nil {
+					log.Println(accErr)
+					return
+				}
+				described, enrichErr := enrich.Backfill(store, acc, catalog)
+				if enrichErr != nil {
+					log.Println(enrichErr)
+				}
+				log.Println(fmt.Sprintf("Described %d unknown items from %s", described, catalog.Name()))
+			}()
+		}
+
+		// send each lookup queued while the API server was unreachable,
+		// and save whatever it finds, in place of the unknown item
+		engine := outbox.NewEngine(store, func(p *database.PendingSync) error {
+			products, apiErr := lookupBarcode(apiServer, apiPort, p.Barcode)
+			monitor.SyncResult(apiErr)
 			if apiErr != nil {
-				fmt.Println(fmt.Sprintf("API access error: %s", apiErr))
-				return
+				return apiErr
+			}
+			return store.WithWrite(func(db *sqlite3.Conn) error {
+				acc := &database.Account{Id: p.AccountId}
+				unknownItem, itemErr := database.GetSingleItem(db, acc, p.ItemId)
+				if itemErr != nil || unknownItem == nil {
+					return itemErr
+				}
+				if saveProducts(db, acc, unknownItem, products, catalog) > 0 {
+					return unknownItem.Purge(db)
+				}
+				return nil
+			})
+		})
+		go engine.Run(context.Background())
+
+		// publish each item added (from this scanner, or any other
+		// process sharing the db) to the MQTT broker, if there is one
+		if len(mqttBroker) > 0 {
+			publisher := &mqtt.Publisher{DB: store,
+				Broker: &mqtt.Broker{Addr: mqttBroker, Username: mqttUsername, Password: mqttPassword},
+				Topic:  mqttTopic}
+			go func() {
+				if mqttErr := publisher.Run(context.Background()); mqttErr != nil {
+					log.Println(mqttErr)
+				}
+			}()
+		}
+
+		// signal the outcome of each scan on the GPIO pins, if any
+		var signals *feedback.Feedback
+		if greenPin >= 0 || yellowPin >= 0 || redPin >= 0 || buzzerPin >= 0 {
+			var gpioErr error
+			signals, gpioErr = feedback.NewGPIO(greenPin, yellowPin, redPin, buzzerPin)
+			if gpioErr != nil {
+				log.Fatal(gpioErr)
 			}
-			rawJson, _ := ioutil.ReadAll(apiResponse.Body)
-			apiResponse.Body.Close()
+		}
+
+		// signal the outcome of each scan, and count it
+		signalFn := func(outcome string) {
+			monitor.CountScan(outcome)
+			signals.Signal(outcome)
+		}
+
+		// the product scanned last, and when, which a date barcode scanned
+		// right after it is the expiration date of
+		var lastCode string
+		var lastScanned time.Time
+
+		setExpiresFn := func(code string, expiry *barcode.Expiry) error {
+			return store.WithWrite(func(db *sqlite3.Conn) error {
+				acc, err := database.GetDesignatedAccount(db)
+				if err != nil {
+					return fmt.Errorf("Client db account access error: %s", err)
+				}
+				if _, err := database.SetBarcodeExpires(db, acc, code, database.ExpiresOn(expiry.Date)); err != nil {
+					return fmt.Errorf("Client db expiration error: %s", err)
+				}
+				fmt.Println(fmt.Sprintf("%s expires on %s", code, expiry.Date.Format("Monday, January 2")))
+				return nil
+			})
+		}
 
-			var products []*commerce.API
-			err := json.Unmarshal(rawJson, &products)
-			if err != nil {
-				fmt.Println(fmt.Sprintf("API barcode lookup error: %s", err))
+		processScanFn := func(scan string) {
+			// a date barcode is the expiration date of the product scanned
+			// just before it, unless it has a product barcode of its own
+			expiry, isDate := barcode.ParseExpiry(scan)
+			if isDate && expiry.GTIN == "" {
+				if lastCode == "" || database.Now().Sub(lastScanned) > EXPIRY_SCAN_WINDOW {
+					fmt.Println(fmt.Sprintf("Date barcode error: no product was scanned just before it (%q)", scan))
+					signalFn(feedback.ERROR)
+					return
+				}
+				if expiryErr := setExpiresFn(lastCode, expiry); expiryErr != nil {
+					fmt.Println(expiryErr)
+					signalFn(feedback.ERROR)
+					return
+				}
+				signalFn(feedback.SUCCESS)
 				return
 			}
+			if isDate {
+				scan = expiry.GTIN
+			}
 
-			// get the Account for this request
-			acc, accErr := database.GetDesignatedAccount(db)
-			if accErr != nil {
-				fmt.Println(fmt.Sprintf("Client db account access error: %s", accErr))
+			// drop anything which is not a barcode (e.g., noise from the
+			// scanner), and use the canonical form of each one that is
+			code, codeErr := barcode.Normalize(scan)
+			if codeErr != nil {
+				fmt.Println(fmt.Sprintf("Barcode error: %s (%q)", codeErr, scan))
+				signalFn(feedback.ERROR)
 				return
 			}
 
-			// get the list of current Vendors according to the Pi client database
-			// and map them according to their API vendor id string
-			vendors := make(map[string]*database.Vendor)
-			for _, v := range database.GetAllVendors(db) {
-				vendors[v.VendorId] = v
-			}
+			var acc *database.Account
+			var repeated *database.Item
+			ignored := false
+			dbErr := store.WithWrite(func(db *sqlite3.Conn) error {
+				// get the Account for this request
+				var err error
+				acc, err = database.GetDesignatedAccount(db)
+				if err != nil {
+					return fmt.Errorf("Client db account access error: %s", err)
+				}
+				scannerDevice.Seen(db)
 
-			productsFound := 0
-			for i, product := range products {
-				v, exists := vendors[product.Vendor]
-				if !exists {
-					if len(product.Vendor) > 0 {
-						amazonId, amazonErr := database.AddVendor(db, product.Vendor, "Amazon")
-						if amazonErr == nil {
-							v = database.GetVendor(db, amazonId)
-							vendors[product.Vendor] = v
-							exists = true
-						}
+				// a barcode saved (or scanned again) just before is a
+				// duplicate scan, which is handled as its policy says,
+				// unless that is to record it as any other scan
+				if duplicateWindow > 0 && duplicatePolicy != database.DUPLICATE_INSERT {
+					recent, err := database.RecentScan(db, acc, code, duplicateWindow)
+					if err != nil {
+						return fmt.Errorf("Client db duplicate scan error: %s", err)
+					}
+					if recent != nil && duplicatePolicy == database.DUPLICATE_IGNORE {
+						ignored = true
+						return database.IgnoreScan(db, acc, recent, scannerDevice.Id)
+					}
+					if recent != nil {
+						repeated = recent
+						return recent.IncrementQuantity(db, 1)
 					}
 				}
 
-				if len(product.ProductName) > 0 {
-					// convert the commerce.API struct into a database.Item
-					// so that it can be logged into the Pi client sqlite db
-					item := database.Item{
-						Index:           int64(i),
-						Barcode:         barcode,
-						Desc:            product.ProductName,
-						UserContributed: false}
-					pk, insertErr := item.Add(db, acc)
-					if insertErr == nil {
-						// also log the vendor/product code combination
-						if exists {
-							database.AddVendorProduct(db, product.SKU, v.Id, pk)
-						}
+				// a barcode already saved only has its quantity changed,
+				// according to the Account's scan mode, without any lookup
+				repeated, err = database.RecordQuantityScan(db, acc, code)
+				if err != nil {
+					return fmt.Errorf("Client db quantity error: %s", err)
+				}
+				return nil
+			})
+			if dbErr != nil {
+				fmt.Println(dbErr)
+				signalFn(feedback.ERROR)
+				return
+			}
+			if ignored {
+				fmt.Println(fmt.Sprintf("Duplicate scan ignored: %s", code))
+				signalFn(feedback.IGNORED)
+				return
+			}
+
+			// remember the product, for a date barcode scanned next, and
+			// give it its own expiration date, if it came with one
+			scannedFn := func() {
+				lastCode, lastScanned = code, database.Now()
+				if isDate {
+					if expiryErr := setExpiresFn(code, expiry); expiryErr != nil {
+						fmt.Println(expiryErr)
 					}
-					productsFound += 1
 				}
 			}
+			if repeated != nil {
+				scannedFn()
+				signalFn(feedback.DUPLICATE)
+				return
+			}
 
-			if productsFound == 0 {
-				// add it to the Pi client sqlite db as "unknown"
-				// so that it can be manually edited/input
-				unknownItem := database.Item{Index: 0, Barcode: barcode}
-				unknownItem.Add(db, acc)
+			// Lookup the barcode in the API server
+			products, apiErr := lookupBarcode(apiServer, apiPort, code)
+			monitor.SyncResult(apiErr)
+			outcome := feedback.UNKNOWN
+			saveErr := store.WithWrite(func(db *sqlite3.Conn) error {
+				if apiErr == nil {
+					scanned := &database.Item{Barcode: code, DeviceId: scannerDevice.Id}
+					if saveProducts(db, acc, scanned, products, catalog) > 0 || len(scanned.Desc) > 0 {
+						outcome = feedback.SUCCESS
+					} else if scanned.Id == 0 {
+						outcome = feedback.ERROR
+					}
+					return nil
+				}
+
+				// save it as "unknown" for now, and queue the lookup, to
+				// be retried once the API server can be reached again
+				fmt.Println(fmt.Sprintf("API access error (queued for later): %s", apiErr))
+				unknownItem := database.Item{Barcode: code, DeviceId: scannerDevice.Id}
+				if insertErr := addUnknown(db, acc, &unknownItem, catalog); insertErr != nil {
+					return insertErr
+				}
+				if queueErr := database.QueueItemSync(db, &unknownItem); queueErr != nil {
+					log.Println(queueErr)
+				}
+				if len(unknownItem.Desc) > 0 {
+					outcome = feedback.SUCCESS
+				}
+				return nil
+			})
+			if saveErr != nil {
+				outcome = feedback.ERROR
+			} else if outcome != feedback.ERROR {
+				scannedFn()
 			}
+			signalFn(outcome)
 		}
 
+		// a scanner which fails (e.g., one unplugged) is retried, so
+		// its errors are only logged
 		errorFn := func(e error) {
-			log.Fatal(e)
+			log.Println(e)
+		}
+
+		scanners := make([]scanner.Scanner, 0)
+		for _, kind := range strings.Split(scannerKinds, ",") {
+			switch strings.TrimSpace(kind) {
+			case SCANNER_HID:
+				scanners = append(scanners, &scanner.HIDScanner{Device: device})
+			case SCANNER_SERIAL:
+				scanners = append(scanners, &scanner.SerialScanner{Port: serialPort, Baud: serialBaud})
+			case SCANNER_BLUETOOTH:
+				scanners = append(scanners, &scanner.BluetoothScanner{Port: bluetoothPort})
+			case SCANNER_CAMERA:
+				scanners = append(scanners, &scanner.CameraScanner{Device: videoDevice})
+			default:
+				log.Fatal(fmt.Sprintf("Unknown scanner kind: %q", kind))
+			}
 		}
 
-		log.Println(fmt.Sprintf("Starting the scanner %s", device))
-		scanner.ScanForever(device, processScanFn, errorFn)
+		for _, s := range scanners {
+			log.Println(fmt.Sprintf("Starting the scanner %s", s.Name()))
+		}
+		log.Fatal(scanner.RunWithStatus(context.Background(), scanners, processScanFn, errorFn, monitor.ScannerStatus))
+	}
+}
+
+// lookupBarcode posts the barcode to the API server, returning the products
+// it found (if any), or an error if the server could not be reached (or
+// its reply could not be read), e.g., when the Pi has no network
+func lookupBarcode(apiServer string, apiPort int, barcode string) ([]*commerce.API, error) {
+	apiResponse, apiErr := http.PostForm(fmt.Sprintf("%s:%d/lookup", apiServer, apiPort), url.Values{"barcode": {barcode}})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	rawJson, readErr := ioutil.ReadAll(apiResponse.Body)
+	apiResponse.Body.Close()
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var products []*commerce.API
+	if err := json.Unmarshal(rawJson, &products); err != nil {
+		return nil, fmt.Errorf("API barcode lookup error: %s", err)
+	}
+	return products, nil
+}
+
+// saveProducts adds each of the (named) products found for the scanned Item
+// to the Pi client sqlite db, along with its vendor/product code, for the
+// Account, and returns how many there were. If there were none, the Item is
+// added as "unknown" instead (unless it was saved already, see addUnknown).
+func saveProducts(db *sqlite3.Conn, acc *database.Account, scanned *database.Item, products []*commerce.API, catalog database.Provider) int {
+	// get the list of current Vendors according to the Pi client database
+	// and map them according to their API vendor id string
+	vendors := make(map[string]*database.Vendor)
+	for _, v := range database.GetAllVendors(db) {
+		vendors[v.VendorId] = v
+	}
+
+	productsFound := 0
+	for i, product := range products {
+		v, exists := vendors[product.Vendor]
+		if !exists {
+			if len(product.Vendor) > 0 {
+				amazonId, amazonErr := database.AddVendor(db, product.Vendor, "Amazon")
+				if amazonErr == nil {
+					v = database.GetVendor(db, amazonId)
+					vendors[product.Vendor] = v
+					exists = true
+				}
+			}
+		}
+
+		if len(product.ProductName) > 0 {
+			// convert the commerce.API struct into a database.Item
+			// so that it can be logged into the Pi client sqlite db
+			ind := int64(i)
+			item := database.Item{
+				Index:           &ind,
+				Barcode:         scanned.Barcode,
+				Desc:            product.ProductName,
+				UserContributed: false,
+				DeviceId:        scanned.DeviceId}
+			pk, insertErr := item.Add(db, acc)
+			if insertErr == nil {
+				// also log the vendor/product code combination
+				if exists {
+					database.AddVendorProduct(db, product.SKU, v.Id, pk)
+				}
+			} else if errors.Is(insertErr, database.ErrDiskFull) {
+				log.Println(database.ErrDiskFull)
+			}
+			productsFound += 1
+		}
+	}
+
+	if productsFound == 0 && scanned.Id == 0 {
+		addUnknown(db, acc, scanned, catalog)
+	}
+	return productsFound
+}
+
+// addUnknown adds the Item which the API server did not find to the Pi
+// client sqlite db, described by the product catalog, if there is one and
+// it has the barcode, or else as "unknown", so that it can be manually
+// edited/input
+func addUnknown(db *sqlite3.Conn, acc *database.Account, item *database.Item, catalog database.Provider) error {
+	var insertErr error
+	if catalog != nil {
+		var unresolved *database.ResolveError
+		if insertErr = item.AddResolved(db, acc, database.CatalogResolver(db, catalog)); errors.As(insertErr, &unresolved) {
+			insertErr = nil
+		}
+	} else {
+		_, insertErr = item.Add(db, acc)
+	}
+	if errors.Is(insertErr, database.ErrDiskFull) {
+		log.Println(database.ErrDiskFull)
 	}
+	return insertErr
 }
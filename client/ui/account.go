@@ -7,6 +7,7 @@ package ui
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/Banrai/PiScan/client/database"
 	"github.com/Banrai/PiScan/server/api"
 	"github.com/Banrai/PiScan/server/digest"
@@ -28,7 +29,12 @@ type AccountForm struct {
 	Account      *database.Account
 	CancelUrl    string
 	FormError    string
+	PageMessage  string
 	Unregistered bool
+	Verified     bool
+	CanVerify    bool
+	HasPIN       bool
+	IsAdmin      bool
 }
 
 /* HTML Response Functions (via templates) */
@@ -52,7 +58,7 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 	defer db.Close()
 
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := CurrentAccount(r, db)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
@@ -76,7 +82,35 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		ActiveTab:    &ActiveTab{Scanned: false, Favorites: false, Account: true, ShowTabs: true},
 		Account:      acc,
 		CancelUrl:    cancelUrl,
-		Unregistered: regStatus}
+		Unregistered: regStatus,
+		CanVerify:    VERIFY_MAIL_SERVER != nil}
+
+	if !regStatus {
+		verified, verifiedErr := acc.IsVerified(db)
+		if verifiedErr != nil {
+			form.FormError = verifiedErr.Error()
+		}
+		form.Verified = verified
+
+		hasPIN, pinErr := acc.HasPIN(db)
+		if pinErr != nil {
+			form.FormError = pinErr.Error()
+		}
+		form.HasPIN = hasPIN
+
+		isAdmin, adminErr := acc.IsAdmin(db)
+		if adminErr != nil {
+			form.FormError = adminErr.Error()
+		}
+		form.IsAdmin = isAdmin
+	}
+
+	// show any ack from the verification, or api code forms
+	if "GET" == r.Method {
+		if ackType := r.URL.Query().Get("ack"); ackType != "" {
+			form.PageMessage = ACCOUNT_ACKS[ackType]
+		}
+	}
 
 	if "POST" == r.Method {
 		form.FormError = BAD_POST // in event of problems
@@ -98,25 +132,34 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 						form.FormError = updateErr.Error()
 					} else {
 						// ping the server with the api code and email for verification
-						ping := func() {
-							v := url.Values{}
-							v.Set("email", emailVal[0])
-							v.Set("api", acc.APICode)
+						go registerWithServer(apiHost, emailVal[0], acc.APICode) // do not wait for the server to reply
 
-							// use the email address as the digest key
-							hmac := digest.GenerateDigest(emailVal[0], v.Encode())
-							v.Set("hmac", hmac)
+						updated, updatedErr := database.GetAccount(db, emailVal[0])
+						if updatedErr != nil {
+							http.Error(w, updatedErr.Error(), http.StatusInternalServerError)
+							return
+						}
 
-							res, err := http.Get(strings.Join([]string{apiHost, "/register?", v.Encode()}, ""))
-							if err == nil {
-								res.Body.Close()
+						// registering means logging in from now on, so
+						// stay logged in, as the newly registered Account
+						if acc.IsAnonymous() {
+							if sessionErr := startSession(w, r, db, updated); sessionErr != nil {
+								http.Error(w, sessionErr.Error(), http.StatusInternalServerError)
+								return
 							}
 						}
 
-						go ping() // do not wait for the server to reply
+						// email the link which verifies the new address, if it changed
+						ack := ""
+						if updated.Email != acc.Email && VERIFY_MAIL_SERVER != nil {
+							ack = "?ack=verify"
+							if !sendVerification(r, db, updated) {
+								ack = "?ack=verify_failed"
+							}
+						}
 
 						// return success
-						http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
+						http.Redirect(w, r, ACCOUNT_URL+ack, http.StatusFound)
 						return
 					}
 				}
@@ -127,6 +170,76 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 	renderAccountEditTemplate(w, form)
 }
 
+// SetAccountPIN handles the form post which sets the PIN the Account logs
+// in with, provided it also has the current one (or its api code), if it
+// had one, returning to the Account page
+func SetAccountPIN(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if "POST" != r.Method {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return
+	}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if acc.IsAnonymous() {
+		http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
+		return
+	}
+
+	ack := "pin"
+	hasPIN, pinErr := acc.HasPIN(db)
+	if pinErr != nil {
+		http.Error(w, pinErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+	if hasPIN {
+		if _, authErr := database.Authenticate(db, acc.Email, r.PostFormValue("current")); authErr != nil {
+			ack = "pin_wrong"
+		}
+	}
+	if pin := r.PostFormValue("pin"); ack == "pin" {
+		if pin != r.PostFormValue("confirm") {
+			ack = "pin_mismatch"
+		} else if setErr := acc.SetPIN(db, pin); errors.Is(setErr, database.ErrBadPIN) {
+			ack = "pin_bad"
+		} else if setErr != nil {
+			http.Error(w, setErr.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, ACCOUNT_URL+"?ack="+ack, http.StatusFound)
+}
+
+// registerWithServer pings the API Server with the email and api code, so
+// that it can verify them
+func registerWithServer(apiHost, email, apiCode string) {
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("api", apiCode)
+
+	// use the email address as the digest key
+	hmac := digest.GenerateDigest(email, v.Encode())
+	v.Set("hmac", hmac)
+
+	res, err := http.Get(strings.Join([]string{apiHost, "/register?", v.Encode()}, ""))
+	if err == nil {
+		res.Body.Close()
+	}
+}
+
 // ConfirmServerAccount responds to the ajax request from the client to
 // lookup and return the status of the given account
 func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
@@ -148,7 +261,7 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 
 	if ack.Error == "" {
 		// get the Account for this request
-		acc, accErr := database.GetDesignatedAccount(db)
+		acc, accErr := CurrentAccount(r, db)
 		if accErr != nil {
 			ack.Error = accErr.Error()
 		}
@@ -0,0 +1,231 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/backup"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Errors
+	NOT_ADMIN = "Sorry, only an administrator can manage the accounts"
+	NOT_SELF  = "Sorry, you cannot do that to your own account"
+
+	// Info messages
+	ACCOUNT_ADDED   = "The account has been added"
+	ACCOUNT_PIN     = "The PIN has been changed"
+	ACCOUNT_ADMIN   = "The account's administrator status has been changed"
+	ACCOUNT_LOGOUT  = "The account has been logged out everywhere"
+	ACCOUNT_DELETED = "The account, and all of its items, have been deleted"
+
+	ADMIN_URL = "/admin/"
+)
+
+var (
+	ErrNotSelf   = errors.New(NOT_SELF)
+	ErrBadAction = errors.New(BAD_REQUEST)
+
+	ADMIN_TEMPLATE_FILES = []string{"admin.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ADMIN_TEMPLATES      *template.Template
+
+	// the message for each ?ack= of the admin page
+	ADMIN_ACKS = map[string]string{
+		"add":     ACCOUNT_ADDED,
+		"pin":     ACCOUNT_PIN,
+		"admin":   ACCOUNT_ADMIN,
+		"logout":  ACCOUNT_LOGOUT,
+		"delete":  ACCOUNT_DELETED,
+		"backup":  BACKUP_TAKEN,
+		"restore": BACKUP_RESTORED,
+	}
+)
+
+// AccountRow is one of the Accounts listed on the admin page
+type AccountRow struct {
+	Account  *database.Account
+	Admin    bool
+	Verified bool
+	HasPIN   bool
+	Items    int64
+	Self     bool // whether it is the admin's own Account
+}
+
+type AdminPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Accounts    []*AccountRow
+	FormError   string
+	PageMessage string
+	CanBackup   bool
+	Snapshots   []*backup.Snapshot
+}
+
+func renderAdminTemplate(w http.ResponseWriter, p *AdminPage) {
+	if TEMPLATES_INITIALIZED {
+		ADMIN_TEMPLATES.Execute(w, p)
+	}
+}
+
+// currentAdmin returns the Account for this request, and whether it is an
+// admin, replying with the error (or that it is not) otherwise
+func currentAdmin(w http.ResponseWriter, r *http.Request, db *sqlite3.Conn) (*database.Account, bool) {
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	isAdmin, adminErr := acc.IsAdmin(db)
+	if adminErr != nil {
+		http.Error(w, adminErr.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if !isAdmin {
+		http.Error(w, NOT_ADMIN, http.StatusForbidden)
+		return nil, false
+	}
+	return acc, true
+}
+
+// getAccountRows returns every registered Account, as the admin sees them
+func getAccountRows(db *sqlite3.Conn, admin *database.Account) ([]*AccountRow, error) {
+	accounts, err := database.GetAllAccounts(db)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*AccountRow, 0, len(accounts))
+	for _, a := range accounts {
+		if a.IsAnonymous() {
+			continue
+		}
+		row := &AccountRow{Account: a, Self: a.Id == admin.Id}
+		if row.Admin, err = a.IsAdmin(db); err != nil {
+			return nil, err
+		}
+		if row.Verified, err = a.IsVerified(db); err != nil {
+			return nil, err
+		}
+		if row.HasPIN, err = a.HasPIN(db); err != nil {
+			return nil, err
+		}
+		if row.Items, err = database.CountItems(db, a); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// adminAction applies the posted action to the Account it names (or, to
+// add one, creates it), returning the ack for it
+func adminAction(r *http.Request, db *sqlite3.Conn, admin *database.Account) (string, error) {
+	action := r.PostFormValue("action")
+	if "add" == action {
+		_, err := database.NewAccount(db, r.PostFormValue("email"), r.PostFormValue("name"), r.PostFormValue("pin"))
+		return action, err
+	}
+
+	id, idErr := strconv.ParseInt(r.PostFormValue("account"), 10, 64)
+	if idErr != nil {
+		return "", idErr
+	}
+	accounts, accErr := database.GetAccountsMap(db, []int64{id})
+	if accErr != nil {
+		return "", accErr
+	}
+	acc, found := accounts[id]
+	if !found || acc.IsAnonymous() {
+		return "", database.ErrNoAccount
+	}
+
+	switch action {
+	case "pin":
+		if err := acc.SetPIN(db, r.PostFormValue("pin")); err != nil {
+			return "", err
+		}
+		// a new PIN means the old one may have been known to someone else
+		_, err := acc.EndSessions(db)
+		return action, err
+	case "admin", "unadmin":
+		if acc.Id == admin.Id {
+			return "", ErrNotSelf
+		}
+		return "admin", acc.SetAdmin(db, "admin" == action)
+	case "logout":
+		if acc.Id == admin.Id {
+			return "", ErrNotSelf
+		}
+		_, err := acc.EndSessions(db)
+		return action, err
+	case "delete":
+		if acc.Id == admin.Id {
+			return "", ErrNotSelf
+		}
+		return action, acc.Delete(db)
+	}
+	return "", ErrBadAction
+}
+
+// AdminAccounts lists the registered Accounts (and the backups, if any)
+// for an administrator (in response to a GET request), and adds one,
+// changes its PIN, or its administrator status, logs it out, or deletes it
+// (in response to a POST request)
+func AdminAccounts(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request, which must be an admin
+	acc, isAdmin := currentAdmin(w, r, db)
+	if !isAdmin {
+		return
+	}
+
+	p := &AdminPage{Title: "Manage Accounts",
+		ActiveTab: &ActiveTab{Account: true, ShowTabs: true},
+		CanBackup: BACKUPS != nil}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		ack, actionErr := adminAction(r, db, acc)
+		if actionErr == nil {
+			http.Redirect(w, r, ADMIN_URL+"?ack="+ack, http.StatusFound)
+			return
+		}
+		p.FormError = actionErr.Error()
+	} else if ackType := r.URL.Query().Get("ack"); ackType != "" {
+		p.PageMessage = ADMIN_ACKS[ackType]
+	} else if errType := r.URL.Query().Get("error"); errType != "" {
+		p.FormError = BACKUP_ERRORS[errType]
+	}
+
+	rows, rowsErr := getAccountRows(db, acc)
+	if rowsErr != nil {
+		http.Error(w, rowsErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Accounts = rows
+
+	if p.CanBackup {
+		snapshots, listErr := BACKUPS.List()
+		if listErr != nil {
+			http.Error(w, listErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.Snapshots = snapshots
+	}
+
+	renderAdminTemplate(w, p)
+}
@@ -0,0 +1,63 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+const (
+	// the folder of the html templates among the compiled in assets
+	EMBEDDED_TEMPLATES = "templates"
+)
+
+var (
+	// the folders of the static resources, beside the templates folder
+	STATIC_FOLDERS = []string{"css", "js", "fonts", "images"}
+)
+
+// the html templates and the static resources, as compiled into the
+// package, so that the WebApp needs no files beside the binary
+//
+//go:embed templates css js fonts images
+var embeddedAssets embed.FS
+
+// parseTemplates parses the template files in the folder, or else the
+// compiled in ones, if it is empty
+func parseTemplates(folder string, files []string) (*template.Template, error) {
+	if folder == "" {
+		return template.ParseFS(embeddedAssets, TEMPLATE_LIST(EMBEDDED_TEMPLATES, files)...)
+	}
+	return template.ParseFiles(TEMPLATE_LIST(folder, files)...)
+}
+
+// readTemplate returns the contents of the template file in the folder, or
+// else of the compiled in one, if it is empty
+func readTemplate(folder, file string) ([]byte, error) {
+	if folder == "" {
+		return embeddedAssets.ReadFile(path.Join(EMBEDDED_TEMPLATES, file))
+	}
+	return ioutil.ReadFile(path.Join(folder, file))
+}
+
+// StaticHandler serves the files of one of the STATIC_FOLDERS (e.g., "css"),
+// from beside the templates folder, or else the compiled in ones, if the
+// templates folder is empty (see InitializeTemplates)
+func StaticHandler(templatesFolder, resource string) http.Handler {
+	if templatesFolder == "" {
+		files, err := fs.Sub(embeddedAssets, resource)
+		if err != nil {
+			return http.NotFoundHandler()
+		}
+		return http.FileServer(http.FS(files))
+	}
+	return http.FileServer(http.Dir(path.Join(templatesFolder, "..", resource)))
+}
@@ -0,0 +1,102 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"context"
+	"fmt"
+	"github.com/Banrai/PiScan/client/backup"
+	"github.com/Banrai/PiScan/client/database"
+	"log"
+	"net/http"
+)
+
+const (
+	// Errors
+	BACKUP_FAILED  = "Sorry, the backup failed (the WebApp log has the details)"
+	UPLOAD_FAILED  = "The backup was taken, but its upload failed (the WebApp log has the details)"
+	RESTORE_FAILED = "Sorry, the restore failed (the WebApp log has the details)"
+
+	// Info messages
+	BACKUP_TAKEN    = "The backup has been taken"
+	BACKUP_RESTORED = "The backup has been restored (the database as it was just before is now the newest backup, in case that needs to be undone)"
+
+	BACKUP_URL  = "/admin/backup/"
+	RESTORE_URL = "/admin/restore/"
+)
+
+var (
+	// the snapshots of the db, if the WebApp takes them (see InitializeBackups)
+	BACKUPS *backup.Backups
+
+	// the error for each ?error= of the admin page
+	BACKUP_ERRORS = map[string]string{
+		"backup":  BACKUP_FAILED,
+		"upload":  UPLOAD_FAILED,
+		"restore": RESTORE_FAILED,
+	}
+)
+
+// InitializeBackups makes the admin page list the snapshots, and offer to
+// take a new one, or restore any of them
+func InitializeBackups(b *backup.Backups) {
+	BACKUPS = b
+}
+
+// backupAction checks that the request is a form post by an admin, while
+// the WebApp takes backups, replying with the error otherwise
+func backupAction(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates) bool {
+	if "POST" != r.Method || BACKUPS == nil {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return false
+	}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	defer db.Close()
+
+	_, isAdmin := currentAdmin(w, r, db)
+	return isAdmin
+}
+
+// TakeBackup handles the admin's form post which takes a snapshot of the
+// db now, rather than waiting for the schedule
+func TakeBackup(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if !backupAction(w, r, dbCoords) {
+		return
+	}
+
+	s, err := BACKUPS.Take(context.Background())
+	if err != nil {
+		log.Println(err)
+		if s == nil {
+			http.Redirect(w, r, ADMIN_URL+"?error=backup", http.StatusFound)
+		} else {
+			http.Redirect(w, r, ADMIN_URL+"?error=upload", http.StatusFound)
+		}
+		return
+	}
+	log.Println(fmt.Sprintf("Backed up the db to %s (%d bytes)", s.Path, s.Size))
+	http.Redirect(w, r, ADMIN_URL+"?ack=backup", http.StatusFound)
+}
+
+// RestoreBackup handles the admin's form post which replaces the db with
+// the snapshot it names
+func RestoreBackup(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if !backupAction(w, r, dbCoords) {
+		return
+	}
+
+	r.ParseForm()
+	if _, err := BACKUPS.Restore(r.PostFormValue("snapshot")); err != nil {
+		log.Println(err)
+		http.Redirect(w, r, ADMIN_URL+"?error=restore", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, ADMIN_URL+"?ack=restore", http.StatusFound)
+}
@@ -27,7 +27,7 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 	defer db.Close()
 
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := CurrentAccount(r, db)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
@@ -87,10 +87,14 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 				} else {
 					// the hidden barcode value must match the retrieved item
 					if item.Barcode == barcodeVal[0] {
-						// update the item in the local client db
-						item.Desc = prodNameVal[0]
+						// update the item's description in the local
+						// client db, keeping its index (if it has one)
+						var index int64
+						if item.Index != nil {
+							index = *item.Index
+						}
 						item.UserContributed = true
-						item.Update(db)
+						item.Update(db, prodNameVal[0], index)
 
 						// also need to mark the contribution to POD in the server
 						if acc.Email != database.ANONYMOUS_EMAIL {
@@ -33,7 +33,7 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 	}
 
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := CurrentAccount(r, db)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
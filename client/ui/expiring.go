@@ -0,0 +1,152 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Info messages
+	EXPIRY_SET     = "The expiration date has been saved"
+	EXPIRY_CLEARED = "The item no longer expires"
+
+	// how many days ahead the expiring items are listed, by default
+	EXPIRING_DAYS = 7
+
+	EXPIRING_URL = "/expiring/"
+)
+
+var (
+	EXPIRING_TEMPLATE_FILES = []string{"expiring.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	EXPIRING_TEMPLATES      *template.Template
+
+	// the message for each ?ack= of the expiring items page
+	EXPIRING_ACKS = map[string]string{
+		"set":   EXPIRY_SET,
+		"clear": EXPIRY_CLEARED,
+	}
+)
+
+type ExpiringPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Item        *database.Item // the one chosen (?item=) to set the expiration date of, if any
+	Items       []*database.Item
+	Days        int
+	Today       string
+	FormError   string
+	PageMessage string
+}
+
+func renderExpiringTemplate(w http.ResponseWriter, p *ExpiringPage) {
+	if TEMPLATES_INITIALIZED {
+		EXPIRING_TEMPLATES.Execute(w, p)
+	}
+}
+
+// expiryAction sets, or clears, the expiration date of the Account's Item
+// which the form names, returning the ack for it
+func expiryAction(r *http.Request, db *sqlite3.Conn, acc *database.Account) (string, error) {
+	id, idErr := strconv.ParseInt(r.PostFormValue("item"), 10, 64)
+	if idErr != nil {
+		return "", idErr
+	}
+	item, itemErr := database.GetSingleItem(db, acc, id)
+	if itemErr != nil {
+		return "", itemErr
+	}
+	if item.Id == database.BAD_PK {
+		return "", database.ErrNoItem
+	}
+
+	action := r.PostFormValue("action")
+	switch action {
+	case "set":
+		day, dateErr := time.ParseInLocation(FORM_DATE, r.PostFormValue("date"), time.Local)
+		if dateErr != nil {
+			return "", dateErr
+		}
+		expires := database.ExpiresOn(day)
+		return action, item.SetExpires(db, &expires)
+	case "clear":
+		return action, item.SetExpires(db, nil)
+	}
+	return "", ErrBadAction
+}
+
+// ExpiringItems shows the Account's Items which expire within the next
+// days (?days=, or EXPIRING_DAYS), soonest first, along with the form which
+// sets the expiration date of the Item chosen (?item=), if any (in response
+// to a GET request), and sets, or clears, an Item's expiration date (in
+// response to a POST request)
+func ExpiringItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := &ExpiringPage{Title: "Expiring Items",
+		ActiveTab: &ActiveTab{Expiring: true, ShowTabs: true},
+		Days:      EXPIRING_DAYS,
+		Today:     database.Now().Local().Format(FORM_DATE)}
+	if days, daysErr := strconv.Atoi(r.FormValue("days")); daysErr == nil && days > 0 {
+		p.Days = days
+	}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		ack, actionErr := expiryAction(r, db, acc)
+		switch {
+		case actionErr == nil:
+			http.Redirect(w, r, EXPIRING_URL+"?ack="+ack, http.StatusFound)
+			return
+		case userError(actionErr), errors.Is(actionErr, database.ErrNoItem):
+			p.FormError = actionErr.Error()
+		default:
+			http.Error(w, actionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if ackType := r.URL.Query().Get("ack"); ackType != "" {
+		p.PageMessage = EXPIRING_ACKS[ackType]
+	}
+
+	if id, idErr := strconv.ParseInt(r.URL.Query().Get("item"), 10, 64); idErr == nil {
+		item, itemErr := database.GetSingleItem(db, acc, id)
+		if itemErr != nil {
+			http.Error(w, itemErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if item.Id != database.BAD_PK {
+			p.Item = item
+		}
+	}
+
+	items, itemsErr := database.GetExpiringItems(db, acc, time.Duration(p.Days)*24*time.Hour)
+	if itemsErr != nil {
+		http.Error(w, itemsErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Items = items
+
+	renderExpiringTemplate(w, p)
+}
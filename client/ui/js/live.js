@@ -0,0 +1,36 @@
+// follow the item changes (from the scanner, or another page) as they
+// happen, through the server-sent events at /live/
+$(function(){
+    if( ! window.EventSource ) {
+	return; // the page still works, on refresh
+    }
+    var source = new EventSource("/live/"),
+      favorites = (window.location.pathname.indexOf("/favorites/") == 0);
+    source.addEventListener("add", function (e) {
+	// the list is rendered by the server, so reload it, unless
+	// the user is in the middle of selecting items
+	if( ! favorites && ! anyItemChecked() ) {
+	    window.location.reload();
+	}
+    });
+    source.addEventListener("delete", function (e) {
+	var d = JSON.parse(e.data);
+	$("#Item_"+d["item_id"]).remove();
+    });
+    source.addEventListener("duplicate", function (e) {
+	// a scan ignored as a duplicate changes nothing, so only say so
+	var d = JSON.parse(e.data),
+	  message = $('<div class="alert alert-warning alert-dismissible" role="alert">' +
+		    '<button type="button" class="close" data-dismiss="alert"><span aria-hidden="true">&times;</span><span class="sr-only">Close</span></button>' +
+		    '<i class="fa fa-repeat"></i> </div>');
+	message.append(document.createTextNode("Ignored a duplicate scan of " + d["barcode"]));
+	$("#LiveMessage").empty().append(message);
+    });
+    $.each(["favorite", "unfavorite"], function (j, action) {
+	source.addEventListener(action, function (e) {
+	    if( favorites && ! anyItemChecked() ) {
+		window.location.reload();
+	    }
+	});
+    });
+});
@@ -0,0 +1,186 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Info messages
+	PRICE_ADDED   = "The price has been recorded"
+	PRICE_DELETED = "The price has been deleted"
+
+	PRICES_URL = "/prices/"
+)
+
+var (
+	PRICES_TEMPLATE_FILES = []string{"prices.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	PRICES_TEMPLATES      *template.Template
+
+	// the message for each ?ack= of the prices page
+	PRICES_ACKS = map[string]string{
+		"add":    PRICE_ADDED,
+		"delete": PRICE_DELETED,
+	}
+)
+
+type PricesPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Account     *database.Account
+	Barcode     string
+	Desc        string // of the Account's Item with the Barcode, if it has one
+	Summaries   []*database.PriceSummary
+	History     []*database.Purchase
+	Currency    string // the one last paid in, or DEFAULT_CURRENCY
+	Today       string
+	FormError   string
+	PageMessage string
+}
+
+func renderPricesTemplate(w http.ResponseWriter, p *PricesPage) {
+	if TEMPLATES_INITIALIZED {
+		PRICES_TEMPLATES.Execute(w, p)
+	}
+}
+
+// postedPurchase returns the Purchase (without its barcode, or description)
+// in the form: its price, currency, store, and, if given, its date
+func postedPurchase(r *http.Request) (*database.Purchase, error) {
+	price, priceErr := database.ParsePrice(r.PostFormValue("price"))
+	if priceErr != nil {
+		return nil, priceErr
+	}
+	p := &database.Purchase{Price: price,
+		Currency: r.PostFormValue("currency"),
+		Store:    r.PostFormValue("store")}
+	if date := r.PostFormValue("date"); date != "" {
+		purchased, dateErr := time.ParseInLocation(FORM_DATE, date, time.Local)
+		if dateErr != nil {
+			return nil, dateErr
+		}
+		// midday, so that the date is the same in any time zone
+		p.Purchased = purchased.Add(12 * time.Hour)
+	}
+	return p, nil
+}
+
+// priceAction records the posted price, or deletes one of the Account's,
+// returning the ack for it
+func priceAction(r *http.Request, db *sqlite3.Conn, acc *database.Account) (string, error) {
+	action := r.PostFormValue("action")
+	switch action {
+	case "add":
+		p, err := postedPurchase(r)
+		if err != nil {
+			return "", err
+		}
+		if p.Quantity, err = postedQuantity(r); err != nil {
+			return "", err
+		}
+		p.Barcode, p.Desc = r.PostFormValue("barcode"), r.PostFormValue("desc")
+		_, err = database.RecordPurchase(db, acc, p)
+		return action, err
+	case "delete":
+		id, idErr := strconv.ParseInt(r.PostFormValue("purchase"), 10, 64)
+		if idErr != nil {
+			return "", idErr
+		}
+		return action, database.DeletePurchase(db, acc, id)
+	}
+	return "", ErrBadAction
+}
+
+// Prices shows the prices paid for the barcode (?barcode=), with what they
+// add up to, and the form which records another (in response to a GET
+// request), and records or deletes a price (in response to a POST request)
+func Prices(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := &PricesPage{Title: "Prices",
+		ActiveTab: &ActiveTab{Shopping: true, ShowTabs: true},
+		Account:   acc,
+		Barcode:   strings.TrimSpace(r.FormValue("barcode")),
+		Currency:  database.DEFAULT_CURRENCY,
+		Today:     database.Now().Local().Format(FORM_DATE)}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		ack, actionErr := priceAction(r, db, acc)
+		switch {
+		case actionErr == nil:
+			http.Redirect(w, r, PRICES_URL+"?barcode="+url.QueryEscape(p.Barcode)+"&ack="+ack, http.StatusFound)
+			return
+		case userError(actionErr):
+			p.FormError = actionErr.Error()
+		default:
+			http.Error(w, actionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if ackType := r.URL.Query().Get("ack"); ackType != "" {
+		p.PageMessage = PRICES_ACKS[ackType]
+	}
+
+	if p.Barcode != "" {
+		history, historyErr := database.GetPriceHistory(db, p.Barcode)
+		if historyErr != nil {
+			http.Error(w, historyErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.History = history
+		p.Summaries = database.SummarizePrices(history)
+		if len(p.Summaries) > 0 {
+			p.Currency = p.Summaries[0].Currency
+		}
+
+		if items, itemsErr := database.QueryItemsFiltered(db, acc, database.ItemQuery{Search: p.Barcode}); itemsErr == nil {
+			for _, item := range items {
+				if item.Barcode == p.Barcode && item.Desc != "" {
+					p.Desc = item.Desc
+					break
+				}
+			}
+		}
+		if p.Desc == "" && len(history) > 0 {
+			p.Desc = history[0].Desc
+		}
+	}
+
+	renderPricesTemplate(w, p)
+}
+
+// priceError reports whether the error is a mistake in the price posted
+func priceError(err error) bool {
+	var timeErr *time.ParseError
+	return errors.Is(err, database.ErrBadPrice) ||
+		errors.Is(err, database.ErrBadCurrency) ||
+		errors.Is(err, database.ErrBadPurchase) ||
+		errors.Is(err, database.ErrBadBarcode) ||
+		errors.Is(err, database.ErrNoPurchase) ||
+		errors.As(err, &timeErr)
+}
@@ -0,0 +1,300 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/https"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Errors
+	LOGIN_FAILED = "Sorry, that email address and PIN (or API code) do not match"
+	LOGIN_LOCKED = "Too many failed attempts: please wait a few minutes before trying again"
+
+	// urls
+	LOGIN_URL  = "/login/"
+	LOGOUT_URL = "/logout/"
+
+	SESSION_COOKIE = "piscan_session"
+
+	// how many failed logins an email address gets, before it has to wait
+	// for LOGIN_LOCKOUT (so that a PIN cannot be guessed quickly), and how
+	// many a client address gets, whichever email addresses it tries
+	MAX_LOGIN_FAILURES        = 5
+	MAX_CLIENT_LOGIN_FAILURES = 20
+	LOGIN_LOCKOUT             = 5 * time.Minute
+
+	// the most email (or client) addresses whose failed logins are kept
+	MAX_LOGIN_FAILURE_ENTRIES = 1024
+)
+
+var (
+	ErrNotLoggedIn = errors.New("not logged in")
+
+	LOGIN_TEMPLATE_FILES = []string{"login.html", "head.html"}
+	LOGIN_TEMPLATES      *template.Template
+
+	// the failed logins of each email address, and of each client address
+	// (see MAX_LOGIN_FAILURES)
+	loginFailures = struct {
+		sync.Mutex
+		byEmail  map[string]*loginFailure
+		byClient map[string]*loginFailure
+	}{byEmail: make(map[string]*loginFailure),
+		byClient: make(map[string]*loginFailure)}
+)
+
+type loginFailure struct {
+	count int
+	last  time.Time
+}
+
+type accountKey struct{}
+
+type LoginForm struct {
+	Title     string
+	Email     string
+	Next      string
+	FormError string
+}
+
+func renderLoginTemplate(w http.ResponseWriter, f *LoginForm) {
+	if TEMPLATES_INITIALIZED {
+		LOGIN_TEMPLATES.Execute(w, f)
+	}
+}
+
+// CurrentAccount returns the Account logged in to make this request, or,
+// while login is not required (see database.LoginRequired), the designated
+// one, or ErrNotLoggedIn
+func CurrentAccount(r *http.Request, db *sqlite3.Conn) (*database.Account, error) {
+	if acc, found := r.Context().Value(accountKey{}).(*database.Account); found {
+		return acc, nil
+	}
+	if cookie, cookieErr := r.Cookie(SESSION_COOKIE); cookieErr == nil {
+		acc, accErr := database.GetSessionAccount(db, cookie.Value)
+		if accErr == nil {
+			return acc, nil
+		}
+		if !errors.Is(accErr, database.ErrNoSession) {
+			return nil, accErr
+		}
+	}
+
+	required, requiredErr := database.LoginRequired(db)
+	if requiredErr != nil {
+		return nil, requiredErr
+	}
+	if required {
+		return nil, ErrNotLoggedIn
+	}
+	return database.GetDesignatedAccount(db)
+}
+
+// RequireLogin serves each request with the handler, provided it was made
+// by a logged in Account (see CurrentAccount), except for those under the
+// public paths (e.g., the login page itself). Any other page is redirected
+// to the login, and any other request is refused.
+func RequireLogin(dbCoords database.ConnCoordinates, h http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range public {
+			if strings.HasPrefix(r.URL.Path, p) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		db, err := database.InitializeDB(dbCoords)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		acc, accErr := CurrentAccount(r, db)
+		db.Close()
+		switch {
+		case errors.Is(accErr, ErrNotLoggedIn):
+			if "GET" == r.Method && !strings.Contains(r.Header.Get("Accept"), "json") {
+				http.Redirect(w, r, LOGIN_URL+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			} else {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			}
+		case accErr != nil:
+			http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		default:
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accountKey{}, acc)))
+		}
+	})
+}
+
+// startSession logs the Account in, with a cookie which only this WebApp
+// can read (and only over https, if that is how it was reached)
+func startSession(w http.ResponseWriter, r *http.Request, db *sqlite3.Conn, acc *database.Account) error {
+	token, err := database.NewSession(db, acc)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(database.SESSION_TTL.Seconds()),
+		Secure:   https.IsSecure(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// loginLocked reports whether the email address, or the client address,
+// has failed to log in too many times, too recently
+func loginLocked(email, client string) bool {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	return failedTooOften(loginFailures.byEmail, email, MAX_LOGIN_FAILURES) ||
+		failedTooOften(loginFailures.byClient, client, MAX_CLIENT_LOGIN_FAILURES)
+}
+
+func failedTooOften(failures map[string]*loginFailure, key string, limit int) bool {
+	f, found := failures[key]
+	if !found {
+		return false
+	}
+	if time.Since(f.last) > LOGIN_LOCKOUT {
+		delete(failures, key)
+		return false
+	}
+	return f.count >= limit
+}
+
+// recordLogin forgets the failed logins of the email address once it logs
+// in, but not those of the client address, which may have tried others
+func recordLogin(email, client string, ok bool) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	if ok {
+		delete(loginFailures.byEmail, email)
+		return
+	}
+	countFailure(loginFailures.byEmail, email)
+	countFailure(loginFailures.byClient, client)
+}
+
+// countFailure adds a failed login under the key, having dropped the
+// failures which are over, so that the map only grows with those which
+// still count; if it is full anyway, the oldest one is dropped
+func countFailure(failures map[string]*loginFailure, key string) {
+	now := time.Now()
+	var oldest string
+	for k, f := range failures {
+		if now.Sub(f.last) > LOGIN_LOCKOUT {
+			delete(failures, k)
+		} else if oldest == "" || f.last.Before(failures[oldest].last) {
+			oldest = k
+		}
+	}
+
+	f, found := failures[key]
+	if !found {
+		if len(failures) >= MAX_LOGIN_FAILURE_ENTRIES {
+			delete(failures, oldest)
+		}
+		f = new(loginFailure)
+		failures[key] = f
+	}
+	f.count += 1
+	f.last = now
+}
+
+// clientAddr returns the address the request came from (which is the
+// client's own, behind a trusted proxy; see https.Proxied), without its port
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// safeNext returns the page to go to after logging in, which must be one
+// of this WebApp's own
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") || strings.HasPrefix(next, LOGIN_URL) {
+		return HOME_URL
+	}
+	return next
+}
+
+// Login presents the login form (in response to a GET request), and logs
+// the Account in with its email address and PIN, or api code (in response
+// to a POST request), returning to the page which needed it
+func Login(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	r.ParseForm()
+	form := &LoginForm{Title: "Log In", Next: safeNext(r.FormValue("next"))}
+
+	if "POST" == r.Method {
+		email := strings.ToLower(strings.TrimSpace(r.PostFormValue("email")))
+		form.Email = email
+		client := clientAddr(r)
+		if loginLocked(email, client) {
+			form.FormError = LOGIN_LOCKED
+		} else {
+			acc, accErr := database.Authenticate(db, email, strings.TrimSpace(r.PostFormValue("secret")))
+			recordLogin(email, client, accErr == nil)
+			switch {
+			case accErr == nil:
+				if sessionErr := startSession(w, r, db, acc); sessionErr != nil {
+					http.Error(w, sessionErr.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, form.Next, http.StatusFound)
+				return
+			case errors.Is(accErr, database.ErrBadCredentials):
+				log.Println(fmt.Sprintf("Failed login for %s", email))
+				form.FormError = LOGIN_FAILED
+			default:
+				form.FormError = accErr.Error()
+			}
+		}
+	}
+
+	renderLoginTemplate(w, form)
+}
+
+// Logout ends the session of this request, returning to the login form
+func Logout(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if cookie, cookieErr := r.Cookie(SESSION_COOKIE); cookieErr == nil {
+		db, err := database.InitializeDB(dbCoords)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+		if endErr := database.EndSession(db, cookie.Value); endErr != nil {
+			log.Println(endErr)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, LOGIN_URL, http.StatusFound)
+}
@@ -0,0 +1,123 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// resetLoginFailures forgets every failed login, before and after the test
+func resetLoginFailures(t *testing.T) {
+	reset := func() {
+		loginFailures.Lock()
+		defer loginFailures.Unlock()
+		loginFailures.byEmail = make(map[string]*loginFailure)
+		loginFailures.byClient = make(map[string]*loginFailure)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// ageLoginFailures makes every failed login older by the duration
+func ageLoginFailures(d time.Duration) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	for _, failures := range []map[string]*loginFailure{loginFailures.byEmail, loginFailures.byClient} {
+		for _, f := range failures {
+			f.last = f.last.Add(-d)
+		}
+	}
+}
+
+func TestLoginLocked(t *testing.T) {
+	resetLoginFailures(t)
+	const ALICE, BOB, CLIENT, OTHER = "alice@example.org", "bob@example.org", "192.0.2.1", "192.0.2.2"
+
+	for k := 0; k < MAX_LOGIN_FAILURES; k++ {
+		if loginLocked(ALICE, CLIENT) {
+			t.Fatalf("loginLocked() after %d failures", k)
+		}
+		recordLogin(ALICE, CLIENT, false)
+	}
+	if !loginLocked(ALICE, OTHER) {
+		t.Error("loginLocked() from another client = false, want the email locked")
+	}
+	if loginLocked(BOB, CLIENT) {
+		t.Error("loginLocked() of another email = true")
+	}
+	ageLoginFailures(LOGIN_LOCKOUT + time.Second)
+	if loginLocked(ALICE, CLIENT) {
+		t.Error("loginLocked() after LOGIN_LOCKOUT = true")
+	}
+
+	// a login forgets the email's failures, but not the client's
+	for k := 0; k < MAX_LOGIN_FAILURES-1; k++ {
+		recordLogin(BOB, CLIENT, false)
+	}
+	recordLogin(BOB, CLIENT, true)
+	recordLogin(BOB, CLIENT, false)
+	if loginLocked(BOB, OTHER) {
+		t.Error("loginLocked() after a login, and a failure = true")
+	}
+	if f := loginFailures.byClient[CLIENT]; f == nil || f.count != MAX_LOGIN_FAILURES {
+		t.Errorf("the client's failures = %+v, want %d", f, MAX_LOGIN_FAILURES)
+	}
+
+	// a client which tries many emails is locked, whichever it tries next
+	for k := MAX_LOGIN_FAILURES; k < MAX_CLIENT_LOGIN_FAILURES; k++ {
+		recordLogin(fmt.Sprintf("guess%d@example.org", k), CLIENT, false)
+	}
+	if !loginLocked("carol@example.org", CLIENT) {
+		t.Error("loginLocked() of a client which tried many emails = false")
+	}
+	if loginLocked("carol@example.org", OTHER) {
+		t.Error("loginLocked() of the email from another client = true")
+	}
+}
+
+func TestLoginFailuresBounded(t *testing.T) {
+	resetLoginFailures(t)
+
+	// the failures which are over are dropped with each new one
+	for k := 0; k < 10; k++ {
+		recordLogin(fmt.Sprintf("guess%d@example.org", k), fmt.Sprintf("192.0.2.%d", k), false)
+	}
+	ageLoginFailures(LOGIN_LOCKOUT + time.Second)
+	recordLogin("alice@example.org", "192.0.2.100", false)
+	if n, m := len(loginFailures.byEmail), len(loginFailures.byClient); n != 1 || m != 1 {
+		t.Errorf("%d emails, and %d clients, kept after the lockout, want 1", n, m)
+	}
+
+	// and those which are not, up to the limit, the oldest going first
+	ageLoginFailures(time.Second)
+	for k := 0; k < 2*MAX_LOGIN_FAILURE_ENTRIES; k++ {
+		recordLogin(fmt.Sprintf("guess%d@example.org", k), fmt.Sprintf("198.51.100.%d", k%256), false)
+	}
+	if n := len(loginFailures.byEmail); n != MAX_LOGIN_FAILURE_ENTRIES {
+		t.Errorf("%d emails kept, want %d", n, MAX_LOGIN_FAILURE_ENTRIES)
+	}
+	if _, found := loginFailures.byEmail["alice@example.org"]; found {
+		t.Error("the oldest email was kept")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		remote, want string
+	}{
+		{"192.0.2.1:54321", "192.0.2.1"},
+		{"[2001:db8::1]:54321", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", LOGIN_URL, nil)
+		r.RemoteAddr = test.remote
+		if got := clientAddr(r); got != test.want {
+			t.Errorf("clientAddr(%q) = %q, want %q", test.remote, got, test.want)
+		}
+	}
+}
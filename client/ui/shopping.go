@@ -0,0 +1,275 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Info messages
+	SHOPPING_ADDED     = "Added to your shopping list"
+	SHOPPING_GENERATED = "Your favorites, and the items you are out of, are on your shopping list"
+	SHOPPING_NOTHING   = "Your favorites, and the items you are out of, were all on your shopping list already"
+	SHOPPING_COMPLETED = "Your shopping trip is complete: anything not bought is on your new list"
+
+	// how many of the completed lists are shown, most recent first
+	SHOPPING_HISTORY_SHOWN = 10
+
+	SHOPPING_URL = "/shopping/"
+)
+
+var (
+	SHOPPING_TEMPLATE_FILES = []string{"shopping.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	SHOPPING_TEMPLATES      *template.Template
+
+	// the message for each ?ack= of the shopping list page
+	SHOPPING_ACKS = map[string]string{
+		"add":      SHOPPING_ADDED,
+		"generate": SHOPPING_GENERATED,
+		"nothing":  SHOPPING_NOTHING,
+		"complete": SHOPPING_COMPLETED,
+	}
+)
+
+type ShoppingPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Needed      []*database.ShoppingItem
+	InCart      []*database.ShoppingItem
+	Purchased   []*database.ShoppingItem
+	History     []*database.ShoppingList
+	Stores      []string // where the Account has shopped, the most recent first
+	Store       string
+	Currency    string
+	FormError   string
+	PageMessage string
+	ShopList    bool // whether the shopping list can be emailed (see EmailShoppingList)
+}
+
+func renderShoppingTemplate(w http.ResponseWriter, p *ShoppingPage) {
+	if TEMPLATES_INITIALIZED {
+		SHOPPING_TEMPLATES.Execute(w, p)
+	}
+}
+
+// postedQuantity returns the quantity in the form, or one, if it has none
+func postedQuantity(r *http.Request) (int64, error) {
+	q := r.PostFormValue("quantity")
+	if q == "" {
+		return 1, nil
+	}
+	return strconv.ParseInt(q, 10, 64)
+}
+
+// shoppingAction applies the posted action to the Account's open shopping
+// list, or the item on it which it names, returning the ack for it (if any)
+func shoppingAction(r *http.Request, db *sqlite3.Conn, acc *database.Account) (string, error) {
+	action := r.PostFormValue("action")
+	switch action {
+	case "add":
+		quantity, qErr := postedQuantity(r)
+		if qErr != nil {
+			return "", qErr
+		}
+		list, listErr := database.GetShoppingList(db, acc)
+		if listErr != nil {
+			return "", listErr
+		}
+		return action, list.AddText(db, r.PostFormValue("desc"), quantity)
+	case "generate":
+		n, err := database.GenerateShoppingList(db, acc, database.ShoppingSources{Favorites: true, LowQuantity: true})
+		if err == nil && n == 0 {
+			return "nothing", nil
+		}
+		return action, err
+	case "complete":
+		_, err := database.CompleteShoppingList(db, acc, r.PostFormValue("restock") != "")
+		return action, err
+	}
+
+	id, idErr := strconv.ParseInt(r.PostFormValue("item"), 10, 64)
+	if idErr != nil {
+		return "", idErr
+	}
+	item, itemErr := database.GetShoppingItem(db, acc, id)
+	if itemErr != nil {
+		return "", itemErr
+	}
+	switch action {
+	case database.SHOPPING_NEEDED, database.SHOPPING_IN_CART:
+		return "", item.MoveTo(db, acc, action)
+	case database.SHOPPING_PURCHASED:
+		// with the price paid, if it was given
+		if r.PostFormValue("price") == "" {
+			return "", item.Buy(db, acc, nil)
+		}
+		price, priceErr := postedPurchase(r)
+		if priceErr != nil {
+			return "", priceErr
+		}
+		return "", item.Buy(db, acc, price)
+	case "quantity":
+		quantity, qErr := postedQuantity(r)
+		if qErr != nil {
+			return "", qErr
+		}
+		return "", item.SetQuantity(db, acc, quantity)
+	case "remove":
+		return "", item.Remove(db, acc)
+	}
+	return "", ErrBadAction
+}
+
+// userError reports whether the error is a mistake in what was posted (to
+// show on the page), rather than a failure of the db
+func userError(err error) bool {
+	var numErr *strconv.NumError
+	return errors.Is(err, database.ErrBadShopping) ||
+		errors.Is(err, database.ErrBadTransition) ||
+		errors.Is(err, database.ErrNoShoppingItem) ||
+		errors.Is(err, ErrBadAction) ||
+		errors.As(err, &numErr) ||
+		priceError(err)
+}
+
+// ShoppingList shows the Account's open shopping list, by the state of
+// each item on it, along with the most recent lists completed (in response
+// to a GET request), and adds to it, moves an item on it from one state to
+// another, or completes it (in response to a POST request)
+func ShoppingList(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := &ShoppingPage{Title: "Shopping List",
+		ActiveTab: &ActiveTab{Shopping: true, ShowTabs: true},
+		ShopList:  SHOPPING_LIST_MAILER != nil && acc.Email != database.ANONYMOUS_EMAIL}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		ack, actionErr := shoppingAction(r, db, acc)
+		switch {
+		case actionErr == nil:
+			target := SHOPPING_URL
+			if ack != "" {
+				target += "?ack=" + ack
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		case userError(actionErr):
+			p.FormError = actionErr.Error()
+		default:
+			http.Error(w, actionErr.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if ackType := r.URL.Query().Get("ack"); ackType != "" {
+		if listMsg, found := SHOPPING_LIST_ACKS[ackType]; found {
+			p.PageMessage = listMsg
+		} else {
+			p.PageMessage = SHOPPING_ACKS[ackType]
+		}
+	}
+
+	list, listErr := database.GetShoppingList(db, acc)
+	if listErr != nil {
+		http.Error(w, listErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, item := range list.Items {
+		switch item.State {
+		case database.SHOPPING_IN_CART:
+			p.InCart = append(p.InCart, item)
+		case database.SHOPPING_PURCHASED:
+			p.Purchased = append(p.Purchased, item)
+		default:
+			p.Needed = append(p.Needed, item)
+		}
+	}
+
+	history, historyErr := database.GetShoppingHistory(db, acc, SHOPPING_HISTORY_SHOWN)
+	if historyErr != nil {
+		http.Error(w, historyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.History = history
+
+	// the price paid for each item bought is most likely in the same
+	// store, and currency, as the last one
+	stores, storesErr := database.GetStores(db, acc)
+	if storesErr != nil {
+		http.Error(w, storesErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Stores = stores
+	if len(stores) > 0 {
+		p.Store = stores[0]
+	}
+	currency, currencyErr := database.GetLastCurrency(db, acc)
+	if currencyErr != nil {
+		http.Error(w, currencyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Currency = currency
+
+	renderShoppingTemplate(w, p)
+}
+
+// AddToShoppingList accepts a form post of one or more Item.Id values (from
+// the scanned or favorite items), and puts each of them on the Account's
+// open shopping list
+func AddToShoppingList(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if "POST" == r.Method {
+		list, listErr := database.GetShoppingList(db, acc)
+		if listErr != nil {
+			http.Error(w, listErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.ParseForm()
+		for _, idString := range r.PostForm["item"] {
+			id, idErr := strconv.ParseInt(idString, 10, 64)
+			if idErr != nil {
+				continue
+			}
+			if item, itemErr := database.GetSingleItem(db, acc, id); itemErr == nil && item.Id == id && item.Desc != "" {
+				list.AddItem(db, item, 1)
+			}
+		}
+	}
+
+	http.Redirect(w, r, SHOPPING_URL+"?ack=add", http.StatusFound)
+}
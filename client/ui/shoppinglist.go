@@ -0,0 +1,86 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/report"
+	"log"
+	"net/http"
+)
+
+const (
+	// Info messages
+	LIST_SENT   = "Your shopping list has been sent to your email address"
+	LIST_EMPTY  = "Your shopping list is empty: add to it, or favorite the items you want to buy again"
+	LIST_FAILED = "Sorry, your shopping list could not be sent. Please try again later."
+
+	FAVORITES_URL = "/favorites/"
+)
+
+var (
+	// the Mailer which sends the shopping lists, if the WebApp has a
+	// mail server (see InitializeShoppingList)
+	SHOPPING_LIST_MAILER *report.Mailer
+
+	// the message for each ?ack= of the shopping list
+	SHOPPING_LIST_ACKS = map[string]string{
+		"list":        LIST_SENT,
+		"list_empty":  LIST_EMPTY,
+		"list_failed": LIST_FAILED,
+	}
+)
+
+// InitializeShoppingList makes the Favorites page offer to email the
+// shopping list, through the Mailer
+func InitializeShoppingList(m *report.Mailer) {
+	SHOPPING_LIST_MAILER = m
+}
+
+// EmailShoppingList handles the form post which emails the Account its
+// shopping list now (see report.Mailer.Send), returning to the favorites
+// (or the shopping list, if it was sent from there), with an ack message
+func EmailShoppingList(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if "POST" != r.Method || SHOPPING_LIST_MAILER == nil {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return
+	}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ack := "list"
+	if sendErr := SHOPPING_LIST_MAILER.Send(db, acc); sendErr != nil {
+		switch {
+		case errors.Is(sendErr, report.ErrUnregistered):
+			http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
+			return
+		case errors.Is(sendErr, report.ErrEmptyList):
+			ack = "list_empty"
+		default:
+			log.Println(sendErr)
+			ack = "list_failed"
+		}
+	}
+	back := FAVORITES_URL
+	if r.PostFormValue("next") == SHOPPING_URL {
+		back = SHOPPING_URL
+	}
+	http.Redirect(w, r, back+"?ack="+ack, http.StatusFound)
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/Banrai/PiScan/client/database"
 	"github.com/mxk/go-sqlite/sqlite3"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"path"
 	"strconv"
@@ -26,10 +25,15 @@ const (
 
 	// Info messages
 	EMAIL_SENT = "The selected items have been sent to your email address"
+	SYNC_WAIT  = "Waiting for the network to look this up"
+	SYNC_RETRY = "Lookup failed, will retry"
 
 	// urls
 	HOME_URL    = "/scanned/"
 	ACCOUNT_URL = "/account/"
+
+	// the date format of the date inputs in the forms
+	FORM_DATE = "2006-01-02"
 )
 
 var (
@@ -50,6 +54,13 @@ var (
 	ITEM_EDIT_TEMPLATES *template.Template
 
 	TEMPLATES_INITIALIZED = false
+
+	// what to show for each Item whose lookup is still queued, by its
+	// sync status (the synced ones show nothing)
+	SYNC_MESSAGES = map[string]string{
+		database.SYNC_PENDING:  SYNC_WAIT,
+		database.SYNC_RETRYING: SYNC_RETRY,
+	}
 )
 
 // Use this to redirect one request to another target (string)
@@ -66,10 +77,11 @@ func MakeHTMLHandler(fn func(http.ResponseWriter, *http.Request, database.ConnCo
 	}
 }
 
-// Show the static template for unsupported browsers
+// Show the static template for unsupported browsers (from the templates
+// folder, or the compiled in one, if it is empty)
 func UnsupportedBrowserHandler(templatesFolder string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		body, err := ioutil.ReadFile(path.Join(templatesFolder, UNSUPPORTED_TEMPLATE_FILE))
+		body, err := readTemplate(templatesFolder, UNSUPPORTED_TEMPLATE_FILE)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -98,6 +110,8 @@ type AjaxAck struct {
 type ActiveTab struct {
 	Scanned   bool
 	Favorites bool
+	Shopping  bool
+	Expiring  bool
 	Account   bool
 	ShowTabs  bool
 }
@@ -113,9 +127,12 @@ type ItemsPage struct {
 	ActiveTab   *ActiveTab
 	Actions     []*Action
 	Items       []*database.Item
+	Devices     map[int64]string // the name of each Device, by id
+	Syncing     map[int64]string // the sync message of each Item still queued, by id
 	Account     *database.Account
 	Scanned     bool
 	PageMessage string
+	ShopList    bool // whether the shopping list can be emailed (see EmailShoppingList)
 }
 
 type ItemForm struct {
@@ -141,14 +158,23 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 	defer db.Close()
 
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := CurrentAccount(r, db)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// define the appropriate fetch item function
+	// define the appropriate fetch item function: the items scanned by
+	// one of the devices only, if it was chosen (?device=id)
+	device, _ := strconv.ParseInt(r.FormValue("device"), 10, 64)
 	fetch := func(db *sqlite3.Conn, acc *database.Account) ([]*database.Item, error) {
+		if device != 0 {
+			q := database.ItemQuery{Device: device}
+			if favorites {
+				q.Favorite = &favorites
+			}
+			return database.QueryItemsFiltered(db, acc, q)
+		}
 		if favorites {
 			return database.GetFavoriteItems(db, acc)
 		} else {
@@ -167,6 +193,24 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 		items = append(items, item)
 	}
 
+	// the names of the devices which scanned them
+	devices := make(map[int64]string)
+	if deviceList, devicesErr := database.GetDevices(db); devicesErr == nil {
+		for _, d := range deviceList {
+			devices[d.Id] = d.Name
+		}
+	}
+
+	// the items whose lookup is still waiting for the API server
+	syncing := make(map[int64]string)
+	if statuses, syncErr := database.GetSyncStatus(db, acc); syncErr == nil {
+		for id, status := range statuses {
+			if msg, waiting := SYNC_MESSAGES[status]; waiting {
+				syncing[id] = msg
+			}
+		}
+	}
+
 	// actions
 	actions := make([]*Action, 0)
 	// commerce options
@@ -176,6 +220,7 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 	if acc.Email != database.ANONYMOUS_EMAIL {
 		actions = append(actions, &Action{Link: "/email/", Icon: "fa fa-envelope", Action: "Email to me"})
 	}
+	actions = append(actions, &Action{Link: "/shopping/add/", Icon: "fa fa-shopping-cart", Action: "Add to shopping list"})
 	if favorites {
 		actions = append(actions, &Action{Link: "/unfavorite/", Icon: "fa fa-star-o", Action: "Remove from favorites"})
 	} else {
@@ -200,7 +245,10 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 		ActiveTab: &ActiveTab{Scanned: !favorites, Favorites: favorites, Account: false, ShowTabs: true},
 		Actions:   actions,
 		Account:   acc,
-		Items:     items}
+		Items:     items,
+		Devices:   devices,
+		Syncing:   syncing,
+		ShopList:  favorites && SHOPPING_LIST_MAILER != nil && acc.Email != database.ANONYMOUS_EMAIL}
 
 	// check for any message to display on page load
 	r.ParseForm()
@@ -208,6 +256,8 @@ func getItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoor
 		ackType := strings.Join(msg, "")
 		if ackType == "email" {
 			p.PageMessage = EMAIL_SENT
+		} else if listMsg, found := SHOPPING_LIST_ACKS[ackType]; found {
+			p.PageMessage = listMsg
 		}
 	}
 
@@ -223,8 +273,7 @@ func deleteItem(db *sqlite3.Conn, acc *database.Account, id int64) (bool, error)
 	item, itemErr := database.GetSingleItem(db, acc, id)
 	if itemErr == nil {
 		if item.Id == id {
-			item.Delete(db)
-			result = true
+			result = (item.DeleteForAccount(db, acc) == nil)
 		}
 	}
 
@@ -244,7 +293,7 @@ func processItems(w http.ResponseWriter, r *http.Request, dbCoords database.Conn
 	defer db.Close()
 
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := CurrentAccount(r, db)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
@@ -297,11 +346,17 @@ func renderItemEditTemplate(w http.ResponseWriter, f *ItemForm) {
 }
 
 // InitializeTemplates confirms the given folder string leads to the html
-// template files, otherwise templates.Must() will complain
+// template files, otherwise templates.Must() will complain; if it is empty,
+// the templates compiled into the package are used instead
 func InitializeTemplates(folder string) {
-	ITEM_LIST_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_LIST_TEMPLATE_FILES)...))
-	ITEM_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_EDIT_TEMPLATE_FILES)...))
-	ACCOUNT_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ACCOUNT_EDIT_TEMPLATE_FILES)...))
+	ITEM_LIST_TEMPLATES = template.Must(parseTemplates(folder, ITEM_LIST_TEMPLATE_FILES))
+	ITEM_EDIT_TEMPLATES = template.Must(parseTemplates(folder, ITEM_EDIT_TEMPLATE_FILES))
+	ACCOUNT_EDIT_TEMPLATES = template.Must(parseTemplates(folder, ACCOUNT_EDIT_TEMPLATE_FILES))
+	LOGIN_TEMPLATES = template.Must(parseTemplates(folder, LOGIN_TEMPLATE_FILES))
+	ADMIN_TEMPLATES = template.Must(parseTemplates(folder, ADMIN_TEMPLATE_FILES))
+	SHOPPING_TEMPLATES = template.Must(parseTemplates(folder, SHOPPING_TEMPLATE_FILES))
+	PRICES_TEMPLATES = template.Must(parseTemplates(folder, PRICES_TEMPLATE_FILES))
+	EXPIRING_TEMPLATES = template.Must(parseTemplates(folder, EXPIRING_TEMPLATE_FILES))
 	TEMPLATES_INITIALIZED = true
 }
 
@@ -364,7 +419,7 @@ func RemoveSingleItem(r *http.Request, dbCoords database.ConnCoordinates, opts .
 
 	if err == nil {
 		// get the Account for this request
-		acc, accErr := database.GetDesignatedAccount(db)
+		acc, accErr := CurrentAccount(r, db)
 		if accErr != nil {
 			ack.Error = accErr.Error()
 		}
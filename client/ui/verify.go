@@ -0,0 +1,189 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/https"
+	"github.com/Banrai/PiScan/server/emailer"
+	"github.com/mxk/go-sqlite/sqlite3"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// Info messages
+	VERIFY_SENT      = "A verification link has been sent to your email address"
+	VERIFY_DONE      = "Thank you, your email address is verified"
+	VERIFY_FAILED    = "Sorry, the verification link could not be sent. Please try again later."
+	API_CODE_RENEWED = "Your API code has been replaced: the old one no longer works"
+	PIN_CHANGED      = "Your PIN has been set: use it, with your email address, to log in"
+	PIN_WRONG        = "Sorry, your current PIN (or API code) is not correct"
+	PIN_MISMATCH     = "Sorry, the new PIN and its confirmation do not match"
+
+	VERIFY_URL     = "/verify/"
+	VERIFY_SUBJECT = "Verify your PiScan email address"
+
+	VERIFY_TEXT = "Please confirm that this is your email address by opening this link within %d hours:\n\n%s\n"
+	VERIFY_HTML = `<p>Please confirm that this is your email address by opening this link within %d hours:</p><p><a href="%s">%s</a></p>`
+)
+
+var (
+	// the mail server, and From address, of the verification emails, if
+	// the WebApp has one (see InitializeVerification)
+	VERIFY_MAIL_SERVER *emailer.MailServer
+	VERIFY_MAIL_SENDER string
+
+	// the message for each ?ack= of the Account page
+	ACCOUNT_ACKS = map[string]string{
+		"verify":        VERIFY_SENT,
+		"verified":      VERIFY_DONE,
+		"verify_failed": VERIFY_FAILED,
+		"api_code":      API_CODE_RENEWED,
+		"bad_token":     database.ErrBadToken.Error(),
+		"expired":       database.ErrTokenExpired.Error(),
+		"pin":           PIN_CHANGED,
+		"pin_wrong":     PIN_WRONG,
+		"pin_mismatch":  PIN_MISMATCH,
+		"pin_bad":       database.ErrBadPIN.Error(),
+	}
+)
+
+// InitializeVerification makes the Account page email a link which
+// verifies each newly registered (or changed) email address
+func InitializeVerification(server *emailer.MailServer, sender string) {
+	VERIFY_MAIL_SERVER = server
+	VERIFY_MAIL_SENDER = sender
+}
+
+// sendVerification emails the Account a new link to VerifyEmail, on this
+// WebApp's host, returning false if it could not
+func sendVerification(r *http.Request, db *sqlite3.Conn, acc *database.Account) bool {
+	if VERIFY_MAIL_SERVER == nil {
+		return false
+	}
+	token, tokenErr := acc.StartVerification(db)
+	if tokenErr != nil {
+		log.Println(tokenErr)
+		return false
+	}
+
+	link := fmt.Sprintf("%s%s?%s", https.BaseURL(r), VERIFY_URL, url.Values{"token": {token}}.Encode())
+	hours := int(database.VERIFY_TOKEN_TTL.Hours())
+	bodies := []*emailer.EmailBody{
+		{ContentType: emailer.TEXT_MIME, MessageBody: fmt.Sprintf(VERIFY_TEXT, hours, link)},
+		{ContentType: emailer.HTML_MIME, MessageBody: fmt.Sprintf(VERIFY_HTML, hours, link, link)}}
+	sender := &emailer.EmailAddress{DisplayName: "PiScan", Address: VERIFY_MAIL_SENDER}
+	recipient := &emailer.EmailAddress{DisplayName: acc.Name, Address: acc.Email}
+	if sendErr := emailer.SendAlternatives(VERIFY_SUBJECT, bodies, VERIFY_MAIL_SERVER, sender, recipient); sendErr != nil {
+		log.Println(sendErr)
+		return false
+	}
+	return true
+}
+
+// VerifyEmail handles the link sent by sendVerification, marking the email
+// address verified, and returning to the Account page
+func VerifyEmail(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	ack := "verified"
+	if _, verifyErr := database.VerifyAccount(db, r.URL.Query().Get("token")); verifyErr != nil {
+		switch {
+		case errors.Is(verifyErr, database.ErrBadToken):
+			ack = "bad_token"
+		case errors.Is(verifyErr, database.ErrTokenExpired):
+			ack = "expired"
+		default:
+			http.Error(w, verifyErr.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, ACCOUNT_URL+"?ack="+ack, http.StatusFound)
+}
+
+// ResendVerification handles the form post which emails the Account a new
+// verification link, replacing any sent before
+func ResendVerification(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if "POST" != r.Method || VERIFY_MAIL_SERVER == nil {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return
+	}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if acc.IsAnonymous() {
+		http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
+		return
+	}
+
+	ack := "verify"
+	if !sendVerification(r, db, acc) {
+		ack = "verify_failed"
+	}
+	http.Redirect(w, r, ACCOUNT_URL+"?ack="+ack, http.StatusFound)
+}
+
+// RegenerateAPICode handles the form post which replaces the Account's api
+// code with a new random one, registering it with the API Server
+func RegenerateAPICode(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
+	if "POST" != r.Method {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return
+	}
+
+	// attempt to connect to the db
+	db, err := database.InitializeDB(dbCoords)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// get the Account for this request
+	acc, accErr := CurrentAccount(r, db)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// get the api server + port from the optional parameters
+	apiHost, apiHostOk := opts[0].(string)
+	if !apiHostOk {
+		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+		return
+	}
+
+	if _, codeErr := acc.RegenerateAPICode(db); codeErr != nil {
+		http.Error(w, codeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !acc.IsAnonymous() {
+		go registerWithServer(apiHost, acc.Email, acc.APICode) // do not wait for the server to reply
+	}
+	http.Redirect(w, r, ACCOUNT_URL+"?ack=api_code", http.StatusFound)
+}
@@ -6,13 +6,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/Banrai/PiScan/client/api"
+	"github.com/Banrai/PiScan/client/backup"
 	"github.com/Banrai/PiScan/client/database"
+	"github.com/Banrai/PiScan/client/https"
+	"github.com/Banrai/PiScan/client/live"
+	"github.com/Banrai/PiScan/client/report"
 	"github.com/Banrai/PiScan/client/ui"
+	"github.com/Banrai/PiScan/server/emailer"
 	"log"
 	"net/http"
-	"path"
+	"time"
 )
 
 const (
@@ -31,29 +38,114 @@ const (
 func main() {
 	var (
 		host, apiHost, templatesFolder, dbPath, dbFile string
-		port, apiPort                                  int
+		smtpHost, smtpUser, smtpPassword, smtpSender   string
+		listTemplates, listSchedule, expirySchedule    string
+		tlsCert, tlsKey, trustedProxies                string
+		backupFolder, backupSchedule, backupUpload     string
+		selfSigned                                     bool
+		port, apiPort, smtpPort, backupKeep            int
+		expiryDays                                     int
 	)
 	flag.StringVar(&host, "host", SERVER_HOST, fmt.Sprintf("Host name or IP address for this server (defaults to '%s')", SERVER_HOST))
 	flag.IntVar(&port, "port", SERVER_PORT, fmt.Sprintf("Port addess for this server (defaults to '%d')", SERVER_PORT))
 	flag.StringVar(&apiHost, "apiHost", API_HOST, "Host name or IP address for the API server (REQUIRED)")
 	flag.IntVar(&apiPort, "apiPort", API_PORT, fmt.Sprintf("Port addess for the API server (defaults to '%d')", API_PORT))
-	flag.StringVar(&templatesFolder, "templates", "", "Path to the html templates (REQUIRED)")
+	flag.StringVar(&templatesFolder, "templates", "", "Path to the html templates, beside the css, js, fonts, and images folders (optional, the ones compiled in are used otherwise)")
 	flag.StringVar(&dbPath, "dbPath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
 	flag.StringVar(&dbFile, "dbFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
+	flag.StringVar(&smtpSender, "smtpSender", "", "The From address of the shopping list and verification emails (they are only sent if it is set)")
+	flag.StringVar(&smtpHost, "smtpHost", emailer.MAIL_SERVER, fmt.Sprintf("The mail server which sends the shopping lists (defaults to '%s')", emailer.MAIL_SERVER))
+	flag.IntVar(&smtpPort, "smtpPort", emailer.MAIL_PORT, fmt.Sprintf("The mail server port (defaults to '%d')", emailer.MAIL_PORT))
+	flag.StringVar(&smtpUser, "smtpUser", "", "The mail server user name (optional)")
+	flag.StringVar(&smtpPassword, "smtpPassword", "", "The mail server password (optional)")
+	flag.StringVar(&listTemplates, "listTemplates", "", fmt.Sprintf("Path to the %s and %s (or %s and %s) templates which replace the default shopping list (or expiry warning) emails (optional)", report.TEXT_TEMPLATE_FILE, report.HTML_TEMPLATE_FILE, report.EXPIRY_TEXT_TEMPLATE_FILE, report.EXPIRY_HTML_TEMPLATE_FILE))
+	flag.StringVar(&listSchedule, "listSchedule", "", "When to email each account its shopping list, as a crontab schedule, e.g., '0 9 * * sat' for every Saturday at 9am (optional)")
+	flag.StringVar(&expirySchedule, "expirySchedule", "", "When to email each account the items which are about to expire, as a crontab schedule, e.g., '0 8 * * *' for every day at 8am (optional)")
+	flag.IntVar(&expiryDays, "expiryDays", report.DEFAULT_EXPIRY_DAYS, fmt.Sprintf("How many days before an item expires it is emailed about (defaults to '%d')", report.DEFAULT_EXPIRY_DAYS))
+	flag.StringVar(&tlsCert, "tlsCert", "", "The certificate file (PEM) with which to serve https (optional)")
+	flag.StringVar(&tlsKey, "tlsKey", "", "The private key file (PEM) of the certificate (optional)")
+	flag.BoolVar(&selfSigned, "selfSigned", false, fmt.Sprintf("Serve https with a self signed certificate, generated on first boot (in the dbPath folder, as %s and %s, unless tlsCert and tlsKey say otherwise)", https.CERT_FILE, https.KEY_FILE))
+	flag.StringVar(&trustedProxies, "trustedProxies", https.DEFAULT_TRUSTED_PROXIES, fmt.Sprintf("The comma-separated addresses (or CIDRs) of the reverse proxies whose X-Forwarded-* headers are trusted (defaults to '%s')", https.DEFAULT_TRUSTED_PROXIES))
+	flag.StringVar(&backupFolder, "backupFolder", "", "The folder into which the sqlite database is backed up (backups are only taken if it is set)")
+	flag.StringVar(&backupSchedule, "backupSchedule", backup.DEFAULT_SCHEDULE, fmt.Sprintf("When to back up the sqlite database, as a crontab schedule (defaults to '%s')", backup.DEFAULT_SCHEDULE))
+	flag.IntVar(&backupKeep, "backupKeep", backup.DEFAULT_KEEP, fmt.Sprintf("How many backups to keep (defaults to '%d')", backup.DEFAULT_KEEP))
+	flag.StringVar(&backupUpload, "backupUpload", "", "Where to upload each backup, as an scp://user@host/folder, s3://bucket/prefix, or webdavs://host/folder url (optional)")
 	flag.Parse()
 
 	// make sure the required parameters are passed when run
-	if templatesFolder == "" || apiHost == "" {
+	if apiHost == "" {
 		fmt.Println("WebApp usage:")
 		flag.PrintDefaults()
 	} else {
 		/* set the server ready for use */
-		// confirm the html templates
+		// confirm the html templates (or use the compiled in ones)
 		ui.InitializeTemplates(templatesFolder)
 
 		// coordinates for connecting to the sqlite database (from the command line options)
 		dbCoordinates := database.ConnCoordinates{DBPath: dbPath, DBFile: dbFile}
 
+		// the shopping list and verification emails, on demand, and on the schedule (along with the expiry warnings), if any
+		if len(smtpSender) > 0 {
+			mailServer := &emailer.MailServer{Host: smtpHost, Port: smtpPort, Username: smtpUser, Password: smtpPassword}
+			ui.InitializeVerification(mailServer, smtpSender)
+
+			templates, templatesErr := report.LoadTemplates(listTemplates)
+			if templatesErr != nil {
+				log.Fatal(templatesErr)
+			}
+			expiryTemplates, expiryErr := report.LoadExpiryTemplates(listTemplates)
+			if expiryErr != nil {
+				log.Fatal(expiryErr)
+			}
+			mailer := &report.Mailer{Server: mailServer,
+				Sender:    smtpSender,
+				Templates: templates,
+				Expiry:    expiryTemplates}
+			ui.InitializeShoppingList(mailer)
+
+			if len(listSchedule) > 0 {
+				schedule, scheduleErr := report.ParseSchedule(listSchedule)
+				if scheduleErr != nil {
+					log.Fatal(scheduleErr)
+				}
+				go mailer.Run(context.Background(), schedule, dbCoordinates)
+			}
+			if len(expirySchedule) > 0 {
+				schedule, scheduleErr := report.ParseSchedule(expirySchedule)
+				if scheduleErr != nil {
+					log.Fatal(scheduleErr)
+				}
+				go mailer.RunExpiryWarnings(context.Background(), schedule, dbCoordinates, time.Duration(expiryDays)*24*time.Hour)
+			}
+		}
+
+		// the backups of the db, on demand, and on the schedule
+		if len(backupFolder) > 0 {
+			backups := &backup.Backups{Coords: dbCoordinates, Folder: backupFolder, Keep: backupKeep}
+			if len(backupUpload) > 0 {
+				uploader, uploadErr := backup.ParseUploader(backupUpload)
+				if uploadErr != nil {
+					log.Fatal(uploadErr)
+				}
+				backups.Uploader = uploader
+			}
+			ui.InitializeBackups(backups)
+
+			schedule, scheduleErr := report.ParseSchedule(backupSchedule)
+			if scheduleErr != nil {
+				log.Fatal(scheduleErr)
+			}
+			go backups.Run(context.Background(), schedule)
+		}
+
+		// clear out the sessions which expired while the WebApp was not running
+		if db, dbErr := database.InitializeDB(dbCoordinates); dbErr == nil {
+			if _, purgeErr := database.PurgeSessions(db); purgeErr != nil {
+				log.Println(purgeErr)
+			}
+			db.Close()
+		}
+
 		// prepare the apiHost:apiPort for handler functions that need them
 		extraCoordinates := make([]interface{}, 1)
 		extraCoordinates[0] = fmt.Sprintf("%s:%d", apiHost, apiPort)
@@ -70,20 +162,64 @@ func main() {
 		http.HandleFunc("/unfavorite/", ui.MakeHTMLHandler(ui.UnfavoriteItems, dbCoordinates))
 		http.HandleFunc("/input/", ui.MakeHTMLHandler(ui.InputUnknownItem, dbCoordinates, extraCoordinates...))
 		http.HandleFunc("/account/", ui.MakeHTMLHandler(ui.EditAccount, dbCoordinates, extraCoordinates...))
+		http.HandleFunc("/account/verify/", ui.MakeHTMLHandler(ui.ResendVerification, dbCoordinates))
+		http.HandleFunc("/account/apicode/", ui.MakeHTMLHandler(ui.RegenerateAPICode, dbCoordinates, extraCoordinates...))
+		http.HandleFunc("/account/pin/", ui.MakeHTMLHandler(ui.SetAccountPIN, dbCoordinates))
+		http.HandleFunc(ui.ADMIN_URL, ui.MakeHTMLHandler(ui.AdminAccounts, dbCoordinates))
+		http.HandleFunc(ui.BACKUP_URL, ui.MakeHTMLHandler(ui.TakeBackup, dbCoordinates))
+		http.HandleFunc(ui.RESTORE_URL, ui.MakeHTMLHandler(ui.RestoreBackup, dbCoordinates))
+		http.HandleFunc(ui.LOGIN_URL, ui.MakeHTMLHandler(ui.Login, dbCoordinates))
+		http.HandleFunc(ui.LOGOUT_URL, ui.MakeHTMLHandler(ui.Logout, dbCoordinates))
+		http.HandleFunc(ui.VERIFY_URL, ui.MakeHTMLHandler(ui.VerifyEmail, dbCoordinates))
 		http.HandleFunc("/email/", ui.MakeHTMLHandler(ui.EmailItems, dbCoordinates, extraCoordinates...))
+		http.HandleFunc("/shoppinglist/", ui.MakeHTMLHandler(ui.EmailShoppingList, dbCoordinates))
+		http.HandleFunc(ui.SHOPPING_URL, ui.MakeHTMLHandler(ui.ShoppingList, dbCoordinates))
+		http.HandleFunc("/shopping/add/", ui.MakeHTMLHandler(ui.AddToShoppingList, dbCoordinates))
+		http.HandleFunc(ui.PRICES_URL, ui.MakeHTMLHandler(ui.Prices, dbCoordinates))
+		http.HandleFunc(ui.EXPIRING_URL, ui.MakeHTMLHandler(ui.ExpiringItems, dbCoordinates))
 
 		// ajax
 		http.HandleFunc("/remove/", ui.MakeHandler(ui.RemoveSingleItem, dbCoordinates, MIME_JSON))
 		http.HandleFunc("/status/", ui.MakeHandler(ui.ConfirmServerAccount, dbCoordinates, MIME_JSON, extraCoordinates...))
 
+		// rest api, authenticated by each account's api code
+		http.HandleFunc(api.API_PREFIX, api.Handler(dbCoordinates))
+
+		// live feed of item changes (server-sent events), from any process
+		liveHub := live.NewHub()
+		database.OnItemChange(func(accountId int64, kind string) { liveHub.Wake() })
+		go func() {
+			if err := liveHub.Tail(context.Background(), dbCoordinates); err != nil {
+				log.Println(err)
+			}
+		}()
+		http.HandleFunc("/live/", live.Handler(liveHub, dbCoordinates))
+
 		// static resources
-		http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(path.Join(templatesFolder, "../css/")))))
-		http.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir(path.Join(templatesFolder, "../js/")))))
-		http.Handle("/fonts/", http.StripPrefix("/fonts/", http.FileServer(http.Dir(path.Join(templatesFolder, "../fonts/")))))
-		http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(path.Join(templatesFolder, "../images/")))))
+		http.Handle("/css/", http.StripPrefix("/css/", ui.StaticHandler(templatesFolder, "css")))
+		http.Handle("/js/", http.StripPrefix("/js/", ui.StaticHandler(templatesFolder, "js")))
+		http.Handle("/fonts/", http.StripPrefix("/fonts/", ui.StaticHandler(templatesFolder, "fonts")))
+		http.Handle("/images/", http.StripPrefix("/images/", ui.StaticHandler(templatesFolder, "images")))
+
+		// every page needs a logged in account (once any is registered),
+		// except the login itself, the static resources, and the rest api
+		// (which has its own authentication)
+		handler := ui.RequireLogin(dbCoordinates, http.DefaultServeMux, ui.LOGIN_URL, ui.VERIFY_URL, "/browser", "/css/", "/js/", "/fonts/", "/images/", api.API_PREFIX)
+
+		// behind a reverse proxy, see the requests as the clients made them
+		proxies, proxiesErr := https.ParseProxies(trustedProxies)
+		if proxiesErr != nil {
+			log.Fatal(proxiesErr)
+		}
+		handler = https.Proxied(handler, proxies)
 
 		/* start the server */
-		log.Println(fmt.Sprintf("Starting the WebApp %s", fmt.Sprintf("%s:%d", host, port)))
-		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil))
+		tlsConfig := &https.Config{CertFile: tlsCert, KeyFile: tlsKey, SelfSigned: selfSigned}
+		scheme := "http"
+		if tlsConfig.Enabled() {
+			scheme = "https"
+		}
+		log.Println(fmt.Sprintf("Starting the WebApp %s://%s", scheme, fmt.Sprintf("%s:%d", host, port)))
+		log.Fatal(tlsConfig.ListenAndServe(fmt.Sprintf("%s:%d", host, port), dbPath, handler))
 	}
 }
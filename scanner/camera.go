@@ -0,0 +1,51 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"context"
+	"os/exec"
+)
+
+const (
+	VIDEO_DEVICE = "/dev/video0"
+	ZBARCAM      = "zbarcam" // from the zbar-tools package
+)
+
+// CameraScanner reads barcodes from a camera (e.g., the Pi camera module,
+// or a usb webcam), with ZBar's zbarcam, which prints each barcode it
+// decodes on a line of its own
+type CameraScanner struct {
+	Device  string // defaults to VIDEO_DEVICE
+	Command string // defaults to ZBARCAM, found in the PATH
+}
+
+func (c *CameraScanner) Name() string {
+	return "camera:" + orDefault(c.Device, VIDEO_DEVICE)
+}
+
+func (c *CameraScanner) Scan(ctx context.Context, scans chan<- string) error {
+	// --raw omits the symbology prefix (e.g., "EAN-13:") from each barcode
+	cmd := exec.CommandContext(ctx, orDefault(c.Command, ZBARCAM), "--raw", "--nodisplay", orDefault(c.Device, VIDEO_DEVICE))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// zbarcam exits at once if the camera is missing, or busy, which
+	// reports it as disconnected again
+	connected(ctx)
+	scanErr := scanLines(ctx, out, scans)
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	if waitErr != nil {
+		// e.g., the camera is missing, or busy
+		return waitErr
+	}
+	return scanErr
+}
@@ -0,0 +1,87 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HIDScanner reads a usb scanner which acts as a keyboard (a "keyboard
+// wedge") from its '/dev/input/event' device. The Device can also be a glob
+// pattern, e.g., "/dev/input/by-id/*-event-kbd", since the event number a
+// scanner gets can change each time it is plugged in: its first match is
+// read, as found each time the Scanner is (re)started.
+type HIDScanner struct {
+	Device string // defaults to SCANNER_DEVICE
+}
+
+func (h *HIDScanner) Name() string {
+	return "hid:" + h.device()
+}
+
+func (h *HIDScanner) device() string {
+	if h.Device == "" {
+		return SCANNER_DEVICE
+	}
+	return h.Device
+}
+
+// resolve returns the device path, or the first match of the pattern
+func (h *HIDScanner) resolve() (string, error) {
+	device := h.device()
+	matches, err := filepath.Glob(device)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("%s: %w", device, os.ErrNotExist)
+	}
+	return matches[0], nil
+}
+
+func (h *HIDScanner) Scan(ctx context.Context, scans chan<- string) error {
+	device, err := h.resolve()
+	if err != nil {
+		return err
+	}
+	dev, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	defer closeOnDone(ctx, dev)()
+	connected(ctx)
+
+	var scanBuffer bytes.Buffer
+	for {
+		scanEvents, scanErr := read(dev)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if scanErr != nil {
+			// e.g., the scanner was unplugged
+			return scanErr
+		}
+		// a single read can end one scan, and start the next
+		for len(scanEvents) > 0 {
+			scannedData, endOfScan, used := decodeEvents(scanEvents)
+			scanEvents = scanEvents[used:]
+			scanBuffer.WriteString(scannedData)
+			if endOfScan {
+				if scanBuffer.Len() > 0 {
+					select {
+					case scans <- scanBuffer.String():
+					case <-ctx.Done():
+						return nil
+					}
+				}
+				scanBuffer.Reset() // clear the buffer and start again
+			}
+		}
+	}
+}
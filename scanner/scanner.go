@@ -1,10 +1,15 @@
 // Copyright Banrai LLC. All rights reserved. Use of this source code is
 // governed by the license that can be found in the LICENSE file.
 
-// Package scanner provides functions for reading barcode scans from
-// usb-connected barcode scanner devices as if they were keyboards, i.e.,
-// by using the corresponding '/dev/input/event' device, inspired by this
-// post on linuxquestions.org:
+// Package scanner provides functions for reading barcode scans from the
+// barcode scanners connected to the Pi, through any of the backends which
+// implement Scanner: usb-connected devices read as if they were keyboards
+// (HIDScanner), serial (SerialScanner) or Bluetooth (BluetoothScanner)
+// devices, or a camera (CameraScanner), all feeding the same scans (see
+// Run).
+//
+// Reading a usb scanner through its '/dev/input/event' device was
+// inspired by this post on linuxquestions.org:
 //
 // http://www.linuxquestions.org/questions/programming-9/read-from-a-usb-barcode-scanner-that-simulates-a-keyboard-495358/#post2767643
 //
@@ -16,10 +21,16 @@
 package scanner
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -27,8 +38,175 @@ const (
 	EVENT_BUFFER   = 64
 	EVENT_CAPTURES = 16
 	SCANNER_DEVICE = "/dev/input/event0" // default location on the Pi
+
+	// how long a Scanner which failed (e.g., one unplugged) waits before
+	// it is started again
+	RETRY_INTERVAL = 2 * time.Second
+
+	// the longest line a serial scanner or camera is expected to send
+	MAX_LINE = 4096
+)
+
+var (
+	ErrNoScanners = errors.New("no scanner backends to run")
 )
 
+// Scanner is one source of barcode scans: Scan sends each barcode read to
+// the channel, until the context is done (returning nil), or the device
+// fails (returning the error, e.g., if it was unplugged, after which Run
+// starts it again)
+type Scanner interface {
+	Name() string
+	Scan(ctx context.Context, scans chan<- string) error
+}
+
+// StatusFn is told, from the Scanner's goroutine, whenever the named
+// Scanner (e.g., "hid:/dev/input/event0") connects to its device, or loses
+// it (see RunWithStatus)
+type StatusFn func(scanner string, connected bool)
+
+// connectedKey is the context key of the function which a Scanner calls
+// once its device is open (see connected)
+type connectedKey struct{}
+
+// Run runs each of the Scanners, on their own goroutines, invoking the
+// given function on each barcode scanned by any of them, one at a time, or
+// the errFn (from the Scanner's goroutine) whenever one fails, until the
+// context is done. A Scanner which fails is started again after
+// RETRY_INTERVAL, so a device can be unplugged and plugged back in (or
+// plugged in only after Run has started), without restarting the client.
+// The errFn is only invoked once for the same error, in a row.
+func Run(ctx context.Context, scanners []Scanner, fn func(string), errFn func(error)) error {
+	return RunWithStatus(ctx, scanners, fn, errFn, nil)
+}
+
+// RunWithStatus is Run, also telling the statusFn (unless nil) that each
+// Scanner is disconnected, when it starts, and whenever it fails, or that
+// it is connected, as soon as it has opened its device
+func RunWithStatus(ctx context.Context, scanners []Scanner, fn func(string), errFn func(error), statusFn StatusFn) error {
+	if len(scanners) == 0 {
+		return ErrNoScanners
+	}
+	scans := make(chan string)
+	for _, s := range scanners {
+		go retry(ctx, s, scans, errFn, statusFn)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case scan := <-scans:
+			fn(scan)
+		}
+	}
+}
+
+// retry runs the Scanner until the context is done, starting it again after
+// each failure
+func retry(ctx context.Context, s Scanner, scans chan<- string, errFn func(error), statusFn StatusFn) {
+	if statusFn != nil {
+		name := s.Name()
+		statusFn(name, false)
+		ctx = context.WithValue(ctx, connectedKey{}, func() { statusFn(name, true) })
+	}
+	var lastErr string
+	for {
+		err := s.Scan(ctx, scans)
+		if ctx.Err() != nil {
+			return
+		}
+		if statusFn != nil {
+			statusFn(s.Name(), false)
+		}
+		if err != nil && err.Error() != lastErr {
+			lastErr = err.Error()
+			errFn(&ScannerError{Scanner: s.Name(), Err: err})
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(RETRY_INTERVAL):
+		}
+	}
+}
+
+// ScannerError is the error passed to Run's errFn, naming the Scanner
+// (e.g., "hid:/dev/input/event0") which failed
+type ScannerError struct {
+	Scanner string
+	Err     error
+}
+
+func (e *ScannerError) Error() string {
+	return e.Scanner + ": " + e.Err.Error()
+}
+
+func (e *ScannerError) Unwrap() error {
+	return e.Err
+}
+
+// connected tells the StatusFn (if any) running the Scanner with the
+// context that its device is open (see RunWithStatus)
+func connected(ctx context.Context) {
+	if fn, ok := ctx.Value(connectedKey{}).(func()); ok {
+		fn()
+	}
+}
+
+// closeOnDone closes the device once the context is done, so that a read
+// blocked on it returns, and returns the function which stops it from
+// doing so, once the device is closed anyway
+func closeOnDone(ctx context.Context, dev io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			dev.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// scanLines sends each line read (ended by a carriage return, a newline,
+// or both) to the channel, trimmed, as one barcode, until the reader fails
+// or the context is done
+func scanLines(ctx context.Context, r io.Reader, scans chan<- string) error {
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, MAX_LINE), MAX_LINE)
+	lines.Split(splitLines)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
+		}
+		select {
+		case scans <- line:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// splitLines is bufio.ScanLines, only ending each line at either a
+// carriage return or a newline, since scanners can be set to send either
+func splitLines(data []byte, atEOF bool) (int, []byte, error) {
+	if j := bytes.IndexAny(data, "\r\n"); j >= 0 {
+		return j + 1, data[:j], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
 // InputEvent is a Go implementation of the native linux device
 // input_event struct, as described in the kernel documentation
 // (https://www.kernel.org/doc/Documentation/input/input.txt),
@@ -123,14 +301,15 @@ func read(dev *os.File) ([]InputEvent, error) {
 
 // DecodeEvents iterates through the list of InputEvents and decodes
 // the barcode data into a string, along with a boolean to indicate if this
-// particular input sequence is done
-func decodeEvents(events []InputEvent) (string, bool) {
+// particular input sequence is done, and how many of the events it used (the
+// rest, if any, are the start of the next sequence)
+func decodeEvents(events []InputEvent) (string, bool, int) {
 	var buffer bytes.Buffer
 	for i := range events {
 		if events[i].Type == 1 && events[i].Value == 1 {
 			if events[i].Code == 28 {
 				// carriage return detected: the barcode sequence ends here
-				return buffer.String(), true
+				return buffer.String(), true, i + 1
 			} else {
 				if events[i].Code != 0 {
 					// this is barcode data we want to capture
@@ -141,34 +320,13 @@ func decodeEvents(events []InputEvent) (string, bool) {
 	}
 	// return what has been collected so far,
 	// even though the barcode is not yet complete
-	return buffer.String(), false
+	return buffer.String(), false, len(events)
 }
 
 // ScanForever takes a linux input device string pointing to the scanner
 // to read from, invokes the given function on the resulting barcode string
 // when complete, or the errfn on error, then goes back to read/scan again
+// (see Run, to read from several scanners, or from other kinds of them)
 func ScanForever(device string, fn func(string), errFn func(error)) {
-	scanner, err := os.Open(device)
-	if err != nil {
-		// invoke the function which handles scanner errors
-		errFn(err)
-	}
-	defer scanner.Close()
-
-	var scanBuffer bytes.Buffer
-	for {
-		scanEvents, scanErr := read(scanner)
-		if scanErr != nil {
-			// invoke the function which handles scanner errors
-			errFn(scanErr)
-		}
-		scannedData, endOfScan := decodeEvents(scanEvents)
-		if endOfScan {
-			// invoke the function which handles the scan result
-			fn(scanBuffer.String())
-			scanBuffer.Reset() // clear the buffer and start again
-		} else {
-			scanBuffer.WriteString(scannedData)
-		}
-	}
+	Run(context.Background(), []Scanner{&HIDScanner{Device: device}}, fn, errFn)
 }
@@ -0,0 +1,218 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// collect runs the scan function with a channel, returning what it sent,
+// and the error it returned
+func collect(t *testing.T, scan func(ctx context.Context, scans chan<- string) error) ([]string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	scans := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- scan(ctx, scans)
+		close(scans)
+	}()
+	results := make([]string, 0)
+	for scan := range scans {
+		results = append(results, scan)
+	}
+	return results, <-done
+}
+
+func sameScans(got, want []string) bool {
+	return strings.Join(got, ",") == strings.Join(want, ",")
+}
+
+func TestScanLines(t *testing.T) {
+	// each line is ended by a carriage return, a newline, or both
+	input := "036000291452\r4006381333931\n\r\n  96385074 \r\n\n9780306406157"
+	want := []string{"036000291452", "4006381333931", "96385074", "9780306406157"}
+	got, err := collect(t, func(ctx context.Context, scans chan<- string) error {
+		return scanLines(ctx, strings.NewReader(input), scans)
+	})
+	if !sameScans(got, want) || err != io.EOF {
+		t.Errorf("scanLines() = %q, %v, want %q, io.EOF", got, err, want)
+	}
+
+	// a line longer than any barcode fails
+	got, err = collect(t, func(ctx context.Context, scans chan<- string) error {
+		return scanLines(ctx, strings.NewReader(strings.Repeat("7", MAX_LINE+1)), scans)
+	})
+	if len(got) != 0 || err == nil || err == io.EOF {
+		t.Errorf("scanLines() of a long line = %q, %v, want an error", got, err)
+	}
+}
+
+// events encodes the keys pressed (and released) as InputEvents, then the
+// enter key, which ends the scan
+func events(codes ...uint16) []InputEvent {
+	results := make([]InputEvent, 0)
+	for j, code := range append(codes, 28) {
+		tv := syscall.NsecToTimeval(int64(j+1) * int64(time.Second))
+		results = append(results,
+			InputEvent{Time: tv, Type: 4, Code: 4, Value: int32(code)}, // the scan code, which is skipped
+			InputEvent{Time: tv, Type: 1, Code: code, Value: 1},
+			InputEvent{Time: tv, Type: 1, Code: code, Value: 0})
+	}
+	return results
+}
+
+func TestDecodeEvents(t *testing.T) {
+	// 0, 3, 6, then q
+	scan, done, used := decodeEvents(events(0x0b, 0x04, 0x07, 0x10))
+	if scan != "036q" || !done || used != 14 {
+		t.Errorf("decodeEvents() = %q, %v, %d, want 036q, done, after 14", scan, done, used)
+	}
+	// the events after the enter key are the next scan's
+	next := append(events(0x0b), events(0x04)...)
+	if scan, done, used := decodeEvents(next); scan != "0" || !done || used != 5 {
+		t.Errorf("decodeEvents() of two scans = %q, %v, %d, want 0, done, after 5", scan, done, used)
+	}
+	// without the enter key, it goes on
+	partial := events(0x0b, 0x04)
+	scan, done, used = decodeEvents(partial[:len(partial)-3])
+	if scan != "03" || done || used != 6 {
+		t.Errorf("decodeEvents() of a partial scan = %q, %v, %d, want 03, not done, after all 6", scan, done, used)
+	}
+	// an unknown key is a dash
+	if scan, _, _ := decodeEvents(events(0x0b, 0x39)); scan != "0-" {
+		t.Errorf("decodeEvents() of an unknown key = %q, want 0-", scan)
+	}
+}
+
+func TestHIDScanner(t *testing.T) {
+	// a device file, as read by the scanner, of two scans, the first read
+	// of which ends the first, and starts the second
+	var buf bytes.Buffer
+	for _, e := range [][]InputEvent{events(0x0b, 0x04, 0x07), events(0x0a, 0x03)} {
+		if err := binary.Write(&buf, binary.LittleEndian, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, "usb-scanner-event-kbd"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// found by its pattern, and read until it ends, as if unplugged
+	h := &HIDScanner{Device: filepath.Join(folder, "*-event-kbd")}
+	got, err := collect(t, h.Scan)
+	if want := []string{"036", "92"}; !sameScans(got, want) || err != io.EOF {
+		t.Errorf("HIDScanner.Scan() = %q, %v, want %q, io.EOF", got, err, want)
+	}
+
+	h = &HIDScanner{Device: filepath.Join(folder, "missing*")}
+	if _, err := collect(t, h.Scan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("HIDScanner.Scan() of a missing device = %v, want os.ErrNotExist", err)
+	}
+	if name := (&HIDScanner{}).Name(); name != "hid:"+SCANNER_DEVICE {
+		t.Errorf("Name() = %q", name)
+	}
+}
+
+func TestCameraScanner(t *testing.T) {
+	// a stand-in for zbarcam, which prints each barcode on a line
+	folder := t.TempDir()
+	zbarcam := filepath.Join(folder, "zbarcam")
+	script := "#!/bin/sh\nprintf '036000291452\\n96385074\\n'\n"
+	if err := os.WriteFile(zbarcam, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &CameraScanner{Command: zbarcam}
+	got, err := collect(t, c.Scan)
+	if want := []string{"036000291452", "96385074"}; !sameScans(got, want) || err != io.EOF {
+		t.Errorf("CameraScanner.Scan() = %q, %v, want %q, io.EOF", got, err, want)
+	}
+
+	// one which fails, as zbarcam does without a camera
+	if err := os.WriteFile(zbarcam, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collect(t, c.Scan); err == nil || err == io.EOF {
+		t.Errorf("CameraScanner.Scan() of a failing zbarcam = %v, want its exit status", err)
+	}
+}
+
+// fakeScanner fails the first time it is started, then sends its scan
+type fakeScanner struct {
+	mutex  sync.Mutex
+	starts int
+}
+
+func (f *fakeScanner) Name() string {
+	return "fake"
+}
+
+func (f *fakeScanner) Scan(ctx context.Context, scans chan<- string) error {
+	f.mutex.Lock()
+	f.starts++
+	starts := f.starts
+	f.mutex.Unlock()
+	if starts == 1 {
+		return errors.New("unplugged")
+	}
+	connected(ctx)
+	select {
+	case scans <- "036000291452":
+	case <-ctx.Done():
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestRunWithStatus(t *testing.T) {
+	if err := Run(context.Background(), nil, nil, nil); err != ErrNoScanners {
+		t.Errorf("Run() without scanners = %v, want ErrNoScanners", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var mutex sync.Mutex
+	statuses := make([]bool, 0)
+	errs := make([]error, 0)
+	scanned := ""
+	err := RunWithStatus(ctx, []Scanner{&fakeScanner{}}, func(scan string) {
+		scanned = scan
+		cancel()
+	}, func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		errs = append(errs, err)
+	}, func(name string, connected bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		statuses = append(statuses, connected)
+	})
+	if err != context.Canceled || scanned != "036000291452" {
+		t.Fatalf("RunWithStatus() = %v, scanned %q", err, scanned)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// disconnected at the start, and after the failure, then connected
+	if want := []bool{false, false, true}; len(statuses) != len(want) || statuses[0] || statuses[1] || !statuses[2] {
+		t.Errorf("the statuses were %v, want %v", statuses, want)
+	}
+	var scannerErr *ScannerError
+	if len(errs) != 1 || !errors.As(errs[0], &scannerErr) || scannerErr.Scanner != "fake" || errs[0].Error() != "fake: unplugged" {
+		t.Errorf("the errors were %v, want the one failure", errs)
+	}
+}
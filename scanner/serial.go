@@ -0,0 +1,73 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"context"
+)
+
+const (
+	SERIAL_PORT    = "/dev/ttyAMA0" // the Pi's own UART
+	SERIAL_BAUD    = 9600           // most scanners' factory setting
+	BLUETOOTH_PORT = "/dev/rfcomm0" // see BluetoothScanner
+)
+
+// SerialScanner reads a scanner connected to a serial port (e.g., the Pi's
+// UART, or a usb-serial adapter), which sends each barcode as a line of
+// text, ended by a carriage return or a newline
+type SerialScanner struct {
+	Port string // defaults to SERIAL_PORT
+	Baud int    // defaults to SERIAL_BAUD
+}
+
+func (s *SerialScanner) Name() string {
+	return "serial:" + orDefault(s.Port, SERIAL_PORT)
+}
+
+func (s *SerialScanner) Scan(ctx context.Context, scans chan<- string) error {
+	baud := s.Baud
+	if baud == 0 {
+		baud = SERIAL_BAUD
+	}
+	return scanSerial(ctx, orDefault(s.Port, SERIAL_PORT), baud, scans)
+}
+
+// BluetoothScanner reads a scanner paired over Bluetooth, using the Serial
+// Port Profile (SPP), once its rfcomm device is bound to it, e.g.:
+//
+//	rfcomm bind 0 <scanner's bluetooth address>
+//
+// which then connects to the scanner whenever the device is opened (so
+// Run keeps trying it until the scanner is in range, and turned on)
+type BluetoothScanner struct {
+	Port string // defaults to BLUETOOTH_PORT
+}
+
+func (b *BluetoothScanner) Name() string {
+	return "bluetooth:" + orDefault(b.Port, BLUETOOTH_PORT)
+}
+
+func (b *BluetoothScanner) Scan(ctx context.Context, scans chan<- string) error {
+	// the baud rate means nothing to an rfcomm device, but it must be
+	// set to something, to put the line in raw mode
+	return scanSerial(ctx, orDefault(b.Port, BLUETOOTH_PORT), SERIAL_BAUD, scans)
+}
+
+func scanSerial(ctx context.Context, port string, baud int, scans chan<- string) error {
+	dev, err := openSerial(port, baud)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	defer closeOnDone(ctx, dev)()
+	connected(ctx)
+	return scanLines(ctx, dev, scans)
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
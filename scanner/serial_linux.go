@@ -0,0 +1,76 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// the termios mask of the baud rate bits, which the syscall package lacks
+const cbaud = 0010017
+
+// BAUD_RATES are the baud rates a SerialScanner can use, and their termios
+// speeds
+var BAUD_RATES = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// openSerial opens the serial port for reading, in raw mode (8 data bits,
+// no parity, one stop bit, and no echo, or line editing), at the baud rate
+func openSerial(port string, baud int) (*os.File, error) {
+	speed, found := BAUD_RATES[baud]
+	if !found {
+		return nil, fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	dev, err := os.OpenFile(port, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dev.SyscallConn()
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	var termiosErr error
+	err = conn.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if termiosErr = ioctl(fd, syscall.TCGETS, &t); termiosErr != nil {
+			return
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | cbaud
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		termiosErr = ioctl(fd, syscall.TCSETS, &t)
+	})
+	if err == nil {
+		err = termiosErr
+	}
+	if err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("%s: %w", port, err)
+	}
+	return dev, nil
+}
+
+func ioctl(fd uintptr, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package scanner
+
+import (
+	"errors"
+	"os"
+)
+
+// openSerial needs the linux termios ioctls, to set the port's baud rate
+func openSerial(port string, baud int) (*os.File, error) {
+	return nil, errors.New("serial scanners are only supported on linux")
+}
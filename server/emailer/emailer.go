@@ -34,6 +34,14 @@ const (
 	HTML_MIME = "text/html"
 )
 
+// MailServer is an smtp server, which may need a login
+type MailServer struct {
+	Host     string
+	Port     int
+	Username string // optional, for PLAIN auth (only sent over TLS, unless the server is localhost)
+	Password string
+}
+
 type EmailAddress struct {
 	DisplayName string
 	Address     string
@@ -192,3 +200,47 @@ func SendFromServer(subject, message, messageType, server string, sender, recipi
 func Send(subject, message, messageType string, sender, recipient *EmailAddress, attachments []*EmailAttachment) error {
 	return SendFromServer(subject, message, messageType, MAIL_SERVER, sender, recipient, attachments, MAIL_PORT)
 }
+
+// SendAlternatives transmits the message in each of its alternative forms
+// (e.g., plain text and html, the preferred one last, as the recipient's
+// mail client shows the last one it can), via the mail server, using
+// STARTTLS if the server offers it
+func SendAlternatives(subject string, bodies []*EmailBody, server *MailServer, sender, recipient *EmailAddress) error {
+	var buf bytes.Buffer
+	boundary := GenerateBoundary()
+
+	from, fromErr := GenerateAddress(sender)
+	if fromErr != nil {
+		return fromErr
+	}
+
+	to, toErr := GenerateAddress(recipient)
+	if toErr != nil {
+		return toErr
+	}
+
+	hdr, hdrErr := GenerateHeaders(from, to, subject, boundary)
+	if hdrErr != nil {
+		return hdrErr
+	}
+	buf.WriteString(hdr)
+
+	for _, b := range bodies {
+		body, bodyErr := GenerateBody(b.MessageBody, b.ContentType, boundary)
+		if bodyErr != nil {
+			return bodyErr
+		}
+		buf.WriteString(body)
+	}
+
+	// add the closing boundary marker
+	buf.WriteString("\r\n--")
+	buf.WriteString(boundary)
+	buf.WriteString("--")
+
+	var auth smtp.Auth
+	if server.Username != "" {
+		auth = smtp.PlainAuth("", server.Username, server.Password, server.Host)
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", server.Host, server.Port), auth, sender.Address, []string{recipient.Address}, buf.Bytes())
+}